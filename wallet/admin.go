@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+
+	"test_task_wallet/auth"
+	"test_task_wallet/logging"
+	"test_task_wallet/problem"
+	"test_task_wallet/walletcore"
+)
+
+// apiKeyRequest - тело запроса на выпуск ключа.
+type apiKeyRequest struct {
+	Name   string   `json:"name"`
+	Client string   `json:"client"`
+	Scopes []string `json:"scopes"`
+}
+
+// issuedAPIKey - ключ вместе с секретом. Секрет возвращается только при выпуске и ротации.
+type issuedAPIKey struct {
+	*walletcore.APIKey
+	Key string `json:"key"`
+}
+
+// walletProductRequest - тело запроса на назначение продукта кошельку.
+type walletProductRequest struct {
+	Product string `json:"product"`
+}
+
+// adminRoutes монтирует управление API ключами и продуктами кошельков. Все маршруты требуют право admin.
+func adminRoutes(walletService *walletcore.Service) func(r chi.Router) {
+	return func(r chi.Router) {
+		r.Use(auth.RequireScope(walletcore.ScopeAdmin))
+		r.Get("/api-keys", handleListAPIKeys(walletService))
+		r.Post("/api-keys", handleIssueAPIKey(walletService))
+		r.Post("/api-keys/{keyId}/rotate", handleRotateAPIKey(walletService))
+		r.Delete("/api-keys/{keyId}", handleRevokeAPIKey(walletService))
+		r.Put("/wallets/{walletUUID}/product", handleSetWalletProduct(walletService))
+	}
+}
+
+func handleListAPIKeys(walletService *walletcore.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keys, err := walletService.ListAPIKeys(r.Context())
+		if err != nil {
+			writeAdminError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, keys)
+	}
+}
+
+func handleIssueAPIKey(walletService *walletcore.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req apiKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, fmt.Sprintf("Invalid request body: %v", err))
+			return
+		}
+		key, plaintext, err := walletService.IssueAPIKey(r.Context(), req.Name, req.Client, req.Scopes)
+		if err != nil {
+			writeAdminError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, issuedAPIKey{APIKey: key, Key: plaintext})
+	}
+}
+
+func handleRotateAPIKey(walletService *walletcore.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := parseKeyID(w, r)
+		if !ok {
+			return
+		}
+		key, plaintext, err := walletService.RotateAPIKey(r.Context(), id)
+		if err != nil {
+			writeAdminError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, issuedAPIKey{APIKey: key, Key: plaintext})
+	}
+}
+
+func handleRevokeAPIKey(walletService *walletcore.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := parseKeyID(w, r)
+		if !ok {
+			return
+		}
+		key, err := walletService.RevokeAPIKey(r.Context(), id)
+		if err != nil {
+			writeAdminError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, key)
+	}
+}
+
+// handleSetWalletProduct назначает кошельку продукт, от которого зависит ставка процентов.
+// Пустой product отключает начисление процентов.
+func handleSetWalletProduct(walletService *walletcore.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		walletID, err := uuid.Parse(chi.URLParam(r, "walletUUID"))
+		if err != nil {
+			problem.WriteValidation(w, r, fmt.Sprintf("Invalid wallet UUID format: %v", err), []walletcore.FieldError{
+				{Field: "walletUUID", Message: err.Error()},
+			})
+			return
+		}
+		var req walletProductRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, fmt.Sprintf("Invalid request body: %v", err))
+			return
+		}
+		product, err := walletService.SetWalletProduct(r.Context(), walletID, req.Product)
+		if err != nil {
+			writeAdminError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, product)
+	}
+}
+
+func parseKeyID(w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	id, err := uuid.Parse(chi.URLParam(r, "keyId"))
+	if err != nil {
+		problem.WriteValidation(w, r, fmt.Sprintf("Invalid key ID: %v", err), []walletcore.FieldError{
+			{Field: "keyId", Message: err.Error()},
+		})
+		return uuid.Nil, false
+	}
+	return id, true
+}
+
+func writeAdminError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case r.Context().Err() != nil:
+		slog.WarnContext(r.Context(), "Admin request aborted", logging.Err(err))
+	case errors.Is(err, walletcore.ErrInvalidRequest):
+		writeValidationProblem(w, r, err)
+	case errors.Is(err, walletcore.ErrAPIKeyNotFound):
+		problem.Write(w, r, http.StatusNotFound, problem.CodeAPIKeyNotFound, "API key not found or already revoked")
+	case errors.Is(err, walletcore.ErrWalletNotFound):
+		problem.Write(w, r, http.StatusNotFound, problem.CodeWalletNotFound, "Wallet not found")
+	case walletcore.IsRetryable(err):
+		writeUnavailableProblem(w, r, err)
+	default:
+		slog.ErrorContext(r.Context(), "Admin request failed", logging.Err(err))
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Internal server error")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
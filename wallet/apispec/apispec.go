@@ -0,0 +1,154 @@
+// Package apispec содержит OpenAPI 3 спецификацию REST API кошелька
+// и middleware для проверки входящих запросов по ней.
+package apispec
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/google/uuid"
+
+	"test_task_wallet/problem"
+	"test_task_wallet/walletcore"
+)
+
+// Document - исходный JSON спецификации, который отдается по /api/v1/openapi.json.
+//
+//go:embed openapi.json
+var Document []byte
+
+func init() {
+	// Формат uuid проверяется так же, как его разбирают обработчики.
+	openapi3.DefineStringFormatCallback("uuid", func(s string) error {
+		_, err := uuid.Parse(s)
+		return err
+	})
+	// Выписки в JSON Lines и camt.053 проверяются как текст: схема ответа - строка.
+	openapi3filter.RegisterBodyDecoder("application/jsonl", openapi3filter.PlainBodyDecoder)
+	openapi3filter.RegisterBodyDecoder("application/xml", openapi3filter.PlainBodyDecoder)
+}
+
+// Spec - загруженная и проверенная спецификация вместе с роутером по ее путям.
+type Spec struct {
+	Doc    *openapi3.T
+	Router routers.Router
+}
+
+// Load разбирает встроенный документ и проверяет его корректность.
+func Load() (*Spec, error) {
+	doc, err := openapi3.NewLoader().LoadFromData(Document)
+	if err != nil {
+		return nil, fmt.Errorf("error loading OpenAPI document: %w", err)
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI document: %w", err)
+	}
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		return nil, fmt.Errorf("error building OpenAPI router: %w", err)
+	}
+	return &Spec{Doc: doc, Router: router}, nil
+}
+
+// ServeDocument отдает спецификацию как application/json.
+func ServeDocument(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(Document)
+}
+
+// ValidateRequests возвращает middleware, отклоняющий с 400 запросы,
+// не соответствующие спецификации. Запросы к путям, которых нет в спецификации,
+// пропускаются без проверки, чтобы ими занимался основной роутер.
+func (s *Spec) ValidateRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, pathParams, err := s.Router.FindRoute(r)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		input := &openapi3filter.RequestValidationInput{
+			Request:    r,
+			PathParams: pathParams,
+			Route:      route,
+			// Ключ проверяет auth.Middleware до этой проверки.
+			Options: &openapi3filter.Options{MultiError: true, AuthenticationFunc: openapi3filter.NoopAuthenticationFunc},
+		}
+		if err := openapi3filter.ValidateRequest(r.Context(), input); err != nil {
+			fields := walletcore.ValidationErrors(fieldErrors(err))
+			problem.WriteValidation(w, r, fmt.Sprintf("Validation error: %v", fields), fields)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ValidateResponse проверяет ответ обработчика по спецификации.
+// Используется в тестах, чтобы поведение обработчиков не расходилось с документом.
+func (s *Spec) ValidateResponse(r *http.Request, status int, header http.Header, body []byte) error {
+	route, pathParams, err := s.Router.FindRoute(r)
+	if err != nil {
+		return fmt.Errorf("route %s %s is not described in the spec: %w", r.Method, r.URL.Path, err)
+	}
+	input := &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: &openapi3filter.RequestValidationInput{
+			Request:    r,
+			PathParams: pathParams,
+			Route:      route,
+		},
+		Status:  status,
+		Header:  header,
+		Options: &openapi3filter.Options{IncludeResponseStatus: true, MultiError: true},
+	}
+	input.SetBodyBytes(body)
+	return openapi3filter.ValidateResponse(r.Context(), input)
+}
+
+// fieldErrors превращает ошибки openapi3filter в список ошибок по полям.
+func fieldErrors(err error) []walletcore.FieldError {
+	// MultiError проверяется без errors.As, чтобы не пропустить RequestError,
+	// который сам оборачивает MultiError.
+	if me, ok := err.(openapi3.MultiError); ok && len(me) > 0 {
+		var fields []walletcore.FieldError
+		for _, e := range me {
+			fields = append(fields, fieldErrors(e)...)
+		}
+		return fields
+	}
+	var reqErr *openapi3filter.RequestError
+	if errors.As(err, &reqErr) {
+		var fields []walletcore.FieldError
+		if reqErr.Err != nil {
+			fields = fieldErrors(reqErr.Err)
+		} else {
+			fields = []walletcore.FieldError{{Field: "body", Message: reqErr.Reason}}
+		}
+		if reqErr.Parameter != nil {
+			for i := range fields {
+				fields[i].Field = reqErr.Parameter.Name
+			}
+		}
+		return fields
+	}
+	var schemaErr *openapi3.SchemaError
+	if errors.As(err, &schemaErr) {
+		return []walletcore.FieldError{{Field: schemaPath(schemaErr), Message: schemaErr.Reason}}
+	}
+	return []walletcore.FieldError{{Field: "body", Message: err.Error()}}
+}
+
+func schemaPath(err *openapi3.SchemaError) string {
+	path := err.JSONPointer()
+	if len(path) == 0 {
+		return "body"
+	}
+	return strings.Join(path, ".")
+}
@@ -0,0 +1,53 @@
+package apispec
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateRequests(t *testing.T) {
+	spec, err := Load()
+	require.NoError(t, err)
+
+	reached := false
+	handler := spec.ValidateRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"valid deposit", http.MethodPost, "/api/v1/wallet", `{"valletId":"7f0c7a5e-8f8e-4b8a-9d55-0d9b8b2f1a11","operationType":"DEPOSIT","amount":10}`, http.StatusOK},
+		{"walletId instead of valletId", http.MethodPost, "/api/v1/wallet", `{"walletId":"7f0c7a5e-8f8e-4b8a-9d55-0d9b8b2f1a11","operationType":"DEPOSIT","amount":10}`, http.StatusBadRequest},
+		{"unknown operation", http.MethodPost, "/api/v1/wallet", `{"valletId":"7f0c7a5e-8f8e-4b8a-9d55-0d9b8b2f1a11","operationType":"TRANSFER","amount":10}`, http.StatusBadRequest},
+		{"zero amount", http.MethodPost, "/api/v1/wallet", `{"valletId":"7f0c7a5e-8f8e-4b8a-9d55-0d9b8b2f1a11","operationType":"WITHDRAW","amount":0}`, http.StatusBadRequest},
+		{"malformed uuid in body", http.MethodPost, "/api/v1/wallet", `{"valletId":"abc","operationType":"DEPOSIT","amount":10}`, http.StatusBadRequest},
+		{"valid balance request", http.MethodGet, "/api/v1/wallets/7f0c7a5e-8f8e-4b8a-9d55-0d9b8b2f1a11", "", http.StatusOK},
+		{"malformed uuid in path", http.MethodGet, "/api/v1/wallets/abc", "", http.StatusBadRequest},
+		{"path outside the spec", http.MethodGet, "/api/v1/unknown", "", http.StatusOK},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			reached = false
+			req := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+			if c.body != "" {
+				req.Header.Set("Content-Type", "application/json")
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, c.status, rec.Code, rec.Body.String())
+			assert.Equal(t, c.status == http.StatusOK, reached)
+		})
+	}
+}
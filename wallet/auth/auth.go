@@ -0,0 +1,215 @@
+// Package auth проверяет, кто вызывает API кошелька и что ему разрешено.
+//
+// Клиенты передают API ключ в заголовке X-API-Key (в gRPC - в метаданных x-api-key)
+// или JWT в заголовке Authorization: Bearer. Middleware проверяет учетные данные
+// и кладет ключ или токен в контекст запроса, а обработчики проверяют права через Require
+// и доступ к конкретному кошельку через AuthorizeWallet.
+//
+// API ключи и сервисные токены действуют на любой кошелек. Токен пользователя
+// позволяет читать только его кошельки и снимать средства только с них.
+package auth
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"test_task_wallet/logging"
+	"test_task_wallet/problem"
+	"test_task_wallet/walletcore"
+)
+
+// APIKeyHeader - заголовок с API ключом.
+const APIKeyHeader = "X-API-Key"
+
+// bearerPrefix - схема заголовка Authorization для JWT.
+const bearerPrefix = "Bearer "
+
+// Ошибки авторизации, которые обработчики переводят в 401 и 403.
+var (
+	ErrUnauthenticated = errors.New("authentication required")
+	ErrForbidden       = errors.New("insufficient scope")
+)
+
+// KeyAuthenticator находит действующий ключ по его значению. Реализуется *walletcore.Service.
+type KeyAuthenticator interface {
+	AuthenticateAPIKey(ctx context.Context, plaintext string) (*walletcore.APIKey, error)
+}
+
+type (
+	apiKeyContextKey struct{}
+	tokenContextKey  struct{}
+)
+
+// WithAPIKey возвращает контекст с ключом вызывающего клиента.
+func WithAPIKey(ctx context.Context, key *walletcore.APIKey) context.Context {
+	return context.WithValue(ctx, apiKeyContextKey{}, key)
+}
+
+// APIKeyFrom возвращает ключ вызывающего клиента, если запрос аутентифицирован.
+func APIKeyFrom(ctx context.Context) (*walletcore.APIKey, bool) {
+	key, ok := ctx.Value(apiKeyContextKey{}).(*walletcore.APIKey)
+	return key, ok
+}
+
+// WithToken возвращает контекст с проверенным JWT вызывающего клиента.
+func WithToken(ctx context.Context, token *Token) context.Context {
+	return context.WithValue(ctx, tokenContextKey{}, token)
+}
+
+// TokenFrom возвращает JWT вызывающего клиента, если запрос аутентифицирован токеном.
+func TokenFrom(ctx context.Context) (*Token, bool) {
+	token, ok := ctx.Value(tokenContextKey{}).(*Token)
+	return token, ok
+}
+
+// Require проверяет, что у клиента есть право scope.
+// Возвращает ErrUnauthenticated для анонимного запроса и ErrForbidden, если права нет.
+func Require(ctx context.Context, scope walletcore.Scope) error {
+	if token, ok := TokenFrom(ctx); ok {
+		if !token.Allows(scope) {
+			return ErrForbidden
+		}
+		return nil
+	}
+	key, ok := APIKeyFrom(ctx)
+	if !ok {
+		return ErrUnauthenticated
+	}
+	if !key.Allows(scope) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// ClientID возвращает идентификатор вызывающего клиента для учета, например в лимитах
+// и уникальности внешних ссылок: "key:<клиент ключа>" для API ключа (см. APIKey.Client)
+// или "sub:<subject>" для токена. Идентификатор не меняется при ротации и общий у всех ключей клиента.
+func ClientID(ctx context.Context) (string, bool) {
+	if token, ok := TokenFrom(ctx); ok {
+		return "sub:" + token.Subject, true
+	}
+	if key, ok := APIKeyFrom(ctx); ok {
+		return key.ClientID(), true
+	}
+	return "", false
+}
+
+// Owner возвращает пользователя, кошельками которого ограничен запрос.
+// Для API ключей и сервисных токенов ok == false: им доступны все кошельки.
+func Owner(ctx context.Context) (string, bool) {
+	token, ok := TokenFrom(ctx)
+	if !ok || token.Service {
+		return "", false
+	}
+	return token.Subject, true
+}
+
+// AuthorizeWallet проверяет, что клиент может видеть кошелек с владельцем ownerID.
+// Возвращает ErrForbidden, если запрос пользователя касается чужого кошелька.
+func AuthorizeWallet(ctx context.Context, ownerID string) error {
+	if owner, ok := Owner(ctx); ok && owner != ownerID {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// credentials - учетные данные из заголовков HTTP запроса или метаданных gRPC.
+type credentials struct {
+	apiKey        string
+	authorization string
+}
+
+// authenticate проверяет учетные данные и добавляет клиента к полям журнала.
+// Если передан заголовок Authorization, проверяется только он.
+// Возвращает ErrUnauthenticated для отсутствующих, неизвестных, отозванных или недействительных данных.
+func authenticate(ctx context.Context, keys KeyAuthenticator, tokens TokenVerifier, creds credentials) (context.Context, error) {
+	if creds.authorization != "" {
+		return authenticateToken(ctx, tokens, creds.authorization)
+	}
+	if creds.apiKey == "" {
+		return ctx, ErrUnauthenticated
+	}
+	key, err := keys.AuthenticateAPIKey(ctx, creds.apiKey)
+	if err != nil {
+		if errors.Is(err, walletcore.ErrInvalidAPIKey) {
+			return ctx, ErrUnauthenticated
+		}
+		return ctx, err
+	}
+	logging.AddFields(ctx, slog.String(logging.KeyClientID, key.ID.String()))
+	return WithAPIKey(ctx, key), nil
+}
+
+// authenticateToken проверяет bearer токен из заголовка Authorization.
+// tokens == nil означает, что JWT не настроены, и любой токен отклоняется.
+func authenticateToken(ctx context.Context, tokens TokenVerifier, authorization string) (context.Context, error) {
+	if len(authorization) <= len(bearerPrefix) || !strings.EqualFold(authorization[:len(bearerPrefix)], bearerPrefix) || tokens == nil {
+		return ctx, ErrUnauthenticated
+	}
+	token, err := tokens.VerifyToken(ctx, strings.TrimSpace(authorization[len(bearerPrefix):]))
+	if err != nil {
+		if errors.Is(err, ErrInvalidToken) {
+			slog.DebugContext(ctx, "Bearer token rejected", logging.Err(err))
+			return ctx, ErrUnauthenticated
+		}
+		return ctx, err
+	}
+	if token.Service {
+		logging.AddFields(ctx, slog.String(logging.KeyClientID, token.Subject))
+	} else {
+		logging.AddFields(ctx, slog.String(logging.KeyUserID, token.Subject))
+	}
+	return WithToken(ctx, token), nil
+}
+
+// Middleware пропускает только запросы с действующим API ключом или JWT.
+// tokens может быть nil, если JWT не настроены.
+func Middleware(keys KeyAuthenticator, tokens TokenVerifier) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, err := authenticate(r.Context(), keys, tokens, credentials{
+				apiKey:        r.Header.Get(APIKeyHeader),
+				authorization: r.Header.Get("Authorization"),
+			})
+			if err != nil {
+				WriteError(w, r, err)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// RequireScope - middleware для маршрутов, которым нужно одно и то же право.
+func RequireScope(scope walletcore.Scope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := Require(r.Context(), scope); err != nil {
+				WriteError(w, r, err)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// WriteError отправляет ответ для ошибки аутентификации или авторизации.
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrUnauthenticated):
+		w.Header().Add("WWW-Authenticate", `ApiKey header="`+APIKeyHeader+`"`)
+		w.Header().Add("WWW-Authenticate", `Bearer realm="wallet"`)
+		problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "A valid API key or bearer token is required")
+	case errors.Is(err, ErrForbidden):
+		problem.Write(w, r, http.StatusForbidden, problem.CodeForbidden, "The credentials do not grant access to this operation or wallet")
+	case walletcore.IsRetryable(err) || errors.Is(err, ErrKeysUnavailable):
+		w.Header().Set("Retry-After", "1")
+		problem.Write(w, r, http.StatusServiceUnavailable, problem.CodeTemporarilyUnavailable, "The service is busy, please retry the request")
+	default:
+		slog.ErrorContext(r.Context(), "API key check failed", logging.Err(err))
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Internal server error")
+	}
+}
@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"test_task_wallet/problem"
+	"test_task_wallet/walletcore"
+)
+
+type staticKeys map[string]*walletcore.APIKey
+
+func (k staticKeys) AuthenticateAPIKey(ctx context.Context, plaintext string) (*walletcore.APIKey, error) {
+	if key, ok := k[plaintext]; ok {
+		return key, nil
+	}
+	return nil, walletcore.ErrInvalidAPIKey
+}
+
+var readKey = &walletcore.APIKey{ID: uuid.New(), Client: "acme", Scopes: []walletcore.Scope{walletcore.ScopeRead}}
+
+func TestMiddleware(t *testing.T) {
+	keys := staticKeys{"good": readKey}
+	handler := Middleware(keys, nil)(RequireScope(walletcore.ScopeRead)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, ok := APIKeyFrom(r.Context())
+		require.True(t, ok)
+		assert.Equal(t, readKey.ID, key.ID)
+		clientID, _ := ClientID(r.Context())
+		assert.Equal(t, "key:acme", clientID, "the client of the key, not the key itself")
+		assert.ErrorIs(t, Require(r.Context(), walletcore.ScopeWithdraw), ErrForbidden)
+	})))
+
+	cases := []struct {
+		name, key string
+		want      int
+	}{
+		{"missing", "", http.StatusUnauthorized},
+		{"unknown", "bad", http.StatusUnauthorized},
+		{"valid", "good", http.StatusOK},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.key != "" {
+				req.Header.Set(APIKeyHeader, tc.key)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, tc.want, rr.Code)
+			if tc.want == http.StatusUnauthorized {
+				assert.Equal(t, problem.ContentType, rr.Header().Get("Content-Type"))
+				assert.NotEmpty(t, rr.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestRequireScopeForbidden(t *testing.T) {
+	handler := Middleware(staticKeys{"good": readKey}, nil)(RequireScope(walletcore.ScopeAdmin)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("handler must not run without the admin scope")
+	})))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(APIKeyHeader, "good")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	interceptor := UnaryServerInterceptor(staticKeys{"good": readKey}, nil)
+	info := &grpc.UnaryServerInfo{FullMethod: "/wallet.v1.WalletService/GetBalance"}
+	handler := func(ctx context.Context, req any) (any, error) {
+		return nil, Require(ctx, walletcore.ScopeRead)
+	}
+
+	_, err := interceptor(context.Background(), nil, info, handler)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-api-key", "good"))
+	_, err = interceptor(ctx, nil, info, handler)
+	assert.NoError(t, err)
+
+	assert.Equal(t, codes.PermissionDenied, status.Code(StatusError(ctx, ErrForbidden)))
+	assert.Equal(t, codes.Internal, status.Code(StatusError(ctx, errors.New("db down"))))
+}
+
+type staticTokens map[string]*Token
+
+func (s staticTokens) VerifyToken(ctx context.Context, raw string) (*Token, error) {
+	if token, ok := s[raw]; ok {
+		return token, nil
+	}
+	return nil, ErrInvalidToken
+}
+
+func TestBearerToken(t *testing.T) {
+	tokens := staticTokens{
+		"alice":   {Subject: "alice"},
+		"billing": {Subject: "billing", Service: true},
+	}
+	var got context.Context
+	handler := Middleware(staticKeys{}, tokens)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Context()
+	}))
+
+	for header, want := range map[string]int{
+		"Bearer alice":   http.StatusOK,
+		"bearer billing": http.StatusOK,
+		"Bearer mallory": http.StatusUnauthorized,
+		"Basic YWxpY2U=": http.StatusUnauthorized,
+		"Bearer ":        http.StatusUnauthorized,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", header)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, want, rr.Code, header)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer alice")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	owner, ok := Owner(got)
+	assert.True(t, ok)
+	assert.Equal(t, "alice", owner)
+	assert.NoError(t, AuthorizeWallet(got, "alice"))
+	assert.ErrorIs(t, AuthorizeWallet(got, "bob"), ErrForbidden)
+	assert.ErrorIs(t, AuthorizeWallet(got, ""), ErrForbidden, "users cannot read service wallets")
+	assert.ErrorIs(t, Require(got, walletcore.ScopeAdmin), ErrForbidden)
+
+	req.Header.Set("Authorization", "Bearer billing")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	_, ok = Owner(got)
+	assert.False(t, ok, "service tokens are not limited to one owner")
+	assert.NoError(t, AuthorizeWallet(got, "alice"))
+
+	// Без настроенных JWT bearer токен отклоняется, даже если API ключ тоже передан.
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer alice")
+	req.Header.Set(APIKeyHeader, "good")
+	rr := httptest.NewRecorder()
+	Middleware(staticKeys{"good": readKey}, nil)(handler).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"test_task_wallet/logging"
+	"test_task_wallet/walletcore"
+)
+
+// UnaryServerInterceptor - аналог Middleware для gRPC.
+// Ключ читается из метаданных x-api-key, токен - из authorization.
+func UnaryServerInterceptor(keys KeyAuthenticator, tokens TokenVerifier) grpc.UnaryServerInterceptor {
+	apiKeyMetadata := strings.ToLower(APIKeyHeader)
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		var creds credentials
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if values := md.Get(apiKeyMetadata); len(values) > 0 {
+				creds.apiKey = values[0]
+			}
+			if values := md.Get("authorization"); len(values) > 0 {
+				creds.authorization = values[0]
+			}
+		}
+		ctx, err := authenticate(ctx, keys, tokens, creds)
+		if err != nil {
+			return nil, StatusError(ctx, err)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StatusError переводит ошибки Require, AuthorizeWallet и проверки учетных данных в gRPC статус.
+func StatusError(ctx context.Context, err error) error {
+	switch {
+	case errors.Is(err, ErrUnauthenticated):
+		return status.Error(codes.Unauthenticated, "a valid API key or bearer token is required")
+	case errors.Is(err, ErrForbidden):
+		return status.Error(codes.PermissionDenied, "the credentials do not grant access to this operation or wallet")
+	case walletcore.IsRetryable(err) || errors.Is(err, ErrKeysUnavailable):
+		return status.Error(codes.Unavailable, "the service is busy, please retry the request")
+	default:
+		slog.ErrorContext(ctx, "API key check failed", logging.Err(err))
+		return status.Error(codes.Internal, "internal server error")
+	}
+}
@@ -0,0 +1,281 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"test_task_wallet/logging"
+)
+
+// ErrKeysUnavailable - ключи подписи JWT не удалось загрузить. Запрос можно повторить позже.
+var ErrKeysUnavailable = errors.New("token signing keys are unavailable")
+
+// keySource возвращает открытые ключи, которыми мог быть подписан токен с идентификатором kid.
+// Для токена без kid возвращаются все ключи.
+type keySource interface {
+	keys(ctx context.Context, kid string) ([]crypto.PublicKey, error)
+}
+
+// publicKey - ключ подписи вместе с его идентификатором из JWKS или PEM заголовка kid.
+type publicKey struct {
+	kid string
+	key crypto.PublicKey
+}
+
+// keySet - набор ключей подписи. Сам является keySource для статических ключей из файла.
+type keySet []publicKey
+
+func (s keySet) find(kid string) []crypto.PublicKey {
+	var keys []crypto.PublicKey
+	for _, k := range s {
+		if kid == "" || k.kid == kid {
+			keys = append(keys, k.key)
+		}
+	}
+	return keys
+}
+
+func (s keySet) keys(ctx context.Context, kid string) ([]crypto.PublicKey, error) {
+	return s.find(kid), nil
+}
+
+// parseKeys разбирает JWKS документ или последовательность PEM блоков.
+func parseKeys(data []byte) (keySet, error) {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		return parseJWKS(trimmed)
+	}
+	return parsePEMKeys(data)
+}
+
+// parsePEMKeys читает блоки PUBLIC KEY и CERTIFICATE. Идентификатор ключа берется из заголовка kid блока.
+func parsePEMKeys(data []byte) (keySet, error) {
+	var set keySet
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		var key crypto.PublicKey
+		switch block.Type {
+		case "PUBLIC KEY":
+			k, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("invalid PEM public key: %w", err)
+			}
+			key = k
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("invalid PEM certificate: %w", err)
+			}
+			key = cert.PublicKey
+		default:
+			return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+		}
+		set = append(set, publicKey{kid: block.Headers["kid"], key: key})
+	}
+	if len(set) == 0 {
+		return nil, errors.New("no PEM public keys found")
+	}
+	return set, nil
+}
+
+// jwk - ключ из JWKS (RFC 7517). Поддерживаются RSA, EC (P-256, P-384, P-521) и OKP (Ed25519).
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS разбирает JWKS документ. Ключи шифрования и ключи неподдерживаемых типов пропускаются,
+// чтобы новый тип ключа у провайдера не ломал проверку остальных токенов.
+func parseJWKS(data []byte) (keySet, error) {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+	var set keySet
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWKS key %q: %w", k.Kid, err)
+		}
+		if key != nil {
+			set = append(set, publicKey{kid: k.Kid, key: key})
+		}
+	}
+	if len(set) == 0 {
+		return nil, errors.New("JWKS contains no supported signing keys")
+	}
+	return set, nil
+}
+
+// publicKey возвращает nil без ошибки для неподдерживаемого типа ключа.
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBase64URL(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("n: %w", err)
+		}
+		e, err := decodeBase64URL(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("e: %w", err)
+		}
+		exp := new(big.Int).SetBytes(e)
+		if !exp.IsInt64() || exp.Int64() < 3 || exp.Int64() > 1<<31-1 {
+			return nil, errors.New("unsupported RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBase64URL(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("x: %w", err)
+		}
+		y, err := decodeBase64URL(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("y: %w", err)
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(x) > size || len(y) > size {
+			return nil, errors.New("coordinate is too long for the curve")
+		}
+		// Несжатая точка: 0x04 || X || Y, координаты дополнены нулями до размера кривой.
+		point := make([]byte, 1+2*size)
+		point[0] = 4
+		copy(point[1+size-len(x):1+size], x)
+		copy(point[1+2*size-len(y):], y)
+		return ecdsa.ParseUncompressedPublicKey(curve, point)
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBase64URL(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("x: %w", err)
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key length")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, nil
+}
+
+func decodeBase64URL(s string) ([]byte, error) {
+	if s == "" {
+		return nil, errors.New("missing value")
+	}
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+const (
+	// jwksMinRefetch ограничивает частоту загрузок JWKS, когда приходят токены с неизвестным kid.
+	jwksMinRefetch   = 30 * time.Second
+	jwksFetchTimeout = 5 * time.Second
+	maxJWKSSize      = 1 << 20
+)
+
+// remoteJWKS загружает ключи по адресу JWKS и кэширует их на refresh.
+// Токен с неизвестным kid вызывает внеочередную загрузку: так подхватывается ротация ключей у провайдера.
+// Если загрузка не удалась, продолжают использоваться ранее полученные ключи.
+type remoteJWKS struct {
+	url     string
+	client  *http.Client
+	refresh time.Duration
+	now     func() time.Time
+
+	mu          sync.Mutex
+	set         keySet
+	fetchedAt   time.Time
+	lastAttempt time.Time
+}
+
+func newRemoteJWKS(url string, refresh time.Duration) *remoteJWKS {
+	return &remoteJWKS{url: url, client: http.DefaultClient, refresh: refresh, now: time.Now}
+}
+
+func (r *remoteJWKS) keys(ctx context.Context, kid string) ([]crypto.PublicKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	stale := r.set == nil || now.Sub(r.fetchedAt) >= r.refresh
+	unknown := kid != "" && len(r.set.find(kid)) == 0
+	if (stale || unknown) && (r.lastAttempt.IsZero() || now.Sub(r.lastAttempt) >= jwksMinRefetch) {
+		r.lastAttempt = now
+		// Отмена одного запроса не должна оставить без ключей остальные до следующей попытки.
+		set, err := r.fetch(context.WithoutCancel(ctx))
+		if err != nil {
+			slog.WarnContext(ctx, "Failed to refresh JWKS", slog.String("url", r.url), logging.Err(err))
+		} else {
+			r.set, r.fetchedAt = set, now
+		}
+	}
+	if r.set == nil {
+		return nil, ErrKeysUnavailable
+	}
+	return r.set.find(kid), nil
+}
+
+func (r *remoteJWKS) fetch(ctx context.Context) (keySet, error) {
+	ctx, cancel := context.WithTimeout(ctx, jwksFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxJWKSSize))
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(data)
+}
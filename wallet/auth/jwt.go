@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"test_task_wallet/config"
+	"test_task_wallet/walletcore"
+)
+
+// ErrInvalidToken - токен не прошел проверку: подпись, срок действия, iss, aud или sub.
+var ErrInvalidToken = errors.New("invalid token")
+
+// tokenLeeway - допустимое расхождение часов с провайдером при проверке exp и nbf.
+const tokenLeeway = 30 * time.Second
+
+// signingMethods - допустимые алгоритмы подписи. Симметричные HS* не принимаются:
+// сервис проверяет токены только открытыми ключами провайдера.
+var signingMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// Token - проверенный JWT вызывающего клиента.
+// Токен дает права read, deposit и withdraw; право admin выдается только API ключам.
+type Token struct {
+	// Subject - claim sub: идентификатор пользователя или сервиса.
+	Subject string
+	// Service - сервисный токен, которому доступны все кошельки.
+	// Токен пользователя ограничен кошельками, владелец которых - Subject.
+	Service bool
+}
+
+// Allows сообщает, дает ли токен право scope.
+func (t *Token) Allows(scope walletcore.Scope) bool {
+	return scope != walletcore.ScopeAdmin
+}
+
+// TokenVerifier проверяет bearer токен. Реализуется *JWTVerifier.
+type TokenVerifier interface {
+	VerifyToken(ctx context.Context, raw string) (*Token, error)
+}
+
+// JWTVerifier проверяет подпись и claims JWT по ключам из JWKS или из файла.
+type JWTVerifier struct {
+	keys         keySource
+	parser       *jwt.Parser
+	serviceScope string
+}
+
+// tokenClaims - claims, которые читает сервис. scope - строка прав через пробел (RFC 8693).
+type tokenClaims struct {
+	jwt.RegisteredClaims
+	Scope string `json:"scope"`
+}
+
+// NewJWTVerifier создает проверку токенов по настройкам cfg.
+// Статические ключи читаются сразу, JWKS загружается при первом запросе.
+func NewJWTVerifier(cfg config.JWT) (*JWTVerifier, error) {
+	var keys keySource
+	switch {
+	case cfg.JWKSURL != "":
+		keys = newRemoteJWKS(cfg.JWKSURL, cfg.RefreshInterval)
+	case cfg.KeysFile != "":
+		data, err := os.ReadFile(cfg.KeysFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading JWT keys: %w", err)
+		}
+		set, err := parseKeys(data)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing JWT keys from %s: %w", cfg.KeysFile, err)
+		}
+		keys = set
+	default:
+		return nil, errors.New("neither JWKS URL nor keys file is configured")
+	}
+	return newJWTVerifier(keys, cfg), nil
+}
+
+func newJWTVerifier(keys keySource, cfg config.JWT) *JWTVerifier {
+	return &JWTVerifier{
+		keys: keys,
+		parser: jwt.NewParser(
+			jwt.WithValidMethods(signingMethods),
+			jwt.WithIssuer(cfg.Issuer),
+			jwt.WithAudience(cfg.Audience),
+			jwt.WithExpirationRequired(),
+			jwt.WithLeeway(tokenLeeway),
+		),
+		serviceScope: cfg.ServiceScope,
+	}
+}
+
+// VerifyToken проверяет токен и возвращает его субъекта.
+// Возвращает ErrInvalidToken для недействительного токена и ErrKeysUnavailable, если ключи не загружены.
+func (v *JWTVerifier) VerifyToken(ctx context.Context, raw string) (*Token, error) {
+	var claims tokenClaims
+	_, err := v.parser.ParseWithClaims(raw, &claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		keys, err := v.keys.keys(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		set := jwt.VerificationKeySet{}
+		for _, k := range keys {
+			set.Keys = append(set.Keys, k)
+		}
+		return set, nil
+	})
+	if err != nil {
+		if errors.Is(err, ErrKeysUnavailable) {
+			return nil, ErrKeysUnavailable
+		}
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: sub claim is required", ErrInvalidToken)
+	}
+	return &Token{
+		Subject: claims.Subject,
+		Service: slices.Contains(strings.Fields(claims.Scope), v.serviceScope),
+	}, nil
+}
@@ -0,0 +1,198 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"test_task_wallet/config"
+	"test_task_wallet/walletcore"
+)
+
+var testJWTConfig = config.JWT{
+	Issuer:          "https://idp.example.com/",
+	Audience:        "wallet",
+	RefreshInterval: time.Hour,
+	ServiceScope:    "wallet:service",
+}
+
+// signToken подписывает токен с claims по умолчанию, которые можно переопределить через extra.
+func signToken(t *testing.T, method jwt.SigningMethod, kid string, key crypto.Signer, extra jwt.MapClaims) string {
+	t.Helper()
+	claims := jwt.MapClaims{
+		"iss": testJWTConfig.Issuer,
+		"aud": testJWTConfig.Audience,
+		"sub": "user-1",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	require.NoError(t, err)
+	return signed
+}
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+// jwkJSON описывает открытый ключ в формате JWKS.
+func jwkJSON(kid string, key crypto.PublicKey) map[string]string {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": kid, "n": b64(k.N.Bytes()), "e": b64(big.NewInt(int64(k.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		point, _ := k.Bytes()
+		size := (len(point) - 1) / 2
+		return map[string]string{"kty": "EC", "kid": kid, "crv": k.Curve.Params().Name, "x": b64(point[1 : 1+size]), "y": b64(point[1+size:])}
+	case ed25519.PublicKey:
+		return map[string]string{"kty": "OKP", "kid": kid, "crv": "Ed25519", "x": b64(k)}
+	}
+	panic("unsupported key")
+}
+
+func TestVerifyToken(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	v := newJWTVerifier(keySet{{kid: "ed1", key: edKey.Public()}}, testJWTConfig)
+	ctx := context.Background()
+
+	token, err := v.VerifyToken(ctx, signToken(t, jwt.SigningMethodEdDSA, "ed1", edKey, nil))
+	require.NoError(t, err)
+	assert.Equal(t, &Token{Subject: "user-1"}, token)
+	assert.True(t, token.Allows(walletcore.ScopeWithdraw))
+	assert.False(t, token.Allows(walletcore.ScopeAdmin), "tokens never grant admin")
+
+	token, err = v.VerifyToken(ctx, signToken(t, jwt.SigningMethodEdDSA, "", edKey, jwt.MapClaims{"sub": "billing", "scope": "openid wallet:service"}))
+	require.NoError(t, err)
+	assert.True(t, token.Service, "a token without kid is checked against every key")
+
+	rejected := map[string]string{
+		"expired":        signToken(t, jwt.SigningMethodEdDSA, "ed1", edKey, jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}),
+		"no expiry":      signToken(t, jwt.SigningMethodEdDSA, "ed1", edKey, jwt.MapClaims{"exp": nil}),
+		"wrong issuer":   signToken(t, jwt.SigningMethodEdDSA, "ed1", edKey, jwt.MapClaims{"iss": "https://evil.example.com/"}),
+		"wrong audience": signToken(t, jwt.SigningMethodEdDSA, "ed1", edKey, jwt.MapClaims{"aud": "other"}),
+		"no subject":     signToken(t, jwt.SigningMethodEdDSA, "ed1", edKey, jwt.MapClaims{"sub": ""}),
+		"unknown kid":    signToken(t, jwt.SigningMethodEdDSA, "ed2", edKey, nil),
+		"wrong key":      signToken(t, jwt.SigningMethodEdDSA, "ed1", otherKey, nil),
+		"garbage":        "not.a.jwt",
+	}
+	for name, raw := range rejected {
+		_, err := v.VerifyToken(ctx, raw)
+		assert.ErrorIs(t, err, ErrInvalidToken, name)
+	}
+
+	// alg=none и HS256 с открытым ключом в качестве секрета не принимаются.
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{"sub": "user-1"}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	require.NoError(t, err)
+	_, err = v.VerifyToken(ctx, unsigned)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	hmac, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "user-1"}).SignedString([]byte(edKey.Public().(ed25519.PublicKey)))
+	require.NoError(t, err)
+	_, err = v.VerifyToken(ctx, hmac)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestRemoteJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	// Сначала провайдер публикует только RSA ключ, затем добавляет EC ключ (ротация).
+	var published atomic.Value
+	published.Store([]map[string]string{jwkJSON("rsa1", &rsaKey.PublicKey)})
+	var fetches atomic.Int32
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		json.NewEncoder(w).Encode(map[string]any{"keys": published.Load()})
+	}))
+	defer idp.Close()
+
+	jwks := newRemoteJWKS(idp.URL, time.Hour)
+	now := time.Now()
+	jwks.now = func() time.Time { return now }
+	v := newJWTVerifier(jwks, testJWTConfig)
+	ctx := context.Background()
+
+	_, err = v.VerifyToken(ctx, signToken(t, jwt.SigningMethodRS256, "rsa1", rsaKey, nil))
+	require.NoError(t, err)
+	_, err = v.VerifyToken(ctx, signToken(t, jwt.SigningMethodRS256, "rsa1", rsaKey, nil))
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, fetches.Load(), "keys are cached")
+
+	published.Store([]map[string]string{jwkJSON("rsa1", &rsaKey.PublicKey), jwkJSON("ec1", &ecKey.PublicKey)})
+	ecToken := signToken(t, jwt.SigningMethodES256, "ec1", ecKey, nil)
+	_, err = v.VerifyToken(ctx, ecToken)
+	assert.ErrorIs(t, err, ErrInvalidToken, "refetch for an unknown kid is rate limited")
+
+	now = now.Add(jwksMinRefetch)
+	_, err = v.VerifyToken(ctx, ecToken)
+	require.NoError(t, err, "unknown kid triggers a refetch")
+	assert.EqualValues(t, 2, fetches.Load())
+}
+
+func TestRemoteJWKSUnavailable(t *testing.T) {
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusBadGateway)
+	}))
+	defer idp.Close()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	v := newJWTVerifier(newRemoteJWKS(idp.URL, time.Hour), testJWTConfig)
+	_, err = v.VerifyToken(context.Background(), signToken(t, jwt.SigningMethodEdDSA, "ed1", key, nil))
+	assert.ErrorIs(t, err, ErrKeysUnavailable)
+}
+
+func TestParseKeys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	require.NoError(t, err)
+
+	set, err := parseKeys(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Headers: map[string]string{"kid": "pem1"}, Bytes: der}))
+	require.NoError(t, err)
+	require.Len(t, set, 1)
+	assert.Equal(t, "pem1", set[0].kid)
+	assert.True(t, rsaKey.PublicKey.Equal(set[0].key))
+
+	doc, err := json.Marshal(map[string]any{"keys": []map[string]string{
+		jwkJSON("rsa1", &rsaKey.PublicKey),
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQAB", "e": "AQAB"},
+		{"kty": "oct", "kid": "hmac", "k": "c2VjcmV0"},
+	}})
+	require.NoError(t, err)
+	set, err = parseKeys(doc)
+	require.NoError(t, err)
+	require.Len(t, set, 1, "encryption and unsupported keys are skipped")
+	assert.True(t, rsaKey.PublicKey.Equal(set[0].key))
+
+	_, err = parseKeys([]byte(`{"keys":[{"kty":"EC","crv":"P-256","x":"AQ","y":"AQ"}]}`))
+	assert.Error(t, err, "a point that is not on the curve is rejected")
+	_, err = parseKeys([]byte("not a key"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+
+	"test_task_wallet/walletcore"
+)
+
+// camt053Namespace - пространство имен camt.053.001.02: эту версию принимают банки-партнеры.
+const camt053Namespace = "urn:iso:std:iso:20022:tech:xsd:camt.053.001.02"
+
+// camtDocument - корневой элемент документа.
+var camtDocument = xml.Name{Space: camt053Namespace, Local: "Document"}
+
+// Коды остатков ISO 20022 (BalanceType12Code).
+const (
+	camtOpeningBooked = "OPBD"
+	camtClosingBooked = "CLBD"
+)
+
+// camtProprietaryIssuer - издатель собственных кодов операций (BkTxCd/Prtry).
+const camtProprietaryIssuer = "WALLET"
+
+type camtAmount struct {
+	Ccy   string `xml:"Ccy,attr"`
+	Value string `xml:",chardata"`
+}
+
+// camtAmountOf - сумма amount минимальных единиц в десятичной записи валюты currency.
+func camtAmountOf(amount int64, currency walletcore.Currency) camtAmount {
+	return camtAmount{Ccy: currency.Code, Value: walletcore.FormatMinor(amount, currency.Exponent)}
+}
+
+type camtDateTime struct {
+	DtTm string `xml:"DtTm"`
+}
+
+// camtBalance - элемент Bal (CashBalance3).
+type camtBalance struct {
+	XMLName   xml.Name     `xml:"Bal"`
+	Code      string       `xml:"Tp>CdOrPrtry>Cd"`
+	Amt       camtAmount   `xml:"Amt"`
+	CdtDbtInd string       `xml:"CdtDbtInd"`
+	Dt        camtDateTime `xml:"Dt"`
+}
+
+// camtEntry - элемент Ntry (ReportEntry2).
+type camtEntry struct {
+	XMLName     xml.Name     `xml:"Ntry"`
+	NtryRef     string       `xml:"NtryRef"`
+	Amt         camtAmount   `xml:"Amt"`
+	CdtDbtInd   string       `xml:"CdtDbtInd"`
+	Sts         string       `xml:"Sts"`
+	BookgDt     camtDateTime `xml:"BookgDt"`
+	ValDt       camtDateTime `xml:"ValDt"`
+	AcctSvcrRef string       `xml:"AcctSvcrRef"`
+	TxCode      string       `xml:"BkTxCd>Prtry>Cd"`
+	TxCodeIssr  string       `xml:"BkTxCd>Prtry>Issr"`
+}
+
+// camtPeriod - элемент FrToDt (DateTimePeriodDetails).
+type camtPeriod struct {
+	FrDtTm string `xml:"FrDtTm"`
+	ToDtTm string `xml:"ToDtTm"`
+}
+
+// camtAccount - элемент Acct (CashAccount20): кошелек как счет с собственным идентификатором.
+type camtAccount struct {
+	ID  string `xml:"Id>Othr>Id"`
+	Ccy string `xml:"Ccy"`
+}
+
+// camt053StatementEncoder пишет выписку как документ camt.053 BankToCustomerStatement
+// с одной выпиской (Stmt). Остатки OPBD и CLBD идут перед операциями, как требует схема,
+// поэтому исходящий остаток берется из входящей строки (StatementEntry.ClosingBalance).
+// Если выгрузка оборвется, документ останется без закрывающих тегов и не пройдет разбор.
+type camt053StatementEncoder struct {
+	enc  *xml.Encoder
+	info statementInfo
+}
+
+func newCAMT053StatementEncoder(w io.Writer, info statementInfo) statementEncoder {
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return &camt053StatementEncoder{enc: enc, info: info}
+}
+
+func (e *camt053StatementEncoder) Write(entry walletcore.StatementEntry) error {
+	switch entry.Kind {
+	case walletcore.StatementOpening:
+		return e.writeHeader(entry)
+	case walletcore.StatementTransaction:
+		indicator := "CRDT"
+		if entry.Type.IsDebit() {
+			indicator = "DBIT"
+		}
+		ref := camtID(entry.TransactionID)
+		return e.enc.Encode(camtEntry{
+			NtryRef:     ref,
+			Amt:         camtAmountOf(entry.Amount, e.info.Currency),
+			CdtDbtInd:   indicator,
+			Sts:         "BOOK",
+			BookgDt:     camtDateTime{statementTime(entry.Timestamp)},
+			ValDt:       camtDateTime{statementTime(entry.Timestamp)},
+			AcctSvcrRef: ref,
+			TxCode:      string(entry.Type),
+			TxCodeIssr:  camtProprietaryIssuer,
+		})
+	case walletcore.StatementClosing:
+		for _, name := range []xml.Name{{Local: "Stmt"}, {Local: "BkToCstmrStmt"}, camtDocument} {
+			if err := e.enc.EncodeToken(xml.EndElement{Name: name}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeHeader открывает документ и пишет заголовок сообщения, реквизиты выписки и оба остатка.
+func (e *camt053StatementEncoder) writeHeader(opening walletcore.StatementEntry) error {
+	now := statementTime(time.Now().Truncate(time.Second))
+	msgID := camtID(uuid.New())
+
+	if err := e.enc.EncodeToken(xml.ProcInst{Target: "xml", Inst: []byte(`version="1.0" encoding="UTF-8"`)}); err != nil {
+		return err
+	}
+	if err := e.enc.EncodeToken(xml.StartElement{Name: camtDocument}); err != nil {
+		return err
+	}
+	if err := e.enc.EncodeToken(xml.StartElement{Name: xml.Name{Local: "BkToCstmrStmt"}}); err != nil {
+		return err
+	}
+	err := e.enc.EncodeElement(struct {
+		MsgId   string `xml:"MsgId"`
+		CreDtTm string `xml:"CreDtTm"`
+	}{msgID, now}, xml.StartElement{Name: xml.Name{Local: "GrpHdr"}})
+	if err != nil {
+		return err
+	}
+	if err := e.enc.EncodeToken(xml.StartElement{Name: xml.Name{Local: "Stmt"}}); err != nil {
+		return err
+	}
+	// Порядок элементов задан схемой AccountStatement2.
+	fields := []struct {
+		name  string
+		value any
+	}{
+		{"Id", msgID},
+		{"CreDtTm", now},
+		{"FrToDt", camtPeriod{FrDtTm: statementTime(opening.Timestamp), ToDtTm: statementTime(e.info.To)}},
+		{"Acct", camtAccount{ID: camtID(e.info.WalletID), Ccy: e.info.Currency.Code}},
+	}
+	for _, f := range fields {
+		if err := e.enc.EncodeElement(f.value, xml.StartElement{Name: xml.Name{Local: f.name}}); err != nil {
+			return err
+		}
+	}
+	if err := e.enc.Encode(camtBalanceOf(camtOpeningBooked, opening.Balance, e.info.Currency, opening.Timestamp)); err != nil {
+		return err
+	}
+	return e.enc.Encode(camtBalanceOf(camtClosingBooked, opening.ClosingBalance, e.info.Currency, e.info.To))
+}
+
+func (e *camt053StatementEncoder) Flush() error {
+	return e.enc.Flush()
+}
+
+// camtBalanceOf - остаток с кодом code на момент at. Сумма в camt.053 неотрицательна,
+// знак передает CdtDbtInd.
+func camtBalanceOf(code string, balance int64, currency walletcore.Currency, at time.Time) camtBalance {
+	indicator := "CRDT"
+	if balance < 0 {
+		indicator, balance = "DBIT", -balance
+	}
+	return camtBalance{
+		Code:      code,
+		Amt:       camtAmountOf(balance, currency),
+		CdtDbtInd: indicator,
+		Dt:        camtDateTime{statementTime(at)},
+	}
+}
+
+// camtID - UUID без дефисов: идентификаторы camt.053 ограничены 34-35 символами.
+func camtID(id uuid.UUID) string {
+	return hex.EncodeToString(id[:])
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/xml"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"test_task_wallet/walletcore"
+)
+
+// validateCAMT053 проверяет документ по схеме camt.053.001.02 через xmllint.
+// CAMT053_XSD задает путь к официальной схеме ISO 20022 вместо подмножества из testdata.
+// В CI (задана переменная CI) отсутствие xmllint - ошибка, а не пропуск теста.
+func validateCAMT053(t *testing.T, document string) error {
+	t.Helper()
+	xmllint, err := exec.LookPath("xmllint")
+	if err != nil {
+		if os.Getenv("CI") != "" {
+			t.Fatal("xmllint is required to validate camt.053 statements in CI")
+		}
+		t.Skip("xmllint is not installed, skipping schema validation")
+	}
+	schema := os.Getenv("CAMT053_XSD")
+	if schema == "" {
+		schema = "testdata/camt.053.001.02.xsd"
+	}
+	file := filepath.Join(t.TempDir(), "statement.xml")
+	require.NoError(t, os.WriteFile(file, []byte(document), 0o600))
+	out, err := exec.Command(xmllint, "--noout", "--schema", schema, file).CombinedOutput()
+	if err != nil {
+		return &schemaError{string(out)}
+	}
+	return nil
+}
+
+type schemaError struct{ output string }
+
+func (e *schemaError) Error() string { return e.output }
+
+func TestCAMT053MatchesSchema(t *testing.T) {
+	document := encodeStatement(t, "camt053")
+	require.NoError(t, validateCAMT053(t, document))
+
+	// Выписка без операций: остатки есть, Ntry нет.
+	entries := testStatement()
+	var empty strings.Builder
+	enc := newCAMT053StatementEncoder(&empty, statementInfo{WalletID: testStatementWallet, To: testStatementTo, Currency: walletcore.DefaultCurrency})
+	require.NoError(t, enc.Write(entries[0]))
+	require.NoError(t, enc.Write(entries[len(entries)-1]))
+	require.NoError(t, enc.Flush())
+	require.NoError(t, validateCAMT053(t, empty.String()))
+
+	// Проверка действительно сверяет документ со схемой: UUID с дефисами длиннее Max34Text.
+	broken := strings.Replace(document, "7f0c7a5e8f8e4b8a9d550d9b8b2f1a11", testStatementWallet.String(), 1)
+	assert.Error(t, validateCAMT053(t, broken))
+}
+
+// camtDocumentForTest - поля документа, которые проверяет тест.
+type camtDocumentForTest struct {
+	XMLName xml.Name `xml:"urn:iso:std:iso:20022:tech:xsd:camt.053.001.02 Document"`
+	Stmt    struct {
+		Acct string `xml:"Acct>Id>Othr>Id"`
+		From string `xml:"FrToDt>FrDtTm"`
+		To   string `xml:"FrToDt>ToDtTm"`
+		Bal  []struct {
+			Code      string     `xml:"Tp>CdOrPrtry>Cd"`
+			Amt       camtAmount `xml:"Amt"`
+			CdtDbtInd string     `xml:"CdtDbtInd"`
+		} `xml:"Bal"`
+		Ntry []struct {
+			Ref       string `xml:"NtryRef"`
+			Amt       string `xml:"Amt"`
+			CdtDbtInd string `xml:"CdtDbtInd"`
+			Code      string `xml:"BkTxCd>Prtry>Cd"`
+		} `xml:"Ntry"`
+	} `xml:"BkToCstmrStmt>Stmt"`
+}
+
+func TestCAMT053Content(t *testing.T) {
+	var doc camtDocumentForTest
+	require.NoError(t, xml.Unmarshal([]byte(encodeStatement(t, "camt053")), &doc))
+
+	assert.Equal(t, "7f0c7a5e8f8e4b8a9d550d9b8b2f1a11", doc.Stmt.Acct)
+	assert.Equal(t, "2026-03-01T00:00:00Z", doc.Stmt.From)
+	assert.Equal(t, "2026-03-02T00:00:00Z", doc.Stmt.To)
+
+	require.Len(t, doc.Stmt.Bal, 2)
+	assert.Equal(t, "OPBD", doc.Stmt.Bal[0].Code)
+	assert.Equal(t, camtAmount{Ccy: "EUR", Value: "1.00"}, doc.Stmt.Bal[0].Amt)
+	assert.Equal(t, "CLBD", doc.Stmt.Bal[1].Code)
+	assert.Equal(t, "1.20", doc.Stmt.Bal[1].Amt.Value)
+	assert.Equal(t, "CRDT", doc.Stmt.Bal[1].CdtDbtInd)
+
+	require.Len(t, doc.Stmt.Ntry, 2)
+	assert.Equal(t, "0b6f3f8e6a1c4d3e9a512f8f4f6a9c01", doc.Stmt.Ntry[0].Ref)
+	assert.Equal(t, "CRDT", doc.Stmt.Ntry[0].CdtDbtInd, "deposits are credits")
+	assert.Equal(t, "DEPOSIT", doc.Stmt.Ntry[0].Code)
+	assert.Equal(t, "0.30", doc.Stmt.Ntry[1].Amt)
+	assert.Equal(t, "DBIT", doc.Stmt.Ntry[1].CdtDbtInd, "withdrawals are debits")
+}
+
+func TestCAMTBalanceSign(t *testing.T) {
+	bal := camtBalanceOf(camtClosingBooked, -25, walletcore.DefaultCurrency, testStatementTo)
+	assert.Equal(t, "DBIT", bal.CdtDbtInd)
+	assert.Equal(t, "25", bal.Amt.Value, "camt.053 amounts are never negative")
+
+	bal = camtBalanceOf(camtClosingBooked, -1250, walletcore.Currency{Code: "EUR", Exponent: 2}, testStatementTo)
+	assert.Equal(t, camtAmount{Ccy: "EUR", Value: "12.50"}, bal.Amt, "amounts are in major units")
+}
@@ -0,0 +1,909 @@
+// Package config загружает настройки сервиса из нескольких источников.
+//
+// Источники применяются по порядку, каждый следующий переопределяет предыдущий:
+//  1. значения по умолчанию;
+//  2. необязательный env-файл (по умолчанию ./config.env, путь задается CONFIG_FILE или -config);
+//  3. переменные окружения;
+//  4. флаги командной строки.
+//
+// Для секретов (DB_PASSWORD, DATABASE_URL, ADMIN_API_KEY) вместо значения можно передать путь
+// к файлу в переменной с суффиксом _FILE, например DB_PASSWORD_FILE=/run/secrets/db_password.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/joho/godotenv"
+)
+
+// DefaultConfigFile - env-файл, который читается, если путь не задан явно.
+const DefaultConfigFile = "./config.env"
+
+// Config - настройки сервиса.
+type Config struct {
+	HTTPPort int
+	GRPCPort int
+	// ShutdownTimeout - сколько ждать завершения текущих запросов и фоновых задач при остановке.
+	ShutdownTimeout time.Duration
+	// ShutdownDelay - пауза между переводом /readyz в 503 и закрытием слушателей.
+	ShutdownDelay time.Duration
+	Database      Database
+	Tracing       Tracing
+	Logging       Logging
+	Auth          Auth
+	RateLimit     RateLimit
+	Receipts      Receipts
+	Scheduler     Scheduler
+	Fees          Fees
+	Interest      Interest
+	Currency      Currency
+	// Args - позиционные аргументы после флагов (например, ID кошельков для verify-chain).
+	Args []string
+}
+
+// RateLimit - ограничение частоты запросов по клиенту и по кошельку.
+type RateLimit struct {
+	// Store - где хранятся счетчики: none (ограничения выключены), memory (в процессе)
+	// или postgres (общие для всех реплик).
+	Store string
+	Rules []RateLimitRule
+	// DBMaxConns - размер отдельного пула соединений для счетчиков в PostgreSQL.
+	DBMaxConns int
+	// DBTimeout - сколько ждать счетчик в PostgreSQL; после этого действует только лимит реплики.
+	DBTimeout time.Duration
+}
+
+// RateLimitRule - лимит для одного маршрута.
+// Задается строкой вида "POST /api/v1/wallet client=50/s:100 wallet=20/s:40",
+// правила разделяются точкой с запятой.
+type RateLimitRule struct {
+	// Method - HTTP метод, GRPC для gRPC вызовов или * для любого.
+	Method string
+	// Route - шаблон маршрута chi, полное имя gRPC метода или * для любого.
+	Route string
+	// Key - client (API ключ или subject токена) или wallet (ID кошелька из запроса).
+	Key string
+	// Rate - запросов в секунду в среднем.
+	Rate float64
+	// Burst - сколько запросов можно выполнить подряд без пауз.
+	Burst int
+}
+
+// Auth - настройки аутентификации клиентов.
+type Auth struct {
+	// AdminAPIKey - ключ администратора, который регистрируется при запуске,
+	// чтобы через него выпустить остальные ключи. Формат: wk_<12 hex>_<секрет>.
+	AdminAPIKey string
+	JWT         JWT
+}
+
+// JWT - проверка bearer токенов конечных пользователей и сервисов.
+// Ключи подписи берутся либо из JWKS по адресу JWKSURL, либо из файла KeysFile.
+type JWT struct {
+	JWKSURL string
+	// KeysFile - JWKS документ или открытые ключи в PEM.
+	KeysFile string
+	Issuer   string
+	Audience string
+	// RefreshInterval - как часто перечитывать JWKS.
+	RefreshInterval time.Duration
+	// ServiceScope - значение в claim scope, которое отличает сервисный токен от пользовательского.
+	ServiceScope string
+}
+
+// Enabled сообщает, настроена ли проверка JWT.
+func (j JWT) Enabled() bool {
+	return j.JWKSURL != "" || j.KeysFile != ""
+}
+
+// Receipts - подпись квитанций об операциях.
+type Receipts struct {
+	// KeysFile - PEM файл с ключами Ed25519: первый закрытый ключ подписывает,
+	// остальные ключи публикуются для проверки ранее выданных квитанций.
+	// Пусто - временный ключ, только для разработки.
+	KeysFile string
+}
+
+// Scheduler - выполнение запланированных операций.
+type Scheduler struct {
+	// PollInterval - как часто искать наступившие запуски. 0 - планировщик в этой реплике не запускается.
+	PollInterval time.Duration
+	// BatchSize - сколько запусков выполнить за проход, прежде чем проверить остановку сервиса.
+	BatchSize int
+}
+
+// Fees - комиссии за операции.
+type Fees struct {
+	// RevenueWallet - кошелек, на который зачисляются комиссии. Обязателен, если заданы правила.
+	RevenueWallet string
+	Rules         []FeeRule
+}
+
+// FeeRule - комиссия за операции одного типа.
+// Задается строкой вида "WITHDRAW 1.5% min=10 max=500", правила разделяются точкой с запятой.
+type FeeRule struct {
+	// Operation - DEPOSIT, WITHDRAW или TRANSFER.
+	Operation string
+	// Tiers - уровни по сумме операции в порядке возрастания From.
+	// Комиссия без уровней задается одним уровнем с From 0.
+	Tiers []FeeTier
+	// Min и Max ограничивают комиссию; Max 0 - без верхней границы.
+	Min int64
+	Max int64
+}
+
+// FeeTier - комиссия для операций на сумму от From: Fixed плюс BasisPoints сотых долей процента от суммы.
+type FeeTier struct {
+	From        int64
+	Fixed       int64
+	BasisPoints int64
+}
+
+// Interest - начисление процентов на остаток.
+type Interest struct {
+	// Rates - годовые ставки по продуктам кошельков в сотых долях процента (450 = 4.5%).
+	// Задаются строкой вида "savings=4.5%; premium=6%".
+	Rates map[string]int64
+	// PollInterval - как часто проверять, есть ли закончившиеся дни и месяцы без начисления.
+	// 0 - проценты в этой реплике не начисляются.
+	PollInterval time.Duration
+}
+
+// Currency - валюта кошельков. Суммы в API и базе - целые числа в минимальных единицах
+// валюты; Exponent - число знаков дробной части в десятичной записи (2 - копейки).
+// Исторически суммы хранятся в целых рублях, поэтому по умолчанию Exponent = 0.
+// Изменение Exponent на существующей базе меняет смысл уже записанных сумм.
+type Currency struct {
+	Code     string
+	Exponent int
+}
+
+// MaxCurrencyExponent - наибольшее число знаков дробной части.
+const MaxCurrencyExponent = 8
+
+// Logging - настройки журнала.
+type Logging struct {
+	// Level - debug, info, warn или error.
+	Level string
+	// Format - json или text (удобнее читать при локальной разработке).
+	Format string
+}
+
+// Tracing - настройки экспорта трассировок OpenTelemetry.
+type Tracing struct {
+	// Exporter - none, stdout или otlp. Адрес коллектора для otlp задается
+	// стандартными переменными OTEL_EXPORTER_OTLP_ENDPOINT и OTEL_EXPORTER_OTLP_TRACES_ENDPOINT.
+	Exporter    string
+	ServiceName string
+	// SampleRatio - доля трассировок, начинаемых сервисом (0..1).
+	// Для входящих запросов с traceparent решение о выборке берется у вызывающей стороны.
+	SampleRatio float64
+}
+
+// Database - настройки подключения к PostgreSQL.
+type Database struct {
+	// URL (DATABASE_URL) имеет приоритет над Host, Port, User, Password и Name.
+	URL      string
+	Host     string
+	Port     int
+	User     string
+	Password string
+	Name     string
+
+	// SSLMode - disable, require, verify-ca или verify-full.
+	SSLMode string
+	// SSLRootCert - путь к сертификату CA для verify-ca и verify-full.
+	SSLRootCert string
+
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+
+	StatementTimeout time.Duration
+	LockTimeout      time.Duration
+	TxMaxAttempts    int
+}
+
+// ValidationError перечисляет все ошибки конфигурации сразу.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// field описывает один параметр: имя переменной окружения, флаг, значение по умолчанию и разбор.
+type field struct {
+	env    string
+	flag   string
+	def    string
+	usage  string
+	secret bool
+	set    func(c *Config, v string) error
+}
+
+var fields = []field{
+	{env: "HTTP_PORT", flag: "http-port", def: "8080", usage: "порт HTTP API",
+		set: func(c *Config, v string) error { return parsePort(v, &c.HTTPPort) }},
+	{env: "GRPC_PORT", flag: "grpc-port", def: "9090", usage: "порт gRPC API",
+		set: func(c *Config, v string) error { return parsePort(v, &c.GRPCPort) }},
+	{env: "SHUTDOWN_TIMEOUT", flag: "shutdown-timeout", def: "30s", usage: "время на завершение текущих запросов при остановке",
+		set: func(c *Config, v string) error { return parseDuration(v, &c.ShutdownTimeout) }},
+	{env: "SHUTDOWN_DELAY", flag: "shutdown-delay", def: "0s", usage: "пауза после перевода /readyz в 503 перед закрытием слушателей",
+		set: func(c *Config, v string) error { return parseDuration(v, &c.ShutdownDelay) }},
+
+	{env: "DATABASE_URL", flag: "database-url", usage: "строка подключения postgres://..., заменяет DB_HOST, DB_PORT, DB_USER, DB_PASSWORD, DB_NAME", secret: true,
+		set: func(c *Config, v string) error { c.Database.URL = v; return nil }},
+	{env: "DB_HOST", flag: "db-host", def: "localhost", usage: "хост PostgreSQL",
+		set: func(c *Config, v string) error { c.Database.Host = v; return nil }},
+	{env: "DB_PORT", flag: "db-port", def: "5432", usage: "порт PostgreSQL",
+		set: func(c *Config, v string) error { return parsePort(v, &c.Database.Port) }},
+	{env: "DB_USER", flag: "db-user", usage: "пользователь PostgreSQL",
+		set: func(c *Config, v string) error { c.Database.User = v; return nil }},
+	{env: "DB_PASSWORD", flag: "db-password", usage: "пароль PostgreSQL", secret: true,
+		set: func(c *Config, v string) error { c.Database.Password = v; return nil }},
+	{env: "DB_NAME", flag: "db-name", usage: "имя базы данных",
+		set: func(c *Config, v string) error { c.Database.Name = v; return nil }},
+	{env: "DB_SSLMODE", flag: "db-sslmode", def: "disable", usage: "disable, require, verify-ca или verify-full",
+		set: func(c *Config, v string) error { c.Database.SSLMode = v; return nil }},
+	{env: "DB_SSLROOTCERT", flag: "db-sslrootcert", usage: "путь к сертификату CA для verify-ca и verify-full",
+		set: func(c *Config, v string) error { c.Database.SSLRootCert = v; return nil }},
+
+	{env: "DB_MAX_OPEN_CONNS", flag: "db-max-open-conns", def: "25", usage: "максимум открытых соединений",
+		set: func(c *Config, v string) error { return parseInt(v, &c.Database.MaxOpenConns) }},
+	{env: "DB_MAX_IDLE_CONNS", flag: "db-max-idle-conns", def: "25", usage: "максимум простаивающих соединений",
+		set: func(c *Config, v string) error { return parseInt(v, &c.Database.MaxIdleConns) }},
+	{env: "DB_CONN_MAX_LIFETIME", flag: "db-conn-max-lifetime", def: "5m", usage: "максимальное время жизни соединения",
+		set: func(c *Config, v string) error { return parseDuration(v, &c.Database.ConnMaxLifetime) }},
+	{env: "DB_CONN_MAX_IDLE_TIME", flag: "db-conn-max-idle-time", def: "0", usage: "максимальное время простоя соединения (0 - без ограничения)",
+		set: func(c *Config, v string) error { return parseDuration(v, &c.Database.ConnMaxIdleTime) }},
+
+	{env: "DB_STATEMENT_TIMEOUT", flag: "db-statement-timeout", def: "5s", usage: "statement_timeout для операций",
+		set: func(c *Config, v string) error { return parseDuration(v, &c.Database.StatementTimeout) }},
+	{env: "DB_LOCK_TIMEOUT", flag: "db-lock-timeout", def: "2s", usage: "lock_timeout для операций",
+		set: func(c *Config, v string) error { return parseDuration(v, &c.Database.LockTimeout) }},
+	{env: "DB_TX_MAX_ATTEMPTS", flag: "db-tx-max-attempts", def: "5", usage: "попыток транзакции при конфликтах сериализации и взаимоблокировках",
+		set: func(c *Config, v string) error { return parseInt(v, &c.Database.TxMaxAttempts) }},
+
+	{env: "ADMIN_API_KEY", flag: "admin-api-key", usage: "ключ администратора, регистрируемый при запуске", secret: true,
+		set: func(c *Config, v string) error { c.Auth.AdminAPIKey = v; return nil }},
+	{env: "JWT_JWKS_URL", flag: "jwt-jwks-url", usage: "адрес JWKS с ключами подписи JWT",
+		set: func(c *Config, v string) error { c.Auth.JWT.JWKSURL = v; return nil }},
+	{env: "JWT_KEYS_FILE", flag: "jwt-keys-file", usage: "файл с ключами подписи JWT (JWKS или PEM)",
+		set: func(c *Config, v string) error { c.Auth.JWT.KeysFile = v; return nil }},
+	{env: "JWT_ISSUER", flag: "jwt-issuer", usage: "ожидаемый claim iss",
+		set: func(c *Config, v string) error { c.Auth.JWT.Issuer = v; return nil }},
+	{env: "JWT_AUDIENCE", flag: "jwt-audience", usage: "ожидаемый claim aud",
+		set: func(c *Config, v string) error { c.Auth.JWT.Audience = v; return nil }},
+	{env: "JWT_JWKS_REFRESH_INTERVAL", flag: "jwt-jwks-refresh-interval", def: "10m", usage: "период обновления JWKS",
+		set: func(c *Config, v string) error { return parseDuration(v, &c.Auth.JWT.RefreshInterval) }},
+	{env: "JWT_SERVICE_SCOPE", flag: "jwt-service-scope", def: "wallet:service", usage: "scope сервисного токена, которому доступны все кошельки",
+		set: func(c *Config, v string) error { c.Auth.JWT.ServiceScope = v; return nil }},
+
+	{env: "RATE_LIMIT_STORE", flag: "rate-limit-store", def: "memory", usage: "хранилище лимитов: none, memory или postgres",
+		set: func(c *Config, v string) error { c.RateLimit.Store = v; return nil }},
+	{env: "RATE_LIMITS", flag: "rate-limits", usage: "лимиты по маршрутам, например \"POST /api/v1/wallet client=50/s:100 wallet=20/s:40\"",
+		def: "POST /api/v1/wallet client=50/s:100 wallet=20/s:40; GET /api/v1/wallets/{walletUUID} client=100/s:200; GRPC * client=100/s:200 wallet=20/s:40",
+		set: func(c *Config, v string) error { return parseRateLimits(v, &c.RateLimit.Rules) }},
+	{env: "RATE_LIMIT_DB_MAX_CONNS", flag: "rate-limit-db-max-conns", def: "4", usage: "соединений в отдельном пуле для лимитов в postgres",
+		set: func(c *Config, v string) error { return parseInt(v, &c.RateLimit.DBMaxConns) }},
+	{env: "RATE_LIMIT_DB_TIMEOUT", flag: "rate-limit-db-timeout", def: "100ms", usage: "таймаут проверки лимита в postgres; после него действует лимит реплики",
+		set: func(c *Config, v string) error { return parseDuration(v, &c.RateLimit.DBTimeout) }},
+
+	{env: "RECEIPT_KEYS_FILE", flag: "receipt-keys-file", usage: "PEM файл с ключами Ed25519 для подписи квитанций (openssl genpkey -algorithm ed25519)",
+		set: func(c *Config, v string) error { c.Receipts.KeysFile = v; return nil }},
+
+	{env: "SCHEDULER_POLL_INTERVAL", flag: "scheduler-poll-interval", def: "10s", usage: "период проверки запланированных операций (0 - не выполнять их в этой реплике)",
+		set: func(c *Config, v string) error { return parseDuration(v, &c.Scheduler.PollInterval) }},
+	{env: "SCHEDULER_BATCH_SIZE", flag: "scheduler-batch-size", def: "100", usage: "запусков за один проход планировщика",
+		set: func(c *Config, v string) error { return parseInt(v, &c.Scheduler.BatchSize) }},
+
+	{env: "FEES", flag: "fees", usage: "комиссии по типам операций, например \"WITHDRAW 1.5% min=10 max=500; DEPOSIT 0:0 10000:5\"",
+		set: func(c *Config, v string) error { return parseFees(v, &c.Fees.Rules) }},
+	{env: "FEE_REVENUE_WALLET", flag: "fee-revenue-wallet", usage: "ID кошелька, на который зачисляются комиссии",
+		set: func(c *Config, v string) error { c.Fees.RevenueWallet = v; return nil }},
+
+	{env: "INTEREST_RATES", flag: "interest-rates", usage: "годовые ставки по продуктам кошельков, например \"savings=4.5%; premium=6%\"",
+		set: func(c *Config, v string) error { return parseInterestRates(v, &c.Interest.Rates) }},
+	{env: "INTEREST_POLL_INTERVAL", flag: "interest-poll-interval", def: "1h", usage: "период проверки начисления процентов (0 - не начислять в этой реплике)",
+		set: func(c *Config, v string) error { return parseDuration(v, &c.Interest.PollInterval) }},
+
+	{env: "CURRENCY", flag: "currency", def: "RUB", usage: "код валюты кошельков по ISO 4217",
+		set: func(c *Config, v string) error { c.Currency.Code = v; return nil }},
+	{env: "CURRENCY_EXPONENT", flag: "currency-exponent", def: "0", usage: "число знаков дробной части валюты (0 - суммы в целых единицах, 2 - в сотых)",
+		set: func(c *Config, v string) error { return parseInt(v, &c.Currency.Exponent) }},
+
+	{env: "LOG_LEVEL", flag: "log-level", def: "info", usage: "уровень журнала: debug, info, warn или error",
+		set: func(c *Config, v string) error { c.Logging.Level = v; return nil }},
+	{env: "LOG_FORMAT", flag: "log-format", def: "json", usage: "формат журнала: json или text",
+		set: func(c *Config, v string) error { c.Logging.Format = v; return nil }},
+
+	{env: "TRACING_EXPORTER", flag: "tracing-exporter", def: "none", usage: "экспорт трассировок: none, stdout или otlp",
+		set: func(c *Config, v string) error { c.Tracing.Exporter = v; return nil }},
+	{env: "OTEL_SERVICE_NAME", flag: "otel-service-name", def: "wallet", usage: "имя сервиса в трассировках",
+		set: func(c *Config, v string) error { c.Tracing.ServiceName = v; return nil }},
+	{env: "TRACING_SAMPLE_RATIO", flag: "tracing-sample-ratio", def: "1", usage: "доля новых трассировок (0..1)",
+		set: func(c *Config, v string) error { return parseFloat(v, &c.Tracing.SampleRatio) }},
+}
+
+// Load собирает конфигурацию из всех источников и проверяет ее.
+// args - аргументы командной строки без имени программы.
+// При -h возвращает flag.ErrHelp.
+func Load(args []string) (*Config, error) {
+	fs := flag.NewFlagSet("wallet", flag.ContinueOnError)
+	configFile := fs.String("config", "", "путь к env-файлу (по умолчанию $CONFIG_FILE или "+DefaultConfigFile+")")
+	flagValues := make(map[string]*string, len(fields))
+	for _, f := range fields {
+		usage := f.usage + " (" + f.env + ")"
+		flagValues[f.env] = fs.String(f.flag, f.def, usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	setFlags := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+
+	fileValues, err := readEnvFile(*configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	lookup := func(key string) (string, bool) {
+		if v, ok := os.LookupEnv(key); ok {
+			return v, true
+		}
+		v, ok := fileValues[key]
+		return v, ok
+	}
+
+	cfg := &Config{Args: fs.Args()}
+	var problems []string
+	for _, f := range fields {
+		value, err := resolve(f, lookup)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		if setFlags[f.flag] {
+			value = *flagValues[f.env]
+		}
+		if err := f.set(cfg, value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", f.env, err))
+		}
+	}
+
+	problems = append(problems, cfg.validate()...)
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, &ValidationError{Problems: problems}
+	}
+	return cfg, nil
+}
+
+// readEnvFile читает env-файл. Отсутствие файла по умолчанию не считается ошибкой.
+func readEnvFile(path string) (map[string]string, error) {
+	explicit := path != ""
+	if !explicit {
+		path = os.Getenv("CONFIG_FILE")
+		explicit = path != ""
+	}
+	if !explicit {
+		path = DefaultConfigFile
+	}
+
+	values, err := godotenv.Read(path)
+	if err != nil {
+		if !explicit && errors.Is(err, os.ErrNotExist) {
+			return map[string]string{}, nil
+		}
+		return nil, fmt.Errorf("error reading config file %s: %w", path, err)
+	}
+	return values, nil
+}
+
+// resolve возвращает значение параметра из окружения или env-файла.
+// Для секретов поддерживается вариант с суффиксом _FILE.
+func resolve(f field, lookup func(string) (string, bool)) (string, error) {
+	value, hasValue := lookup(f.env)
+	if !f.secret {
+		if !hasValue {
+			return f.def, nil
+		}
+		return value, nil
+	}
+
+	path, hasFile := lookup(f.env + "_FILE")
+	switch {
+	case hasValue && hasFile:
+		return "", fmt.Errorf("%s and %s_FILE are mutually exclusive", f.env, f.env)
+	case hasFile:
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("%s_FILE: %v", f.env, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case hasValue:
+		return value, nil
+	}
+	return f.def, nil
+}
+
+// validate проверяет значения, которые зависят друг от друга.
+func (c *Config) validate() []string {
+	var problems []string
+	if c.HTTPPort != 0 && c.HTTPPort == c.GRPCPort {
+		problems = append(problems, "HTTP_PORT and GRPC_PORT must differ")
+	}
+	if c.ShutdownTimeout <= 0 {
+		problems = append(problems, "SHUTDOWN_TIMEOUT: must be positive")
+	}
+	if c.ShutdownDelay < 0 {
+		problems = append(problems, "SHUTDOWN_DELAY: must not be negative")
+	}
+
+	db := c.Database
+	if db.URL != "" {
+		if u, err := url.Parse(db.URL); err != nil || (u.Scheme != "postgres" && u.Scheme != "postgresql") {
+			problems = append(problems, "DATABASE_URL: must be a postgres:// or postgresql:// URL")
+		}
+	} else {
+		if db.Host == "" {
+			problems = append(problems, "DB_HOST: must be set when DATABASE_URL is empty")
+		}
+		if db.User == "" {
+			problems = append(problems, "DB_USER: must be set when DATABASE_URL is empty")
+		}
+		if db.Name == "" {
+			problems = append(problems, "DB_NAME: must be set when DATABASE_URL is empty")
+		}
+	}
+
+	switch db.SSLMode {
+	case "disable", "require":
+	case "verify-ca", "verify-full":
+		if db.SSLRootCert == "" {
+			problems = append(problems, fmt.Sprintf("DB_SSLROOTCERT: required for DB_SSLMODE=%s", db.SSLMode))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("DB_SSLMODE: %q is not one of disable, require, verify-ca, verify-full", db.SSLMode))
+	}
+	if db.SSLRootCert != "" {
+		if _, err := os.Stat(db.SSLRootCert); err != nil {
+			problems = append(problems, fmt.Sprintf("DB_SSLROOTCERT: %v", err))
+		}
+	}
+
+	if db.MaxOpenConns < 1 {
+		problems = append(problems, "DB_MAX_OPEN_CONNS: must be at least 1")
+	}
+	if db.MaxIdleConns < 0 || db.MaxIdleConns > db.MaxOpenConns {
+		problems = append(problems, "DB_MAX_IDLE_CONNS: must be between 0 and DB_MAX_OPEN_CONNS")
+	}
+	for name, d := range map[string]time.Duration{
+		"DB_CONN_MAX_LIFETIME":  db.ConnMaxLifetime,
+		"DB_CONN_MAX_IDLE_TIME": db.ConnMaxIdleTime,
+		"DB_STATEMENT_TIMEOUT":  db.StatementTimeout,
+		"DB_LOCK_TIMEOUT":       db.LockTimeout,
+	} {
+		if d < 0 {
+			problems = append(problems, name+": must not be negative")
+		}
+	}
+	if db.TxMaxAttempts < 1 {
+		problems = append(problems, "DB_TX_MAX_ATTEMPTS: must be at least 1")
+	}
+
+	if jwt := c.Auth.JWT; jwt.Enabled() {
+		if jwt.JWKSURL != "" && jwt.KeysFile != "" {
+			problems = append(problems, "JWT_JWKS_URL and JWT_KEYS_FILE are mutually exclusive")
+		}
+		if jwt.JWKSURL != "" {
+			if u, err := url.Parse(jwt.JWKSURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+				problems = append(problems, "JWT_JWKS_URL: must be an http:// or https:// URL")
+			}
+		}
+		if jwt.KeysFile != "" {
+			if _, err := os.Stat(jwt.KeysFile); err != nil {
+				problems = append(problems, fmt.Sprintf("JWT_KEYS_FILE: %v", err))
+			}
+		}
+		// Без проверки iss и aud подошел бы любой токен, подписанный тем же провайдером.
+		if jwt.Issuer == "" {
+			problems = append(problems, "JWT_ISSUER: required when JWT authentication is enabled")
+		}
+		if jwt.Audience == "" {
+			problems = append(problems, "JWT_AUDIENCE: required when JWT authentication is enabled")
+		}
+		if jwt.RefreshInterval <= 0 {
+			problems = append(problems, "JWT_JWKS_REFRESH_INTERVAL: must be positive")
+		}
+		if jwt.ServiceScope == "" {
+			problems = append(problems, "JWT_SERVICE_SCOPE: must not be empty")
+		}
+	}
+
+	switch c.RateLimit.Store {
+	case "none", "memory", "postgres":
+	default:
+		problems = append(problems, fmt.Sprintf("RATE_LIMIT_STORE: %q is not one of none, memory, postgres", c.RateLimit.Store))
+	}
+	if c.RateLimit.Store == "postgres" {
+		if c.RateLimit.DBMaxConns < 1 {
+			problems = append(problems, "RATE_LIMIT_DB_MAX_CONNS: must be at least 1")
+		}
+		if c.RateLimit.DBTimeout <= 0 {
+			problems = append(problems, "RATE_LIMIT_DB_TIMEOUT: must be positive")
+		}
+	}
+	if c.Receipts.KeysFile != "" {
+		if _, err := os.Stat(c.Receipts.KeysFile); err != nil {
+			problems = append(problems, fmt.Sprintf("RECEIPT_KEYS_FILE: %v", err))
+		}
+	}
+
+	if c.Scheduler.PollInterval < 0 {
+		problems = append(problems, "SCHEDULER_POLL_INTERVAL: must not be negative")
+	}
+	if c.Scheduler.BatchSize < 1 {
+		problems = append(problems, "SCHEDULER_BATCH_SIZE: must be at least 1")
+	}
+
+	if c.Fees.RevenueWallet != "" {
+		if _, err := uuid.Parse(c.Fees.RevenueWallet); err != nil {
+			problems = append(problems, "FEE_REVENUE_WALLET: must be a wallet UUID")
+		}
+	} else if len(c.Fees.Rules) > 0 {
+		problems = append(problems, "FEE_REVENUE_WALLET: required when FEES is set")
+	}
+
+	if c.Interest.PollInterval < 0 {
+		problems = append(problems, "INTEREST_POLL_INTERVAL: must not be negative")
+	}
+
+	if !validCurrencyCode(c.Currency.Code) {
+		problems = append(problems, fmt.Sprintf("CURRENCY: %q is not a three-letter ISO 4217 code", c.Currency.Code))
+	}
+	if c.Currency.Exponent < 0 || c.Currency.Exponent > MaxCurrencyExponent {
+		problems = append(problems, fmt.Sprintf("CURRENCY_EXPONENT: must be between 0 and %d", MaxCurrencyExponent))
+	}
+
+	switch strings.ToLower(c.Logging.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		problems = append(problems, fmt.Sprintf("LOG_LEVEL: %q is not one of debug, info, warn, error", c.Logging.Level))
+	}
+	switch c.Logging.Format {
+	case "json", "text":
+	default:
+		problems = append(problems, fmt.Sprintf("LOG_FORMAT: %q is not one of json, text", c.Logging.Format))
+	}
+
+	switch c.Tracing.Exporter {
+	case "none", "stdout", "otlp":
+	default:
+		problems = append(problems, fmt.Sprintf("TRACING_EXPORTER: %q is not one of none, stdout, otlp", c.Tracing.Exporter))
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		problems = append(problems, "TRACING_SAMPLE_RATIO: must be between 0 and 1")
+	}
+	return problems
+}
+
+// DSN возвращает строку подключения для lib/pq.
+// Параметры sslmode и sslrootcert из DATABASE_URL имеют приоритет над DB_SSLMODE и DB_SSLROOTCERT.
+func (d Database) DSN() string {
+	if d.URL != "" {
+		u, err := url.Parse(d.URL)
+		if err != nil {
+			return d.URL
+		}
+		q := u.Query()
+		if q.Get("sslmode") == "" {
+			q.Set("sslmode", d.SSLMode)
+		}
+		if q.Get("sslrootcert") == "" && d.SSLRootCert != "" {
+			q.Set("sslrootcert", d.SSLRootCert)
+		}
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+
+	params := []struct{ key, value string }{
+		{"host", d.Host},
+		{"port", strconv.Itoa(d.Port)},
+		{"user", d.User},
+		{"password", d.Password},
+		{"dbname", d.Name},
+		{"sslmode", d.SSLMode},
+		{"sslrootcert", d.SSLRootCert},
+	}
+	parts := make([]string, 0, len(params))
+	for _, p := range params {
+		if p.value != "" {
+			parts = append(parts, p.key+"="+quoteDSNValue(p.value))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// quoteDSNValue экранирует значение для формата key=value, например пароль с пробелами.
+func quoteDSNValue(v string) string {
+	if v != "" && !strings.ContainsAny(v, ` '\`) {
+		return v
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
+
+func parsePort(v string, dst *int) error {
+	port, err := strconv.Atoi(v)
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("%q is not a valid port", v)
+	}
+	*dst = port
+	return nil
+}
+
+func parseInt(v string, dst *int) error {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("%q is not an integer", v)
+	}
+	*dst = n
+	return nil
+}
+
+func parseFloat(v string, dst *float64) error {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return fmt.Errorf("%q is not a number", v)
+	}
+	*dst = f
+	return nil
+}
+
+// parseRateLimits разбирает правила вида "METHOD ROUTE key=N/unit[:burst] ...", разделенные ';'.
+// unit - s, m или h. Без burst допускается N запросов подряд.
+func parseRateLimits(v string, dst *[]RateLimitRule) error {
+	var rules []RateLimitRule
+	for _, spec := range strings.Split(v, ";") {
+		parts := strings.Fields(spec)
+		if len(parts) == 0 {
+			continue
+		}
+		if len(parts) < 3 {
+			return fmt.Errorf("%q: expected METHOD ROUTE key=N/unit[:burst]", strings.TrimSpace(spec))
+		}
+		method, route := strings.ToUpper(parts[0]), parts[1]
+		for _, limit := range parts[2:] {
+			rule, err := parseRateLimit(limit)
+			if err != nil {
+				return fmt.Errorf("%s %s: %w", method, route, err)
+			}
+			rule.Method, rule.Route = method, route
+			rules = append(rules, rule)
+		}
+	}
+	*dst = rules
+	return nil
+}
+
+func parseRateLimit(v string) (RateLimitRule, error) {
+	key, limit, ok := strings.Cut(v, "=")
+	if !ok || (key != "client" && key != "wallet") {
+		return RateLimitRule{}, fmt.Errorf("%q: expected client=N/unit or wallet=N/unit", v)
+	}
+	limit, burstStr, hasBurst := strings.Cut(limit, ":")
+	countStr, unit, ok := strings.Cut(limit, "/")
+	if !ok {
+		return RateLimitRule{}, fmt.Errorf("%q: missing /s, /m or /h", v)
+	}
+	count, err := strconv.Atoi(countStr)
+	if err != nil || count < 1 {
+		return RateLimitRule{}, fmt.Errorf("%q: request count must be a positive integer", v)
+	}
+	per := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}[unit]
+	if per == 0 {
+		return RateLimitRule{}, fmt.Errorf("%q: unit must be s, m or h", v)
+	}
+	burst := count
+	if hasBurst {
+		burst, err = strconv.Atoi(burstStr)
+		if err != nil || burst < 1 {
+			return RateLimitRule{}, fmt.Errorf("%q: burst must be a positive integer", v)
+		}
+	}
+	return RateLimitRule{Key: key, Rate: float64(count) / per.Seconds(), Burst: burst}, nil
+}
+
+// parseFees разбирает правила вида "OPERATION FEE [min=N] [max=N]", разделенные ';'.
+// FEE - N (фиксированная сумма), P% (процент, до сотых), N+P% или уровни FROM:VALUE ...
+// с такими же значениями для операций на сумму от FROM.
+func parseFees(v string, dst *[]FeeRule) error {
+	var rules []FeeRule
+	seen := map[string]bool{}
+	for _, spec := range strings.Split(v, ";") {
+		parts := strings.Fields(spec)
+		if len(parts) == 0 {
+			continue
+		}
+		rule := FeeRule{Operation: strings.ToUpper(parts[0])}
+		switch rule.Operation {
+		case "DEPOSIT", "WITHDRAW", "TRANSFER":
+		default:
+			return fmt.Errorf("%q: operation must be DEPOSIT, WITHDRAW or TRANSFER", parts[0])
+		}
+		if seen[rule.Operation] {
+			return fmt.Errorf("%s: duplicate fee rule", rule.Operation)
+		}
+		seen[rule.Operation] = true
+
+		flat := 0
+		for _, part := range parts[1:] {
+			if key, value, ok := strings.Cut(part, "="); ok {
+				n, err := strconv.ParseInt(value, 10, 64)
+				if err != nil || n < 0 {
+					return fmt.Errorf("%s: %q must be a non-negative integer", rule.Operation, part)
+				}
+				switch key {
+				case "min":
+					rule.Min = n
+				case "max":
+					rule.Max = n
+				default:
+					return fmt.Errorf("%s: unknown option %q, expected min= or max=", rule.Operation, key)
+				}
+				continue
+			}
+			tier, err := parseFeeTier(part)
+			if err != nil {
+				return fmt.Errorf("%s: %w", rule.Operation, err)
+			}
+			if !strings.Contains(part, ":") {
+				flat++
+			}
+			rule.Tiers = append(rule.Tiers, tier)
+		}
+
+		switch {
+		case len(rule.Tiers) == 0:
+			return fmt.Errorf("%s: missing fee", rule.Operation)
+		case flat > 0 && len(rule.Tiers) > 1:
+			return fmt.Errorf("%s: several fees must be tiers FROM:VALUE", rule.Operation)
+		case rule.Max > 0 && rule.Min > rule.Max:
+			return fmt.Errorf("%s: min must not exceed max", rule.Operation)
+		}
+		for i := 1; i < len(rule.Tiers); i++ {
+			if rule.Tiers[i].From <= rule.Tiers[i-1].From {
+				return fmt.Errorf("%s: tiers must be in ascending order of amount", rule.Operation)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	*dst = rules
+	return nil
+}
+
+// parseFeeTier разбирает "[FROM:]VALUE", где VALUE - N, P% или N+P%.
+func parseFeeTier(v string) (FeeTier, error) {
+	var tier FeeTier
+	value := v
+	if from, rest, ok := strings.Cut(v, ":"); ok {
+		n, err := strconv.ParseInt(from, 10, 64)
+		if err != nil || n < 0 {
+			return FeeTier{}, fmt.Errorf("%q: tier amount must be a non-negative integer", v)
+		}
+		tier.From, value = n, rest
+	}
+	fixed, percent, combined := strings.Cut(value, "+")
+	if !combined {
+		fixed, percent = value, ""
+		if strings.HasSuffix(value, "%") {
+			fixed, percent = "", value
+		}
+	}
+	if fixed != "" || combined {
+		n, err := strconv.ParseInt(fixed, 10, 64)
+		if err != nil || n < 0 {
+			return FeeTier{}, fmt.Errorf("%q: fixed fee must be a non-negative integer", v)
+		}
+		tier.Fixed = n
+	}
+	if percent != "" || combined {
+		bp, err := parseBasisPoints(percent)
+		if err != nil {
+			return FeeTier{}, fmt.Errorf("%q: %w", v, err)
+		}
+		tier.BasisPoints = bp
+	}
+	return tier, nil
+}
+
+// parseInterestRates разбирает ставки вида "product=P%", разделенные ';'.
+// Имя продукта - до 32 строчных латинских букв, цифр, '-' и '_'.
+func parseInterestRates(v string, dst *map[string]int64) error {
+	rates := map[string]int64{}
+	for _, spec := range strings.Split(v, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		product, rate, ok := strings.Cut(spec, "=")
+		if !ok || !validProductName(product) {
+			return fmt.Errorf("%q: expected product=P%% with a product name of up to 32 characters a-z, 0-9, - or _", spec)
+		}
+		if _, dup := rates[product]; dup {
+			return fmt.Errorf("%s: duplicate interest rate", product)
+		}
+		bp, err := parseBasisPoints(rate)
+		if err != nil {
+			return fmt.Errorf("%s: %w", product, err)
+		}
+		rates[product] = bp
+	}
+	*dst = rates
+	return nil
+}
+
+func validProductName(name string) bool {
+	if name == "" || len(name) > 32 {
+		return false
+	}
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// validCurrencyCode проверяет, что code - три заглавные латинские буквы.
+func validCurrencyCode(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, r := range code {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseBasisPoints переводит процент вида "1.25%" в сотые доли процента (125).
+func parseBasisPoints(v string) (int64, error) {
+	number, ok := strings.CutSuffix(v, "%")
+	if !ok {
+		return 0, errors.New("percentage must end with %")
+	}
+	whole, frac, _ := strings.Cut(number, ".")
+	if len(frac) > 2 {
+		return 0, errors.New("percentage allows at most two decimal places")
+	}
+	frac += strings.Repeat("0", 2-len(frac))
+	w, err1 := strconv.Atoi(whole)
+	f, err2 := strconv.Atoi(frac)
+	if err1 != nil || err2 != nil || w < 0 || f < 0 || w*100+f > 10000 {
+		return 0, errors.New("percentage must be between 0% and 100%")
+	}
+	return int64(w*100 + f), nil
+}
+
+func parseDuration(v string, dst *time.Duration) error {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("%q is not a duration (e.g. 500ms, 5s, 1m)", v)
+	}
+	*dst = d
+	return nil
+}
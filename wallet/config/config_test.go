@@ -0,0 +1,237 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeFile создает файл во временном каталоге теста и возвращает путь к нему.
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadLayersSources(t *testing.T) {
+	envFile := writeFile(t, "config.env", "DB_HOST=file-host\nDB_USER=file-user\nDB_NAME=wallet\nDB_PORT=6000\nHTTP_PORT=8081\n")
+	t.Setenv("CONFIG_FILE", envFile)
+	t.Setenv("DB_PORT", "7000")
+	t.Setenv("DB_LOCK_TIMEOUT", "750ms")
+
+	cfg, err := Load([]string{"-http-port", "9999"})
+	require.NoError(t, err)
+
+	assert.Equal(t, "file-host", cfg.Database.Host, "env file overrides defaults")
+	assert.Equal(t, 7000, cfg.Database.Port, "environment overrides env file")
+	assert.Equal(t, 9999, cfg.HTTPPort, "flags override everything")
+	assert.Equal(t, 9090, cfg.GRPCPort, "defaults apply when nothing is set")
+	assert.Equal(t, 750*time.Millisecond, cfg.Database.LockTimeout)
+	assert.Equal(t, 25, cfg.Database.MaxOpenConns)
+}
+
+func TestSecretFromFile(t *testing.T) {
+	secret := writeFile(t, "db_password", "s3cret pass\n")
+	t.Setenv("CONFIG_FILE", writeFile(t, "config.env", "DB_USER=u\nDB_NAME=n\n"))
+	t.Setenv("DB_PASSWORD_FILE", secret)
+
+	cfg, err := Load(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "s3cret pass", cfg.Database.Password)
+	assert.Contains(t, cfg.Database.DSN(), `password='s3cret pass'`)
+
+	t.Setenv("DB_PASSWORD", "inline")
+	_, err = Load(nil)
+	assert.ErrorContains(t, err, "mutually exclusive")
+}
+
+func TestDatabaseURL(t *testing.T) {
+	t.Setenv("CONFIG_FILE", writeFile(t, "config.env", ""))
+	t.Setenv("DATABASE_URL", "postgres://u:p@db.internal:5432/wallet?sslmode=require")
+
+	cfg, err := Load(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "postgres://u:p@db.internal:5432/wallet?sslmode=require", cfg.Database.DSN())
+
+	t.Setenv("DATABASE_URL", "postgres://u:p@db.internal:5432/wallet")
+	cfg, err = Load(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "postgres://u:p@db.internal:5432/wallet?sslmode=disable", cfg.Database.DSN())
+}
+
+func TestValidationReportsAllProblems(t *testing.T) {
+	t.Setenv("CONFIG_FILE", writeFile(t, "config.env", ""))
+	t.Setenv("DB_PORT", "abc")
+	t.Setenv("DB_SSLMODE", "verify-full")
+	t.Setenv("DB_MAX_IDLE_CONNS", "100")
+	t.Setenv("DB_STATEMENT_TIMEOUT", "soon")
+	t.Setenv("TRACING_EXPORTER", "jaeger")
+
+	_, err := Load(nil)
+	var verr *ValidationError
+	require.True(t, errors.As(err, &verr), "got %v", err)
+
+	joined := verr.Error()
+	for _, want := range []string{"DB_PORT", "DB_USER", "DB_NAME", "DB_SSLROOTCERT", "DB_MAX_IDLE_CONNS", "DB_STATEMENT_TIMEOUT", "TRACING_EXPORTER"} {
+		assert.Contains(t, joined, want)
+	}
+}
+
+func TestMissingDefaultFileIsOptional(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Setenv("DB_USER", "u")
+	t.Setenv("DB_NAME", "n")
+
+	_, err := Load(nil)
+	require.NoError(t, err)
+
+	_, err = Load([]string{"-config", "missing.env"})
+	assert.ErrorContains(t, err, "missing.env")
+}
+
+func TestJWT(t *testing.T) {
+	t.Setenv("CONFIG_FILE", writeFile(t, "config.env", "DB_USER=u\nDB_NAME=n\n"))
+
+	cfg, err := Load(nil)
+	require.NoError(t, err)
+	assert.False(t, cfg.Auth.JWT.Enabled(), "JWT is disabled unless a key source is configured")
+
+	t.Setenv("JWT_JWKS_URL", "https://idp.example.com/.well-known/jwks.json")
+	_, err = Load(nil)
+	assert.ErrorContains(t, err, "JWT_ISSUER")
+	assert.ErrorContains(t, err, "JWT_AUDIENCE")
+
+	t.Setenv("JWT_ISSUER", "https://idp.example.com/")
+	t.Setenv("JWT_AUDIENCE", "wallet")
+	cfg, err = Load(nil)
+	require.NoError(t, err)
+	assert.True(t, cfg.Auth.JWT.Enabled())
+	assert.Equal(t, 10*time.Minute, cfg.Auth.JWT.RefreshInterval)
+	assert.Equal(t, "wallet:service", cfg.Auth.JWT.ServiceScope)
+
+	t.Setenv("JWT_KEYS_FILE", writeFile(t, "jwks.json", "{}"))
+	_, err = Load(nil)
+	assert.ErrorContains(t, err, "mutually exclusive")
+}
+
+func TestRateLimits(t *testing.T) {
+	var rules []RateLimitRule
+	require.NoError(t, parseRateLimits("post /api/v1/wallet client=50/s:100 wallet=30/m; GRPC * client=3600/h", &rules))
+	assert.Equal(t, []RateLimitRule{
+		{Method: "POST", Route: "/api/v1/wallet", Key: "client", Rate: 50, Burst: 100},
+		{Method: "POST", Route: "/api/v1/wallet", Key: "wallet", Rate: 0.5, Burst: 30},
+		{Method: "GRPC", Route: "*", Key: "client", Rate: 1, Burst: 3600},
+	}, rules)
+
+	for _, bad := range []string{"POST /api/v1/wallet", "GET * ip=1/s", "GET * client=0/s", "GET * client=5/d", "GET * client=5/s:0", "GET * client=5"} {
+		assert.Error(t, parseRateLimits(bad, &rules), bad)
+	}
+
+	t.Setenv("CONFIG_FILE", writeFile(t, "config.env", "DB_USER=u\nDB_NAME=n\n"))
+	cfg, err := Load(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "memory", cfg.RateLimit.Store)
+	assert.NotEmpty(t, cfg.RateLimit.Rules, "default limits protect POST /api/v1/wallet")
+
+	assert.Equal(t, 4, cfg.RateLimit.DBMaxConns)
+	assert.Equal(t, 100*time.Millisecond, cfg.RateLimit.DBTimeout)
+
+	t.Setenv("RATE_LIMIT_STORE", "postgres")
+	t.Setenv("RATE_LIMIT_DB_MAX_CONNS", "0")
+	_, err = Load(nil)
+	assert.ErrorContains(t, err, "RATE_LIMIT_DB_MAX_CONNS")
+
+	t.Setenv("RATE_LIMIT_STORE", "redis")
+	_, err = Load(nil)
+	assert.ErrorContains(t, err, "RATE_LIMIT_STORE")
+}
+
+func TestScheduler(t *testing.T) {
+	t.Setenv("CONFIG_FILE", writeFile(t, "config.env", "DB_USER=u\nDB_NAME=n\n"))
+	cfg, err := Load(nil)
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Second, cfg.Scheduler.PollInterval)
+	assert.Equal(t, 100, cfg.Scheduler.BatchSize)
+
+	cfg, err = Load([]string{"-scheduler-poll-interval", "0"})
+	require.NoError(t, err)
+	assert.Zero(t, cfg.Scheduler.PollInterval, "0 turns the scheduler off on this replica")
+
+	t.Setenv("SCHEDULER_BATCH_SIZE", "0")
+	_, err = Load(nil)
+	assert.ErrorContains(t, err, "SCHEDULER_BATCH_SIZE")
+}
+
+func TestFees(t *testing.T) {
+	var rules []FeeRule
+	require.NoError(t, parseFees("withdraw 1.5% min=10 max=500; DEPOSIT 5; TRANSFER 0:10 1000:2+1% 100000:0.25%", &rules))
+	assert.Equal(t, []FeeRule{
+		{Operation: "WITHDRAW", Tiers: []FeeTier{{BasisPoints: 150}}, Min: 10, Max: 500},
+		{Operation: "DEPOSIT", Tiers: []FeeTier{{Fixed: 5}}},
+		{Operation: "TRANSFER", Tiers: []FeeTier{{Fixed: 10}, {From: 1000, Fixed: 2, BasisPoints: 100}, {From: 100000, BasisPoints: 25}}},
+	}, rules)
+
+	for _, bad := range []string{
+		"INTEREST 5", "WITHDRAW", "WITHDRAW 5; WITHDRAW 1%", "WITHDRAW 5 1%", "WITHDRAW 101%", "WITHDRAW 0.125%",
+		"WITHDRAW 1.5", "WITHDRAW -5", "WITHDRAW 5+", "WITHDRAW 1% min=10 max=5", "WITHDRAW 1% cap=5",
+		"WITHDRAW 1000:1% 0:2%",
+	} {
+		assert.Error(t, parseFees(bad, &rules), bad)
+	}
+
+	t.Setenv("CONFIG_FILE", writeFile(t, "config.env", "DB_USER=u\nDB_NAME=n\n"))
+	cfg, err := Load(nil)
+	require.NoError(t, err)
+	assert.Empty(t, cfg.Fees.Rules, "no fees by default")
+
+	t.Setenv("FEES", "WITHDRAW 1%")
+	_, err = Load(nil)
+	assert.ErrorContains(t, err, "FEE_REVENUE_WALLET: required")
+
+	t.Setenv("FEE_REVENUE_WALLET", "revenue")
+	_, err = Load(nil)
+	assert.ErrorContains(t, err, "FEE_REVENUE_WALLET: must be a wallet UUID")
+
+	t.Setenv("FEE_REVENUE_WALLET", "7b0c4c1e-4c1f-4b8e-9f59-1d2f3a4b5c6d")
+	cfg, err = Load(nil)
+	require.NoError(t, err)
+	assert.Len(t, cfg.Fees.Rules, 1)
+}
+
+func TestInterestRates(t *testing.T) {
+	var rates map[string]int64
+	require.NoError(t, parseInterestRates("savings=4.5%; premium_2=12%;", &rates))
+	assert.Equal(t, map[string]int64{"savings": 450, "premium_2": 1200}, rates)
+
+	for _, bad := range []string{"savings", "savings=4.5", "Savings=1%", "savings=1%; savings=2%", "savings=101%", "=1%"} {
+		assert.Error(t, parseInterestRates(bad, &rates), bad)
+	}
+
+	t.Setenv("CONFIG_FILE", writeFile(t, "config.env", "DB_USER=u\nDB_NAME=n\n"))
+	cfg, err := Load(nil)
+	require.NoError(t, err)
+	assert.Empty(t, cfg.Interest.Rates)
+	assert.Equal(t, time.Hour, cfg.Interest.PollInterval)
+}
+
+func TestCurrency(t *testing.T) {
+	t.Setenv("CONFIG_FILE", writeFile(t, "config.env", "DB_USER=u\nDB_NAME=n\n"))
+	cfg, err := Load(nil)
+	require.NoError(t, err)
+	assert.Equal(t, Currency{Code: "RUB", Exponent: 0}, cfg.Currency, "amounts are whole rubles by default")
+
+	cfg, err = Load([]string{"-currency", "EUR", "-currency-exponent", "2"})
+	require.NoError(t, err)
+	assert.Equal(t, Currency{Code: "EUR", Exponent: 2}, cfg.Currency)
+
+	for _, args := range [][]string{{"-currency", "eur"}, {"-currency", "EURO"}, {"-currency-exponent", "9"}, {"-currency-exponent", "-1"}} {
+		_, err := Load(args)
+		assert.Error(t, err, args)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"test_task_wallet/apispec"
+	"test_task_wallet/auth"
+	"test_task_wallet/config"
+	"test_task_wallet/metrics"
+	"test_task_wallet/problem"
+	"test_task_wallet/ratelimit"
+	"test_task_wallet/receipt"
+	"test_task_wallet/walletcore"
+)
+
+// Ключи, которые принимает testKeys.
+const (
+	testAdminKey = "wk_00000000000a_admin"
+	testReadKey  = "wk_00000000000b_read"
+)
+
+// testKeys - хранилище ключей для тестов без базы данных.
+type testKeys map[string]*walletcore.APIKey
+
+func newTestKeys() testKeys {
+	return testKeys{
+		testAdminKey: {ID: uuid.New(), Name: "test-admin", Scopes: []walletcore.Scope{walletcore.ScopeAdmin}},
+		testReadKey:  {ID: uuid.New(), Name: "test-read", Scopes: []walletcore.Scope{walletcore.ScopeRead}},
+	}
+}
+
+func (k testKeys) AuthenticateAPIKey(ctx context.Context, plaintext string) (*walletcore.APIKey, error) {
+	if key, ok := k[plaintext]; ok {
+		return key, nil
+	}
+	return nil, walletcore.ErrInvalidAPIKey
+}
+
+// testTokens - bearer токены для тестов без провайдера учетных записей: значение токена совпадает с subject.
+type testTokens map[string]*auth.Token
+
+func newTestTokens() testTokens {
+	return testTokens{
+		"alice":   {Subject: "alice"},
+		"bob":     {Subject: "bob"},
+		"billing": {Subject: "billing", Service: true},
+	}
+}
+
+func (t testTokens) VerifyToken(ctx context.Context, raw string) (*auth.Token, error) {
+	if token, ok := t[raw]; ok {
+		return token, nil
+	}
+	return nil, auth.ErrInvalidToken
+}
+
+// withAPIKey добавляет ключ ко всем запросам, в которых его нет.
+func withAPIKey(h http.Handler, key string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(auth.APIKeyHeader) == "" {
+			r.Header.Set(auth.APIKeyHeader, key)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// withBearerToken передает токен в заголовке Authorization.
+func withBearerToken(h http.Handler, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+token)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// newTestSigner подписывает квитанции временным ключом.
+func newTestSigner(t *testing.T) *receipt.Signer {
+	signer, err := receipt.NewSigner(config.Receipts{})
+	require.NoError(t, err)
+	return signer
+}
+
+// newTestRouter - роутер без базы данных с ключами из newTestKeys.
+func newTestRouter(t *testing.T, spec *apispec.Spec) http.Handler {
+	return createRouter(routerDeps{keys: newTestKeys(), tokens: newTestTokens(), receipts: newTestSigner(t),
+		spec: spec, health: newHealthChecker(nil), metrics: metrics.New()})
+}
+
+// checkContract выполняет запрос к handler и проверяет ответ по OpenAPI спецификации.
+func checkContract(t *testing.T, spec *apispec.Spec, handler http.Handler, method, path, body string, wantStatus int) {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	respBody, err := io.ReadAll(rec.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, wantStatus, rec.Code, "unexpected status for %s %s: %s", method, path, respBody)
+
+	// Тело запроса уже прочитано обработчиком, для проверки ответа нужен только маршрут.
+	specReq := httptest.NewRequest(method, path, nil)
+	err = spec.ValidateResponse(specReq, rec.Code, rec.Header(), respBody)
+	require.NoError(t, err, "response of %s %s drifted from the OpenAPI spec", method, path)
+}
+
+// TestHandlersMatchSpecWithoutDB проверяет ответы, которые не требуют базы данных.
+func TestHandlersMatchSpecWithoutDB(t *testing.T) {
+	spec, err := apispec.Load()
+	require.NoError(t, err)
+	anonymous := newTestRouter(t, spec)
+	router := withAPIKey(anonymous, testAdminKey)
+
+	checkContract(t, spec, anonymous, http.MethodGet, "/api/v1/openapi.json", "", http.StatusOK)
+	checkContract(t, spec, anonymous, http.MethodGet, "/.well-known/wallet-receipt-keys", "", http.StatusOK)
+	checkContract(t, spec, anonymous, http.MethodGet, "/api/v1/wallets/"+uuid.NewString(), "", http.StatusUnauthorized)
+	checkContract(t, spec, withAPIKey(anonymous, "wk_00000000000c_unknown"), http.MethodGet, "/api/v1/admin/api-keys", "", http.StatusUnauthorized)
+	checkContract(t, spec, withAPIKey(anonymous, testReadKey), http.MethodPost, "/api/v1/wallet",
+		`{"valletId":"`+uuid.NewString()+`","operationType":"DEPOSIT","amount":1}`, http.StatusForbidden)
+	checkContract(t, spec, withAPIKey(anonymous, testReadKey), http.MethodGet, "/api/v1/admin/api-keys", "", http.StatusForbidden)
+	checkContract(t, spec, withBearerToken(anonymous, "mallory"), http.MethodGet, "/api/v1/wallets/"+uuid.NewString(), "", http.StatusUnauthorized)
+	checkContract(t, spec, withBearerToken(anonymous, "billing"), http.MethodGet, "/api/v1/admin/api-keys", "", http.StatusForbidden)
+	checkContract(t, spec, router, http.MethodPost, "/api/v1/admin/api-keys", `{"name":"","scopes":["read"]}`, http.StatusBadRequest)
+	checkContract(t, spec, router, http.MethodGet, "/api/v1/wallets/not-a-uuid", "", http.StatusBadRequest)
+	checkContract(t, spec, anonymous, http.MethodGet, "/api/v1/wallets/"+uuid.NewString()+"/statement", "", http.StatusUnauthorized)
+	checkContract(t, spec, router, http.MethodGet, "/api/v1/wallets/"+uuid.NewString()+"/statement?format=xml", "", http.StatusBadRequest)
+	checkContract(t, spec, router, http.MethodGet, "/api/v1/wallets/"+uuid.NewString()+"/statement?from=yesterday", "", http.StatusBadRequest)
+	checkContract(t, spec, router, http.MethodPost, "/api/v1/wallet", `{"valletId":"abc","operationType":"DEPOSIT","amount":1}`, http.StatusBadRequest)
+	checkContract(t, spec, router, http.MethodPost, "/api/v1/wallet", `{"valletId":"`+uuid.NewString()+`","operationType":"DEPOSIT","amount":-5}`, http.StatusBadRequest)
+	checkContract(t, spec, router, http.MethodPost, "/api/v1/wallet", `{"valletId":"`+uuid.Nil.String()+`","operationType":"DEPOSIT","amount":5}`, http.StatusBadRequest)
+	checkContract(t, spec, anonymous, http.MethodGet, "/api/v1/schedules", "", http.StatusUnauthorized)
+	checkContract(t, spec, withAPIKey(anonymous, testReadKey), http.MethodPost, "/api/v1/schedules",
+		`{"walletId":"`+uuid.NewString()+`","operationType":"DEPOSIT","amount":1,"cron":"@daily"}`, http.StatusForbidden)
+	checkContract(t, spec, router, http.MethodPost, "/api/v1/schedules",
+		`{"walletId":"`+uuid.NewString()+`","operationType":"DEPOSIT","amount":1,"cron":"every day"}`, http.StatusBadRequest)
+	checkContract(t, spec, router, http.MethodGet, "/api/v1/schedules?limit=0", "", http.StatusBadRequest)
+	checkContract(t, spec, router, http.MethodGet, "/api/v1/schedules/not-a-uuid", "", http.StatusBadRequest)
+	checkContract(t, spec, withAPIKey(anonymous, testReadKey), http.MethodPut, "/api/v1/admin/wallets/"+uuid.NewString()+"/product",
+		`{"product":"savings"}`, http.StatusForbidden)
+	checkContract(t, spec, router, http.MethodPut, "/api/v1/admin/wallets/not-a-uuid/product", `{"product":"savings"}`, http.StatusBadRequest)
+	checkContract(t, spec, anonymous, http.MethodGet, "/api/v1/transactions?externalReference=order-42", "", http.StatusUnauthorized)
+	checkContract(t, spec, router, http.MethodGet, "/api/v1/transactions", "", http.StatusBadRequest)
+	checkContract(t, spec, router, http.MethodPost, "/api/v1/wallet",
+		`{"valletId":"`+uuid.NewString()+`","operationType":"DEPOSIT","amount":1,"metadata":[1]}`, http.StatusBadRequest)
+	checkContract(t, spec, router, http.MethodPost, "/api/v1/wallet",
+		`{"valletId":"`+uuid.NewString()+`","operationType":"DEPOSIT","amountDecimal":"12,50"}`, http.StatusBadRequest)
+	checkContract(t, spec, router, http.MethodPost, "/api/v1/wallet", `{"valletId":"`+uuid.NewString()+`","operationType":"DEPOSIT"}`, http.StatusBadRequest)
+
+	// expvar не отдается: его cmdline - аргументы запуска, среди которых бывают секреты.
+	rec := httptest.NewRecorder()
+	anonymous.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+// TestSuccessResponsesMatchSpecWithoutDB сверяет со спецификацией успешные ответы:
+// сервис работает поверх fakeDB, которая отдает заготовленные строки.
+func TestSuccessResponsesMatchSpecWithoutDB(t *testing.T) {
+	spec, err := apispec.Load()
+	require.NoError(t, err)
+
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	walletService := walletcore.NewService(newFakeDBService(
+		fakeQuery{match: "SELECT balance, owner_id FROM wallets", columns: []string{"balance", "owner_id"},
+			rows: [][]driver.Value{{int64(1250), nil}}},
+		fakeQuery{match: "FROM transactions WHERE client_id = $1 AND external_reference = $2",
+			columns: []string{"id", "wallet_id", "operation_type", "amount", "timestamp", "api_key_id", "related_transaction_id",
+				"description", "external_reference", "tags", "metadata"},
+			rows: [][]driver.Value{{uuid.NewString(), uuid.NewString(), "DEPOSIT", int64(1250), now, nil, nil,
+				"March invoice", "order-42", "{invoice,march}", []byte(`{"orderId": 42}`)}}},
+		fakeQuery{match: "FROM schedules",
+			columns: []string{"id", "wallet_id", "operation_type", "target_wallet_id", "amount", "cron", "interval_seconds",
+				"start_at", "end_at", "max_retries", "status", "next_run_at", "occurrence_at", "attempt", "last_run_at",
+				"owner_id", "api_key_id", "client_id", "created_at", "updated_at"},
+			rows: [][]driver.Value{{uuid.NewString(), uuid.NewString(), "DEPOSIT", nil, int64(500), "@daily", nil,
+				now, nil, int64(0), "active", now.Add(24 * time.Hour), now.Add(24 * time.Hour), int64(0), nil,
+				nil, nil, "key:test-read", now, now}}},
+	))
+	deps := routerDeps{walletService: walletService, keys: newTestKeys(), tokens: newTestTokens(), receipts: newTestSigner(t),
+		spec: spec, health: newHealthChecker(&fakeSchemaChecker{version: walletcore.SchemaVersion()}), metrics: metrics.New()}
+	anonymous := createRouter(deps)
+	router := withAPIKey(anonymous, testReadKey)
+
+	checkContract(t, spec, router, http.MethodGet, "/api/v1/wallets/"+uuid.NewString(), "", http.StatusOK)
+	checkContract(t, spec, router, http.MethodGet, "/api/v1/transactions?externalReference=order-42", "", http.StatusOK)
+	checkContract(t, spec, router, http.MethodGet, "/api/v1/schedules", "", http.StatusOK)
+	checkContract(t, spec, anonymous, http.MethodGet, "/healthz", "", http.StatusOK)
+	checkContract(t, spec, anonymous, http.MethodGet, "/readyz", "", http.StatusOK)
+	checkContract(t, spec, anonymous, http.MethodGet, "/metrics", "", http.StatusOK)
+
+	deps.health = newHealthChecker(&fakeSchemaChecker{pingErr: errors.New("connection refused"), version: walletcore.SchemaVersion()})
+	checkContract(t, spec, createRouter(deps), http.MethodGet, "/readyz", "", http.StatusServiceUnavailable)
+}
+
+// TestHandlersMatchSpec проходит по всем сценариям API на реальной базе и сверяет ответы со спецификацией.
+func TestHandlersMatchSpec(t *testing.T) {
+	testServer, dbService, cleanup := setupTestEnvironment(t)
+	defer cleanup()
+
+	require.NoError(t, clearDatabase(dbService.DB), "Failed to clear database before test")
+
+	spec, err := apispec.Load()
+	require.NoError(t, err)
+	router := testServer.Config.Handler
+
+	walletID := uuid.New()
+	operation := func(opType string, amount int64) string {
+		return fmt.Sprintf(`{"valletId":"%s","operationType":"%s","amount":%d}`, walletID, opType, amount)
+	}
+
+	checkContract(t, spec, router, http.MethodPost, "/api/v1/wallet", operation("DEPOSIT", 100), http.StatusOK)
+	checkContract(t, spec, router, http.MethodPost, "/api/v1/wallet", operation("WITHDRAW", 40), http.StatusOK)
+	checkContract(t, spec, router, http.MethodPost, "/api/v1/wallet", operation("WITHDRAW", 1000), http.StatusBadRequest)
+	checkContract(t, spec, router, http.MethodGet, "/api/v1/wallets/"+walletID.String(), "", http.StatusOK)
+	checkContract(t, spec, router, http.MethodGet, "/api/v1/wallets/"+uuid.NewString(), "", http.StatusNotFound)
+
+	checkContract(t, spec, router, http.MethodGet, "/api/v1/wallets/"+walletID.String()+"/statement", "", http.StatusOK)
+	checkContract(t, spec, router, http.MethodGet, "/api/v1/wallets/"+walletID.String()+"/statement?format=jsonl&from=2020-01-01", "", http.StatusOK)
+	checkContract(t, spec, router, http.MethodGet, "/api/v1/wallets/"+walletID.String()+"/statement?format=camt053", "", http.StatusOK)
+	checkContract(t, spec, router, http.MethodGet, "/api/v1/wallets/"+uuid.NewString()+"/statement", "", http.StatusNotFound)
+
+	walletID = uuid.New()
+	checkContract(t, spec, router, http.MethodPost, "/api/v1/wallet", operation("WITHDRAW", 1), http.StatusNotFound)
+}
+
+func TestValidationProblemDetails(t *testing.T) {
+	spec, err := apispec.Load()
+	require.NoError(t, err)
+	router := withAPIKey(newTestRouter(t, spec), testAdminKey)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/wallet",
+		bytes.NewBufferString(`{"valletId":"`+uuid.Nil.String()+`","operationType":"DEPOSIT","amount":5}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, problem.ContentType, rec.Header().Get("Content-Type"))
+
+	var p problem.Details
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &p))
+	assert.Equal(t, problem.CodeValidationFailed, p.Code)
+	assert.NotEmpty(t, p.RequestID, "problem must carry the request ID from middleware.RequestID")
+	require.Len(t, p.Errors, 1)
+	assert.Equal(t, "valletId", p.Errors[0].Field)
+}
+
+func TestRateLimitedResponseMatchesSpec(t *testing.T) {
+	spec, err := apispec.Load()
+	require.NoError(t, err)
+	router := createRouter(routerDeps{
+		keys: newTestKeys(),
+		limiter: ratelimit.New(ratelimit.NewMemoryStore(), []config.RateLimitRule{
+			{Method: "*", Route: "*", Key: "client", Rate: 1.0 / 60, Burst: 1},
+		}),
+		spec:    spec,
+		health:  newHealthChecker(nil),
+		metrics: metrics.New(),
+	})
+
+	// Ограничение проверяется до прав маршрута, поэтому второй запрос без права admin получает 429, а не 403.
+	checkContract(t, spec, withAPIKey(router, testReadKey), http.MethodGet, "/api/v1/admin/api-keys", "", http.StatusForbidden)
+	checkContract(t, spec, withAPIKey(router, testReadKey), http.MethodGet, "/api/v1/admin/api-keys", "", http.StatusTooManyRequests)
+	checkContract(t, spec, withAPIKey(router, testAdminKey), http.MethodPost, "/api/v1/admin/api-keys", `{"name":"","scopes":["read"]}`, http.StatusBadRequest)
+}
+
+func TestWalletIDFromRequest(t *testing.T) {
+	walletID := uuid.New()
+	body := `{"valletId":"` + strings.ToUpper(walletID.String()) + `","operationType":"DEPOSIT","amount":1}`
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/wallet", strings.NewReader(body))
+	assert.Equal(t, walletID.String(), walletIDFromRequest(req))
+	rest, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(rest), "the handler still sees the whole body")
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/wallets/"+walletID.String(), nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("walletUUID", walletID.String())
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	assert.Equal(t, walletID.String(), walletIDFromRequest(req))
+
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/admin/api-keys", strings.NewReader(`{"name":"x"}`))
+	assert.Empty(t, walletIDFromRequest(req))
+}
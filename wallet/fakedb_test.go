@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"test_task_wallet/walletcore"
+)
+
+// fakeQuery - заготовленный ответ на запросы, текст которых содержит match.
+type fakeQuery struct {
+	match   string
+	columns []string
+	rows    [][]driver.Value
+}
+
+// fakeDB - драйвер database/sql без PostgreSQL для проверок обработчиков: на запрос
+// отвечает первый fakeQuery, фрагмент которого есть в тексте запроса. Аргументы не
+// учитываются; запрос без ответа завершается ошибкой, чтобы тест не прошел случайно.
+type fakeDB []fakeQuery
+
+// newFakeDBService возвращает DBService поверх fakeDB.
+func newFakeDBService(queries ...fakeQuery) *walletcore.DBService {
+	return &walletcore.DBService{DB: sql.OpenDB(fakeDB(queries))}
+}
+
+func (db fakeDB) Connect(context.Context) (driver.Conn, error) { return fakeConn{db}, nil }
+
+func (db fakeDB) Driver() driver.Driver { return fakeDriver{} }
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(string) (driver.Conn, error) {
+	return nil, errors.New("fake database is opened only through sql.OpenDB")
+}
+
+type fakeConn struct{ db fakeDB }
+
+func (c fakeConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	for _, q := range c.db {
+		if strings.Contains(query, q.match) {
+			return &fakeRows{columns: q.columns, rows: q.rows}, nil
+		}
+	}
+	return nil, fmt.Errorf("fake database has no answer for query %q", query)
+}
+
+func (c fakeConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	return nil, fmt.Errorf("fake database is read-only, got %q", query)
+}
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("fake database does not prepare statements, got %q", query)
+}
+
+func (c fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+func (c fakeConn) Close() error { return nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
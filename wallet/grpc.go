@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"test_task_wallet/auth"
+	"test_task_wallet/logging"
+	"test_task_wallet/ratelimit"
+	"test_task_wallet/walletcore"
+	"test_task_wallet/walletpb"
+)
+
+const (
+	defaultTransactionsLimit = 50
+	maxTransactionsLimit     = 1000
+)
+
+// walletGRPCServer реализует walletpb.WalletServiceServer поверх того же walletcore.Service, что и REST API.
+type walletGRPCServer struct {
+	walletpb.UnimplementedWalletServiceServer
+	walletService *walletcore.Service
+}
+
+// createGRPCServer создает gRPC сервер с зарегистрированным WalletService.
+// tokens и limiter могут быть nil, если JWT или лимиты не настроены.
+func createGRPCServer(walletService *walletcore.Service, tokens auth.TokenVerifier, limiter *ratelimit.Limiter) *grpc.Server {
+	s := grpc.NewServer(grpc.ChainUnaryInterceptor(
+		unaryLogging(slog.Default()),
+		auth.UnaryServerInterceptor(walletService, tokens),
+		limiter.UnaryServerInterceptor(),
+	))
+	walletpb.RegisterWalletServiceServer(s, &walletGRPCServer{walletService: walletService})
+	return s
+}
+
+// unaryLogging пишет одну запись на каждый вызов, аналогично logging.AccessLog для HTTP.
+// Поля операции, добавленные walletcore, попадают и в эту запись.
+func unaryLogging(logger *slog.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+		ctx = logging.WithFields(ctx)
+		resp, err := handler(ctx, req)
+
+		code := status.Code(err)
+		level := slog.LevelInfo
+		switch code {
+		case codes.OK:
+		case codes.Internal, codes.Unknown, codes.DataLoss:
+			level = slog.LevelError
+		default:
+			level = slog.LevelWarn
+		}
+		logger.LogAttrs(ctx, level, "grpc request",
+			slog.String("method", info.FullMethod),
+			slog.String("code", code.String()),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+		)
+		return resp, err
+	}
+}
+
+func (s *walletGRPCServer) Deposit(ctx context.Context, req *walletpb.DepositRequest) (*walletpb.WalletResponse, error) {
+	if err := auth.Require(ctx, walletcore.ScopeDeposit); err != nil {
+		return nil, auth.StatusError(ctx, err)
+	}
+	walletID, err := parseWalletID(req.GetWalletId())
+	if err != nil {
+		return nil, err
+	}
+	details, err := fromPBDetails(req.GetDetails())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.walletService.Apply(ctx, walletcore.WalletRequest{
+		WalletID: walletID, OperationType: walletcore.Deposit, Amount: req.GetAmount(), AmountDecimal: req.GetAmountDecimal(), Details: details,
+	}, operationOptions(ctx))
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return toWalletResponse(resp), nil
+}
+
+func (s *walletGRPCServer) Withdraw(ctx context.Context, req *walletpb.WithdrawRequest) (*walletpb.WalletResponse, error) {
+	if err := auth.Require(ctx, walletcore.ScopeWithdraw); err != nil {
+		return nil, auth.StatusError(ctx, err)
+	}
+	walletID, err := parseWalletID(req.GetWalletId())
+	if err != nil {
+		return nil, err
+	}
+	details, err := fromPBDetails(req.GetDetails())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.walletService.Apply(ctx, walletcore.WalletRequest{
+		WalletID: walletID, OperationType: walletcore.Withdraw, Amount: req.GetAmount(), AmountDecimal: req.GetAmountDecimal(), Details: details,
+	}, operationOptions(ctx))
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return toWalletResponse(resp), nil
+}
+
+func (s *walletGRPCServer) GetBalance(ctx context.Context, req *walletpb.GetBalanceRequest) (*walletpb.WalletResponse, error) {
+	if err := auth.Require(ctx, walletcore.ScopeRead); err != nil {
+		return nil, auth.StatusError(ctx, err)
+	}
+	walletID, err := parseWalletID(req.GetWalletId())
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.walletService.Balance(ctx, walletID)
+	if err == nil {
+		err = authorizeWalletRead(ctx, resp.OwnerID)
+	}
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return toWalletResponse(resp), nil
+}
+
+func (s *walletGRPCServer) ListTransactions(ctx context.Context, req *walletpb.ListTransactionsRequest) (*walletpb.ListTransactionsResponse, error) {
+	if err := auth.Require(ctx, walletcore.ScopeRead); err != nil {
+		return nil, auth.StatusError(ctx, err)
+	}
+	walletID, err := parseWalletID(req.GetWalletId())
+	if err != nil {
+		return nil, err
+	}
+
+	limit := int(req.GetLimit())
+	if limit < 0 || limit > maxTransactionsLimit || req.GetOffset() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "limit must be between 0 and %d, offset must not be negative", maxTransactionsLimit)
+	}
+	if limit == 0 {
+		limit = defaultTransactionsLimit
+	}
+
+	wallet, err := s.walletService.Balance(ctx, walletID)
+	if err == nil {
+		err = authorizeWalletRead(ctx, wallet.OwnerID)
+	}
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	transactions, err := s.walletService.Transactions(ctx, walletID, limit, int(req.GetOffset()))
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	resp := &walletpb.ListTransactionsResponse{}
+	for _, t := range transactions {
+		resp.Transactions = append(resp.Transactions, &walletpb.Transaction{
+			TransactionId: t.ID.String(),
+			WalletId:      t.WalletID.String(),
+			OperationType: string(t.Type),
+			Amount:        t.Amount,
+			Timestamp:     timestamppb.New(t.Timestamp),
+			Details:       toPBDetails(t.Details),
+			AmountDecimal: t.AmountDecimal,
+			Currency:      t.Currency,
+		})
+	}
+	return resp, nil
+}
+
+// operationOptions читает параметры операции из метаданных вызова.
+// Ключ идемпотентности передается как idempotency-key, аналогично заголовку Idempotency-Key в REST.
+func operationOptions(ctx context.Context) walletcore.OperationOptions {
+	var opts walletcore.OperationOptions
+	if key, ok := auth.APIKeyFrom(ctx); ok {
+		opts.APIKeyID = key.ID
+	}
+	opts.OwnerID, _ = auth.Owner(ctx)
+	opts.ClientID, _ = auth.ClientID(ctx)
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if keys := md.Get("idempotency-key"); len(keys) > 0 {
+			opts.IdempotencyKey = keys[0]
+		}
+	}
+	return opts
+}
+
+// fromPBDetails переводит описание операции из gRPC запроса; metadata становится JSON объектом.
+func fromPBDetails(d *walletpb.OperationDetails) (walletcore.Details, error) {
+	details := walletcore.Details{
+		Description:       d.GetDescription(),
+		ExternalReference: d.GetExternalReference(),
+		Tags:              d.GetTags(),
+	}
+	if d.GetMetadata() != nil {
+		var err error
+		if details.Metadata, err = protojson.Marshal(d.GetMetadata()); err != nil {
+			return details, status.Errorf(codes.InvalidArgument, "invalid metadata: %v", err)
+		}
+	}
+	return details, nil
+}
+
+// toPBDetails переводит описание операции для ответа; nil, если описания нет.
+func toPBDetails(d walletcore.Details) *walletpb.OperationDetails {
+	if d.IsZero() {
+		return nil
+	}
+	details := &walletpb.OperationDetails{
+		Description:       d.Description,
+		ExternalReference: d.ExternalReference,
+		Tags:              d.Tags,
+	}
+	if len(d.Metadata) > 0 {
+		details.Metadata = &structpb.Struct{}
+		if err := protojson.Unmarshal(d.Metadata, details.Metadata); err != nil {
+			details.Metadata = nil
+		}
+	}
+	return details
+}
+
+func toWalletResponse(resp *walletcore.WalletResponse) *walletpb.WalletResponse {
+	return &walletpb.WalletResponse{WalletId: resp.WalletID.String(), Balance: resp.Balance,
+		BalanceDecimal: resp.BalanceDecimal, Currency: resp.Currency}
+}
+
+// parseWalletID разбирает UUID кошелька и возвращает InvalidArgument при неверном формате.
+func parseWalletID(s string) (uuid.UUID, error) {
+	walletID, err := uuid.Parse(s)
+	if err != nil {
+		return uuid.Nil, status.Errorf(codes.InvalidArgument, "invalid wallet UUID format: %v", err)
+	}
+	return walletID, nil
+}
+
+// grpcError переводит доменные ошибки walletcore в gRPC статусы.
+func grpcError(ctx context.Context, err error) error {
+	switch {
+	case errors.Is(err, walletcore.ErrInvalidRequest):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, walletcore.ErrWalletNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, walletcore.ErrWalletAccessDenied):
+		// Чужой кошелек выглядит как несуществующий (см. authorizeWalletRead).
+		return status.Error(codes.NotFound, walletcore.ErrWalletNotFound.Error())
+	case errors.Is(err, walletcore.ErrInsufficientFunds), errors.Is(err, walletcore.ErrBalanceOverflow):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, walletcore.ErrIdempotencyKeyReuse), errors.Is(err, walletcore.ErrExternalReferenceConflict):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case walletcore.IsRetryable(err):
+		return status.Error(codes.Unavailable, "the wallet is busy, please retry the request")
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	default:
+		slog.ErrorContext(ctx, "Wallet operation failed", logging.Err(err))
+		return status.Error(codes.Internal, "internal server error")
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"test_task_wallet/auth"
+	"test_task_wallet/walletcore"
+)
+
+func TestGRPCErrorMapping(t *testing.T) {
+	cases := []struct {
+		err  error
+		code codes.Code
+	}{
+		{fmt.Errorf("%w: amount must be positive", walletcore.ErrInvalidRequest), codes.InvalidArgument},
+		{walletcore.ErrWalletNotFound, codes.NotFound},
+		{walletcore.ErrWalletAccessDenied, codes.NotFound},
+		{walletcore.ErrInsufficientFunds, codes.FailedPrecondition},
+		{walletcore.ErrBalanceOverflow, codes.FailedPrecondition},
+		{walletcore.ErrIdempotencyKeyReuse, codes.AlreadyExists},
+		{fmt.Errorf("%w: canceling statement due to lock timeout", walletcore.ErrLockTimeout), codes.Unavailable},
+		{fmt.Errorf("%w: query failed", context.Canceled), codes.Canceled},
+		{errors.New("connection refused"), codes.Internal},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.code, status.Code(grpcError(context.Background(), c.err)), "unexpected code for %v", c.err)
+	}
+}
+
+func TestParseWalletIDRejectsInvalidUUID(t *testing.T) {
+	_, err := parseWalletID("not-a-uuid")
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestForeignWalletLooksMissing(t *testing.T) {
+	ctx := auth.WithToken(context.Background(), &auth.Token{Subject: "alice"})
+	assert.NoError(t, authorizeWalletRead(ctx, "alice"))
+	err := authorizeWalletRead(ctx, "bob")
+	assert.ErrorIs(t, err, walletcore.ErrWalletNotFound)
+	assert.Equal(t, codes.NotFound, status.Code(grpcError(ctx, err)), "the same status as for a missing wallet")
+	assert.NoError(t, authorizeWalletRead(context.Background(), "bob"), "API keys read any wallet")
+}
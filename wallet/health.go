@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"test_task_wallet/logging"
+	"test_task_wallet/walletcore"
+)
+
+// defaultReadinessTimeout ограничивает проверку каждой зависимости в /readyz.
+const defaultReadinessTimeout = 2 * time.Second
+
+// schemaChecker - зависимости, которые проверяет /readyz. Реализуется *walletcore.DBService.
+type schemaChecker interface {
+	Ping(ctx context.Context) error
+	AppliedSchemaVersion(ctx context.Context) (int, error)
+}
+
+// healthChecker обслуживает /healthz и /readyz.
+type healthChecker struct {
+	db           schemaChecker
+	timeout      time.Duration
+	shuttingDown atomic.Bool
+}
+
+func newHealthChecker(db schemaChecker) *healthChecker {
+	return &healthChecker{db: db, timeout: defaultReadinessTimeout}
+}
+
+// SetShuttingDown помечает реплику как завершающую работу, после чего /readyz отвечает 503.
+func (h *healthChecker) SetShuttingDown() {
+	h.shuttingDown.Store(true)
+}
+
+// checkStatus - состояние одной зависимости.
+type checkStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// healthResponse - тело ответов /healthz и /readyz.
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkStatus `json:"checks,omitempty"`
+}
+
+const (
+	statusOK   = "ok"
+	statusFail = "fail"
+)
+
+// handleLiveness сообщает только то, что процесс жив и обрабатывает запросы.
+func (h *healthChecker) handleLiveness(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, healthResponse{Status: statusOK})
+}
+
+// handleReadiness проверяет БД, версию схемы и признак остановки.
+// Если хотя бы одна проверка не прошла, отвечает 503, чтобы реплику вывели из балансировки.
+func (h *healthChecker) handleReadiness(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]checkStatus{
+		"database":   h.check(r.Context(), "database", h.db.Ping),
+		"migrations": h.check(r.Context(), "migrations", h.checkMigrations),
+		"shutdown":   {Status: statusOK},
+	}
+	if h.shuttingDown.Load() {
+		checks["shutdown"] = checkStatus{Status: statusFail, Error: "shutdown in progress"}
+	}
+
+	resp := healthResponse{Status: statusOK, Checks: checks}
+	code := http.StatusOK
+	for _, c := range checks {
+		if c.Status != statusOK {
+			resp.Status = statusFail
+			code = http.StatusServiceUnavailable
+		}
+	}
+	writeHealth(w, code, resp)
+}
+
+func (h *healthChecker) checkMigrations(ctx context.Context) error {
+	version, err := h.db.AppliedSchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if want := walletcore.SchemaVersion(); version < want {
+		return fmt.Errorf("schema version %d, want %d", version, want)
+	}
+	return nil
+}
+
+// check выполняет проверку с ограничением по времени. /readyz доступен без
+// аутентификации, поэтому причина ошибки только пишется в лог, а в ответе - "unavailable".
+func (h *healthChecker) check(ctx context.Context, name string, fn func(context.Context) error) checkStatus {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	if err := fn(ctx); err != nil {
+		slog.WarnContext(ctx, "Readiness check failed", "check", name, logging.Err(err))
+		return checkStatus{Status: statusFail, Error: "unavailable"}
+	}
+	return checkStatus{Status: statusOK}
+}
+
+func writeHealth(w http.ResponseWriter, code int, resp healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"test_task_wallet/walletcore"
+)
+
+type fakeSchemaChecker struct {
+	pingErr    error
+	version    int
+	versionErr error
+}
+
+func (f *fakeSchemaChecker) Ping(ctx context.Context) error { return f.pingErr }
+
+func (f *fakeSchemaChecker) AppliedSchemaVersion(ctx context.Context) (int, error) {
+	return f.version, f.versionErr
+}
+
+func TestReadiness(t *testing.T) {
+	current := walletcore.SchemaVersion()
+	tests := []struct {
+		name         string
+		db           *fakeSchemaChecker
+		shuttingDown bool
+		wantCode     int
+		wantFailed   string
+	}{
+		{name: "ready", db: &fakeSchemaChecker{version: current}, wantCode: http.StatusOK},
+		{name: "database down", db: &fakeSchemaChecker{pingErr: errors.New("connection refused"), versionErr: errors.New("connection refused")},
+			wantCode: http.StatusServiceUnavailable, wantFailed: "database"},
+		{name: "migrations behind", db: &fakeSchemaChecker{version: current - 1},
+			wantCode: http.StatusServiceUnavailable, wantFailed: "migrations"},
+		{name: "shutting down", db: &fakeSchemaChecker{version: current}, shuttingDown: true,
+			wantCode: http.StatusServiceUnavailable, wantFailed: "shutdown"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHealthChecker(tt.db)
+			if tt.shuttingDown {
+				h.SetShuttingDown()
+			}
+
+			rr := httptest.NewRecorder()
+			h.handleReadiness(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			assert.Equal(t, tt.wantCode, rr.Code)
+
+			var resp healthResponse
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+			require.Len(t, resp.Checks, 3)
+			if tt.wantFailed == "" {
+				assert.Equal(t, statusOK, resp.Status)
+				return
+			}
+			assert.Equal(t, statusFail, resp.Status)
+			assert.Equal(t, statusFail, resp.Checks[tt.wantFailed].Status)
+			assert.NotEmpty(t, resp.Checks[tt.wantFailed].Error)
+			assert.NotContains(t, rr.Body.String(), "connection refused", "error details stay in the log")
+		})
+	}
+}
+
+func TestLivenessIgnoresDependencies(t *testing.T) {
+	h := newHealthChecker(&fakeSchemaChecker{pingErr: errors.New("connection refused")})
+	h.SetShuttingDown()
+
+	rr := httptest.NewRecorder()
+	h.handleLiveness(rr, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"status":"ok"}`, rr.Body.String())
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"test_task_wallet/config"
+	"test_task_wallet/walletcore"
+)
+
+// runAccrueInterest выполняет команду accrue-interest: начисляет проценты за закончившиеся
+// необработанные дни, зачисляет закончившиеся месяцы и пишет итог в w. Повторный запуск
+// безопасен - уже обработанные дни и месяцы пропускаются.
+func runAccrueInterest(ctx context.Context, w io.Writer, cfg *config.Config) error {
+	dbService, err := walletcore.NewDBService(ctx, cfg.Database.DSN(), walletcore.DefaultPoolConfig())
+	if err != nil {
+		return fmt.Errorf("failed to initialize database service: %w", err)
+	}
+	defer dbService.DB.Close()
+
+	walletService := walletcore.NewService(dbService)
+	walletService.SetInterestRates(cfg.Interest.Rates)
+	report, err := walletService.AccrueInterest(ctx, time.Now())
+	if report != nil {
+		fmt.Fprintf(w, "%d days accrued (%d accruals), %d postings, %d posted\n",
+			report.Days, report.Accruals, report.Postings, report.Posted)
+	}
+	return err
+}
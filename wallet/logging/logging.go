@@ -0,0 +1,160 @@
+// Package logging настраивает структурированные логи log/slog.
+//
+// Каждая запись дополняется полями из контекста: request_id из middleware.RequestID,
+// trace_id и span_id из OpenTelemetry, а также полями операции (wallet_id, operation,
+// amount), которые обработчик добавляет через AddFields. Значения полей с
+// чувствительными именами (пароли, токены, ключи) заменяются на [REDACTED].
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"go.opentelemetry.io/otel/trace"
+
+	"test_task_wallet/config"
+)
+
+// Имена общих полей. Использовать их вместо строковых литералов,
+// чтобы одно и то же поле называлось одинаково во всех пакетах.
+const (
+	KeyRequestID = "request_id"
+	KeyTraceID   = "trace_id"
+	KeySpanID    = "span_id"
+	KeyWalletID  = "wallet_id"
+	KeyOperation = "operation"
+	KeyAmount    = "amount"
+	KeyClientID  = "client_id"
+	KeyUserID    = "user_id"
+	KeyError     = "error"
+)
+
+// Redacted заменяет значения чувствительных полей.
+const Redacted = "[REDACTED]"
+
+// sensitiveKeys - подстроки имен полей, значения которых не попадают в логи.
+var sensitiveKeys = []string{"password", "secret", "token", "authorization", "api_key", "apikey", "dsn", "database_url"}
+
+// New создает логгер, пишущий в w.
+func New(w io.Writer, cfg config.Logging) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %w", cfg.Level, err)
+	}
+
+	handlerOpts := &slog.HandlerOptions{Level: level, ReplaceAttr: redact}
+	var h slog.Handler
+	switch cfg.Format {
+	case "json", "":
+		h = slog.NewJSONHandler(w, handlerOpts)
+	case "text":
+		h = slog.NewTextHandler(w, handlerOpts)
+	default:
+		return nil, fmt.Errorf("invalid log format %q", cfg.Format)
+	}
+	return slog.New(contextHandler{h}), nil
+}
+
+// Err - поле с текстом ошибки.
+func Err(err error) slog.Attr {
+	return slog.String(KeyError, err.Error())
+}
+
+// redact скрывает значения полей с чувствительными именами, в том числе вложенных в группы.
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if isSensitive(a.Key) {
+		return slog.String(a.Key, Redacted)
+	}
+	return a
+}
+
+func isSensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldsKey - ключ контекста для полей запроса.
+type fieldsKey struct{}
+
+// fields накапливает поля запроса. Хранится в контексте по указателю, поэтому
+// поля, добавленные обработчиком, видны и в записи журнала доступа внешнего middleware.
+type fields struct {
+	mu    sync.Mutex
+	attrs []slog.Attr
+}
+
+// WithFields возвращает контекст, в который можно добавлять поля через AddFields.
+// Если контекст уже содержит набор полей, возвращается без изменений.
+func WithFields(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(fieldsKey{}).(*fields); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, fieldsKey{}, &fields{})
+}
+
+// AddFields добавляет поля ко всем последующим записям с этим контекстом.
+// Без WithFields выше по цепочке вызов ничего не делает.
+func AddFields(ctx context.Context, attrs ...slog.Attr) {
+	f, ok := ctx.Value(fieldsKey{}).(*fields)
+	if !ok {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, a := range attrs {
+		f.set(a)
+	}
+}
+
+// set заменяет поле с тем же именем, чтобы повторный AddFields не дублировал ключи.
+func (f *fields) set(a slog.Attr) {
+	for i := range f.attrs {
+		if f.attrs[i].Key == a.Key {
+			f.attrs[i] = a
+			return
+		}
+	}
+	f.attrs = append(f.attrs, a)
+}
+
+func (f *fields) snapshot() []slog.Attr {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]slog.Attr(nil), f.attrs...)
+}
+
+// contextHandler добавляет к записи поля из контекста.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := middleware.GetReqID(ctx); id != "" {
+		r.AddAttrs(slog.String(KeyRequestID, id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String(KeyTraceID, sc.TraceID().String()), slog.String(KeySpanID, sc.SpanID().String()))
+	}
+	if f, ok := ctx.Value(fieldsKey{}).(*fields); ok {
+		r.AddAttrs(f.snapshot()...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,98 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"test_task_wallet/config"
+)
+
+// decodeLines разбирает JSON записи журнала, по одной на строку.
+func decodeLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var lines []map[string]any
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var m map[string]any
+		require.NoError(t, dec.Decode(&m))
+		lines = append(lines, m)
+	}
+	return lines
+}
+
+func TestAccessLogIncludesRequestAndOperationFields(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, config.Logging{Level: "info", Format: "json"})
+	require.NoError(t, err)
+
+	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
+	r.Use(AccessLog(logger))
+	r.Post("/api/v1/wallet", func(w http.ResponseWriter, r *http.Request) {
+		AddFields(r.Context(), slog.String(KeyWalletID, "w-1"), slog.String(KeyOperation, "WITHDRAW"), slog.Int64(KeyAmount, 500))
+		logger.InfoContext(r.Context(), "inside handler")
+		w.WriteHeader(http.StatusBadRequest)
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/wallet", nil)
+	req.Header.Set(middleware.RequestIDHeader, "req-7")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	lines := decodeLines(t, &buf)
+	require.Len(t, lines, 2)
+	for _, line := range lines {
+		assert.Equal(t, "req-7", line[KeyRequestID])
+		assert.Equal(t, "w-1", line[KeyWalletID])
+		assert.Equal(t, "WITHDRAW", line[KeyOperation])
+		assert.Equal(t, 500.0, line[KeyAmount])
+	}
+
+	access := lines[1]
+	assert.Equal(t, "http request", access["msg"])
+	assert.Equal(t, "WARN", access["level"])
+	assert.Equal(t, 400.0, access["status"])
+	assert.Equal(t, "/api/v1/wallet", access["route"])
+}
+
+func TestSensitiveFieldsAreRedacted(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, config.Logging{Level: "debug", Format: "json"})
+	require.NoError(t, err)
+
+	logger.Debug("connecting",
+		slog.String("db_password", "hunter2"),
+		slog.Group("headers", slog.String("Authorization", "Bearer abc")),
+		slog.String("DATABASE_URL", "postgres://u:p@db/wallet"),
+		slog.String(KeyWalletID, "w-1"),
+	)
+
+	out := buf.String()
+	assert.NotContains(t, out, "hunter2")
+	assert.NotContains(t, out, "Bearer abc")
+	assert.NotContains(t, out, "u:p@db")
+	assert.Contains(t, out, "w-1")
+}
+
+func TestLevelFiltersRecords(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, config.Logging{Level: "warn", Format: "json"})
+	require.NoError(t, err)
+
+	logger.Info("hidden")
+	logger.Warn("shown")
+	lines := decodeLines(t, &buf)
+	require.Len(t, lines, 1)
+	assert.Equal(t, "shown", lines[0]["msg"])
+
+	_, err = New(&buf, config.Logging{Level: "verbose", Format: "json"})
+	assert.Error(t, err)
+}
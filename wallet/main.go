@@ -1,302 +1,557 @@
 package main
 
 import (
-	"database/sql"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/google/uuid"
-	"github.com/joho/godotenv"
-
+	"google.golang.org/grpc"
+
+	"test_task_wallet/apispec"
+	"test_task_wallet/auth"
+	"test_task_wallet/config"
+	"test_task_wallet/logging"
+	"test_task_wallet/metrics"
+	"test_task_wallet/problem"
+	"test_task_wallet/ratelimit"
+	"test_task_wallet/receipt"
+	"test_task_wallet/tracing"
 	"test_task_wallet/walletcore"
 )
 
-// Main функция - точка входа в приложение
+// Main функция - точка входа в приложение.
+// "wallet verify-chain [флаги] [ID кошелька ...]" вместо запуска сервера проверяет цепочки хэшей операций,
+// "wallet accrue-interest [флаги]" - начисляет проценты за пропущенные дни и месяцы.
 func main() {
-	err := godotenv.Load("./config.env")
+	args := os.Args[1:]
+	var command string
+	if len(args) > 0 && (args[0] == "verify-chain" || args[0] == "accrue-interest") {
+		command, args = args[0], args[1:]
+	}
+	cfg, err := config.Load(args)
 	if err != nil {
-		log.Fatalf("Error loading .env file: %v", err)
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	switch command {
+	case "verify-chain":
+		if err := runVerifyChain(context.Background(), os.Stdout, cfg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	case "accrue-interest":
+		if err := runAccrueInterest(context.Background(), os.Stdout, cfg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	dbHost := os.Getenv("DB_HOST")
-	dbPort := os.Getenv("DB_PORT")
-	dbUser := os.Getenv("DB_USER")
-	dbPassword := os.Getenv("DB_PASSWORD")
-	dbName := os.Getenv("DB_NAME")
-	httpPort := os.Getenv("HTTP_PORT")
+	logger, err := logging.New(os.Stdout, cfg.Logging)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	// Стандартный пакет log тоже пишет через этот логгер.
+	slog.SetDefault(logger)
 
-	if dbHost == "" || dbPort == "" || dbUser == "" || dbPassword == "" || dbName == "" || httpPort == "" {
-		log.Fatal("One or more environment variables are not set. Check config.env")
+	// После первого сигнала обработчик снимается, поэтому повторный SIGINT/SIGTERM завершит процесс сразу.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err = run(ctx, stop, cfg)
+	stop()
+	if err != nil {
+		slog.Error("Server failed", logging.Err(err))
+		os.Exit(1)
 	}
+	slog.Info("Server stopped")
+}
 
-	dsn := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		dbHost, dbPort, dbUser, dbPassword, dbName)
+// run запускает HTTP и gRPC серверы и блокируется до отмены ctx или ошибки сервера.
+// Затем перестает принимать новые запросы, дожидается текущих операций
+// (не дольше cfg.ShutdownTimeout), останавливает фоновые задачи и только после этого закрывает БД.
+func run(ctx context.Context, stopSignals context.CancelFunc, cfg *config.Config) error {
+	shutdownTracing, err := tracing.Setup(ctx, cfg.Tracing)
+	if err != nil {
+		return fmt.Errorf("failed to set up tracing: %w", err)
+	}
+	defer func() {
+		// Отправляем оставшиеся span'ы уже после остановки серверов и закрытия БД.
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Error("Error flushing traces", logging.Err(err))
+		}
+	}()
 
-	// Используем NewDBService из walletcore
-	dbService, err := walletcore.NewDBService(dsn) // <-- ИЗМЕНЕНИЕ ЗДЕСЬ
+	pool := walletcore.PoolConfig{
+		MaxOpenConns:    cfg.Database.MaxOpenConns,
+		MaxIdleConns:    cfg.Database.MaxIdleConns,
+		ConnMaxLifetime: cfg.Database.ConnMaxLifetime,
+		ConnMaxIdleTime: cfg.Database.ConnMaxIdleTime,
+	}
+	dbService, err := walletcore.NewDBService(ctx, cfg.Database.DSN(), pool)
 	if err != nil {
-		log.Fatalf("Failed to initialize database service: %v", err)
+		return fmt.Errorf("failed to initialize database service: %w", err)
 	}
+	dbService.StatementTimeout = cfg.Database.StatementTimeout
+	dbService.LockTimeout = cfg.Database.LockTimeout
 	defer func() {
 		if err := dbService.DB.Close(); err != nil {
-			log.Printf("Error closing DB connection: %v", err)
+			slog.Error("Error closing DB connection", logging.Err(err))
 		}
+		slog.Info("DB connection closed")
 	}()
 
-	err = dbService.InitSchema()
+	if err := dbService.InitSchema(ctx); err != nil {
+		return fmt.Errorf("failed to initialize database schema: %w", err)
+	}
+
+	spec, err := apispec.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load OpenAPI specification: %w", err)
+	}
+
+	walletService := walletcore.NewService(dbService)
+	walletService.TxRunner().MaxAttempts = cfg.Database.TxMaxAttempts
+	if cfg.Auth.AdminAPIKey != "" {
+		err := walletService.EnsureAPIKey(ctx, "bootstrap-admin", cfg.Auth.AdminAPIKey, []walletcore.Scope{walletcore.ScopeAdmin})
+		if err != nil {
+			return fmt.Errorf("failed to register ADMIN_API_KEY: %w", err)
+		}
+	}
+	var tokens auth.TokenVerifier
+	if cfg.Auth.JWT.Enabled() {
+		verifier, err := auth.NewJWTVerifier(cfg.Auth.JWT)
+		if err != nil {
+			return fmt.Errorf("failed to set up JWT authentication: %w", err)
+		}
+		tokens = verifier
+	}
+	receipts, err := receipt.NewSigner(cfg.Receipts)
+	if err != nil {
+		return fmt.Errorf("failed to load receipt signing keys: %w", err)
+	}
+	walletService.SetReceiptSigner(receipts)
+	walletService.SetInterestRates(cfg.Interest.Rates)
+	walletService.SetCurrency(walletcore.Currency{Code: cfg.Currency.Code, Exponent: cfg.Currency.Exponent})
+	if len(cfg.Fees.Rules) > 0 {
+		walletService.SetFees(walletcore.NewFees(uuid.MustParse(cfg.Fees.RevenueWallet), feeRules(cfg.Fees.Rules)))
+		slog.Info("Operation fees enabled", "revenue_wallet", cfg.Fees.RevenueWallet, "rules", len(cfg.Fees.Rules))
+	}
+
+	appMetrics := metrics.New()
+	appMetrics.RegisterDB(dbService.DB)
+	appMetrics.RegisterTxRunner(walletService.TxRunner())
+	walletService.SetObserver(appMetrics)
+
+	workers := newBackgroundWorkers()
+	health := newHealthChecker(dbService)
+
+	var limitStore ratelimit.Store
+	switch cfg.RateLimit.Store {
+	case "memory":
+		limitStore = ratelimit.NewMemoryStore()
+	case "postgres":
+		// Отдельный пул: проверки лимитов на каждом запросе не должны ждать соединения
+		// вместе с операциями и не могут занять весь пул, если БД отвечает медленно.
+		limitDB, err := walletcore.NewDBService(ctx, cfg.Database.DSN(), walletcore.PoolConfig{
+			MaxOpenConns:    cfg.RateLimit.DBMaxConns,
+			MaxIdleConns:    cfg.RateLimit.DBMaxConns,
+			ConnMaxLifetime: cfg.Database.ConnMaxLifetime,
+			ConnMaxIdleTime: cfg.Database.ConnMaxIdleTime,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to initialize rate limit database pool: %w", err)
+		}
+		defer limitDB.DB.Close()
+		limitDB.StatementTimeout = cfg.Database.StatementTimeout
+		pgStore := ratelimit.NewPostgresStore(limitDB)
+		pgStore.Timeout = cfg.RateLimit.DBTimeout
+		workers.Go("rate-limit-cleanup", func(ctx context.Context) { pgStore.Cleanup(ctx, time.Minute) })
+		limitStore = pgStore
+	}
+	limiter := ratelimit.New(limitStore, cfg.RateLimit.Rules)
+
+	if cfg.Interest.PollInterval > 0 {
+		workers.Go("interest", func(ctx context.Context) {
+			walletService.RunInterest(ctx, cfg.Interest.PollInterval)
+		})
+	}
+	if cfg.Scheduler.PollInterval > 0 {
+		workers.Go("scheduler", func(ctx context.Context) {
+			walletService.RunScheduler(ctx, cfg.Scheduler.PollInterval, cfg.Scheduler.BatchSize)
+		})
+	}
+
+	httpServer := &http.Server{
+		Addr: fmt.Sprintf(":%d", cfg.HTTPPort),
+		Handler: createRouter(routerDeps{
+			walletService: walletService,
+			keys:          walletService,
+			tokens:        tokens,
+			limiter:       limiter,
+			receipts:      receipts,
+			spec:          spec,
+			health:        health,
+			metrics:       appMetrics,
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	grpcListener, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.GRPCPort))
 	if err != nil {
-		log.Fatalf("Failed to initialize database schema: %v", err)
+		return fmt.Errorf("failed to listen on gRPC port %d: %w", cfg.GRPCPort, err)
+	}
+	grpcServer := createGRPCServer(walletService, tokens, limiter)
+
+	serveErr := make(chan error, 2)
+	go func() {
+		slog.Info("Starting gRPC server", "port", cfg.GRPCPort)
+		if err := grpcServer.Serve(grpcListener); err != nil {
+			serveErr <- fmt.Errorf("gRPC server failed: %w", err)
+		}
+	}()
+	go func() {
+		slog.Info("Starting HTTP server", "port", cfg.HTTPPort)
+		if err := httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			serveErr <- fmt.Errorf("HTTP server failed: %w", err)
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		slog.Info("Shutdown signal received, draining connections")
+	case err = <-serveErr:
+		slog.Error("Shutting down after server error", logging.Err(err))
+	}
+	stopSignals()
+
+	// Сначала /readyz начинает отвечать 503, чтобы балансировщик перестал присылать трафик,
+	// и только потом серверы перестают принимать соединения.
+	health.SetShuttingDown()
+	if cfg.ShutdownDelay > 0 {
+		slog.Info("Waiting before closing listeners", "delay", cfg.ShutdownDelay.String())
+		time.Sleep(cfg.ShutdownDelay)
 	}
 
-	router := createRouter(dbService)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	return errors.Join(err, shutdown(shutdownCtx, httpServer, grpcServer, workers))
+}
 
-	log.Printf("Starting server on port %s...", httpPort)
-	log.Fatal(http.ListenAndServe(":"+httpPort, router))
+// feeRules переводит правила комиссий из конфигурации в правила walletcore.
+func feeRules(rules []config.FeeRule) []walletcore.FeeRule {
+	out := make([]walletcore.FeeRule, 0, len(rules))
+	for _, rule := range rules {
+		tiers := make([]walletcore.FeeTier, 0, len(rule.Tiers))
+		for _, tier := range rule.Tiers {
+			tiers = append(tiers, walletcore.FeeTier{From: tier.From, Fixed: tier.Fixed, BasisPoints: tier.BasisPoints})
+		}
+		out = append(out, walletcore.FeeRule{
+			Operation: walletcore.OperationType(rule.Operation),
+			Tiers:     tiers,
+			Min:       rule.Min,
+			Max:       rule.Max,
+		})
+	}
+	return out
 }
 
-// createRouter теперь принимает *walletcore.DBService
-func createRouter(dbService *walletcore.DBService) http.Handler { // <-- ИЗМЕНЕНИЕ ЗДЕСЬ
+// shutdown останавливает серверы, затем фоновые задачи. Соединение с БД закрывает вызывающая сторона.
+func shutdown(ctx context.Context, httpServer *http.Server, grpcServer *grpc.Server, workers *backgroundWorkers) error {
+	var wg sync.WaitGroup
+	var httpErr error
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		// Shutdown закрывает слушатель и ждет завершения всех активных запросов.
+		if err := httpServer.Shutdown(ctx); err != nil {
+			httpErr = fmt.Errorf("HTTP server shutdown: %w", err)
+			httpServer.Close()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			grpcServer.Stop()
+		}
+	}()
+	wg.Wait()
+
+	return errors.Join(httpErr, workers.Stop(ctx))
+}
+
+// requestTimeout ограничивает обработку обычных запросов API. Остальные маршруты
+// либо не обращаются к БД, либо сами ограничивают время (/readyz, выписка).
+const requestTimeout = 60 * time.Second
+
+// statementTimeout ограничивает выгрузку выписки: пока клиент читает ответ, она держит
+// транзакцию REPEATABLE READ и соединение из пула.
+const statementTimeout = 10 * time.Minute
+
+// routerDeps - зависимости HTTP роутера.
+type routerDeps struct {
+	walletService *walletcore.Service
+	keys          auth.KeyAuthenticator
+	tokens        auth.TokenVerifier // nil, если JWT не настроены
+	limiter       *ratelimit.Limiter // nil, если лимиты выключены
+	receipts      *receipt.Signer    // nil, если квитанции не подписываются
+	spec          *apispec.Spec
+	health        *healthChecker
+	metrics       *metrics.Metrics
+}
+
+// createRouter собирает HTTP роутер: API кошельков, проверки состояния и служебные маршруты.
+func createRouter(deps routerDeps) http.Handler {
 	r := chi.NewRouter()
 	r.Use(middleware.RequestID)
-	r.Use(middleware.Logger)
+	r.Use(tracing.Middleware)
+	r.Use(deps.metrics.Middleware)
+	r.Use(logging.AccessLog(slog.Default()))
 	r.Use(middleware.Recoverer)
-	r.Use(middleware.Timeout(60 * time.Second))
+	r.NotFound(problem.NotFound)
+	r.MethodNotAllowed(problem.MethodNotAllowed)
+
+	// Проверки для оркестратора: /healthz - процесс жив, /readyz - реплика готова принимать трафик
+	r.Get("/healthz", deps.health.handleLiveness)
+	r.Get("/readyz", deps.health.handleReadiness)
+
+	// Метрики Prometheus, в том числе счетчики TxRunner. Переменные expvar не публикуются:
+	// они включают os.Args, а в аргументах могут быть секреты (-db-password, -admin-api-key).
+	r.Method(http.MethodGet, "/metrics", deps.metrics.Handler())
+
+	// Ключи проверки квитанций публичны: партнеры проверяют квитанции без API ключа.
+	if deps.receipts != nil {
+		r.Get("/.well-known/wallet-receipt-keys", deps.receipts.ServeKeys)
+	}
 
 	r.Route("/api/v1", func(r chi.Router) {
-		r.Post("/wallet", handleWalletOperation(dbService))
-		r.Get("/wallets/{walletUUID}", handleGetWalletBalance(dbService))
+		r.Get("/openapi.json", apispec.ServeDocument)
+
+		// Остальные маршруты требуют API ключ или JWT. Аутентификация идет раньше проверки
+		// по спецификации, чтобы анонимный клиент не узнавал подробности о формате запросов.
+		r.Group(func(r chi.Router) {
+			r.Use(auth.Middleware(deps.keys, deps.tokens))
+			r.Use(deps.spec.ValidateRequests)
+			r.Use(deps.limiter.Middleware(walletIDFromRequest))
+
+			// Выписка передается потоком и может идти дольше requestTimeout, но не дольше statementTimeout.
+			r.With(auth.RequireScope(walletcore.ScopeRead)).Get("/wallets/{walletUUID}/statement",
+				handleStatement(deps.walletService, statementTimeout))
+
+			r.Group(func(r chi.Router) {
+				r.Use(middleware.Timeout(requestTimeout))
+				r.Post("/wallet", handleWalletOperation(deps.walletService))
+				r.With(auth.RequireScope(walletcore.ScopeRead)).Get("/wallets/{walletUUID}", handleGetWalletBalance(deps.walletService))
+				r.With(auth.RequireScope(walletcore.ScopeRead)).Get("/transactions", handleFindTransaction(deps.walletService))
+				r.Route("/schedules", scheduleRoutes(deps.walletService))
+				r.Route("/admin", adminRoutes(deps.walletService))
+			})
+		})
 	})
 	return r
 }
 
-// // handleWalletOperation теперь использует типы из walletcore и dbService из walletcore
-// func handleWalletOperation(dbService *walletcore.DBService) http.HandlerFunc { // <-- ИЗМЕНЕНИЕ ЗДЕСЬ
-// 	return func(w http.ResponseWriter, r *http.Request) {
-// 		var req walletcore.WalletRequest // <-- ИЗМЕНЕНИЕ ЗДЕСЬ
-// 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-// 			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
-// 			return
-// 		}
-
-// 		if err := req.Validate(); err != nil {
-// 			http.Error(w, fmt.Sprintf("Validation error: %v", err), http.StatusBadRequest)
-// 			return
-// 		}
-
-// 		tx, err := dbService.DB.Begin()
-// 		if err != nil {
-// 			log.Printf("Error beginning transaction: %v", err)
-// 			http.Error(w, "Internal server error", http.StatusInternalServerError)
-// 			return
-// 		}
-// 		defer func() {
-// 			if r := recover(); r != nil {
-// 				tx.Rollback()
-// 				panic(r)
-// 			}
-// 		}()
-
-// 		wlt, err := dbService.GetWallet(req.WalletID, tx)
-// 		if err != nil {
-// 			if err == sql.ErrNoRows {
-// 				if req.OperationType == walletcore.Withdraw { // <-- ИЗМЕНЕНИЕ ЗДЕСЬ
-// 					tx.Rollback()
-// 					http.Error(w, "Wallet not found for withdrawal operation", http.StatusNotFound)
-// 					return
-// 				}
-// 				wlt, err = dbService.CreateWallet(tx, req.WalletID, 0)
-// 				if err != nil {
-// 					log.Printf("Failed to create new wallet %s: %v", req.WalletID, err)
-// 					tx.Rollback()
-// 					http.Error(w, "Internal server error", http.StatusInternalServerError)
-// 					return
-// 				}
-// 				log.Printf("New wallet %s created with balance %d", wlt.ID, wlt.Balance)
-// 			} else {
-// 				log.Printf("Error getting wallet %s: %v", req.WalletID, err)
-// 				tx.Rollback()
-// 				http.Error(w, "Internal server error", http.StatusInternalServerError)
-// 				return
-// 			}
-// 		}
-
-// 		newBalance := wlt.Balance
-// 		switch req.OperationType {
-// 		case walletcore.Deposit: // <-- ИЗМЕНЕНИЕ ЗДЕСЬ
-// 			newBalance += req.Amount
-// 		case walletcore.Withdraw: // <-- ИЗМЕНЕНИЕ ЗДЕСЬ
-// 			if wlt.Balance < req.Amount {
-// 				tx.Rollback()
-// 				http.Error(w, "Insufficient balance", http.StatusBadRequest)
-// 				return
-// 			}
-// 			newBalance -= req.Amount
-// 		}
-
-// 		err = dbService.UpdateWalletBalance(tx, wlt.ID, newBalance)
-// 		if err != nil {
-// 			log.Printf("Failed to update wallet %s balance: %v", wlt.ID, err)
-// 			tx.Rollback()
-// 			http.Error(w, "Internal server error", http.StatusInternalServerError)
-// 			return
-// 		}
-
-// 		err = dbService.AddTransactionRecord(tx, wlt.ID, req.OperationType, req.Amount)
-// 		if err != nil {
-// 			log.Printf("Failed to add transaction record for wallet %s: %v", wlt.ID, err)
-// 			tx.Rollback()
-// 			http.Error(w, "Internal server error", http.StatusInternalServerError)
-// 			return
-// 		}
-
-// 		if err := tx.Commit(); err != nil {
-// 			log.Printf("Error committing transaction for wallet %s: %v", wlt.ID, err)
-// 			http.Error(w, "Internal server error", http.StatusInternalServerError)
-// 			return
-// 		}
-
-// 		response := walletcore.WalletResponse{ // <-- ИЗМЕНЕНИЕ ЗДЕСЬ
-// 			WalletID: wlt.ID,
-// 			Balance:  newBalance,
-// 		}
-// 		w.Header().Set("Content-Type", "application/json")
-// 		json.NewEncoder(w).Encode(response)
-// 	}
-// }
-
-func handleWalletOperation(dbService *walletcore.DBService) http.HandlerFunc {
-    return func(w http.ResponseWriter, r *http.Request) {
-        var req walletcore.WalletRequest
-        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-            http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
-            return
-        }
-
-        if err := req.Validate(); err != nil {
-            http.Error(w, fmt.Sprintf("Validation error: %v", err), http.StatusBadRequest)
-            return
-        }
-
-        tx, err := dbService.DB.Begin()
-        if err != nil {
-            log.Printf("Error beginning transaction: %v", err)
-            http.Error(w, "Internal server error", http.StatusInternalServerError)
-            return
-        }
-        // ***************************************************************
-        // ИЗМЕНЕНИЕ ЗДЕСЬ:
-        // Устанавливаем Rollback в defer.
-        // Если транзакция будет успешно закоммичена позже, Rollback ничего не сделает.
-        defer tx.Rollback() // Это безопасный откат
-        // ***************************************************************
-
-        wlt, err := dbService.GetWallet(req.WalletID, tx)
-        if err != nil {
-            if err == sql.ErrNoRows {
-                if req.OperationType == walletcore.Withdraw {
-                    // tx.Rollback() // Эта строка теперь не нужна, defer tx.Rollback() позаботится
-                    http.Error(w, "Wallet not found for withdrawal operation", http.StatusNotFound)
-                    return
-                }
-                wlt, err = dbService.CreateWallet(tx, req.WalletID, 0)
-                if err != nil {
-                    log.Printf("Failed to create new wallet %s: %v", req.WalletID, err)
-                    // tx.Rollback() // Эта строка теперь не нужна
-                    http.Error(w, "Internal server error", http.StatusInternalServerError)
-                    return
-                }
-                log.Printf("New wallet %s created with balance %d", wlt.ID, wlt.Balance)
-            } else {
-                log.Printf("Error getting wallet %s: %v", req.WalletID, err)
-                // tx.Rollback() // Эта строка теперь не нужна
-                http.Error(w, "Internal server error", http.StatusInternalServerError)
-                return
-            }
-        }
-
-        newBalance := wlt.Balance
-        switch req.OperationType {
-        case walletcore.Deposit:
-            newBalance += req.Amount
-        case walletcore.Withdraw:
-            if wlt.Balance < req.Amount {
-                // tx.Rollback() // Эта строка теперь не нужна
-                http.Error(w, "Insufficient balance", http.StatusBadRequest)
-                return
-            }
-            newBalance -= req.Amount
-        }
-
-        err = dbService.UpdateWalletBalance(tx, wlt.ID, newBalance)
-        if err != nil {
-            log.Printf("Failed to update wallet %s balance: %v", wlt.ID, err)
-            // tx.Rollback() // Эта строка теперь не нужна
-            http.Error(w, "Internal server error", http.StatusInternalServerError)
-            return
-        }
-
-        err = dbService.AddTransactionRecord(tx, wlt.ID, req.OperationType, req.Amount)
-        if err != nil {
-            log.Printf("Failed to add transaction record for wallet %s: %v", wlt.ID, err)
-            // tx.Rollback() // Эта строка теперь не нужна
-            http.Error(w, "Internal server error", http.StatusInternalServerError)
-            return
-        }
-
-        // ***************************************************************
-        // ИЗМЕНЕНИЕ ЗДЕСЬ:
-        // Явно вызываем Commit().
-        // Если Commit() успешен, defer tx.Rollback() будет проигнорирован (или не будет иметь эффекта).
-        // ***************************************************************
-        if err := tx.Commit(); err != nil {
-            log.Printf("Error committing transaction for wallet %s: %v", wlt.ID, err)
-            // Здесь Rollback не нужен, так как Commit уже пытается зафиксировать,
-            // и если он провалится, то транзакция уже, по сути, недействительна.
-            http.Error(w, "Internal server error", http.StatusInternalServerError)
-            return
-        }
-
-        response := walletcore.WalletResponse{
-            WalletID: wlt.ID,
-            Balance:  newBalance,
-        }
-        w.Header().Set("Content-Type", "application/json")
-        json.NewEncoder(w).Encode(response)
-    }
+// walletIDFromRequest возвращает кошелек запроса для лимитов по кошельку: из пути
+// или из поля valletId тела POST запроса. Прочитанное тело возвращается в запрос.
+func walletIDFromRequest(r *http.Request) string {
+	if param := chi.URLParam(r, "walletUUID"); param != "" {
+		if id, err := uuid.Parse(param); err == nil {
+			return id.String()
+		}
+		return ""
+	}
+	if r.Method != http.MethodPost || r.Body == nil {
+		return ""
+	}
+	// Тело операции небольшое; читаем с запасом, остаток (если есть) остается в потоке.
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	if err != nil {
+		return ""
+	}
+	var req walletcore.WalletRequest
+	if json.Unmarshal(body, &req) != nil || req.WalletID == uuid.Nil {
+		return ""
+	}
+	return req.WalletID.String()
 }
 
-// handleGetWalletBalance теперь использует типы из walletcore и dbService из walletcore
-func handleGetWalletBalance(dbService *walletcore.DBService) http.HandlerFunc { // <-- ИЗМЕНЕНИЕ ЗДЕСЬ
+// handleWalletOperation выполняет пополнение или снятие через общую логику walletcore.
+func handleWalletOperation(walletService *walletcore.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req walletcore.WalletRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, fmt.Sprintf("Invalid request body: %v", err))
+			return
+		}
+		// Право зависит от типа операции, поэтому проверяется после разбора тела.
+		if err := auth.Require(r.Context(), walletcore.ScopeFor(req.OperationType)); err != nil {
+			auth.WriteError(w, r, err)
+			return
+		}
+
+		opts := walletcore.OperationOptions{IdempotencyKey: r.Header.Get("Idempotency-Key")}
+		if key, ok := auth.APIKeyFrom(r.Context()); ok {
+			opts.APIKeyID = key.ID
+		}
+		opts.ClientID, _ = auth.ClientID(r.Context())
+		// Пользователь снимает только со своих кошельков; это проверяется под блокировкой кошелька.
+		opts.OwnerID, _ = auth.Owner(r.Context())
+		response, err := walletService.Apply(r.Context(), req, opts)
+		if err != nil {
+			switch {
+			case r.Context().Err() != nil:
+				// Клиент отключился или сработал middleware.Timeout, который сам отвечает 504.
+				slog.WarnContext(r.Context(), "Wallet operation aborted", logging.Err(err))
+			case walletcore.IsRetryable(err):
+				writeUnavailableProblem(w, r, err)
+			case errors.Is(err, walletcore.ErrInvalidRequest):
+				writeValidationProblem(w, r, err)
+			case errors.Is(err, walletcore.ErrIdempotencyKeyReuse):
+				problem.Write(w, r, http.StatusConflict, problem.CodeIdempotencyKeyReused, "Idempotency key was already used for a different request")
+			case errors.Is(err, walletcore.ErrExternalReferenceConflict):
+				problem.Write(w, r, http.StatusConflict, problem.CodeExternalReferenceConflict, "External reference was already used for another transaction")
+			case errors.Is(err, walletcore.ErrWalletNotFound), errors.Is(err, walletcore.ErrWalletAccessDenied):
+				// Чужой кошелек выглядит как несуществующий (см. authorizeWalletRead).
+				problem.Write(w, r, http.StatusNotFound, problem.CodeWalletNotFound, "Wallet not found for withdrawal operation")
+			case errors.Is(err, walletcore.ErrInsufficientFunds):
+				problem.Write(w, r, http.StatusBadRequest, problem.CodeInsufficientBalance, "Insufficient balance")
+			case errors.Is(err, walletcore.ErrBalanceOverflow):
+				problem.Write(w, r, http.StatusUnprocessableEntity, problem.CodeBalanceOverflow, "Balance would exceed the maximum amount")
+			default:
+				slog.ErrorContext(r.Context(), "Wallet operation failed", logging.Err(err))
+				problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Internal server error")
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// handleGetWalletBalance возвращает текущий баланс кошелька без блокировки.
+// Пользователь с JWT видит только свои кошельки.
+func handleGetWalletBalance(walletService *walletcore.Service) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		walletUUIDStr := chi.URLParam(r, "walletUUID")
 		walletID, err := uuid.Parse(walletUUIDStr)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Invalid wallet UUID format: %v", err), http.StatusBadRequest)
+			problem.WriteValidation(w, r, fmt.Sprintf("Invalid wallet UUID format: %v", err), []walletcore.FieldError{
+				{Field: "walletUUID", Message: err.Error()},
+			})
 			return
 		}
 
-		balance, err := dbService.GetWalletBalanceSimple(walletID)
+		response, err := walletService.Balance(r.Context(), walletID)
+		if err == nil {
+			err = authorizeWalletRead(r.Context(), response.OwnerID)
+		}
 		if err != nil {
-			if err == sql.ErrNoRows {
-				http.Error(w, "Wallet not found", http.StatusNotFound)
-			} else {
-				log.Printf("Error getting wallet balance for %s: %v", walletID, err)
-				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			switch {
+			case errors.Is(err, walletcore.ErrWalletNotFound):
+				problem.Write(w, r, http.StatusNotFound, problem.CodeWalletNotFound, "Wallet not found")
+			case r.Context().Err() != nil:
+				slog.WarnContext(r.Context(), "Balance request aborted", logging.Err(err))
+			case walletcore.IsRetryable(err):
+				writeUnavailableProblem(w, r, err)
+			default:
+				slog.ErrorContext(r.Context(), "Balance request failed", logging.Err(err))
+				problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Internal server error")
 			}
 			return
 		}
 
-		response := walletcore.WalletResponse{ // <-- ИЗМЕНЕНИЕ ЗДЕСЬ
-			WalletID: walletID,
-			Balance:  balance,
-		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
 	}
-}
\ No newline at end of file
+}
+
+// authorizeWalletRead проверяет, что клиент может читать кошелек с владельцем ownerID.
+// Чужой кошелек выглядит как несуществующий (ErrWalletNotFound), чтобы по ответу
+// нельзя было узнать, занят ли ID.
+func authorizeWalletRead(ctx context.Context, ownerID string) error {
+	if err := auth.AuthorizeWallet(ctx, ownerID); err != nil {
+		return walletcore.ErrWalletNotFound
+	}
+	return nil
+}
+
+// handleFindTransaction ищет операцию вызывающего клиента по внешней ссылке из параметра externalReference.
+func handleFindTransaction(walletService *walletcore.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reference := r.URL.Query().Get("externalReference")
+		if reference == "" {
+			problem.WriteValidation(w, r, "externalReference is required", []walletcore.FieldError{
+				{Field: "externalReference", Message: "externalReference is required"},
+			})
+			return
+		}
+		clientID, _ := auth.ClientID(r.Context())
+
+		transaction, err := walletService.TransactionByReference(r.Context(), clientID, reference)
+		if err != nil {
+			switch {
+			case errors.Is(err, walletcore.ErrTransactionNotFound):
+				problem.Write(w, r, http.StatusNotFound, problem.CodeTransactionNotFound, "Transaction not found")
+			case r.Context().Err() != nil:
+				slog.WarnContext(r.Context(), "Transaction search aborted", logging.Err(err))
+			case walletcore.IsRetryable(err):
+				writeUnavailableProblem(w, r, err)
+			default:
+				slog.ErrorContext(r.Context(), "Transaction search failed", logging.Err(err))
+				problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Internal server error")
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(transaction)
+	}
+}
+
+// writeUnavailableProblem отправляет 503 для временных ошибок БД, после которых запрос можно повторить.
+func writeUnavailableProblem(w http.ResponseWriter, r *http.Request, err error) {
+	slog.WarnContext(r.Context(), "Temporary database error", logging.Err(err))
+	w.Header().Set("Retry-After", "1")
+	problem.Write(w, r, http.StatusServiceUnavailable, problem.CodeTemporarilyUnavailable,
+		"The wallet is busy, please retry the request")
+}
+
+// writeValidationProblem отправляет 400 с ошибками по полям из walletcore.ValidationErrors.
+func writeValidationProblem(w http.ResponseWriter, r *http.Request, err error) {
+	var fields walletcore.ValidationErrors
+	errors.As(err, &fields)
+	problem.WriteValidation(w, r, fmt.Sprintf("Validation error: %v", fields), fields)
+}
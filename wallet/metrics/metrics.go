@@ -0,0 +1,197 @@
+// Package metrics собирает метрики сервиса в формате Prometheus и отдает их на /metrics.
+//
+// Метрики HTTP размечаются шаблоном маршрута chi, а не фактическим путем,
+// чтобы UUID кошельков не раздували число временных рядов.
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"test_task_wallet/walletcore"
+)
+
+const namespace = "wallet"
+
+// unmatchedRoute - метка маршрута для запросов, не попавших ни в один маршрут.
+const unmatchedRoute = "unmatched"
+
+// Metrics хранит коллекторы сервиса в собственном реестре.
+// Реализует walletcore.Observer.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	httpRequests *prometheus.CounterVec
+	httpDuration *prometheus.HistogramVec
+
+	operations        *prometheus.CounterVec
+	operationAmount   *prometheus.CounterVec
+	insufficientFunds *prometheus.CounterVec
+	txDuration        *prometheus.HistogramVec
+	lockWait          prometheus.Histogram
+}
+
+// New создает реестр с метриками сервиса, среды выполнения Go и процесса.
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "requests_total",
+			Help:      "HTTP requests by method, route pattern and status code.",
+		}, []string{"method", "route", "status"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "HTTP request latency by method, route pattern and status code.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "operations_total",
+			Help:      "Committed wallet operations by operation type.",
+		}, []string{"operation"}),
+		operationAmount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "operation_amount_total",
+			Help:      "Sum of committed operation amounts by operation type.",
+		}, []string{"operation"}),
+		insufficientFunds: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "insufficient_funds_rejections_total",
+			Help:      "Operations rejected because the wallet balance was too low.",
+		}, []string{"operation"}),
+		txDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "db",
+			Name:      "transaction_duration_seconds",
+			Help:      "Duration of a single database transaction attempt by outcome.",
+			Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		}, []string{"outcome"}),
+		lockWait: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "db",
+			Name:      "lock_wait_seconds",
+			Help:      "Time spent acquiring the wallet row lock.",
+			Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2},
+		}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.httpRequests,
+		m.httpDuration,
+		m.operations,
+		m.operationAmount,
+		m.insufficientFunds,
+		m.txDuration,
+		m.lockWait,
+	)
+	return m
+}
+
+// Registry возвращает реестр, например для регистрации дополнительных коллекторов в тестах.
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+// Handler отдает метрики в текстовом формате Prometheus.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// RegisterDB экспортирует статистику пула соединений из db.Stats().
+func (m *Metrics) RegisterDB(db *sql.DB) {
+	m.registry.MustRegister(collectors.NewDBStatsCollector(db, "wallet"))
+}
+
+// RegisterTxRunner экспортирует счетчики повторов транзакций TxRunner.
+func (m *Metrics) RegisterTxRunner(r *walletcore.TxRunner) {
+	counter := func(name, help string, value func(walletcore.TxStats) int64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "db",
+			Name:      name,
+			Help:      help,
+		}, func() float64 { return float64(value(r.Stats())) })
+	}
+	m.registry.MustRegister(
+		counter("transactions_total", "Units of work started by the transaction runner.",
+			func(s walletcore.TxStats) int64 { return s.Transactions }),
+		counter("transaction_attempts_total", "Transaction attempts, including retries.",
+			func(s walletcore.TxStats) int64 { return s.Attempts }),
+		counter("serialization_retries_total", "Transactions retried after a serialization failure (40001).",
+			func(s walletcore.TxStats) int64 { return s.SerializationRetries }),
+		counter("deadlock_retries_total", "Transactions retried after a deadlock (40P01).",
+			func(s walletcore.TxStats) int64 { return s.DeadlockRetries }),
+		counter("transaction_retries_exhausted_total", "Units of work that failed after all retry attempts.",
+			func(s walletcore.TxStats) int64 { return s.Exhausted }),
+	)
+}
+
+// Middleware считает запросы и их длительность. Должен стоять в корневом роутере chi,
+// чтобы к моменту записи метрики шаблон маршрута был уже известен.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		labels := prometheus.Labels{
+			"method": r.Method,
+			"route":  routePattern(r),
+			"status": strconv.Itoa(status),
+		}
+		m.httpRequests.With(labels).Inc()
+		m.httpDuration.With(labels).Observe(time.Since(start).Seconds())
+	})
+}
+
+func routePattern(r *http.Request) string {
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		if pattern := rctx.RoutePattern(); pattern != "" {
+			return pattern
+		}
+	}
+	return unmatchedRoute
+}
+
+// OperationApplied реализует walletcore.Observer.
+func (m *Metrics) OperationApplied(op walletcore.OperationType, amount int64) {
+	m.operations.WithLabelValues(string(op)).Inc()
+	m.operationAmount.WithLabelValues(string(op)).Add(float64(amount))
+}
+
+// InsufficientFunds реализует walletcore.Observer.
+func (m *Metrics) InsufficientFunds(op walletcore.OperationType, amount int64) {
+	m.insufficientFunds.WithLabelValues(string(op)).Inc()
+}
+
+// TxFinished реализует walletcore.Observer.
+func (m *Metrics) TxFinished(duration time.Duration, err error) {
+	outcome := "committed"
+	if err != nil {
+		outcome = "rolled_back"
+	}
+	m.txDuration.WithLabelValues(outcome).Observe(duration.Seconds())
+}
+
+// LockWaited реализует walletcore.Observer.
+func (m *Metrics) LockWaited(duration time.Duration) {
+	m.lockWait.Observe(duration.Seconds())
+}
@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"test_task_wallet/walletcore"
+)
+
+func TestMiddlewareLabelsByRoutePattern(t *testing.T) {
+	m := New()
+	r := chi.NewRouter()
+	r.Use(m.Middleware)
+	r.Get("/api/v1/wallets/{walletUUID}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	for _, path := range []string{"/api/v1/wallets/a", "/api/v1/wallets/b", "/missing"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.httpRequests.WithLabelValues("GET", "/api/v1/wallets/{walletUUID}", "404")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.httpRequests.WithLabelValues("GET", unmatchedRoute, "404")))
+	assert.Equal(t, 2, testutil.CollectAndCount(m.httpDuration))
+}
+
+func TestObserver(t *testing.T) {
+	m := New()
+	var obs walletcore.Observer = m
+
+	obs.OperationApplied(walletcore.Deposit, 100)
+	obs.OperationApplied(walletcore.Deposit, 50)
+	obs.InsufficientFunds(walletcore.Withdraw, 500)
+	obs.TxFinished(10*time.Millisecond, nil)
+	obs.TxFinished(time.Millisecond, errors.New("rolled back"))
+	obs.LockWaited(time.Millisecond)
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.operations.WithLabelValues("DEPOSIT")))
+	assert.Equal(t, 150.0, testutil.ToFloat64(m.operationAmount.WithLabelValues("DEPOSIT")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.insufficientFunds.WithLabelValues("WITHDRAW")))
+	assert.Equal(t, 2, testutil.CollectAndCount(m.txDuration))
+	assert.Equal(t, 1, testutil.CollectAndCount(m.lockWait))
+}
+
+func TestHandlerExposesTxRunnerStats(t *testing.T) {
+	m := New()
+	m.RegisterTxRunner(walletcore.NewTxRunner(nil))
+
+	rr := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.True(t, strings.Contains(rr.Body.String(), "wallet_db_serialization_retries_total 0"))
+}
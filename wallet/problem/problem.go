@@ -0,0 +1,92 @@
+// Package problem формирует ответы об ошибках в формате application/problem+json (RFC 7807).
+//
+// Клиентам следует опираться на поле code: оно стабильно, в отличие от текста detail.
+package problem
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+
+	"test_task_wallet/walletcore"
+)
+
+// ContentType - тип содержимого ответов об ошибках.
+const ContentType = "application/problem+json"
+
+// Стабильные коды ошибок API.
+const (
+	CodeInvalidBody               = "invalid_body"
+	CodeValidationFailed          = "validation_failed"
+	CodeWalletNotFound            = "wallet_not_found"
+	CodeInsufficientBalance       = "insufficient_balance"
+	CodeBalanceOverflow           = "balance_overflow"
+	CodeIdempotencyKeyReused      = "idempotency_key_reused"
+	CodeUnauthorized              = "unauthorized"
+	CodeForbidden                 = "forbidden"
+	CodeAPIKeyNotFound            = "api_key_not_found"
+	CodeScheduleNotFound          = "schedule_not_found"
+	CodeTransactionNotFound       = "transaction_not_found"
+	CodeExternalReferenceConflict = "external_reference_conflict"
+	CodeNotFound                  = "not_found"
+	CodeMethodNotAllowed          = "method_not_allowed"
+	CodeRateLimited               = "rate_limited"
+	CodeTemporarilyUnavailable    = "temporarily_unavailable"
+	CodeInternal                  = "internal_error"
+)
+
+// Details - тело ответа об ошибке.
+type Details struct {
+	Type      string                  `json:"type"`
+	Title     string                  `json:"title"`
+	Status    int                     `json:"status"`
+	Detail    string                  `json:"detail,omitempty"`
+	Instance  string                  `json:"instance,omitempty"`
+	Code      string                  `json:"code"`
+	RequestID string                  `json:"requestId,omitempty"`
+	Errors    []walletcore.FieldError `json:"errors,omitempty"`
+}
+
+// New заполняет Details для запроса r: тип выводится из кода, заголовок - из статуса.
+func New(r *http.Request, status int, code, detail string) *Details {
+	return &Details{
+		Type:      "urn:wallet:problem:" + code,
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		Code:      code,
+		RequestID: middleware.GetReqID(r.Context()),
+	}
+}
+
+// Write отправляет ответ об ошибке.
+func Write(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	New(r, status, code, detail).Write(w)
+}
+
+// WriteValidation отправляет 400 с перечнем ошибок по полям.
+func WriteValidation(w http.ResponseWriter, r *http.Request, detail string, fields []walletcore.FieldError) {
+	p := New(r, http.StatusBadRequest, CodeValidationFailed, detail)
+	p.Errors = fields
+	p.Write(w)
+}
+
+// Write сериализует Details в w.
+func (p *Details) Write(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// NotFound - обработчик для неизвестных путей.
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	Write(w, r, http.StatusNotFound, CodeNotFound, "No route for "+r.Method+" "+r.URL.Path)
+}
+
+// MethodNotAllowed - обработчик для неподдерживаемых методов.
+func MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	Write(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method "+r.Method+" is not allowed for "+r.URL.Path)
+}
@@ -0,0 +1,64 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"test_task_wallet/auth"
+	"test_task_wallet/problem"
+)
+
+// Middleware ограничивает запросы по правилам для шаблона маршрута chi.
+// Ставится после auth.Middleware, чтобы клиент был известен. walletID достает кошелек из запроса.
+func (l *Limiter) Middleware(walletID func(r *http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if l == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			clientID, _ := auth.ClientID(r.Context())
+			route := chi.RouteContext(r.Context()).RoutePattern()
+			if retry := l.Check(r.Context(), r.Method, route, clientID, walletID(r)); retry > 0 {
+				seconds := retryAfterSeconds(retry)
+				w.Header().Set("Retry-After", seconds)
+				problem.Write(w, r, http.StatusTooManyRequests, problem.CodeRateLimited,
+					fmt.Sprintf("Too many requests, retry in %s s", seconds))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// UnaryServerInterceptor - аналог Middleware для gRPC. Метод запроса в правилах - GRPC,
+// маршрут - полное имя метода. Кошелек берется из поля wallet_id сообщения.
+// Ставится после auth.UnaryServerInterceptor.
+func (l *Limiter) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if l == nil {
+			return handler(ctx, req)
+		}
+		clientID, _ := auth.ClientID(ctx)
+		var walletID string
+		if r, ok := req.(interface{ GetWalletId() string }); ok {
+			// Разбор приводит ID к одному написанию, чтобы регистр не давал отдельный счетчик.
+			if id, err := uuid.Parse(r.GetWalletId()); err == nil {
+				walletID = id.String()
+			}
+		}
+		if retry := l.Check(ctx, "GRPC", info.FullMethod, clientID, walletID); retry > 0 {
+			seconds := retryAfterSeconds(retry)
+			grpc.SetHeader(ctx, metadata.Pairs("retry-after", seconds))
+			return nil, status.Errorf(codes.ResourceExhausted, "too many requests, retry in %s s", seconds)
+		}
+		return handler(ctx, req)
+	}
+}
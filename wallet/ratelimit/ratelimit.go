@@ -0,0 +1,200 @@
+// Package ratelimit ограничивает частоту запросов по клиенту и по кошельку.
+//
+// Лимиты задаются правилами config.RateLimitRule для маршрутов HTTP и методов gRPC.
+// Счетчики работают по алгоритму GCRA (эквивалент token bucket, которому нужно
+// хранить одно время на ключ) и живут либо в памяти процесса, либо в PostgreSQL,
+// чтобы лимиты соблюдались для всех реплик вместе.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"test_task_wallet/config"
+	"test_task_wallet/logging"
+	"test_task_wallet/walletcore"
+)
+
+// Store учитывает запросы по ключам.
+type Store interface {
+	// Take учитывает один запрос по ключу key с лимитом l.
+	// Возвращает 0, если запрос разрешен, иначе - через сколько его можно повторить.
+	Take(ctx context.Context, key string, l Limit) (time.Duration, error)
+}
+
+// Limit - средняя частота и допустимая серия запросов.
+type Limit struct {
+	Rate  float64 // запросов в секунду
+	Burst int
+}
+
+// interval - среднее время между запросами.
+func (l Limit) interval() time.Duration {
+	return time.Duration(float64(time.Second) / l.Rate)
+}
+
+// window - на сколько вперед можно "занять" время: Burst запросов подряд.
+func (l Limit) window() time.Duration {
+	return time.Duration(l.Burst) * l.interval()
+}
+
+// take - шаг GCRA: по теоретическому времени прибытия tat возвращает новое значение
+// и задержку до повтора (0, если запрос разрешен).
+func (l Limit) take(tat, now time.Time) (time.Time, time.Duration) {
+	if tat.Before(now) {
+		tat = now
+	}
+	next := tat.Add(l.interval())
+	if over := next.Sub(now) - l.window(); over > 0 {
+		return tat, over
+	}
+	return next, 0
+}
+
+// MemoryStore хранит счетчики в памяти процесса. Лимиты действуют на каждую реплику отдельно.
+type MemoryStore struct {
+	now func() time.Time
+
+	mu        sync.Mutex
+	tat       map[string]time.Time
+	lastSweep time.Time
+}
+
+// sweepInterval - как часто MemoryStore удаляет счетчики, которые уже не ограничивают запросы.
+const sweepInterval = time.Minute
+
+// NewMemoryStore создает хранилище счетчиков в памяти.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{now: time.Now, tat: make(map[string]time.Time)}
+}
+
+func (s *MemoryStore) Take(ctx context.Context, key string, l Limit) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if now.Sub(s.lastSweep) >= sweepInterval {
+		for k, tat := range s.tat {
+			if tat.Before(now) {
+				delete(s.tat, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	tat, retry := l.take(s.tat[key], now)
+	s.tat[key] = tat
+	return retry, nil
+}
+
+// DefaultPostgresTimeout - сколько PostgresStore ждет счетчик в БД по умолчанию.
+const DefaultPostgresTimeout = 100 * time.Millisecond
+
+// PostgresStore хранит счетчики в таблице rate_limits, общей для всех реплик.
+//
+// Перед обращением к БД запрос проверяется тем же лимитом в памяти реплики: если его
+// превышает одна реплика, превышен и общий лимит, и клиент, засыпающий сервис запросами,
+// отсекается без запроса к БД. Если БД не ответила за Timeout, Take возвращает ошибку,
+// но запрос уже прошел лимит реплики: ограничения ослабевают, а не пропадают.
+// db лучше давать отдельным небольшим пулом, чтобы проверки лимитов не занимали соединения операций.
+type PostgresStore struct {
+	db    *walletcore.DBService
+	local *MemoryStore
+	// Timeout ограничивает обращение к БД за счетчиком.
+	Timeout time.Duration
+}
+
+// NewPostgresStore создает хранилище счетчиков в PostgreSQL.
+func NewPostgresStore(db *walletcore.DBService) *PostgresStore {
+	return &PostgresStore{db: db, local: NewMemoryStore(), Timeout: DefaultPostgresTimeout}
+}
+
+func (s *PostgresStore) Take(ctx context.Context, key string, l Limit) (time.Duration, error) {
+	if wait, _ := s.local.Take(ctx, key, l); wait > 0 {
+		return wait, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+	defer cancel()
+	wait, err := s.db.TakeRateLimitToken(ctx, key, l.interval(), l.window())
+	if err != nil {
+		return 0, fmt.Errorf("shared rate limit unavailable, applied the replica limit only: %w", err)
+	}
+	return wait, nil
+}
+
+// Cleanup периодически удаляет устаревшие счетчики, пока ctx не отменен.
+func (s *PostgresStore) Cleanup(ctx context.Context, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.db.DeleteExpiredRateLimits(ctx); err != nil && ctx.Err() == nil {
+				slog.WarnContext(ctx, "Failed to delete expired rate limits", logging.Err(err))
+			}
+		}
+	}
+}
+
+// Limiter применяет правила к запросам. nil *Limiter ничего не ограничивает.
+type Limiter struct {
+	store Store
+	rules []config.RateLimitRule
+}
+
+// New создает Limiter. Возвращает nil, если store == nil или правил нет.
+func New(store Store, rules []config.RateLimitRule) *Limiter {
+	if store == nil || len(rules) == 0 {
+		return nil
+	}
+	return &Limiter{store: store, rules: rules}
+}
+
+// Check применяет к запросу все правила для method и route.
+// clientID и walletID могут быть пустыми, тогда правила для них пропускаются.
+// Возвращает наибольшую задержку среди нарушенных правил или 0.
+// Ошибка хранилища не блокирует запрос: лимиты защищают сервис, а не заменяют его доступность.
+// PostgresStore при этом все равно применяет лимит реплики.
+func (l *Limiter) Check(ctx context.Context, method, route, clientID, walletID string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	var retry time.Duration
+	for _, rule := range l.rules {
+		if !matches(rule.Method, method) || !matches(rule.Route, route) {
+			continue
+		}
+		id := clientID
+		if rule.Key == "wallet" {
+			id = walletID
+		}
+		if id == "" {
+			continue
+		}
+		// Ключ включает правило, а не сам маршрут: правило "* *" дает один счетчик на все маршруты.
+		key := rule.Key + ":" + rule.Method + " " + rule.Route + ":" + id
+		wait, err := l.store.Take(ctx, key, Limit{Rate: rule.Rate, Burst: rule.Burst})
+		if err != nil {
+			slog.WarnContext(ctx, "Rate limit check failed", slog.String("rule", rule.Method+" "+rule.Route), logging.Err(err))
+			continue
+		}
+		retry = max(retry, wait)
+	}
+	return retry
+}
+
+func matches(pattern, value string) bool {
+	return pattern == "*" || pattern == value
+}
+
+// retryAfterSeconds округляет задержку вверх до целых секунд для заголовка Retry-After.
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
@@ -0,0 +1,167 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"test_task_wallet/auth"
+	"test_task_wallet/config"
+	"test_task_wallet/problem"
+	"test_task_wallet/walletcore"
+	"test_task_wallet/walletpb"
+)
+
+// fakeClock - управляемое время для MemoryStore.
+type fakeClock struct{ now time.Time }
+
+func (c *fakeClock) Now() time.Time          { return c.now }
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func newTestStore() (*MemoryStore, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1_700_000_000, 0)}
+	s := NewMemoryStore()
+	s.now = clock.Now
+	return s, clock
+}
+
+func TestMemoryStoreBurstAndRefill(t *testing.T) {
+	store, clock := newTestStore()
+	ctx := context.Background()
+	limit := Limit{Rate: 2, Burst: 3} // запрос каждые 500ms, до трех подряд
+
+	for i := range 3 {
+		retry, err := store.Take(ctx, "k", limit)
+		require.NoError(t, err)
+		assert.Zero(t, retry, "request %d fits into the burst", i+1)
+	}
+	retry, _ := store.Take(ctx, "k", limit)
+	assert.Equal(t, 500*time.Millisecond, retry)
+
+	retry, _ = store.Take(ctx, "other", limit)
+	assert.Zero(t, retry, "keys are limited independently")
+
+	clock.Advance(499 * time.Millisecond)
+	retry, _ = store.Take(ctx, "k", limit)
+	assert.Equal(t, time.Millisecond, retry, "a rejected request does not consume the budget")
+
+	clock.Advance(time.Millisecond)
+	retry, _ = store.Take(ctx, "k", limit)
+	assert.Zero(t, retry)
+
+	clock.Advance(time.Hour)
+	for range 3 {
+		retry, _ = store.Take(ctx, "k", limit)
+		assert.Zero(t, retry, "an idle bucket refills only up to the burst")
+	}
+	retry, _ = store.Take(ctx, "k", limit)
+	assert.NotZero(t, retry)
+	assert.Len(t, store.tat, 1, "expired buckets are swept")
+}
+
+func TestPostgresStoreFallsBackToReplicaLimit(t *testing.T) {
+	// БД недоступна: соединение отклоняется сразу.
+	db, err := sql.Open("postgres", "host=127.0.0.1 port=1 user=u dbname=n sslmode=disable connect_timeout=1")
+	require.NoError(t, err)
+	defer db.Close()
+	store := NewPostgresStore(&walletcore.DBService{DB: db})
+	local, _ := newTestStore()
+	store.local = local
+	ctx := context.Background()
+	limit := Limit{Rate: 1, Burst: 2}
+
+	for range 2 {
+		retry, err := store.Take(ctx, "k", limit)
+		assert.Error(t, err, "the shared counter is unavailable")
+		assert.Zero(t, retry, "the request fits into the replica limit")
+	}
+	retry, err := store.Take(ctx, "k", limit)
+	require.NoError(t, err, "the replica limit rejects without asking the database")
+	assert.Equal(t, time.Second, retry)
+}
+
+func TestLimiterRules(t *testing.T) {
+	store, _ := newTestStore()
+	l := New(store, []config.RateLimitRule{
+		{Method: "POST", Route: "/api/v1/wallet", Key: "client", Rate: 1, Burst: 2},
+		{Method: "POST", Route: "/api/v1/wallet", Key: "wallet", Rate: 1, Burst: 1},
+		{Method: "*", Route: "*", Key: "client", Rate: 1, Burst: 5},
+	})
+	ctx := context.Background()
+
+	assert.Zero(t, l.Check(ctx, "POST", "/api/v1/wallet", "key:a", "w1"))
+	assert.NotZero(t, l.Check(ctx, "POST", "/api/v1/wallet", "key:a", "w1"), "second operation on the same wallet")
+	assert.NotZero(t, l.Check(ctx, "POST", "/api/v1/wallet", "key:b", "w1"), "the wallet limit is shared by all clients")
+	assert.Zero(t, l.Check(ctx, "POST", "/api/v1/wallet", "key:b", "w2"))
+	assert.NotZero(t, l.Check(ctx, "POST", "/api/v1/wallet", "key:a", "w3"), "client a used up its burst of 2")
+
+	// Правило "* *" - один счетчик на все маршруты: у клиента a уже 3 запроса из 5.
+	assert.Zero(t, l.Check(ctx, "GET", "/api/v1/wallets/{walletUUID}", "key:a", ""))
+	assert.Zero(t, l.Check(ctx, "GET", "/api/v1/admin/api-keys", "key:a", ""))
+	assert.NotZero(t, l.Check(ctx, "GET", "/api/v1/admin/api-keys", "key:a", ""))
+
+	var disabled *Limiter
+	assert.Zero(t, disabled.Check(ctx, "POST", "/api/v1/wallet", "key:a", "w1"))
+	assert.Nil(t, New(nil, []config.RateLimitRule{{Method: "*", Route: "*", Key: "client", Rate: 1, Burst: 1}}))
+}
+
+func TestMiddleware(t *testing.T) {
+	store, _ := newTestStore()
+	l := New(store, []config.RateLimitRule{
+		{Method: "GET", Route: "/api/v1/wallets/{walletUUID}", Key: "client", Rate: 0.5, Burst: 1},
+	})
+	key := &walletcore.APIKey{ID: uuid.New()}
+
+	r := chi.NewRouter()
+	r.Route("/api/v1", func(r chi.Router) {
+		r.Group(func(r chi.Router) {
+			r.Use(func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					next.ServeHTTP(w, r.WithContext(auth.WithAPIKey(r.Context(), key)))
+				})
+			})
+			r.Use(l.Middleware(func(r *http.Request) string { return chi.URLParam(r, "walletUUID") }))
+			r.Get("/wallets/{walletUUID}", func(w http.ResponseWriter, r *http.Request) {})
+		})
+	})
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		return rr
+	}
+	assert.Equal(t, http.StatusOK, get("/api/v1/wallets/"+uuid.NewString()).Code)
+	rr := get("/api/v1/wallets/" + uuid.NewString())
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code, "the rule matches the route pattern, not the concrete path")
+	assert.Equal(t, "2", rr.Header().Get("Retry-After"))
+	assert.Equal(t, problem.ContentType, rr.Header().Get("Content-Type"))
+	assert.True(t, strings.Contains(rr.Body.String(), problem.CodeRateLimited))
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	store, _ := newTestStore()
+	l := New(store, []config.RateLimitRule{{Method: "GRPC", Route: "*", Key: "wallet", Rate: 1, Burst: 1}})
+	interceptor := l.UnaryServerInterceptor()
+	info := &grpc.UnaryServerInfo{FullMethod: "/wallet.v1.WalletService/Withdraw"}
+	handler := func(ctx context.Context, req any) (any, error) { return "ok", nil }
+	walletID := uuid.New()
+
+	_, err := interceptor(context.Background(), &walletpb.WithdrawRequest{WalletId: walletID.String()}, info, handler)
+	require.NoError(t, err)
+	_, err = interceptor(context.Background(), &walletpb.WithdrawRequest{WalletId: strings.ToUpper(walletID.String())}, info, handler)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "wallet IDs are normalized before counting")
+	_, err = interceptor(context.Background(), &walletpb.WithdrawRequest{WalletId: uuid.NewString()}, info, handler)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,84 @@
+package receipt
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// Key - открытый ключ проверки квитанций.
+type Key struct {
+	ID     string
+	Public ed25519.PublicKey
+}
+
+// KeyID - идентификатор ключа: первые 8 байт SHA-256 открытого ключа в hex.
+// Выводится из ключа, поэтому одинаков на всех репликах и не требует настройки.
+func KeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// KeySet - опубликованные ключи проверки. В JSON - документ JWKS.
+// Набор можно сохранить и проверять квитанции без доступа к сервису.
+type KeySet struct {
+	Keys []Key
+}
+
+// Find возвращает ключ с идентификатором id.
+func (s *KeySet) Find(id string) (ed25519.PublicKey, bool) {
+	for _, k := range s.Keys {
+		if k.ID == id {
+			return k.Public, true
+		}
+	}
+	return nil, false
+}
+
+// jwk - ключ Ed25519 в формате JWK (RFC 8037).
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Kid string `json:"kid"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+}
+
+func (s KeySet) MarshalJSON() ([]byte, error) {
+	doc := struct {
+		Keys []jwk `json:"keys"`
+	}{Keys: make([]jwk, 0, len(s.Keys))}
+	for _, k := range s.Keys {
+		doc.Keys = append(doc.Keys, jwk{
+			Kty: "OKP", Crv: "Ed25519", Use: "sig", Alg: "EdDSA",
+			Kid: k.ID, X: base64.RawURLEncoding.EncodeToString(k.Public),
+		})
+	}
+	return json.Marshal(doc)
+}
+
+// UnmarshalJSON читает JWKS. Ключи других типов пропускаются.
+func (s *KeySet) UnmarshalJSON(data []byte) error {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	s.Keys = nil
+	for _, k := range doc.Keys {
+		if k.Kty != "OKP" || k.Crv != "Ed25519" {
+			continue
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return fmt.Errorf("key %q: invalid Ed25519 public key", k.Kid)
+		}
+		s.Keys = append(s.Keys, Key{ID: k.Kid, Public: ed25519.PublicKey(x)})
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+// Package receipt подписывает квитанции об операциях кошелька ключом Ed25519
+// и проверяет их без обращения к сервису.
+//
+// Подписывается не JSON, а строка из полей квитанции, разделенных переводом строки:
+//
+//	wallet-receipt/v2
+//	<transactionId>
+//	<walletId>
+//	<operationType>
+//	<amount>
+//	<fee>
+//	<balance>
+//	<timestamp в UTC, RFC 3339 с дробной частью без хвостовых нулей>
+//	<keyId>
+//
+// Квитанции первой версии (без поля version) подписаны без строки <fee> и с
+// первой строкой wallet-receipt/v1; Verify проверяет и их.
+//
+// Так квитанцию можно проверить на любом языке, не повторяя сериализацию JSON сервера.
+// Открытые ключи публикуются в формате JWKS (RFC 8037, kty OKP, crv Ed25519).
+package receipt
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Ошибки проверки квитанции.
+var (
+	ErrUnknownKey       = errors.New("receipt is signed with an unknown key")
+	ErrInvalidSignature = errors.New("receipt signature is invalid")
+)
+
+// Версии подписываемого сообщения - его первая строка. Меняется вместе с набором полей.
+const (
+	messageVersionV1 = "wallet-receipt/v1" // Без комиссии
+	messageVersion   = "wallet-receipt/v2" // Текущая: с комиссией
+)
+
+// Receipt - подписанное подтверждение того, что сервис принял операцию.
+type Receipt struct {
+	// Version - версия подписанного сообщения; пусто у квитанций первой версии.
+	Version       string    `json:"version,omitempty"`
+	TransactionID uuid.UUID `json:"transactionId"`
+	WalletID      uuid.UUID `json:"walletId"`
+	OperationType string    `json:"operationType"`
+	Amount        int64     `json:"amount"`
+	// Fee - комиссия за операцию, 0 если ее нет.
+	Fee int64 `json:"fee"`
+	// Balance - баланс кошелька после операции.
+	Balance   int64     `json:"balance"`
+	Timestamp time.Time `json:"timestamp"`
+	// KeyID - идентификатор ключа подписи из опубликованного набора ключей.
+	KeyID string `json:"keyId"`
+	// Signature - подпись Ed25519 сообщения Message, в JSON - base64.
+	Signature []byte `json:"signature"`
+}
+
+// Message возвращает подписываемое сообщение (формат описан в документации пакета).
+func (r *Receipt) Message() []byte {
+	if r.Version == "" {
+		return []byte(strings.Join([]string{
+			messageVersionV1,
+			r.TransactionID.String(),
+			r.WalletID.String(),
+			r.OperationType,
+			strconv.FormatInt(r.Amount, 10),
+			strconv.FormatInt(r.Balance, 10),
+			r.Timestamp.UTC().Format(time.RFC3339Nano),
+			r.KeyID,
+		}, "\n"))
+	}
+	return []byte(strings.Join([]string{
+		r.Version,
+		r.TransactionID.String(),
+		r.WalletID.String(),
+		r.OperationType,
+		strconv.FormatInt(r.Amount, 10),
+		strconv.FormatInt(r.Fee, 10),
+		strconv.FormatInt(r.Balance, 10),
+		r.Timestamp.UTC().Format(time.RFC3339Nano),
+		r.KeyID,
+	}, "\n"))
+}
+
+// sign подписывает квитанцию ключом priv с идентификатором keyID.
+func (r *Receipt) sign(keyID string, priv ed25519.PrivateKey) {
+	r.Version = messageVersion
+	r.Timestamp = r.Timestamp.UTC()
+	r.KeyID = keyID
+	r.Signature = ed25519.Sign(priv, r.Message())
+}
+
+// Verify проверяет подпись квитанции ключами keys.
+func (r *Receipt) Verify(keys *KeySet) error {
+	pub, ok := keys.Find(r.KeyID)
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownKey, r.KeyID)
+	}
+	if !ed25519.Verify(pub, r.Message(), r.Signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package receipt
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"test_task_wallet/config"
+)
+
+func newKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	return priv
+}
+
+func pemBlock(t *testing.T, key any) string {
+	t.Helper()
+	var (
+		der []byte
+		typ string
+		err error
+	)
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		typ = "PUBLIC KEY"
+		der, err = x509.MarshalPKIXPublicKey(k)
+	default:
+		typ = "PRIVATE KEY"
+		der, err = x509.MarshalPKCS8PrivateKey(k)
+	}
+	require.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}))
+}
+
+func testReceipt() *Receipt {
+	return &Receipt{
+		TransactionID: uuid.MustParse("0b6f3f8e-6a1c-4d3e-9a51-2f8f4f6a9c01"),
+		WalletID:      uuid.MustParse("7f0c7a5e-8f8e-4b8a-9d55-0d9b8b2f1a11"),
+		OperationType: "DEPOSIT",
+		Amount:        150,
+		Fee:           2,
+		Balance:       1148,
+		Timestamp:     time.Date(2026, 3, 1, 12, 30, 0, 123456000, time.FixedZone("MSK", 3*3600)),
+	}
+}
+
+func TestMessageFormat(t *testing.T) {
+	r := testReceipt()
+	r.Version, r.KeyID = messageVersion, "0011223344556677"
+	// Формат опубликован для партнеров: изменение требует новой версии сообщения.
+	assert.Equal(t, "wallet-receipt/v2\n"+
+		"0b6f3f8e-6a1c-4d3e-9a51-2f8f4f6a9c01\n"+
+		"7f0c7a5e-8f8e-4b8a-9d55-0d9b8b2f1a11\n"+
+		"DEPOSIT\n150\n2\n1148\n"+
+		"2026-03-01T09:30:00.123456Z\n"+
+		"0011223344556677", string(r.Message()))
+
+	// Квитанции первой версии проверяются по прежнему формату.
+	r.Version = ""
+	assert.Equal(t, "wallet-receipt/v1\n"+
+		"0b6f3f8e-6a1c-4d3e-9a51-2f8f4f6a9c01\n"+
+		"7f0c7a5e-8f8e-4b8a-9d55-0d9b8b2f1a11\n"+
+		"DEPOSIT\n150\n1148\n"+
+		"2026-03-01T09:30:00.123456Z\n"+
+		"0011223344556677", string(r.Message()))
+}
+
+func TestSignAndVerify(t *testing.T) {
+	signer, err := newSigner([]ed25519.PrivateKey{newKey(t)}, nil)
+	require.NoError(t, err)
+
+	r := testReceipt()
+	require.NoError(t, signer.Sign(r))
+	assert.Equal(t, time.UTC, r.Timestamp.Location())
+	require.NoError(t, r.Verify(signer.KeySet()))
+
+	// Квитанция проходит через JSON, как у партнера.
+	data, err := json.Marshal(r)
+	require.NoError(t, err)
+	var decoded Receipt
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	require.NoError(t, decoded.Verify(signer.KeySet()))
+
+	changes := map[string]func(*Receipt){
+		"transaction": func(r *Receipt) { r.TransactionID = uuid.New() },
+		"wallet":      func(r *Receipt) { r.WalletID = uuid.New() },
+		"type":        func(r *Receipt) { r.OperationType = "WITHDRAW" },
+		"amount":      func(r *Receipt) { r.Amount++ },
+		"fee":         func(r *Receipt) { r.Fee-- },
+		"version":     func(r *Receipt) { r.Version = "" },
+		"balance":     func(r *Receipt) { r.Balance++ },
+		"timestamp":   func(r *Receipt) { r.Timestamp = r.Timestamp.Add(time.Microsecond) },
+	}
+	for name, change := range changes {
+		tampered := decoded
+		change(&tampered)
+		assert.ErrorIs(t, tampered.Verify(signer.KeySet()), ErrInvalidSignature, name)
+	}
+
+	other, err := newSigner([]ed25519.PrivateKey{newKey(t)}, nil)
+	require.NoError(t, err)
+	assert.ErrorIs(t, decoded.Verify(other.KeySet()), ErrUnknownKey)
+}
+
+func TestKeySetJSON(t *testing.T) {
+	signer, err := newSigner([]ed25519.PrivateKey{newKey(t), newKey(t)}, nil)
+	require.NoError(t, err)
+
+	data, err := json.Marshal(signer.KeySet())
+	require.NoError(t, err)
+	var doc struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	require.NoError(t, json.Unmarshal(data, &doc))
+	require.Len(t, doc.Keys, 2)
+	assert.Equal(t, "OKP", doc.Keys[0]["kty"])
+	assert.Equal(t, "Ed25519", doc.Keys[0]["crv"])
+
+	var keys KeySet
+	require.NoError(t, json.Unmarshal(data, &keys))
+	assert.Equal(t, signer.KeySet().Keys, keys.Keys)
+
+	assert.Error(t, json.Unmarshal([]byte(`{"keys":[{"kty":"OKP","crv":"Ed25519","kid":"a","x":"AAAA"}]}`), &keys))
+}
+
+func TestNewSignerRotation(t *testing.T) {
+	current, next, retired := newKey(t), newKey(t), newKey(t)
+	file := filepath.Join(t.TempDir(), "receipt-keys.pem")
+	keys := pemBlock(t, current) + pemBlock(t, next) + pemBlock(t, retired.Public().(ed25519.PublicKey)) +
+		pemBlock(t, current.Public().(ed25519.PublicKey))
+	require.NoError(t, os.WriteFile(file, []byte(keys), 0o600))
+
+	signer, err := NewSigner(config.Receipts{KeysFile: file})
+	require.NoError(t, err)
+	ids := []string{}
+	for _, k := range signer.KeySet().Keys {
+		ids = append(ids, k.ID)
+	}
+	assert.Equal(t, []string{
+		KeyID(current.Public().(ed25519.PublicKey)),
+		KeyID(retired.Public().(ed25519.PublicKey)),
+		KeyID(next.Public().(ed25519.PublicKey)),
+	}, ids, "the active key goes first, duplicates are dropped")
+
+	r := testReceipt()
+	require.NoError(t, signer.Sign(r))
+	assert.Equal(t, ids[0], r.KeyID, "the first private key signs")
+}
+
+func TestNewSignerRejectsBadKeys(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"only public keys": pemBlock(t, newKey(t).Public().(ed25519.PublicKey)),
+		"ecdsa key":        pemBlock(t, ecKey),
+		"certificate":      "-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n",
+	} {
+		file := filepath.Join(dir, name+".pem")
+		require.NoError(t, os.WriteFile(file, []byte(content), 0o600))
+		_, err := NewSigner(config.Receipts{KeysFile: file})
+		assert.Error(t, err, name)
+	}
+
+	signer, err := NewSigner(config.Receipts{})
+	require.NoError(t, err, "without a keys file the signer uses a temporary key")
+	assert.Len(t, signer.KeySet().Keys, 1)
+}
@@ -0,0 +1,133 @@
+package receipt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"test_task_wallet/config"
+)
+
+// Signer подписывает квитанции активным ключом и публикует все ключи проверки.
+//
+// Ключи читаются из PEM файла cfg.KeysFile: блоки PRIVATE KEY (PKCS#8, Ed25519)
+// и PUBLIC KEY (PKIX). Первый закрытый ключ - активный, остальные ключи только публикуются,
+// чтобы выданные ими квитанции продолжали проверяться.
+//
+// Смена ключа на нескольких репликах проходит в два выката: сначала новый ключ
+// добавляется в конец файла (его уже публикуют все реплики), затем переносится в начало.
+// Старый ключ после этого можно оставить в файле как PUBLIC KEY.
+type Signer struct {
+	keyID string
+	priv  ed25519.PrivateKey
+	keys  KeySet
+}
+
+// NewSigner загружает ключи из cfg.KeysFile. Если файл не задан, создается временный ключ:
+// квитанции, подписанные им, нельзя проверить после перезапуска, поэтому так только для разработки.
+func NewSigner(cfg config.Receipts) (*Signer, error) {
+	if cfg.KeysFile == "" {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate receipt signing key: %w", err)
+		}
+		slog.Warn("RECEIPT_KEYS_FILE is not set, receipts are signed with a temporary key")
+		return newSigner([]ed25519.PrivateKey{priv}, nil)
+	}
+
+	data, err := os.ReadFile(cfg.KeysFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read receipt keys: %w", err)
+	}
+	private, public, err := parsePEMKeys(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cfg.KeysFile, err)
+	}
+	return newSigner(private, public)
+}
+
+// newSigner подписывает первым ключом из private и публикует все ключи без повторов.
+func newSigner(private []ed25519.PrivateKey, public []ed25519.PublicKey) (*Signer, error) {
+	if len(private) == 0 {
+		return nil, errors.New("no Ed25519 private key to sign receipts")
+	}
+	for _, priv := range private {
+		public = append(public, priv.Public().(ed25519.PublicKey))
+	}
+	active := private[0].Public().(ed25519.PublicKey)
+	s := &Signer{keyID: KeyID(active), priv: private[0]}
+	s.keys.Keys = append(s.keys.Keys, Key{ID: s.keyID, Public: active})
+	for _, pub := range public {
+		if _, ok := s.keys.Find(KeyID(pub)); !ok {
+			s.keys.Keys = append(s.keys.Keys, Key{ID: KeyID(pub), Public: pub})
+		}
+	}
+	return s, nil
+}
+
+// parsePEMKeys читает закрытые и открытые ключи Ed25519. Другие блоки и ключи других типов - ошибка,
+// чтобы опечатка в файле не оставила сервис без ожидаемого ключа.
+func parsePEMKeys(data []byte) ([]ed25519.PrivateKey, []ed25519.PublicKey, error) {
+	var (
+		private []ed25519.PrivateKey
+		public  []ed25519.PublicKey
+	)
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid private key: %w", err)
+			}
+			priv, ok := key.(ed25519.PrivateKey)
+			if !ok {
+				return nil, nil, fmt.Errorf("private key is %T, want Ed25519", key)
+			}
+			private = append(private, priv)
+		case "PUBLIC KEY":
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid public key: %w", err)
+			}
+			pub, ok := key.(ed25519.PublicKey)
+			if !ok {
+				return nil, nil, fmt.Errorf("public key is %T, want Ed25519", key)
+			}
+			public = append(public, pub)
+		default:
+			return nil, nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+		}
+	}
+	return private, public, nil
+}
+
+// Sign заполняет KeyID и Signature квитанции.
+func (s *Signer) Sign(r *Receipt) error {
+	r.sign(s.keyID, s.priv)
+	return nil
+}
+
+// KeySet возвращает опубликованные ключи проверки; активный ключ идет первым.
+func (s *Signer) KeySet() *KeySet {
+	return &s.keys
+}
+
+// ServeKeys отдает ключи проверки в формате JWKS.
+func (s *Signer) ServeKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	// Клиенты кэшируют набор, но новый ключ должен стать виден до того, как им начнут подписывать.
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(s.keys)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+
+	"test_task_wallet/auth"
+	"test_task_wallet/logging"
+	"test_task_wallet/problem"
+	"test_task_wallet/walletcore"
+)
+
+// Размер страницы списков расписаний и запусков.
+const (
+	defaultSchedulePageLimit = 100
+	maxSchedulePageLimit     = 1000
+)
+
+// scheduleRoutes монтирует управление запланированными операциями.
+// Чтение требует право read; создание, изменение и отмена - право на саму операцию
+// (deposit или withdraw, для перевода - withdraw). Клиент видит только созданные им расписания.
+func scheduleRoutes(walletService *walletcore.Service) func(r chi.Router) {
+	return func(r chi.Router) {
+		r.With(auth.RequireScope(walletcore.ScopeRead)).Get("/", handleListSchedules(walletService))
+		r.Post("/", handleCreateSchedule(walletService))
+		r.With(auth.RequireScope(walletcore.ScopeRead)).Get("/{scheduleId}", handleGetSchedule(walletService))
+		r.Patch("/{scheduleId}", handleUpdateSchedule(walletService))
+		r.Delete("/{scheduleId}", handleCancelSchedule(walletService))
+		r.With(auth.RequireScope(walletcore.ScopeRead)).Get("/{scheduleId}/runs", handleListScheduleRuns(walletService))
+	}
+}
+
+func handleCreateSchedule(walletService *walletcore.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req walletcore.ScheduleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, fmt.Sprintf("Invalid request body: %v", err))
+			return
+		}
+		if err := auth.Require(r.Context(), walletcore.ScopeFor(req.OperationType)); err != nil {
+			auth.WriteError(w, r, err)
+			return
+		}
+
+		var opts walletcore.OperationOptions
+		if key, ok := auth.APIKeyFrom(r.Context()); ok {
+			opts.APIKeyID = key.ID
+		}
+		opts.OwnerID, _ = auth.Owner(r.Context())
+		opts.ClientID, _ = auth.ClientID(r.Context())
+		sc, err := walletService.CreateSchedule(r.Context(), req, opts)
+		if err != nil {
+			writeScheduleError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, sc)
+	}
+}
+
+func handleListSchedules(walletService *walletcore.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var filter walletcore.ScheduleFilter
+		var fieldErrs walletcore.ValidationErrors
+		if v := r.URL.Query().Get("walletId"); v != "" {
+			id, err := uuid.Parse(v)
+			if err != nil {
+				fieldErrs = append(fieldErrs, walletcore.FieldError{Field: "walletId", Message: err.Error()})
+			}
+			filter.WalletID = id
+		}
+		filter.Limit, filter.Offset, fieldErrs = parseSchedulePage(r, fieldErrs)
+		if len(fieldErrs) > 0 {
+			writeValidationProblem(w, r, fieldErrs)
+			return
+		}
+		filter.ClientID, _ = auth.ClientID(r.Context())
+
+		schedules, err := walletService.ListSchedules(r.Context(), filter)
+		if err != nil {
+			writeScheduleError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, schedules)
+	}
+}
+
+func handleGetSchedule(walletService *walletcore.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := parseScheduleID(w, r)
+		if !ok {
+			return
+		}
+		client, _ := auth.ClientID(r.Context())
+		sc, err := walletService.GetSchedule(r.Context(), id, client)
+		if err != nil {
+			writeScheduleError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, sc)
+	}
+}
+
+func handleUpdateSchedule(walletService *walletcore.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := parseScheduleID(w, r)
+		if !ok {
+			return
+		}
+		var upd walletcore.ScheduleUpdate
+		if err := json.NewDecoder(r.Body).Decode(&upd); err != nil {
+			problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidBody, fmt.Sprintf("Invalid request body: %v", err))
+			return
+		}
+		client, ok := authorizeScheduleChange(w, r, walletService, id)
+		if !ok {
+			return
+		}
+		sc, err := walletService.UpdateSchedule(r.Context(), id, upd, client)
+		if err != nil {
+			writeScheduleError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, sc)
+	}
+}
+
+func handleCancelSchedule(walletService *walletcore.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := parseScheduleID(w, r)
+		if !ok {
+			return
+		}
+		client, ok := authorizeScheduleChange(w, r, walletService, id)
+		if !ok {
+			return
+		}
+		sc, err := walletService.CancelSchedule(r.Context(), id, client)
+		if err != nil {
+			writeScheduleError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, sc)
+	}
+}
+
+func handleListScheduleRuns(walletService *walletcore.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := parseScheduleID(w, r)
+		if !ok {
+			return
+		}
+		limit, offset, fieldErrs := parseSchedulePage(r, nil)
+		if len(fieldErrs) > 0 {
+			writeValidationProblem(w, r, fieldErrs)
+			return
+		}
+		client, _ := auth.ClientID(r.Context())
+		runs, err := walletService.ScheduleRuns(r.Context(), id, client, limit, offset)
+		if err != nil {
+			writeScheduleError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, runs)
+	}
+}
+
+// authorizeScheduleChange проверяет, что клиент может менять расписание: оно ему видно,
+// и у него есть право на операцию расписания. Возвращает клиента для вызова сервиса.
+func authorizeScheduleChange(w http.ResponseWriter, r *http.Request, walletService *walletcore.Service, id uuid.UUID) (string, bool) {
+	client, _ := auth.ClientID(r.Context())
+	sc, err := walletService.GetSchedule(r.Context(), id, client)
+	if err != nil {
+		writeScheduleError(w, r, err)
+		return "", false
+	}
+	if err := auth.Require(r.Context(), walletcore.ScopeFor(sc.OperationType)); err != nil {
+		auth.WriteError(w, r, err)
+		return "", false
+	}
+	return client, true
+}
+
+func parseScheduleID(w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	id, err := uuid.Parse(chi.URLParam(r, "scheduleId"))
+	if err != nil {
+		problem.WriteValidation(w, r, fmt.Sprintf("Invalid schedule ID: %v", err), []walletcore.FieldError{
+			{Field: "scheduleId", Message: err.Error()},
+		})
+		return uuid.Nil, false
+	}
+	return id, true
+}
+
+// parseSchedulePage читает limit и offset из запроса и добавляет ошибки к errs.
+func parseSchedulePage(r *http.Request, errs walletcore.ValidationErrors) (limit, offset int, _ walletcore.ValidationErrors) {
+	limit = defaultSchedulePageLimit
+	query := r.URL.Query()
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxSchedulePageLimit {
+			errs = append(errs, walletcore.FieldError{Field: "limit", Message: fmt.Sprintf("limit must be between 1 and %d", maxSchedulePageLimit)})
+		}
+		limit = n
+	}
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			errs = append(errs, walletcore.FieldError{Field: "offset", Message: "offset must not be negative"})
+		}
+		offset = n
+	}
+	return limit, offset, errs
+}
+
+func writeScheduleError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case r.Context().Err() != nil:
+		slog.WarnContext(r.Context(), "Schedule request aborted", logging.Err(err))
+	case errors.Is(err, walletcore.ErrInvalidRequest):
+		writeValidationProblem(w, r, err)
+	case errors.Is(err, walletcore.ErrScheduleNotFound):
+		problem.Write(w, r, http.StatusNotFound, problem.CodeScheduleNotFound, "Schedule not found")
+	case errors.Is(err, walletcore.ErrWalletNotFound), errors.Is(err, walletcore.ErrWalletAccessDenied):
+		problem.Write(w, r, http.StatusNotFound, problem.CodeWalletNotFound, "Wallet not found")
+	case walletcore.IsRetryable(err):
+		writeUnavailableProblem(w, r, err)
+	default:
+		slog.ErrorContext(r.Context(), "Schedule request failed", logging.Err(err))
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Internal server error")
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+
+	"test_task_wallet/logging"
+	"test_task_wallet/problem"
+	"test_task_wallet/walletcore"
+)
+
+// statementEncoder пишет строки выписки в одном из форматов.
+type statementEncoder interface {
+	Write(e walletcore.StatementEntry) error
+	// Flush дописывает буферизованные строки в ответ.
+	Flush() error
+}
+
+// statementInfo - сведения о выписке, которых нет в ее строках.
+type statementInfo struct {
+	WalletID uuid.UUID
+	// To - конец периода; начало приходит во входящем остатке.
+	To time.Time
+	// Currency - валюта кошелька для форматов с десятичной записью сумм.
+	Currency walletcore.Currency
+}
+
+// statementFormats - поддерживаемые форматы выписки: Content-Type, расширение файла и конструктор кодировщика.
+var statementFormats = map[string]struct {
+	contentType string
+	extension   string
+	newEncoder  func(w io.Writer, info statementInfo) statementEncoder
+}{
+	"csv":     {"text/csv; charset=utf-8", "csv", newCSVStatementEncoder},
+	"jsonl":   {"application/jsonl", "jsonl", newJSONLStatementEncoder},
+	"camt053": {"application/xml", "xml", newCAMT053StatementEncoder},
+}
+
+// handleStatement выгружает выписку кошелька потоком: GET /api/v1/wallets/{walletUUID}/statement?from=&to=&format=.
+// from и to - RFC 3339 или дата YYYY-MM-DD (начало дня в UTC); from включительно, to - нет.
+// format - csv (по умолчанию), jsonl или camt053 (ISO 20022 BankToCustomerStatement).
+// Выгрузка, включая запись ответа медленному клиенту, ограничена timeout: по его истечении
+// транзакция выписки откатывается, а ответ обрывается.
+func handleStatement(walletService *walletcore.Service, timeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		walletID, err := uuid.Parse(chi.URLParam(r, "walletUUID"))
+		if err != nil {
+			problem.WriteValidation(w, r, fmt.Sprintf("Invalid wallet UUID format: %v", err), []walletcore.FieldError{
+				{Field: "walletUUID", Message: err.Error()},
+			})
+			return
+		}
+		query := r.URL.Query()
+		var fieldErrs walletcore.ValidationErrors
+		from, err := parseStatementTime(query.Get("from"))
+		if err != nil {
+			fieldErrs = append(fieldErrs, walletcore.FieldError{Field: "from", Message: err.Error()})
+		}
+		to, err := parseStatementTime(query.Get("to"))
+		if err != nil {
+			fieldErrs = append(fieldErrs, walletcore.FieldError{Field: "to", Message: err.Error()})
+		}
+		formatName := query.Get("format")
+		if formatName == "" {
+			formatName = "csv"
+		}
+		format, ok := statementFormats[formatName]
+		if !ok {
+			fieldErrs = append(fieldErrs, walletcore.FieldError{Field: "format", Message: "must be csv, jsonl or camt053"})
+		}
+		if len(fieldErrs) > 0 {
+			writeValidationProblem(w, r, fieldErrs)
+			return
+		}
+
+		wallet, err := walletService.Balance(r.Context(), walletID)
+		if err == nil {
+			err = authorizeWalletRead(r.Context(), wallet.OwnerID)
+		}
+		if err != nil {
+			writeStatementError(w, r, err)
+			return
+		}
+
+		// Конец периода фиксируется здесь, чтобы кодировщик знал его до первой строки.
+		if to.IsZero() {
+			to = time.Now()
+		}
+		// Контекст отменяет запросы к БД, а срок записи прерывает Write, заблокированный
+		// клиентом, который не читает ответ.
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout)); err != nil &&
+			!errors.Is(err, http.ErrNotSupported) {
+			slog.WarnContext(r.Context(), "Failed to set statement write deadline", logging.Err(err))
+		}
+		// Заголовки отправляются с первой строкой: до нее об ошибке еще можно ответить problem+json.
+		var enc statementEncoder
+		err = walletService.Statement(ctx, walletID, from, to, func(e walletcore.StatementEntry) error {
+			if enc == nil {
+				w.Header().Set("Content-Type", format.contentType)
+				w.Header().Set("Content-Disposition",
+					fmt.Sprintf(`attachment; filename="statement-%s.%s"`, walletID, format.extension))
+				enc = format.newEncoder(w, statementInfo{WalletID: walletID, To: to, Currency: walletService.Currency()})
+			}
+			return enc.Write(e)
+		})
+		if enc == nil {
+			writeStatementError(w, r, err)
+			return
+		}
+		if err == nil {
+			err = enc.Flush()
+		}
+		if err != nil {
+			// Ответ уже начат; клиент увидит обрыв без строки closing.
+			slog.WarnContext(r.Context(), "Statement export aborted", logging.Err(err))
+		}
+	}
+}
+
+// writeStatementError отвечает на ошибку, случившуюся до начала выгрузки.
+func writeStatementError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, walletcore.ErrWalletNotFound):
+		problem.Write(w, r, http.StatusNotFound, problem.CodeWalletNotFound, "Wallet not found")
+	case errors.Is(err, walletcore.ErrInvalidRequest):
+		writeValidationProblem(w, r, err)
+	case r.Context().Err() != nil:
+		slog.WarnContext(r.Context(), "Statement request aborted", logging.Err(err))
+	case errors.Is(err, context.DeadlineExceeded):
+		slog.WarnContext(r.Context(), "Statement export timed out", logging.Err(err))
+		problem.Write(w, r, http.StatusServiceUnavailable, problem.CodeTemporarilyUnavailable,
+			"The statement export timed out, please request a shorter period")
+	case walletcore.IsRetryable(err):
+		writeUnavailableProblem(w, r, err)
+	default:
+		slog.ErrorContext(r.Context(), "Statement request failed", logging.Err(err))
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternal, "Internal server error")
+	}
+}
+
+// parseStatementTime разбирает границу периода. Пустая строка - нулевое время (граница не задана).
+func parseStatementTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, errors.New("must be an RFC 3339 timestamp or a YYYY-MM-DD date")
+}
+
+// statementTime - формат времени в выписке: UTC с дробной частью до микросекунд.
+func statementTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// csvStatementEncoder пишет выписку в CSV с заголовком
+// record,transaction_id,timestamp,operation_type,amount,balance,amount_decimal,balance_decimal,currency.
+// Суммы в минимальных единицах идут первыми, чтобы разбор по номерам колонок не сдвигался.
+type csvStatementEncoder struct {
+	w             *csv.Writer
+	currency      walletcore.Currency
+	headerWritten bool
+}
+
+func newCSVStatementEncoder(w io.Writer, info statementInfo) statementEncoder {
+	return &csvStatementEncoder{w: csv.NewWriter(w), currency: info.Currency}
+}
+
+func (e *csvStatementEncoder) Write(entry walletcore.StatementEntry) error {
+	if !e.headerWritten {
+		e.headerWritten = true
+		if err := e.w.Write([]string{"record", "transaction_id", "timestamp", "operation_type", "amount", "balance",
+			"amount_decimal", "balance_decimal", "currency"}); err != nil {
+			return err
+		}
+	}
+	record := []string{string(entry.Kind), "", statementTime(entry.Timestamp), "", "", strconv.FormatInt(entry.Balance, 10),
+		"", walletcore.FormatMinor(entry.Balance, e.currency.Exponent), e.currency.Code}
+	if entry.Kind == walletcore.StatementTransaction {
+		record[1] = entry.TransactionID.String()
+		record[3] = string(entry.Type)
+		record[4] = strconv.FormatInt(entry.Amount, 10)
+		record[6] = walletcore.FormatMinor(entry.Amount, e.currency.Exponent)
+	}
+	// csv.Writer буферизует вывод и сам сбрасывает его в ответ по мере заполнения буфера.
+	return e.w.Write(record)
+}
+
+func (e *csvStatementEncoder) Flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// jsonlStatementEncoder пишет выписку в JSON Lines: по объекту на строку.
+type jsonlStatementEncoder struct {
+	enc      *json.Encoder
+	currency walletcore.Currency
+}
+
+// statementLine - строка выписки в JSON Lines.
+type statementLine struct {
+	Record         walletcore.StatementEntryKind `json:"record"`
+	TransactionID  *uuid.UUID                    `json:"transactionId,omitempty"`
+	Timestamp      string                        `json:"timestamp"`
+	OperationType  walletcore.OperationType      `json:"operationType,omitempty"`
+	Amount         *int64                        `json:"amount,omitempty"`
+	Balance        int64                         `json:"balance"`
+	AmountDecimal  string                        `json:"amountDecimal,omitempty"`
+	BalanceDecimal string                        `json:"balanceDecimal"`
+	Currency       string                        `json:"currency"`
+}
+
+func newJSONLStatementEncoder(w io.Writer, info statementInfo) statementEncoder {
+	return &jsonlStatementEncoder{enc: json.NewEncoder(w), currency: info.Currency}
+}
+
+func (e *jsonlStatementEncoder) Write(entry walletcore.StatementEntry) error {
+	line := statementLine{Record: entry.Kind, Timestamp: statementTime(entry.Timestamp), Balance: entry.Balance,
+		BalanceDecimal: walletcore.FormatMinor(entry.Balance, e.currency.Exponent), Currency: e.currency.Code}
+	if entry.Kind == walletcore.StatementTransaction {
+		line.TransactionID = &entry.TransactionID
+		line.OperationType = entry.Type
+		line.Amount = &entry.Amount
+		line.AmountDecimal = walletcore.FormatMinor(entry.Amount, e.currency.Exponent)
+	}
+	// Encode пишет строку вместе с переводом строки сразу в ответ.
+	return e.enc.Encode(line)
+}
+
+func (e *jsonlStatementEncoder) Flush() error {
+	return nil
+}
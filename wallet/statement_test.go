@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"test_task_wallet/walletcore"
+)
+
+var (
+	testStatementWallet = uuid.MustParse("7f0c7a5e-8f8e-4b8a-9d55-0d9b8b2f1a11")
+	testStatementTo     = time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+	// Валюта с копейками, чтобы десятичные суммы отличались от минимальных единиц.
+	testStatementCurrency = walletcore.Currency{Code: "EUR", Exponent: 2}
+)
+
+func testStatement() []walletcore.StatementEntry {
+	start := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	return []walletcore.StatementEntry{
+		{Kind: walletcore.StatementOpening, Timestamp: start, Balance: 100, ClosingBalance: 120},
+		{Kind: walletcore.StatementTransaction, TransactionID: uuid.MustParse("0b6f3f8e-6a1c-4d3e-9a51-2f8f4f6a9c01"),
+			Timestamp: start.Add(90 * time.Minute), Type: walletcore.Deposit, Amount: 50, Balance: 150},
+		{Kind: walletcore.StatementTransaction, TransactionID: uuid.MustParse("1c7a4f9d-7b2d-4e4f-8b62-3a9a5b7bad02"),
+			Timestamp: start.Add(2*time.Hour + 1500*time.Microsecond), Type: walletcore.Withdraw, Amount: 30, Balance: 120},
+		{Kind: walletcore.StatementClosing, Timestamp: testStatementTo, Balance: 120},
+	}
+}
+
+func encodeStatement(t *testing.T, format string) string {
+	var buf bytes.Buffer
+	enc := statementFormats[format].newEncoder(&buf, statementInfo{WalletID: testStatementWallet, To: testStatementTo, Currency: testStatementCurrency})
+	for _, e := range testStatement() {
+		require.NoError(t, enc.Write(e))
+	}
+	require.NoError(t, enc.Flush())
+	return buf.String()
+}
+
+func TestCSVStatement(t *testing.T) {
+	assert.Equal(t, strings.Join([]string{
+		"record,transaction_id,timestamp,operation_type,amount,balance,amount_decimal,balance_decimal,currency",
+		"opening,,2026-03-01T00:00:00Z,,,100,,1.00,EUR",
+		"transaction,0b6f3f8e-6a1c-4d3e-9a51-2f8f4f6a9c01,2026-03-01T01:30:00Z,DEPOSIT,50,150,0.50,1.50,EUR",
+		"transaction,1c7a4f9d-7b2d-4e4f-8b62-3a9a5b7bad02,2026-03-01T02:00:00.0015Z,WITHDRAW,30,120,0.30,1.20,EUR",
+		"closing,,2026-03-02T00:00:00Z,,,120,,1.20,EUR",
+		"",
+	}, "\n"), encodeStatement(t, "csv"))
+}
+
+func TestJSONLStatement(t *testing.T) {
+	assert.Equal(t, strings.Join([]string{
+		`{"record":"opening","timestamp":"2026-03-01T00:00:00Z","balance":100,"balanceDecimal":"1.00","currency":"EUR"}`,
+		`{"record":"transaction","transactionId":"0b6f3f8e-6a1c-4d3e-9a51-2f8f4f6a9c01","timestamp":"2026-03-01T01:30:00Z","operationType":"DEPOSIT","amount":50,"balance":150,"amountDecimal":"0.50","balanceDecimal":"1.50","currency":"EUR"}`,
+		`{"record":"transaction","transactionId":"1c7a4f9d-7b2d-4e4f-8b62-3a9a5b7bad02","timestamp":"2026-03-01T02:00:00.0015Z","operationType":"WITHDRAW","amount":30,"balance":120,"amountDecimal":"0.30","balanceDecimal":"1.20","currency":"EUR"}`,
+		`{"record":"closing","timestamp":"2026-03-02T00:00:00Z","balance":120,"balanceDecimal":"1.20","currency":"EUR"}`,
+		"",
+	}, "\n"), encodeStatement(t, "jsonl"))
+}
+
+func TestParseStatementTime(t *testing.T) {
+	ts, err := parseStatementTime("")
+	require.NoError(t, err)
+	assert.True(t, ts.IsZero())
+
+	ts, err = parseStatementTime("2026-03-01")
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), ts)
+
+	ts, err = parseStatementTime("2026-03-01T10:00:00+03:00")
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2026, 3, 1, 7, 0, 0, 0, time.UTC), ts.UTC())
+
+	_, err = parseStatementTime("01.03.2026")
+	assert.Error(t, err)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/uuid"
+
+	"test_task_wallet/config"
+	"test_task_wallet/walletcore"
+)
+
+// errChainBroken - хотя бы у одного кошелька цепочка хэшей разорвана.
+var errChainBroken = errors.New("transaction chain is broken")
+
+// runVerifyChain выполняет команду verify-chain: проверяет цепочки хэшей кошельков
+// из cfg.Args (всех кошельков, если аргументов нет) и пишет отчет в w.
+// Возвращает errChainBroken, если найден разрыв.
+func runVerifyChain(ctx context.Context, w io.Writer, cfg *config.Config) error {
+	ids := make([]uuid.UUID, 0, len(cfg.Args))
+	for _, arg := range cfg.Args {
+		id, err := uuid.Parse(arg)
+		if err != nil {
+			return fmt.Errorf("invalid wallet ID %q: %w", arg, err)
+		}
+		ids = append(ids, id)
+	}
+
+	dbService, err := walletcore.NewDBService(ctx, cfg.Database.DSN(), walletcore.DefaultPoolConfig())
+	if err != nil {
+		return fmt.Errorf("failed to initialize database service: %w", err)
+	}
+	defer dbService.DB.Close()
+
+	return verifyChains(ctx, w, walletcore.NewService(dbService), ids)
+}
+
+// verifyChains проверяет цепочки кошельков ids (всех кошельков, если ids пуст)
+// и пишет по строке на кошелек.
+func verifyChains(ctx context.Context, w io.Writer, walletService *walletcore.Service, ids []uuid.UUID) error {
+	if len(ids) == 0 {
+		var err error
+		if ids, err = walletService.WalletIDs(ctx); err != nil {
+			return fmt.Errorf("failed to list wallets: %w", err)
+		}
+	}
+
+	broken := 0
+	for _, id := range ids {
+		report, err := walletService.VerifyChain(ctx, id)
+		if err != nil {
+			return err
+		}
+		if !report.OK() {
+			broken++
+			fmt.Fprintf(w, "%s BROKEN after %d verified records: %s\n", id, report.Verified, report.Break)
+			continue
+		}
+		fmt.Fprintf(w, "%s OK %d records", id, report.Verified)
+		if report.Legacy > 0 {
+			fmt.Fprintf(w, ", %d unchained legacy records", report.Legacy)
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "%d wallets checked, %d broken\n", len(ids), broken)
+	if broken > 0 {
+		return errChainBroken
+	}
+	return nil
+}
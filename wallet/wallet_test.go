@@ -1,25 +1,32 @@
 package main
 
 import (
-	
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"os/exec"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"test_task_wallet/apispec"
+	"test_task_wallet/metrics"
+	"test_task_wallet/ratelimit"
+	"test_task_wallet/walletclient"
 	"test_task_wallet/walletcore" // Убедись, что путь к модулю верный
 )
 
@@ -68,14 +75,31 @@ func setupTestEnvironment(t *testing.T) (*httptest.Server, *walletcore.DBService
 	dsn := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
 		testDBHost, testDBPort, testDBUser, testDBPassword, testDBName)
 
-	dbService, err := walletcore.NewDBService(dsn)
+	dbService, err := walletcore.NewDBService(context.Background(), dsn, walletcore.DefaultPoolConfig())
 	require.NoError(t, err, "Failed to initialize database service for tests")
 
-	err = dbService.InitSchema()
+	err = dbService.InitSchema(context.Background())
 	require.NoError(t, err, "Failed to initialize test database schema")
 
-	router := createRouter(dbService)
-	testServer := httptest.NewServer(router)
+	spec, err := apispec.Load()
+	require.NoError(t, err, "Failed to load OpenAPI specification")
+
+	walletService := walletcore.NewService(dbService)
+	receipts := newTestSigner(t)
+	walletService.SetReceiptSigner(receipts)
+	_, adminKey, err := walletService.IssueAPIKey(context.Background(), "integration-tests", "", []string{"admin"})
+	require.NoError(t, err, "Failed to issue API key for tests")
+
+	router := createRouter(routerDeps{
+		walletService: walletService,
+		keys:          walletService,
+		tokens:        newTestTokens(),
+		receipts:      receipts,
+		spec:          spec,
+		health:        newHealthChecker(dbService),
+		metrics:       metrics.New(),
+	})
+	testServer := httptest.NewServer(withAPIKey(router, adminKey))
 	log.Printf("Test HTTP server started at %s", testServer.URL)
 
 	cleanup := func() {
@@ -112,7 +136,7 @@ func setupTestEnvironment(t *testing.T) (*httptest.Server, *walletcore.DBService
 }
 
 func clearDatabase(db *sql.DB) error {
-	_, err := db.Exec(`TRUNCATE TABLE transactions RESTART IDENTITY CASCADE; TRUNCATE TABLE wallets RESTART IDENTITY CASCADE;`)
+	_, err := db.Exec(`TRUNCATE TABLE transactions RESTART IDENTITY CASCADE; TRUNCATE TABLE wallets RESTART IDENTITY CASCADE; TRUNCATE TABLE schedules CASCADE; TRUNCATE TABLE interest_days, interest_months;`)
 	return err
 }
 
@@ -195,6 +219,15 @@ func TestWalletOperations(t *testing.T) {
 	err = json.Unmarshal(body, &walletResp)
 	require.NoError(t, err, "Failed to unmarshal response after failed withdrawal attempt")
 	assert.Equal(t, int64(700), walletResp.Balance, "Balance should remain unchanged after failed withdrawal")
+
+	overflowReq := walletcore.WalletRequest{
+		WalletID:      testWalletID,
+		OperationType: walletcore.Deposit,
+		Amount:        math.MaxInt64,
+	}
+	resp, body = makeRequest(t, client, http.MethodPost, testServer.URL+"/api/v1/wallet", overflowReq)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode, "Expected 422 for a deposit overflowing the balance")
+	assert.Contains(t, string(body), `"code":"balance_overflow"`)
 }
 
 func TestConcurrentDeposits(t *testing.T) {
@@ -333,6 +366,736 @@ func TestConcurrentMixedOperations(t *testing.T) {
 	fmt.Printf("Final balance for wallet %s after mixed ops: %d (Expected: %d)\n", walletID.String(), walletResp.Balance, expectedFinalBalance)
 }
 
+func TestIdempotentDeposit(t *testing.T) {
+	testServer, dbService, cleanup := setupTestEnvironment(t)
+	defer cleanup()
+
+	err := clearDatabase(dbService.DB)
+	require.NoError(t, err, "Failed to clear database before test")
+
+	c := walletclient.New(testServer.URL, walletclient.WithIdempotencyKeyFunc(func() string { return "order-42" }))
+	walletID := uuid.New()
+
+	for i := 0; i < 3; i++ {
+		wallet, err := c.Deposit(context.Background(), walletID, 500)
+		require.NoError(t, err, "Deposit #%d failed", i)
+		assert.Equal(t, int64(500), wallet.Balance, "Repeated deposit with the same key must not change the balance")
+	}
+
+	_, err = c.Deposit(context.Background(), walletID, 700)
+	assert.ErrorIs(t, err, walletclient.ErrIdempotencyKeyReused)
+
+	_, err = c.Withdraw(context.Background(), uuid.New(), 1)
+	assert.ErrorIs(t, err, walletclient.ErrIdempotencyKeyReused)
+}
+
+func TestIdempotencyKeysPerClient(t *testing.T) {
+	_, dbService, cleanup := setupTestEnvironment(t)
+	defer cleanup()
+	require.NoError(t, clearDatabase(dbService.DB), "Failed to clear database before test")
+
+	ctx := context.Background()
+	walletService := walletcore.NewService(dbService)
+	alice := walletcore.OperationOptions{IdempotencyKey: "order-1", OwnerID: "alice", ClientID: "sub:alice"}
+	bob := walletcore.OperationOptions{IdempotencyKey: "order-1", OwnerID: "bob", ClientID: "sub:bob"}
+	aliceWallet, bobWallet := uuid.New(), uuid.New()
+
+	_, err := walletService.Deposit(ctx, aliceWallet, 100, alice)
+	require.NoError(t, err)
+	resp, err := walletService.Deposit(ctx, bobWallet, 70, bob)
+	require.NoError(t, err, "the same key from another client is a new operation")
+	assert.EqualValues(t, 70, resp.Balance)
+
+	alice.IdempotencyKey = "order-2"
+	_, err = walletService.Withdraw(ctx, aliceWallet, 10, alice)
+	require.NoError(t, err)
+	// Тот же клиент, но другой пользователь: владелец проверяется и при повторе.
+	_, err = walletService.Withdraw(ctx, aliceWallet, 10, walletcore.OperationOptions{
+		IdempotencyKey: "order-2", OwnerID: "bob", ClientID: "sub:alice",
+	})
+	assert.ErrorIs(t, err, walletcore.ErrWalletAccessDenied, "a replay must not reveal someone else's withdrawal")
+}
+
+func TestAPIKeyScopesAndRotation(t *testing.T) {
+	testServer, dbService, cleanup := setupTestEnvironment(t)
+	defer cleanup()
+	require.NoError(t, clearDatabase(dbService.DB), "Failed to clear database before test")
+
+	walletService := walletcore.NewService(dbService)
+	key, plaintext, err := walletService.IssueAPIKey(context.Background(), "depositor", "", []string{"deposit", "read"})
+	require.NoError(t, err)
+
+	c := walletclient.New(testServer.URL, walletclient.WithAPIKey(plaintext), walletclient.WithRetries(0, 0))
+	walletID := uuid.New()
+	_, err = c.Deposit(context.Background(), walletID, 100)
+	require.NoError(t, err)
+	_, err = c.Withdraw(context.Background(), walletID, 10)
+	assert.ErrorIs(t, err, walletclient.ErrForbidden)
+
+	transactions, err := walletService.Transactions(context.Background(), walletID, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, transactions, 1)
+	require.NotNil(t, transactions[0].APIKeyID, "transaction must record the API key that performed it")
+	assert.Equal(t, key.ID, *transactions[0].APIKeyID)
+
+	_, rotated, err := walletService.RotateAPIKey(context.Background(), key.ID)
+	require.NoError(t, err)
+	_, err = c.GetBalance(context.Background(), walletID)
+	assert.ErrorIs(t, err, walletclient.ErrUnauthorized, "old secret must stop working after rotation")
+
+	c = walletclient.New(testServer.URL, walletclient.WithAPIKey(rotated), walletclient.WithRetries(0, 0))
+	_, err = c.GetBalance(context.Background(), walletID)
+	require.NoError(t, err)
+
+	_, err = walletService.RevokeAPIKey(context.Background(), key.ID)
+	require.NoError(t, err)
+	_, err = c.GetBalance(context.Background(), walletID)
+	assert.ErrorIs(t, err, walletclient.ErrUnauthorized)
+
+	// Новый ключ того же клиента продолжает его историю: внешние ссылки не зависят от ключа.
+	assert.Equal(t, key.ID.String(), key.Client, "a key without an explicit client is its own client")
+	replacement, _, err := walletService.IssueAPIKey(context.Background(), "depositor-2", key.Client, []string{"deposit"})
+	require.NoError(t, err)
+	assert.Equal(t, key.Client, replacement.Client)
+	_, err = walletService.Apply(context.Background(), walletcore.WalletRequest{
+		WalletID: walletID, OperationType: walletcore.Deposit, Amount: 1, Details: walletcore.Details{ExternalReference: "invoice-1"},
+	}, walletcore.OperationOptions{APIKeyID: key.ID, ClientID: "key:" + key.Client})
+	require.NoError(t, err)
+	_, err = walletService.Apply(context.Background(), walletcore.WalletRequest{
+		WalletID: walletID, OperationType: walletcore.Deposit, Amount: 1, Details: walletcore.Details{ExternalReference: "invoice-1"},
+	}, walletcore.OperationOptions{APIKeyID: replacement.ID, ClientID: "key:" + replacement.Client})
+	assert.ErrorIs(t, err, walletcore.ErrExternalReferenceConflict)
+
+	// Ключ из конфигурации регистрируется один раз; другой секрет с тем же префиксом не запускается.
+	admin := []walletcore.Scope{walletcore.ScopeAdmin}
+	require.NoError(t, walletService.EnsureAPIKey(context.Background(), "bootstrap", "wk_0123456789ab_first", admin))
+	require.NoError(t, walletService.EnsureAPIKey(context.Background(), "bootstrap", "wk_0123456789ab_first", admin))
+	err = walletService.EnsureAPIKey(context.Background(), "bootstrap", "wk_0123456789ab_second", admin)
+	assert.ErrorIs(t, err, walletcore.ErrInvalidAPIKey)
+}
+
+func TestWalletOwnership(t *testing.T) {
+	testServer, dbService, cleanup := setupTestEnvironment(t)
+	defer cleanup()
+	require.NoError(t, clearDatabase(dbService.DB), "Failed to clear database before test")
+
+	ctx := context.Background()
+	alice := walletclient.New(testServer.URL, walletclient.WithBearerToken("alice"), walletclient.WithRetries(0, 0))
+	bob := walletclient.New(testServer.URL, walletclient.WithBearerToken("bob"), walletclient.WithRetries(0, 0))
+	billing := walletclient.New(testServer.URL, walletclient.WithBearerToken("billing"), walletclient.WithRetries(0, 0))
+
+	walletID := uuid.New()
+	wallet, err := alice.Deposit(ctx, walletID, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", wallet.OwnerID, "a wallet created with a user token belongs to that user")
+
+	_, err = bob.GetBalance(ctx, walletID)
+	assert.ErrorIs(t, err, walletclient.ErrWalletNotFound, "someone else's wallet looks like a missing one")
+	_, err = bob.Withdraw(ctx, walletID, 10)
+	assert.ErrorIs(t, err, walletclient.ErrWalletNotFound, "a withdrawal from someone else's wallet is refused as missing")
+	_, err = bob.Deposit(ctx, walletID, 5)
+	require.NoError(t, err, "anyone may top up someone else's wallet")
+	_, err = walletcore.NewService(dbService).CreateSchedule(ctx, walletcore.ScheduleRequest{
+		WalletID: walletID, OperationType: walletcore.Withdraw, Amount: 1, Cron: "@daily",
+	}, walletcore.OperationOptions{OwnerID: "bob", ClientID: "sub:bob"})
+	assert.ErrorIs(t, err, walletcore.ErrWalletNotFound, "schedules on someone else's wallet are refused as missing")
+
+	wallet, err = alice.Withdraw(ctx, walletID, 10)
+	require.NoError(t, err)
+	assert.Equal(t, int64(95), wallet.Balance)
+
+	wallet, err = billing.GetBalance(ctx, walletID)
+	require.NoError(t, err, "service tokens can act on any wallet")
+	assert.Equal(t, int64(95), wallet.Balance)
+
+	// Кошелек, созданный по API ключу, не принадлежит ни одному пользователю.
+	serviceWallet := uuid.New()
+	resp, _ := makeRequest(t, testServer.Client(), http.MethodPost, testServer.URL+"/api/v1/wallet",
+		walletcore.WalletRequest{WalletID: serviceWallet, OperationType: walletcore.Deposit, Amount: 50})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = alice.GetBalance(ctx, serviceWallet)
+	assert.ErrorIs(t, err, walletclient.ErrWalletNotFound)
+}
+
+func TestPostgresRateLimit(t *testing.T) {
+	_, dbService, cleanup := setupTestEnvironment(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	store := ratelimit.NewPostgresStore(dbService)
+	limit := ratelimit.Limit{Rate: 1, Burst: 2}
+	key := "client:test:" + uuid.NewString()
+
+	for i := 0; i < 2; i++ {
+		retry, err := store.Take(ctx, key, limit)
+		require.NoError(t, err)
+		assert.Zero(t, retry, "request %d fits into the burst", i+1)
+	}
+	retry, err := store.Take(ctx, key, limit)
+	require.NoError(t, err)
+	assert.Greater(t, retry, time.Duration(0))
+	assert.LessOrEqual(t, retry, time.Second)
+
+	// Второе хранилище поверх той же БД видит тот же счетчик, как другая реплика.
+	retry, err = ratelimit.NewPostgresStore(dbService).Take(ctx, key, limit)
+	require.NoError(t, err)
+	assert.Greater(t, retry, time.Duration(0))
+
+	time.Sleep(2 * time.Second)
+	deleted, err := dbService.DeleteExpiredRateLimits(ctx)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, deleted, int64(1))
+}
+
+func TestVerifyChain(t *testing.T) {
+	testServer, dbService, cleanup := setupTestEnvironment(t)
+	defer cleanup()
+	require.NoError(t, clearDatabase(dbService.DB), "Failed to clear database before test")
+
+	ctx := context.Background()
+	walletService := walletcore.NewService(dbService)
+	c := walletclient.New(testServer.URL, walletclient.WithRetries(0, 0))
+	intact, tampered, truncated := uuid.New(), uuid.New(), uuid.New()
+	for _, id := range []uuid.UUID{intact, tampered, truncated} {
+		for _, amount := range []int64{100, 50, 25} {
+			_, err := c.Deposit(ctx, id, amount)
+			require.NoError(t, err)
+		}
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, verifyChains(ctx, &out, walletService, nil))
+	assert.Contains(t, out.String(), "3 wallets checked, 0 broken")
+
+	_, err := dbService.DB.Exec(`UPDATE transactions SET amount = 500 WHERE wallet_id = $1 AND chain_seq = 2`, tampered)
+	require.NoError(t, err)
+	_, err = dbService.DB.Exec(`DELETE FROM transactions WHERE wallet_id = $1 AND chain_seq = 3`, truncated)
+	require.NoError(t, err)
+
+	report, err := walletService.VerifyChain(ctx, tampered)
+	require.NoError(t, err)
+	require.False(t, report.OK())
+	assert.Equal(t, int64(2), report.Break.Seq, "the first broken link is the edited record")
+
+	report, err = walletService.VerifyChain(ctx, truncated)
+	require.NoError(t, err)
+	require.False(t, report.OK(), "removing the last record must be detected through the chain head")
+
+	out.Reset()
+	err = verifyChains(ctx, &out, walletService, []uuid.UUID{intact, tampered})
+	assert.ErrorIs(t, err, errChainBroken)
+	assert.Contains(t, out.String(), intact.String()+" OK 3 records")
+	assert.Contains(t, out.String(), tampered.String()+" BROKEN after 1 verified records")
+
+	_, err = walletService.VerifyChain(ctx, uuid.New())
+	assert.ErrorIs(t, err, walletcore.ErrWalletNotFound)
+}
+
+func TestSignedReceipts(t *testing.T) {
+	testServer, dbService, cleanup := setupTestEnvironment(t)
+	defer cleanup()
+	require.NoError(t, clearDatabase(dbService.DB), "Failed to clear database before test")
+
+	ctx := context.Background()
+	c := walletclient.New(testServer.URL, walletclient.WithRetries(0, 0),
+		walletclient.WithIdempotencyKeyFunc(func() string { return "receipt-test" }))
+	walletID := uuid.New()
+
+	wallet, err := c.Deposit(ctx, walletID, 300)
+	require.NoError(t, err)
+	require.NotNil(t, wallet.Receipt)
+	assert.Equal(t, walletID, wallet.Receipt.WalletID)
+	assert.Equal(t, "DEPOSIT", wallet.Receipt.OperationType)
+	assert.Equal(t, int64(300), wallet.Receipt.Amount)
+	assert.Equal(t, int64(300), wallet.Receipt.Balance)
+	require.NoError(t, c.VerifyReceipt(ctx, wallet.Receipt))
+
+	transactions, err := walletcore.NewService(dbService).Transactions(ctx, walletID, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, transactions, 1)
+	assert.Equal(t, transactions[0].ID, wallet.Receipt.TransactionID)
+
+	// Повтор с тем же ключом идемпотентности возвращает ту же квитанцию.
+	replayed, err := c.Deposit(ctx, walletID, 300)
+	require.NoError(t, err)
+	require.NotNil(t, replayed.Receipt)
+	assert.Equal(t, wallet.Receipt.TransactionID, replayed.Receipt.TransactionID)
+	assert.True(t, wallet.Receipt.Timestamp.Equal(replayed.Receipt.Timestamp))
+	require.NoError(t, c.VerifyReceipt(ctx, replayed.Receipt))
+
+	balance, err := c.GetBalance(ctx, walletID)
+	require.NoError(t, err)
+	assert.Nil(t, balance.Receipt, "balance requests carry no receipt")
+}
+
+func TestStatement(t *testing.T) {
+	testServer, dbService, cleanup := setupTestEnvironment(t)
+	defer cleanup()
+	require.NoError(t, clearDatabase(dbService.DB), "Failed to clear database before test")
+
+	ctx := context.Background()
+	c := walletclient.New(testServer.URL, walletclient.WithRetries(0, 0))
+	walletID := uuid.New()
+	_, err := c.Deposit(ctx, walletID, 1000)
+	require.NoError(t, err)
+	from := time.Now()
+	_, err = c.Withdraw(ctx, walletID, 300)
+	require.NoError(t, err)
+	_, err = c.Deposit(ctx, walletID, 50)
+	require.NoError(t, err)
+	to := time.Now()
+	_, err = c.Deposit(ctx, walletID, 5)
+	require.NoError(t, err)
+
+	url := fmt.Sprintf("%s/api/v1/wallets/%s/statement?format=jsonl&from=%s&to=%s", testServer.URL, walletID,
+		from.UTC().Format(time.RFC3339Nano), to.UTC().Format(time.RFC3339Nano))
+	resp, body := makeRequest(t, testServer.Client(), http.MethodGet, url, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+	assert.Equal(t, "application/jsonl", resp.Header.Get("Content-Type"))
+
+	var lines []map[string]interface{}
+	for _, line := range bytes.Split(bytes.TrimSpace(body), []byte("\n")) {
+		var v map[string]interface{}
+		require.NoError(t, json.Unmarshal(line, &v))
+		lines = append(lines, v)
+	}
+	require.Len(t, lines, 4, "opening, two operations in the period and closing")
+	assert.Equal(t, "opening", lines[0]["record"])
+	assert.EqualValues(t, 1000, lines[0]["balance"])
+	assert.Equal(t, "WITHDRAW", lines[1]["operationType"])
+	assert.EqualValues(t, 700, lines[1]["balance"])
+	assert.EqualValues(t, 750, lines[2]["balance"])
+	assert.Equal(t, "closing", lines[3]["record"])
+	assert.EqualValues(t, 750, lines[3]["balance"])
+
+	resp, body = makeRequest(t, testServer.Client(), http.MethodGet,
+		fmt.Sprintf("%s/api/v1/wallets/%s/statement", testServer.URL, walletID), nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+	rows := strings.Split(strings.TrimSpace(string(body)), "\n")
+	require.Len(t, rows, 7, "header, opening, four operations and closing")
+	assert.True(t, strings.HasPrefix(rows[1], "opening,"))
+	assert.True(t, strings.HasSuffix(rows[1], ",0,,0,RUB"), "the full history starts from zero")
+	assert.True(t, strings.HasSuffix(rows[6], ",755,,755,RUB"))
+
+	alice := walletclient.New(testServer.URL, walletclient.WithBearerToken("alice"), walletclient.WithRetries(0, 0))
+	_, err = alice.GetBalance(ctx, walletID)
+	require.ErrorIs(t, err, walletclient.ErrWalletNotFound)
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/api/v1/wallets/%s/statement", testServer.URL, walletID), nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer alice")
+	resp, err = testServer.Client().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "users get statements only for their own wallets")
+}
+
+func TestStatementTimeout(t *testing.T) {
+	testServer, dbService, cleanup := setupTestEnvironment(t)
+	defer cleanup()
+	require.NoError(t, clearDatabase(dbService.DB), "Failed to clear database before test")
+
+	walletID := uuid.New()
+	_, err := walletclient.New(testServer.URL, walletclient.WithRetries(0, 0)).Deposit(context.Background(), walletID, 100)
+	require.NoError(t, err)
+
+	router := chi.NewRouter()
+	router.Get("/wallets/{walletUUID}/statement", handleStatement(walletcore.NewService(dbService), time.Nanosecond))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/wallets/%s/statement", walletID), nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code, rec.Body.String())
+	assert.Contains(t, rec.Body.String(), "temporarily_unavailable")
+
+	var open int
+	require.NoError(t, dbService.DB.QueryRow(
+		`SELECT count(*) FROM pg_stat_activity WHERE datname = current_database() AND state LIKE 'idle in transaction%'`).Scan(&open))
+	assert.Zero(t, open, "the statement transaction is rolled back after the timeout")
+}
+
+func TestSchedules(t *testing.T) {
+	testServer, dbService, cleanup := setupTestEnvironment(t)
+	defer cleanup()
+	require.NoError(t, clearDatabase(dbService.DB), "Failed to clear database before test")
+
+	ctx := context.Background()
+	c := walletclient.New(testServer.URL, walletclient.WithRetries(0, 0))
+	source, target := uuid.New(), uuid.New()
+	_, err := c.Deposit(ctx, source, 100)
+	require.NoError(t, err)
+	_, err = c.Deposit(ctx, target, 1)
+	require.NoError(t, err)
+
+	createSchedule := func(body map[string]interface{}) walletcore.Schedule {
+		resp, respBody := makeRequest(t, testServer.Client(), http.MethodPost, testServer.URL+"/api/v1/schedules", body)
+		require.Equal(t, http.StatusCreated, resp.StatusCode, string(respBody))
+		var sc walletcore.Schedule
+		require.NoError(t, json.Unmarshal(respBody, &sc))
+		return sc
+	}
+	startAt := time.Now().Add(-time.Second).UTC().Format(time.RFC3339Nano)
+	transfer := createSchedule(map[string]interface{}{
+		"walletId": source, "operationType": "TRANSFER", "targetWalletId": target, "amount": 30, "startAt": startAt,
+	})
+	withdraw := createSchedule(map[string]interface{}{
+		"walletId": source, "operationType": "WITHDRAW", "amount": 1000, "startAt": startAt,
+	})
+	daily := createSchedule(map[string]interface{}{
+		"walletId": target, "operationType": "DEPOSIT", "amount": 5, "cron": "@daily",
+	})
+	assert.Equal(t, walletcore.ScheduleActive, daily.Status)
+
+	resp, body := makeRequest(t, testServer.Client(), http.MethodPost, testServer.URL+"/api/v1/schedules", map[string]interface{}{
+		"walletId": source, "operationType": "TRANSFER", "targetWalletId": uuid.New(), "amount": 1, "cron": "@hourly",
+	})
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, string(body))
+
+	// Планировщик вызывается напрямую, чтобы не ждать интервала опроса.
+	walletService := walletcore.NewService(dbService)
+	ran, err := walletService.RunDueSchedules(ctx, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 2, ran, "only the due one-time operations run")
+	ran, err = walletService.RunDueSchedules(ctx, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 0, ran, "each run happens exactly once")
+
+	balance, err := c.GetBalance(ctx, source)
+	require.NoError(t, err)
+	assert.EqualValues(t, 70, balance)
+	balance, err = c.GetBalance(ctx, target)
+	require.NoError(t, err)
+	assert.EqualValues(t, 31, balance)
+
+	runsOf := func(id uuid.UUID) []walletcore.ScheduleRun {
+		resp, body := makeRequest(t, testServer.Client(), http.MethodGet, fmt.Sprintf("%s/api/v1/schedules/%s/runs", testServer.URL, id), nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+		var runs []walletcore.ScheduleRun
+		require.NoError(t, json.Unmarshal(body, &runs))
+		return runs
+	}
+	runs := runsOf(transfer.ID)
+	require.Len(t, runs, 1)
+	assert.Equal(t, walletcore.RunSucceeded, runs[0].Status)
+	assert.NotNil(t, runs[0].TransactionID)
+	runs = runsOf(withdraw.ID)
+	require.Len(t, runs, 1)
+	assert.Equal(t, walletcore.RunFailed, runs[0].Status)
+	assert.Equal(t, "insufficient balance", runs[0].Error)
+
+	resp, body = makeRequest(t, testServer.Client(), http.MethodGet, fmt.Sprintf("%s/api/v1/schedules/%s", testServer.URL, withdraw.ID), nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+	var sc walletcore.Schedule
+	require.NoError(t, json.Unmarshal(body, &sc))
+	assert.Equal(t, walletcore.ScheduleFailed, sc.Status)
+
+	resp, body = makeRequest(t, testServer.Client(), http.MethodDelete, fmt.Sprintf("%s/api/v1/schedules/%s", testServer.URL, daily.ID), nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+	require.NoError(t, json.Unmarshal(body, &sc))
+	assert.Equal(t, walletcore.ScheduleCancelled, sc.Status)
+	assert.Nil(t, sc.NextRunAt)
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/api/v1/schedules/%s", testServer.URL, transfer.ID), nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer alice")
+	resp, err = testServer.Client().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "users see only their own schedules")
+
+	// Клиенты API ключей тоже видят только свои расписания.
+	payroll := walletcore.OperationOptions{ClientID: "key:payroll"}
+	own, err := walletService.CreateSchedule(ctx, walletcore.ScheduleRequest{
+		WalletID: target, OperationType: walletcore.Deposit, Amount: 1, Cron: "@daily",
+	}, payroll)
+	require.NoError(t, err)
+	listed, err := walletService.ListSchedules(ctx, walletcore.ScheduleFilter{ClientID: payroll.ClientID, Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, listed, 1)
+	assert.Equal(t, own.ID, listed[0].ID)
+	_, err = walletService.GetSchedule(ctx, transfer.ID, payroll.ClientID)
+	assert.ErrorIs(t, err, walletcore.ErrScheduleNotFound)
+	_, err = walletService.CancelSchedule(ctx, own.ID, "key:other")
+	assert.ErrorIs(t, err, walletcore.ErrScheduleNotFound)
+	_, err = walletService.CancelSchedule(ctx, own.ID, payroll.ClientID)
+	require.NoError(t, err)
+
+	// Ключ расписания проверяется при каждом запуске.
+	key, _, err := walletService.IssueAPIKey(ctx, "payroll", "", []string{"deposit"})
+	require.NoError(t, err)
+	revoked, err := walletService.CreateSchedule(ctx, walletcore.ScheduleRequest{
+		WalletID: target, OperationType: walletcore.Deposit, Amount: 5, StartAt: &sc.StartAt,
+	}, walletcore.OperationOptions{APIKeyID: key.ID})
+	require.NoError(t, err)
+	_, err = walletService.RevokeAPIKey(ctx, key.ID)
+	require.NoError(t, err)
+	ran, err = walletService.RunDueSchedules(ctx, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 1, ran)
+	runs = runsOf(revoked.ID)
+	require.Len(t, runs, 1)
+	assert.Equal(t, walletcore.RunFailed, runs[0].Status)
+	assert.Equal(t, walletcore.ErrScheduleKeyRevoked.Error(), runs[0].Error)
+	balance, err = c.GetBalance(ctx, target)
+	require.NoError(t, err)
+	assert.EqualValues(t, 31, balance, "operations of a revoked key are not executed")
+
+	// Расписание, операция которого упирается во временную ошибку, откладывается
+	// и не задерживает остальные.
+	blocked, err := walletService.CreateSchedule(ctx, walletcore.ScheduleRequest{
+		WalletID: source, OperationType: walletcore.Withdraw, Amount: 1, StartAt: &sc.StartAt, MaxRetries: 1,
+	}, walletcore.OperationOptions{})
+	require.NoError(t, err)
+	next, err := walletService.CreateSchedule(ctx, walletcore.ScheduleRequest{
+		WalletID: target, OperationType: walletcore.Deposit, Amount: 1, StartAt: &sc.StartAt,
+	}, walletcore.OperationOptions{})
+	require.NoError(t, err)
+
+	lockTx, err := dbService.DB.Begin()
+	require.NoError(t, err)
+	defer lockTx.Rollback()
+	_, err = lockTx.Exec(`SELECT 1 FROM wallets WHERE id = $1 FOR UPDATE`, source)
+	require.NoError(t, err)
+	lockTimeout := dbService.LockTimeout
+	dbService.LockTimeout = 100 * time.Millisecond
+	ran, err = walletService.RunDueSchedules(ctx, 10)
+	dbService.LockTimeout = lockTimeout
+	require.NoError(t, lockTx.Rollback())
+	require.NoError(t, err)
+	assert.Equal(t, 2, ran)
+
+	runs = runsOf(blocked.ID)
+	require.Len(t, runs, 1)
+	assert.Equal(t, walletcore.RunFailed, runs[0].Status)
+	blockedNow, err := walletService.GetSchedule(ctx, blocked.ID, "")
+	require.NoError(t, err)
+	assert.Equal(t, walletcore.ScheduleActive, blockedNow.Status)
+	require.NotNil(t, blockedNow.NextRunAt)
+	assert.True(t, blockedNow.NextRunAt.After(time.Now()), "the failed attempt is retried later")
+	runs = runsOf(next.ID)
+	require.Len(t, runs, 1)
+	assert.Equal(t, walletcore.RunSucceeded, runs[0].Status, "the next schedule is not held up")
+}
+
+func TestFees(t *testing.T) {
+	_, dbService, cleanup := setupTestEnvironment(t)
+	defer cleanup()
+	require.NoError(t, clearDatabase(dbService.DB), "Failed to clear database before test")
+
+	ctx := context.Background()
+	revenue, walletID := uuid.New(), uuid.New()
+	walletService := walletcore.NewService(dbService)
+	signer := newTestSigner(t)
+	walletService.SetReceiptSigner(signer)
+	walletService.SetFees(walletcore.NewFees(revenue, []walletcore.FeeRule{
+		{Operation: walletcore.Withdraw, Tiers: []walletcore.FeeTier{{BasisPoints: 100}}, Min: 5},
+	}))
+
+	resp, err := walletService.Deposit(ctx, walletID, 1000, walletcore.OperationOptions{})
+	require.NoError(t, err)
+	assert.Zero(t, resp.Fee, "deposits have no fee rule")
+
+	opts := walletcore.OperationOptions{IdempotencyKey: uuid.NewString()}
+	resp, err = walletService.Withdraw(ctx, walletID, 100, opts)
+	require.NoError(t, err)
+	assert.EqualValues(t, 5, resp.Fee, "1% of 100 is raised to the minimum")
+	assert.EqualValues(t, 895, resp.Balance)
+	replay, err := walletService.Withdraw(ctx, walletID, 100, opts)
+	require.NoError(t, err)
+	assert.Equal(t, resp.Fee, replay.Fee, "a replay reports the original fee")
+	for _, r := range []*walletcore.WalletResponse{resp, replay} {
+		require.NotNil(t, r.Receipt)
+		assert.EqualValues(t, 5, r.Receipt.Fee, "the fee is part of the signed receipt")
+		require.NoError(t, r.Receipt.Verify(signer.KeySet()))
+	}
+
+	_, err = walletService.Withdraw(ctx, walletID, 890, walletcore.OperationOptions{})
+	require.ErrorIs(t, err, walletcore.ErrInsufficientFunds, "the balance must also cover the fee")
+
+	balance, err := walletService.Balance(ctx, revenue)
+	require.NoError(t, err)
+	assert.EqualValues(t, 5, balance.Balance)
+
+	transactions, err := walletService.Transactions(ctx, walletID, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, transactions, 3)
+	var withdrawal, fee walletcore.Transaction
+	for _, tr := range transactions {
+		switch tr.Type {
+		case walletcore.Withdraw:
+			withdrawal = tr
+		case walletcore.Fee:
+			fee = tr
+		}
+	}
+	require.NotNil(t, fee.RelatedID)
+	assert.Equal(t, withdrawal.ID, *fee.RelatedID)
+	assert.EqualValues(t, 5, fee.Amount)
+
+	for _, id := range []uuid.UUID{walletID, revenue} {
+		report, err := walletService.VerifyChain(ctx, id)
+		require.NoError(t, err)
+		assert.True(t, report.OK(), "fee records keep the chain and balance consistent")
+	}
+}
+
+func TestInterest(t *testing.T) {
+	_, dbService, cleanup := setupTestEnvironment(t)
+	defer cleanup()
+	require.NoError(t, clearDatabase(dbService.DB), "Failed to clear database before test")
+
+	ctx := context.Background()
+	walletID := uuid.New()
+	walletService := walletcore.NewService(dbService)
+	// 36.5% годовых с 1 000 000 - ровно 1000 в день.
+	walletService.SetInterestRates(map[string]int64{"savings": 3650})
+
+	_, err := walletService.Deposit(ctx, walletID, 1_000_000, walletcore.OperationOptions{})
+	require.NoError(t, err)
+	_, err = walletService.SetWalletProduct(ctx, walletID, "savings")
+	require.NoError(t, err)
+	_, err = walletService.SetWalletProduct(ctx, uuid.New(), "savings")
+	require.ErrorIs(t, err, walletcore.ErrWalletNotFound)
+
+	// Кошелек и пополнение появились задолго до прошлого месяца, дни до его начала уже обработаны.
+	now := time.Now().UTC()
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -1, 0)
+	past := now.AddDate(0, 0, -70)
+	_, err = dbService.DB.Exec(`UPDATE wallets SET created_at = $2 WHERE id = $1`, walletID, past)
+	require.NoError(t, err)
+	_, err = dbService.DB.Exec(`UPDATE transactions SET timestamp = $2 WHERE wallet_id = $1`, walletID, past)
+	require.NoError(t, err)
+	_, err = dbService.DB.Exec(`INSERT INTO interest_days (day) VALUES ($1::date)`, month.AddDate(0, 0, -1).Format(time.DateOnly))
+	require.NoError(t, err)
+
+	report, err := walletService.AccrueInterest(ctx, now)
+	require.NoError(t, err)
+	days := int(now.Truncate(24*time.Hour).Sub(month).Hours() / 24)
+	monthDays := int64(month.AddDate(0, 1, 0).Sub(month).Hours() / 24)
+	assert.Equal(t, days, report.Days)
+	assert.Equal(t, days, report.Accruals)
+	assert.Equal(t, 1, report.Postings, "only the finished month is posted")
+	assert.Equal(t, monthDays*1000, report.Posted)
+
+	balance, err := walletService.Balance(ctx, walletID)
+	require.NoError(t, err)
+	assert.Equal(t, 1_000_000+monthDays*1000, balance.Balance)
+
+	transactions, err := walletService.Transactions(ctx, walletID, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, transactions, 2)
+	assert.Equal(t, walletcore.Interest, transactions[0].Type)
+	assert.Equal(t, monthDays*1000, transactions[0].Amount)
+
+	report, err = walletService.AccrueInterest(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, walletcore.InterestReport{}, *report, "a rerun neither accrues nor posts again")
+}
+
+func TestTransactionDetails(t *testing.T) {
+	_, dbService, cleanup := setupTestEnvironment(t)
+	defer cleanup()
+	require.NoError(t, clearDatabase(dbService.DB), "Failed to clear database before test")
+
+	ctx := context.Background()
+	walletID := uuid.New()
+	walletService := walletcore.NewService(dbService)
+	shop := walletcore.OperationOptions{ClientID: "sub:shop"}
+	details := walletcore.Details{
+		Description:       "Order payment",
+		ExternalReference: "order-42",
+		Tags:              []string{"shop", "spring"},
+		Metadata:          json.RawMessage(`{"orderId": 42}`),
+	}
+
+	_, err := walletService.Apply(ctx, walletcore.WalletRequest{
+		WalletID: walletID, OperationType: walletcore.Deposit, Amount: 100, Details: details,
+	}, shop)
+	require.NoError(t, err)
+	_, err = walletService.Apply(ctx, walletcore.WalletRequest{
+		WalletID: walletID, OperationType: walletcore.Deposit, Amount: 100, Details: walletcore.Details{ExternalReference: "order-42"},
+	}, shop)
+	require.ErrorIs(t, err, walletcore.ErrExternalReferenceConflict)
+	_, err = walletService.Apply(ctx, walletcore.WalletRequest{
+		WalletID: walletID, OperationType: walletcore.Deposit, Amount: 50, Details: walletcore.Details{ExternalReference: "order-42"},
+	}, walletcore.OperationOptions{ClientID: "sub:market"})
+	require.NoError(t, err, "references are unique per client")
+
+	balance, err := walletService.Balance(ctx, walletID)
+	require.NoError(t, err)
+	assert.EqualValues(t, 150, balance.Balance, "the conflicting operation is rolled back")
+
+	found, err := walletService.TransactionByReference(ctx, "sub:shop", "order-42")
+	require.NoError(t, err)
+	assert.EqualValues(t, 100, found.Amount)
+	assert.Equal(t, details.Description, found.Description)
+	assert.Equal(t, details.Tags, found.Tags)
+	assert.JSONEq(t, string(details.Metadata), string(found.Metadata))
+	_, err = walletService.TransactionByReference(ctx, "sub:shop", "order-43")
+	require.ErrorIs(t, err, walletcore.ErrTransactionNotFound)
+
+	transactions, err := walletService.Transactions(ctx, walletID, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, transactions, 2)
+	for _, tr := range transactions {
+		assert.Equal(t, "order-42", tr.ExternalReference, "history returns the details")
+	}
+
+	report, err := walletService.VerifyChain(ctx, walletID)
+	require.NoError(t, err)
+	require.True(t, report.OK(), "details are hashed in the form stored by PostgreSQL: %v", report.Break)
+	_, err = dbService.DB.Exec(`UPDATE transactions SET description = 'Refund' WHERE client_id = 'sub:shop'`)
+	require.NoError(t, err)
+	report, err = walletService.VerifyChain(ctx, walletID)
+	require.NoError(t, err)
+	assert.False(t, report.OK(), "changed details break the chain")
+}
+
+func TestMoney(t *testing.T) {
+	_, dbService, cleanup := setupTestEnvironment(t)
+	defer cleanup()
+	require.NoError(t, clearDatabase(dbService.DB), "Failed to clear database before test")
+
+	ctx := context.Background()
+	walletID := uuid.New()
+	walletService := walletcore.NewService(dbService)
+	walletService.SetCurrency(walletcore.Currency{Code: "EUR", Exponent: 2})
+
+	resp, err := walletService.Apply(ctx, walletcore.WalletRequest{
+		WalletID: walletID, OperationType: walletcore.Deposit, AmountDecimal: "12.50",
+	}, walletcore.OperationOptions{})
+	require.NoError(t, err)
+	assert.EqualValues(t, 1250, resp.Balance)
+	assert.Equal(t, "12.50", resp.BalanceDecimal)
+	assert.Equal(t, "EUR", resp.Currency)
+
+	_, err = walletService.Deposit(ctx, walletID, math.MaxInt64, walletcore.OperationOptions{})
+	require.ErrorIs(t, err, walletcore.ErrBalanceOverflow, "an overflowing deposit is rejected")
+	balance, err := walletService.Balance(ctx, walletID)
+	require.NoError(t, err)
+	assert.Equal(t, "12.50", balance.BalanceDecimal, "the balance is unchanged")
+
+	transactions, err := walletService.Transactions(ctx, walletID, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, transactions, 1)
+	assert.Equal(t, "12.50", transactions[0].AmountDecimal)
+
+	sc, err := walletService.CreateSchedule(ctx, walletcore.ScheduleRequest{
+		WalletID: walletID, OperationType: walletcore.Withdraw, AmountDecimal: "1.25", IntervalSeconds: 3600,
+	}, walletcore.OperationOptions{})
+	require.NoError(t, err)
+	assert.EqualValues(t, 125, sc.Amount)
+	assert.Equal(t, "1.25", sc.AmountDecimal)
+	assert.Equal(t, "EUR", sc.Currency)
+	_, err = walletService.CreateSchedule(ctx, walletcore.ScheduleRequest{
+		WalletID: walletID, OperationType: walletcore.Withdraw, Amount: 100, AmountDecimal: "1.25", IntervalSeconds: 3600,
+	}, walletcore.OperationOptions{})
+	require.ErrorIs(t, err, walletcore.ErrInvalidRequest, "amount and amountDecimal must agree")
+
+	amount := "2.00"
+	sc, err = walletService.UpdateSchedule(ctx, sc.ID, walletcore.ScheduleUpdate{AmountDecimal: &amount}, "")
+	require.NoError(t, err)
+	assert.EqualValues(t, 200, sc.Amount)
+	assert.Equal(t, "2.00", sc.AmountDecimal)
+}
+
 func makeRequest(t *testing.T, client *http.Client, method, url string, body interface{}) (*http.Response, []byte) {
 	var reqBody io.Reader
 	if body != nil {
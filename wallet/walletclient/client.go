@@ -0,0 +1,329 @@
+// Package walletclient - типизированный Go клиент для REST API кошелька.
+//
+// Операции пополнения и снятия отправляются с заголовком Idempotency-Key.
+// Ключ создается один раз на вызов и повторяется во всех попытках,
+// поэтому повтор после обрыва соединения не изменит баланс дважды.
+package walletclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"test_task_wallet/receipt"
+)
+
+// Ошибки API, которые можно проверять через errors.Is.
+var (
+	ErrInvalidRequest       = errors.New("walletclient: invalid request")
+	ErrWalletNotFound       = errors.New("walletclient: wallet not found")
+	ErrInsufficientBalance  = errors.New("walletclient: insufficient balance")
+	ErrBalanceOverflow      = errors.New("walletclient: balance would exceed the maximum amount")
+	ErrIdempotencyKeyReused = errors.New("walletclient: idempotency key was already used for a different request")
+	ErrUnauthorized         = errors.New("walletclient: missing, unknown or revoked API key")
+	ErrForbidden            = errors.New("walletclient: API key lacks the required scope")
+	ErrRateLimited          = errors.New("walletclient: rate limit exceeded")
+	ErrUnavailable          = errors.New("walletclient: service temporarily unavailable")
+	ErrServer               = errors.New("walletclient: server error")
+)
+
+// APIError описывает ответ сервера в формате application/problem+json.
+// Unwrap возвращает одну из ошибок Err*, соответствующую коду ответа.
+type APIError struct {
+	StatusCode  int
+	Code        string
+	Message     string
+	RequestID   string
+	FieldErrors []FieldError
+	// RetryAfter - пауза из заголовка Retry-After (для 429 и 503), 0 если заголовка нет.
+	RetryAfter time.Duration
+	kind       error
+}
+
+// FieldError - ошибка проверки конкретного поля запроса.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("wallet API returned %d (%s): %s", e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("wallet API returned %d: %s", e.StatusCode, e.Message)
+}
+
+func (e *APIError) Unwrap() error {
+	return e.kind
+}
+
+// Wallet - баланс кошелька, возвращаемый API.
+type Wallet struct {
+	ID      uuid.UUID `json:"walletId"`
+	Balance int64     `json:"balance"`
+	OwnerID string    `json:"ownerId,omitempty"`
+	// Fee - комиссия, списанная вместе с Deposit или Withdraw; Balance уже ее учитывает.
+	Fee int64 `json:"fee,omitempty"`
+	// BalanceDecimal - Balance в десятичной записи валюты Currency, например "12.50".
+	BalanceDecimal string `json:"balanceDecimal,omitempty"`
+	Currency       string `json:"currency,omitempty"`
+	// Receipt - подписанная квитанция, есть только в ответе на Deposit и Withdraw.
+	// Проверяется через VerifyReceipt.
+	Receipt *receipt.Receipt `json:"receipt,omitempty"`
+}
+
+// operationRequest повторяет WalletRequest сервера, включая поле valletId.
+type operationRequest struct {
+	WalletID      uuid.UUID `json:"valletId"`
+	OperationType string    `json:"operationType"`
+	Amount        int64     `json:"amount"`
+}
+
+// Client выполняет запросы к API кошелька. Безопасен для одновременного использования.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	timeout    time.Duration
+	maxRetries int
+	backoff    time.Duration
+	newKey     func() string
+	apiKey     string
+	token      string
+
+	// receiptKeys - кэш ключей проверки квитанций для VerifyReceipt.
+	receiptKeysMu sync.Mutex
+	receiptKeys   *receipt.KeySet
+}
+
+// Option настраивает Client.
+type Option func(*Client)
+
+// WithHTTPClient задает http.Client для запросов.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithTimeout ограничивает время одной попытки запроса.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) { c.timeout = d }
+}
+
+// WithRetries задает число повторов после первой попытки и начальную паузу между ними.
+// Пауза удваивается после каждой попытки.
+func WithRetries(maxRetries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.backoff = backoff
+	}
+}
+
+// WithAPIKey задает API ключ, который отправляется в заголовке X-API-Key.
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithBearerToken задает JWT, который отправляется в заголовке Authorization.
+// Если задан и API ключ, сервер проверяет только токен.
+func WithBearerToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithIdempotencyKeyFunc задает генератор ключей идемпотентности (по умолчанию UUID v4).
+func WithIdempotencyKeyFunc(f func() string) Option {
+	return func(c *Client) { c.newKey = f }
+}
+
+// New создает клиент для сервиса по адресу baseURL, например "http://wallet:8080".
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: http.DefaultClient,
+		timeout:    10 * time.Second,
+		maxRetries: 2,
+		backoff:    100 * time.Millisecond,
+		newKey:     uuid.NewString,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Deposit пополняет кошелек, создавая его при необходимости.
+func (c *Client) Deposit(ctx context.Context, walletID uuid.UUID, amount int64) (*Wallet, error) {
+	return c.operation(ctx, walletID, "DEPOSIT", amount)
+}
+
+// Withdraw списывает средства. Возвращает ErrInsufficientBalance или ErrWalletNotFound
+// для соответствующих отказов.
+func (c *Client) Withdraw(ctx context.Context, walletID uuid.UUID, amount int64) (*Wallet, error) {
+	return c.operation(ctx, walletID, "WITHDRAW", amount)
+}
+
+// GetBalance возвращает текущий баланс кошелька.
+func (c *Client) GetBalance(ctx context.Context, walletID uuid.UUID) (*Wallet, error) {
+	var wallet Wallet
+	if err := c.do(ctx, http.MethodGet, "/api/v1/wallets/"+walletID.String(), nil, "", &wallet); err != nil {
+		return nil, err
+	}
+	return &wallet, nil
+}
+
+func (c *Client) operation(ctx context.Context, walletID uuid.UUID, opType string, amount int64) (*Wallet, error) {
+	body, err := json.Marshal(operationRequest{WalletID: walletID, OperationType: opType, Amount: amount})
+	if err != nil {
+		return nil, fmt.Errorf("walletclient: encoding request: %w", err)
+	}
+
+	var wallet Wallet
+	if err := c.do(ctx, http.MethodPost, "/api/v1/wallet", body, c.newKey(), &wallet); err != nil {
+		return nil, err
+	}
+	return &wallet, nil
+}
+
+// do выполняет запрос с повторами. Повторяются только сетевые ошибки, ответы 5xx и 429.
+// Если сервер прислал Retry-After больше текущей паузы, ждем столько, сколько он просит.
+func (c *Client) do(ctx context.Context, method, path string, body []byte, idempotencyKey string, out interface{}) error {
+	backoff := c.backoff
+	var lastErr error
+	for attempt := 0; attempt <= c.maxRetries; attempt++ {
+		if attempt > 0 {
+			wait := backoff
+			var apiErr *APIError
+			if errors.As(lastErr, &apiErr) && apiErr.RetryAfter > wait {
+				wait = apiErr.RetryAfter
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return fmt.Errorf("walletclient: %w (last error: %v)", ctx.Err(), lastErr)
+			case <-timer.C:
+			}
+			backoff *= 2
+		}
+
+		retry, err := c.attempt(ctx, method, path, body, idempotencyKey, out)
+		if err == nil {
+			return nil
+		}
+		if !retry || ctx.Err() != nil {
+			return err
+		}
+		lastErr = err
+	}
+	return lastErr
+}
+
+func (c *Client) attempt(ctx context.Context, method, path string, body []byte, idempotencyKey string, out interface{}) (retry bool, err error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return false, fmt.Errorf("walletclient: building request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("walletclient: %s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return true, fmt.Errorf("walletclient: reading response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr := newAPIError(resp.StatusCode, respBody)
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			apiErr.RetryAfter = time.Duration(seconds) * time.Second
+		}
+		return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, apiErr
+	}
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return false, fmt.Errorf("walletclient: decoding response: %w", err)
+	}
+	return false, nil
+}
+
+// problemBody - поля application/problem+json, которые использует клиент.
+type problemBody struct {
+	Detail    string       `json:"detail"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"requestId"`
+	Errors    []FieldError `json:"errors"`
+}
+
+// newAPIError сопоставляет ответ сервера с типизированной ошибкой по стабильному коду.
+func newAPIError(status int, body []byte) *APIError {
+	e := &APIError{StatusCode: status, Message: strings.TrimSpace(string(body))}
+
+	var p problemBody
+	if err := json.Unmarshal(body, &p); err == nil && p.Code != "" {
+		e.Code = p.Code
+		e.Message = p.Detail
+		e.RequestID = p.RequestID
+		e.FieldErrors = p.Errors
+	}
+
+	switch {
+	case e.Code == "wallet_not_found":
+		e.kind = ErrWalletNotFound
+	case e.Code == "insufficient_balance":
+		e.kind = ErrInsufficientBalance
+	case e.Code == "balance_overflow":
+		e.kind = ErrBalanceOverflow
+	case e.Code == "idempotency_key_reused":
+		e.kind = ErrIdempotencyKeyReused
+	case e.Code == "unauthorized", status == http.StatusUnauthorized:
+		e.kind = ErrUnauthorized
+	case e.Code == "forbidden", status == http.StatusForbidden:
+		e.kind = ErrForbidden
+	case e.Code == "validation_failed", e.Code == "invalid_body":
+		e.kind = ErrInvalidRequest
+	case e.Code == "rate_limited", status == http.StatusTooManyRequests:
+		e.kind = ErrRateLimited
+	case e.Code == "temporarily_unavailable", status == http.StatusServiceUnavailable:
+		e.kind = ErrUnavailable
+	case status >= 500:
+		e.kind = ErrServer
+	case status == http.StatusNotFound:
+		e.kind = ErrWalletNotFound
+	default:
+		e.kind = ErrInvalidRequest
+	}
+	return e
+}
@@ -0,0 +1,223 @@
+package walletclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"test_task_wallet/config"
+	"test_task_wallet/receipt"
+)
+
+func writeProblem(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":      "urn:wallet:problem:" + code,
+		"title":     http.StatusText(status),
+		"status":    status,
+		"code":      code,
+		"detail":    "test",
+		"requestId": "req-1",
+	})
+}
+
+func TestRetriesReuseIdempotencyKey(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		keys []string
+	)
+	walletID := uuid.New()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		attempt := len(keys)
+		mu.Unlock()
+
+		if attempt < 3 {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		var req operationRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		json.NewEncoder(w).Encode(Wallet{ID: req.WalletID, Balance: req.Amount})
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL, WithRetries(3, time.Millisecond))
+	wallet, err := c.Deposit(context.Background(), walletID, 150)
+	require.NoError(t, err)
+	assert.Equal(t, int64(150), wallet.Balance)
+
+	require.Len(t, keys, 3)
+	assert.NotEmpty(t, keys[0])
+	assert.Equal(t, keys[0], keys[1])
+	assert.Equal(t, keys[0], keys[2])
+}
+
+func TestTypedErrors(t *testing.T) {
+	cases := []struct {
+		status int
+		code   string
+		want   error
+	}{
+		{http.StatusBadRequest, "insufficient_balance", ErrInsufficientBalance},
+		{http.StatusUnprocessableEntity, "balance_overflow", ErrBalanceOverflow},
+		{http.StatusNotFound, "wallet_not_found", ErrWalletNotFound},
+		{http.StatusBadRequest, "validation_failed", ErrInvalidRequest},
+		{http.StatusConflict, "idempotency_key_reused", ErrIdempotencyKeyReused},
+		{http.StatusUnauthorized, "unauthorized", ErrUnauthorized},
+		{http.StatusForbidden, "forbidden", ErrForbidden},
+		{http.StatusTooManyRequests, "rate_limited", ErrRateLimited},
+		{http.StatusServiceUnavailable, "temporarily_unavailable", ErrUnavailable},
+		{http.StatusInternalServerError, "internal_error", ErrServer},
+	}
+	for _, tc := range cases {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			writeProblem(w, tc.status, tc.code)
+		}))
+
+		_, err := New(srv.URL, WithRetries(0, 0)).Withdraw(context.Background(), uuid.New(), 10)
+		assert.True(t, errors.Is(err, tc.want), "code %s: got %v", tc.code, err)
+
+		var apiErr *APIError
+		require.True(t, errors.As(err, &apiErr))
+		assert.Equal(t, tc.status, apiErr.StatusCode)
+		assert.Equal(t, tc.code, apiErr.Code)
+		assert.Equal(t, "req-1", apiErr.RequestID)
+		srv.Close()
+	}
+}
+
+func TestCredentialHeaders(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("X-API-Key") + "|" + r.Header.Get("Authorization")
+		json.NewEncoder(w).Encode(Wallet{})
+	}))
+	defer srv.Close()
+
+	_, err := New(srv.URL, WithAPIKey("wk_0123456789ab_secret")).GetBalance(context.Background(), uuid.New())
+	require.NoError(t, err)
+	assert.Equal(t, "wk_0123456789ab_secret|", got)
+
+	_, err = New(srv.URL, WithBearerToken("eyJ.token")).GetBalance(context.Background(), uuid.New())
+	require.NoError(t, err)
+	assert.Equal(t, "|Bearer eyJ.token", got)
+}
+
+func TestRateLimitedHonorsRetryAfter(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "1")
+			writeProblem(w, http.StatusTooManyRequests, "rate_limited")
+			return
+		}
+		json.NewEncoder(w).Encode(Wallet{Balance: 7})
+	}))
+	defer srv.Close()
+
+	start := time.Now()
+	wallet, err := New(srv.URL, WithRetries(1, time.Millisecond)).GetBalance(context.Background(), uuid.New())
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), wallet.Balance)
+	assert.GreaterOrEqual(t, time.Since(start), time.Second, "the retry waits for Retry-After instead of the backoff")
+
+	calls = 0
+	_, err = New(srv.URL, WithRetries(0, 0)).GetBalance(context.Background(), uuid.New())
+	var apiErr *APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.ErrorIs(t, err, ErrRateLimited)
+	assert.Equal(t, time.Second, apiErr.RetryAfter)
+}
+
+func TestClientErrorsAreNotRetried(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		writeProblem(w, http.StatusBadRequest, "insufficient_balance")
+	}))
+	defer srv.Close()
+
+	_, err := New(srv.URL, WithRetries(5, time.Millisecond)).Withdraw(context.Background(), uuid.New(), 10)
+	assert.ErrorIs(t, err, ErrInsufficientBalance)
+	assert.Equal(t, 1, calls)
+}
+
+func TestTimeoutPerAttempt(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer srv.Close()
+
+	start := time.Now()
+	_, err := New(srv.URL, WithTimeout(20*time.Millisecond), WithRetries(1, time.Millisecond)).
+		GetBalance(context.Background(), uuid.New())
+	require.Error(t, err)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestVerifyReceipt(t *testing.T) {
+	oldSigner, err := receipt.NewSigner(config.Receipts{})
+	require.NoError(t, err)
+	newSigner, err := receipt.NewSigner(config.Receipts{})
+	require.NoError(t, err)
+
+	var (
+		mu      sync.Mutex
+		signer  = oldSigner
+		fetches int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, ReceiptKeysPath, r.URL.Path)
+		mu.Lock()
+		defer mu.Unlock()
+		fetches++
+		signer.ServeKeys(w, r)
+	}))
+	defer srv.Close()
+
+	sign := func(s *receipt.Signer) *receipt.Receipt {
+		r := &receipt.Receipt{TransactionID: uuid.New(), WalletID: uuid.New(), OperationType: "DEPOSIT",
+			Amount: 10, Balance: 10, Timestamp: time.Now()}
+		require.NoError(t, s.Sign(r))
+		return r
+	}
+
+	c := New(srv.URL)
+	ctx := context.Background()
+	require.NoError(t, c.VerifyReceipt(ctx, sign(oldSigner)))
+	require.NoError(t, c.VerifyReceipt(ctx, sign(oldSigner)))
+	assert.Equal(t, 1, fetches, "keys are cached")
+
+	forged := sign(oldSigner)
+	forged.Amount = 1000
+	assert.ErrorIs(t, c.VerifyReceipt(ctx, forged), receipt.ErrInvalidSignature)
+	assert.Equal(t, 1, fetches, "a bad signature with a known key does not refetch keys")
+
+	// После смены ключа на сервере клиент перечитывает ключи.
+	mu.Lock()
+	signer = newSigner
+	mu.Unlock()
+	require.NoError(t, c.VerifyReceipt(ctx, sign(newSigner)))
+	assert.Equal(t, 2, fetches)
+
+	stranger, err := receipt.NewSigner(config.Receipts{})
+	require.NoError(t, err)
+	assert.ErrorIs(t, c.VerifyReceipt(ctx, sign(stranger)), receipt.ErrUnknownKey)
+}
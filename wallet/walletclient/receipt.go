@@ -0,0 +1,44 @@
+package walletclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"test_task_wallet/receipt"
+)
+
+// ReceiptKeysPath - адрес опубликованных ключей проверки квитанций.
+const ReceiptKeysPath = "/.well-known/wallet-receipt-keys"
+
+// ReceiptKeys загружает открытые ключи проверки квитанций. Набор можно сохранить
+// (он сериализуется в JSON) и проверять квитанции без доступа к сервису через receipt.Receipt.Verify.
+func (c *Client) ReceiptKeys(ctx context.Context) (*receipt.KeySet, error) {
+	var keys receipt.KeySet
+	if err := c.do(ctx, http.MethodGet, ReceiptKeysPath, nil, "", &keys); err != nil {
+		return nil, err
+	}
+	return &keys, nil
+}
+
+// VerifyReceipt проверяет подпись квитанции ключами сервиса. Ключи загружаются
+// при первом вызове и перезагружаются, если квитанция подписана неизвестным ключом
+// (например, после смены ключа на сервере).
+// Возвращает receipt.ErrInvalidSignature или receipt.ErrUnknownKey, если квитанция не подтверждена.
+func (c *Client) VerifyReceipt(ctx context.Context, r *receipt.Receipt) error {
+	c.receiptKeysMu.Lock()
+	defer c.receiptKeysMu.Unlock()
+
+	if c.receiptKeys != nil {
+		err := r.Verify(c.receiptKeys)
+		if !errors.Is(err, receipt.ErrUnknownKey) {
+			return err
+		}
+	}
+	keys, err := c.ReceiptKeys(ctx)
+	if err != nil {
+		return err
+	}
+	c.receiptKeys = keys
+	return r.Verify(keys)
+}
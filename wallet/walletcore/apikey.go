@@ -0,0 +1,421 @@
+package walletcore
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Scope - право, выданное API ключу.
+type Scope string
+
+const (
+	ScopeRead     Scope = "read"
+	ScopeDeposit  Scope = "deposit"
+	ScopeWithdraw Scope = "withdraw"
+	// ScopeAdmin разрешает управление ключами и включает все остальные права.
+	ScopeAdmin Scope = "admin"
+)
+
+// AllScopes - все известные права.
+var AllScopes = []Scope{ScopeRead, ScopeDeposit, ScopeWithdraw, ScopeAdmin}
+
+// ScopeFor возвращает право, необходимое для операции. Перевод списывает средства, поэтому требует withdraw.
+func ScopeFor(op OperationType) Scope {
+	if op == Withdraw || op == Transfer {
+		return ScopeWithdraw
+	}
+	return ScopeDeposit
+}
+
+// Ошибки API ключей.
+var (
+	ErrAPIKeyNotFound = errors.New("api key not found")
+	// ErrInvalidAPIKey возвращается для неизвестных, отозванных и искаженных ключей.
+	// Причина намеренно не уточняется.
+	ErrInvalidAPIKey = errors.New("invalid api key")
+)
+
+// apiKeyPrefix - начало каждого ключа. Упрощает поиск утекших ключей в коде и логах.
+const apiKeyPrefix = "wk_"
+
+// MaxAPIKeyNameLength - максимальная длина имени ключа.
+const MaxAPIKeyNameLength = 100
+
+// APIKey - ключ сервиса-клиента. Секретная часть хранится только в виде хеша.
+type APIKey struct {
+	ID   uuid.UUID `json:"id"`
+	Name string    `json:"name"`
+	// Client - клиент, которому выдан ключ. Не меняется при ротации и общий у всех ключей
+	// клиента, поэтому операции клиента (например, его внешние ссылки) не зависят от того,
+	// каким ключом они выполнены. По умолчанию - ID ключа.
+	Client    string     `json:"client"`
+	Prefix    string     `json:"prefix"` // Открытая часть ключа, по которой его можно узнать
+	Scopes    []Scope    `json:"scopes"`
+	CreatedAt time.Time  `json:"createdAt"`
+	RotatedAt *time.Time `json:"rotatedAt,omitempty"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+// Allows сообщает, есть ли у ключа право scope. ScopeAdmin включает все права.
+func (k *APIKey) Allows(scope Scope) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientID возвращает идентификатор клиента ключа для учета (см. auth.ClientID).
+func (k *APIKey) ClientID() string {
+	return "key:" + k.Client
+}
+
+// Revoked сообщает, отозван ли ключ.
+func (k *APIKey) Revoked() bool {
+	return k.RevokedAt != nil
+}
+
+// ParseScopes проверяет список прав и убирает повторы.
+func ParseScopes(values []string) ([]Scope, error) {
+	if len(values) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+	seen := make(map[Scope]bool, len(values))
+	var scopes []Scope
+	for _, v := range values {
+		s := Scope(v)
+		known := false
+		for _, k := range AllScopes {
+			known = known || s == k
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown scope %q", v)
+		}
+		if !seen[s] {
+			seen[s] = true
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes, nil
+}
+
+// newAPIKeySecret создает ключ вида wk_<prefix>_<secret> и возвращает его вместе с prefix.
+func newAPIKeySecret() (plaintext, prefix string, err error) {
+	buf := make([]byte, 6+32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", fmt.Errorf("error generating api key: %w", err)
+	}
+	prefix = hex.EncodeToString(buf[:6])
+	return apiKeyPrefix + prefix + "_" + base64.RawURLEncoding.EncodeToString(buf[6:]), prefix, nil
+}
+
+// parseAPIKey возвращает prefix ключа или false, если строка не похожа на ключ.
+func parseAPIKey(plaintext string) (string, bool) {
+	rest, ok := strings.CutPrefix(plaintext, apiKeyPrefix)
+	if !ok {
+		return "", false
+	}
+	prefix, secret, ok := strings.Cut(rest, "_")
+	if !ok || len(prefix) != 12 || secret == "" {
+		return "", false
+	}
+	if _, err := hex.DecodeString(prefix); err != nil {
+		return "", false
+	}
+	return prefix, true
+}
+
+// hashAPIKey - SHA-256 от ключа целиком. Ключи случайные и длинные,
+// поэтому медленный хеш для паролей здесь не нужен.
+func hashAPIKey(plaintext string) []byte {
+	sum := sha256.Sum256([]byte(plaintext))
+	return sum[:]
+}
+
+// validateAPIKeyRequest проверяет имя, клиента и права нового ключа.
+func validateAPIKeyRequest(name, client string, scopes []string) ([]Scope, error) {
+	var errs ValidationErrors
+	name = strings.TrimSpace(name)
+	if name == "" {
+		errs = append(errs, FieldError{Field: "name", Message: "name is required"})
+	} else if len(name) > MaxAPIKeyNameLength {
+		errs = append(errs, FieldError{Field: "name", Message: fmt.Sprintf("name must be at most %d characters", MaxAPIKeyNameLength)})
+	}
+	if len(client) > MaxAPIKeyNameLength || (client != "" && !printable(client)) {
+		errs = append(errs, FieldError{Field: "client",
+			Message: fmt.Sprintf("client must be at most %d characters without spaces or control characters", MaxAPIKeyNameLength)})
+	}
+	parsed, err := ParseScopes(scopes)
+	if err != nil {
+		errs = append(errs, FieldError{Field: "scopes", Message: err.Error()})
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidRequest, errs)
+	}
+	return parsed, nil
+}
+
+// IssueAPIKey создает ключ клиента client; пустой client - новый клиент с ID ключа.
+// Открытый ключ возвращается только здесь, сохранить его должен вызывающий.
+func (s *Service) IssueAPIKey(ctx context.Context, name, client string, scopes []string) (*APIKey, string, error) {
+	parsed, err := validateAPIKeyRequest(name, client, scopes)
+	if err != nil {
+		return nil, "", err
+	}
+	plaintext, prefix, err := newAPIKeySecret()
+	if err != nil {
+		return nil, "", err
+	}
+	key := &APIKey{ID: uuid.New(), Name: strings.TrimSpace(name), Client: client, Prefix: prefix, Scopes: parsed}
+	if key.Client == "" {
+		key.Client = key.ID.String()
+	}
+	if err := s.db.InsertAPIKey(ctx, key, hashAPIKey(plaintext)); err != nil {
+		return nil, "", err
+	}
+	slog.InfoContext(ctx, "API key issued", "key_id", key.ID, "key_name", key.Name, "client", key.Client)
+	return key, plaintext, nil
+}
+
+// EnsureAPIKey регистрирует заранее известный ключ, если его еще нет.
+// Используется для первого ключа администратора из конфигурации. Если ключ с тем же
+// префиксом уже зарегистрирован с другим секретом, возвращает ErrInvalidAPIKey: иначе
+// сервис запустился бы с ключом, который не проходит аутентификацию.
+func (s *Service) EnsureAPIKey(ctx context.Context, name, plaintext string, scopes []Scope) error {
+	prefix, ok := parseAPIKey(plaintext)
+	if !ok {
+		return fmt.Errorf("%w: expected format %s<12 hex chars>_<secret>", ErrInvalidAPIKey, apiKeyPrefix)
+	}
+	existing, hash, err := s.db.GetAPIKeyByPrefix(ctx, prefix)
+	switch {
+	case err == nil:
+		if subtle.ConstantTimeCompare(hash, hashAPIKey(plaintext)) != 1 {
+			return fmt.Errorf("%w: key with prefix %s is already registered with a different secret", ErrInvalidAPIKey, prefix)
+		}
+		if existing.Revoked() {
+			slog.WarnContext(ctx, "Configured API key is revoked", "key_id", existing.ID)
+		}
+		return nil
+	case !errors.Is(err, ErrAPIKeyNotFound):
+		return err
+	}
+	key := &APIKey{ID: uuid.New(), Name: name, Prefix: prefix, Scopes: scopes}
+	key.Client = key.ID.String()
+	if err := s.db.InsertAPIKey(ctx, key, hashAPIKey(plaintext)); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "API key registered from configuration", "key_id", key.ID, "key_name", key.Name)
+	return nil
+}
+
+// RotateAPIKey выдает ключу новый секрет. ID, имя, клиент и права сохраняются,
+// поэтому история операций остается привязанной к тому же клиенту. Старый секрет сразу перестает работать.
+func (s *Service) RotateAPIKey(ctx context.Context, id uuid.UUID) (*APIKey, string, error) {
+	plaintext, prefix, err := newAPIKeySecret()
+	if err != nil {
+		return nil, "", err
+	}
+	key, err := s.db.RotateAPIKey(ctx, id, prefix, hashAPIKey(plaintext))
+	if err != nil {
+		return nil, "", err
+	}
+	slog.InfoContext(ctx, "API key rotated", "key_id", key.ID)
+	return key, plaintext, nil
+}
+
+// RevokeAPIKey отзывает ключ. Повторный отзыв не считается ошибкой.
+func (s *Service) RevokeAPIKey(ctx context.Context, id uuid.UUID) (*APIKey, error) {
+	key, err := s.db.RevokeAPIKey(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	slog.InfoContext(ctx, "API key revoked", "key_id", key.ID)
+	return key, nil
+}
+
+// ListAPIKeys возвращает все ключи, включая отозванные.
+func (s *Service) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	return s.db.ListAPIKeys(ctx)
+}
+
+// AuthenticateAPIKey находит действующий ключ по его открытому значению.
+// Для любого неподходящего ключа возвращает ErrInvalidAPIKey.
+func (s *Service) AuthenticateAPIKey(ctx context.Context, plaintext string) (*APIKey, error) {
+	prefix, ok := parseAPIKey(plaintext)
+	if !ok {
+		return nil, ErrInvalidAPIKey
+	}
+	key, hash, err := s.db.GetAPIKeyByPrefix(ctx, prefix)
+	if err != nil {
+		if errors.Is(err, ErrAPIKeyNotFound) {
+			return nil, ErrInvalidAPIKey
+		}
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(hash, hashAPIKey(plaintext)) != 1 || key.Revoked() {
+		return nil, ErrInvalidAPIKey
+	}
+	return key, nil
+}
+
+const apiKeyColumns = `id, name, client, prefix, scopes, created_at, rotated_at, revoked_at`
+
+// scanAPIKey читает колонки apiKeyColumns и, если передан hash, key_hash после них.
+func scanAPIKey(row interface{ Scan(...any) error }, hash *[]byte) (*APIKey, error) {
+	var (
+		k      APIKey
+		scopes pq.StringArray
+	)
+	dest := []any{&k.ID, &k.Name, &k.Client, &k.Prefix, &scopes, &k.CreatedAt, &k.RotatedAt, &k.RevokedAt}
+	if hash != nil {
+		dest = append(dest, hash)
+	}
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	for _, s := range scopes {
+		k.Scopes = append(k.Scopes, Scope(s))
+	}
+	return &k, nil
+}
+
+func scopeStrings(scopes []Scope) pq.StringArray {
+	out := make(pq.StringArray, len(scopes))
+	for i, s := range scopes {
+		out[i] = string(s)
+	}
+	return out
+}
+
+// InsertAPIKey сохраняет новый ключ и заполняет CreatedAt.
+func (s *DBService) InsertAPIKey(ctx context.Context, key *APIKey, hash []byte) (err error) {
+	const query = `INSERT INTO api_keys (id, name, client, prefix, key_hash, scopes) VALUES ($1, $2, $3, $4, $5, $6) RETURNING created_at`
+	ctx, span := startDBSpan(ctx, "DBService.InsertAPIKey", "INSERT", query)
+	defer func() { endSpan(span, err) }()
+
+	qctx, cancel := s.withStatementTimeout(ctx)
+	defer cancel()
+
+	err = s.DB.QueryRowContext(qctx, query, key.ID, key.Name, key.Client, key.Prefix, hash, scopeStrings(key.Scopes)).Scan(&key.CreatedAt)
+	if err != nil {
+		return s.classify(ctx, fmt.Errorf("failed to insert api key: %w", err))
+	}
+	return nil
+}
+
+// GetAPIKey возвращает ключ по ID внутри транзакции tx. ErrAPIKeyNotFound, если ключа нет.
+func (s *DBService) GetAPIKey(ctx context.Context, tx *sql.Tx, id uuid.UUID) (_ *APIKey, err error) {
+	const query = `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE id = $1`
+	ctx, span := startDBSpan(ctx, "DBService.GetAPIKey", "SELECT", query)
+	defer func() { endSpan(span, err) }()
+
+	key, err := scanAPIKey(tx.QueryRowContext(ctx, query, id), nil)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrAPIKeyNotFound
+		}
+		return nil, s.classify(ctx, fmt.Errorf("failed to get api key: %w", err))
+	}
+	return key, nil
+}
+
+// GetAPIKeyByPrefix возвращает ключ и его хеш. ErrAPIKeyNotFound, если ключа нет.
+func (s *DBService) GetAPIKeyByPrefix(ctx context.Context, prefix string) (_ *APIKey, _ []byte, err error) {
+	const query = `SELECT ` + apiKeyColumns + `, key_hash FROM api_keys WHERE prefix = $1`
+	ctx, span := startDBSpan(ctx, "DBService.GetAPIKeyByPrefix", "SELECT", query)
+	defer func() { endSpan(span, err) }()
+
+	qctx, cancel := s.withStatementTimeout(ctx)
+	defer cancel()
+
+	var hash []byte
+	key, err := scanAPIKey(s.DB.QueryRowContext(qctx, query, prefix), &hash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, ErrAPIKeyNotFound
+		}
+		return nil, nil, s.classify(ctx, fmt.Errorf("failed to load api key: %w", err))
+	}
+	return key, hash, nil
+}
+
+// ListAPIKeys возвращает ключи в порядке создания.
+func (s *DBService) ListAPIKeys(ctx context.Context) (_ []APIKey, err error) {
+	const query = `SELECT ` + apiKeyColumns + ` FROM api_keys ORDER BY created_at, id`
+	ctx, span := startDBSpan(ctx, "DBService.ListAPIKeys", "SELECT", query)
+	defer func() { endSpan(span, err) }()
+
+	qctx, cancel := s.withStatementTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.DB.QueryContext(qctx, query)
+	if err != nil {
+		return nil, s.classify(ctx, fmt.Errorf("failed to list api keys: %w", err))
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan api key: %w", err)
+		}
+		keys = append(keys, *key)
+	}
+	return keys, s.classify(ctx, rows.Err())
+}
+
+// RotateAPIKey заменяет prefix и хеш действующего ключа.
+// Для отозванного или несуществующего ключа возвращает ErrAPIKeyNotFound.
+func (s *DBService) RotateAPIKey(ctx context.Context, id uuid.UUID, prefix string, hash []byte) (_ *APIKey, err error) {
+	const query = `UPDATE api_keys SET prefix = $2, key_hash = $3, rotated_at = NOW()
+         WHERE id = $1 AND revoked_at IS NULL RETURNING ` + apiKeyColumns
+	ctx, span := startDBSpan(ctx, "DBService.RotateAPIKey", "UPDATE", query)
+	defer func() { endSpan(span, err) }()
+
+	qctx, cancel := s.withStatementTimeout(ctx)
+	defer cancel()
+
+	key, err := scanAPIKey(s.DB.QueryRowContext(qctx, query, id, prefix, hash), nil)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrAPIKeyNotFound
+		}
+		return nil, s.classify(ctx, fmt.Errorf("failed to rotate api key: %w", err))
+	}
+	return key, nil
+}
+
+// RevokeAPIKey помечает ключ отозванным. Время первого отзыва сохраняется.
+func (s *DBService) RevokeAPIKey(ctx context.Context, id uuid.UUID) (_ *APIKey, err error) {
+	const query = `UPDATE api_keys SET revoked_at = COALESCE(revoked_at, NOW())
+         WHERE id = $1 RETURNING ` + apiKeyColumns
+	ctx, span := startDBSpan(ctx, "DBService.RevokeAPIKey", "UPDATE", query)
+	defer func() { endSpan(span, err) }()
+
+	qctx, cancel := s.withStatementTimeout(ctx)
+	defer cancel()
+
+	key, err := scanAPIKey(s.DB.QueryRowContext(qctx, query, id), nil)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrAPIKeyNotFound
+		}
+		return nil, s.classify(ctx, fmt.Errorf("failed to revoke api key: %w", err))
+	}
+	return key, nil
+}
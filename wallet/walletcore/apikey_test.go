@@ -0,0 +1,56 @@
+package walletcore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIKeyFormat(t *testing.T) {
+	plaintext, prefix, err := newAPIKeySecret()
+	require.NoError(t, err)
+
+	parsed, ok := parseAPIKey(plaintext)
+	require.True(t, ok, "generated key %q must parse", plaintext)
+	assert.Equal(t, prefix, parsed)
+	assert.Len(t, hashAPIKey(plaintext), 32)
+
+	other, _, err := newAPIKeySecret()
+	require.NoError(t, err)
+	assert.NotEqual(t, plaintext, other)
+
+	for _, bad := range []string{"", "wk_", "wk_short_secret", "sk_0123456789ab_secret", "wk_0123456789zz_secret", "wk_0123456789ab_"} {
+		_, ok := parseAPIKey(bad)
+		assert.False(t, ok, "%q must be rejected", bad)
+	}
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	key := &APIKey{Scopes: []Scope{ScopeRead, ScopeDeposit}}
+	assert.True(t, key.Allows(ScopeFor(Deposit)))
+	assert.False(t, key.Allows(ScopeFor(Withdraw)))
+	assert.False(t, key.Allows(ScopeAdmin))
+
+	admin := &APIKey{Scopes: []Scope{ScopeAdmin}}
+	assert.True(t, admin.Allows(ScopeWithdraw), "admin implies every scope")
+
+	scopes, err := ParseScopes([]string{"read", "read", "withdraw"})
+	require.NoError(t, err)
+	assert.Equal(t, []Scope{ScopeRead, ScopeWithdraw}, scopes)
+
+	_, err = ParseScopes([]string{"root"})
+	assert.Error(t, err)
+	_, err = ParseScopes(nil)
+	assert.Error(t, err)
+}
+
+func TestIssueAPIKeyValidatesBeforeTouchingDB(t *testing.T) {
+	svc := NewService(nil)
+	_, _, err := svc.IssueAPIKey(t.Context(), " ", "acme billing", []string{"superuser"})
+	require.ErrorIs(t, err, ErrInvalidRequest)
+
+	var fields ValidationErrors
+	require.ErrorAs(t, err, &fields)
+	assert.Len(t, fields, 3)
+}
@@ -0,0 +1,292 @@
+package walletcore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/uuid"
+)
+
+// Цепочка хэшей делает правку истории операций заметной: каждая запись хранит
+// SHA-256 своего содержимого и хэша предыдущей записи того же кошелька,
+// а кошелек - хэш последней записи. Изменение суммы, удаление или вставка записи
+// ломают цепочку начиная с этого места, что находит VerifyChain.
+//
+// Хэш не содержит секрета, поэтому не защищает от того, кто пересчитает всю цепочку
+// после правки; он защищает от точечного изменения данных в обход сервиса.
+
+// chainHashVersion - версия формата хэша для новых записей. Меняется, если в хэш
+// добавляются поля; версия хранится в каждой записи (chain_version), поэтому записи
+// старых версий проверяются по своему формату.
+//
+//	1 - ID, кошелек, номер в цепочке, тип, сумма, время, API ключ, предыдущий хэш;
+//	2 - плюс связанная операция (related_transaction_id);
+//	3 - плюс клиент (client_id) и описание операции: description, external_reference,
+//	    tags, metadata.
+//
+// Так в хэш входят все колонки записи, кроме служебных полей самой цепочки.
+const chainHashVersion = 3
+
+// chainHash считает хэш записи в формате t.ChainVersion (0 - первая версия): версия, ID,
+// кошелек, номер в цепочке, тип, сумма, время в микросекундах, API ключ и хэш предыдущей
+// записи, со второй версии - связанная операция, с третьей - клиент и описание операции.
+// Поля фиксированной длины идут без разделителей, строки - с префиксом длины,
+// метки - с префиксом их числа.
+func (t *Transaction) chainHash() []byte {
+	version := t.ChainVersion
+	if version == 0 {
+		version = 1
+	}
+	h := sha256.New()
+	h.Write([]byte{byte(version)})
+	h.Write(t.ID[:])
+	h.Write(t.WalletID[:])
+	binary.Write(h, binary.BigEndian, t.Seq)
+	binary.Write(h, binary.BigEndian, uint16(len(t.Type)))
+	h.Write([]byte(t.Type))
+	binary.Write(h, binary.BigEndian, t.Amount)
+	binary.Write(h, binary.BigEndian, t.Timestamp.UnixMicro())
+	var apiKeyID uuid.UUID
+	if t.APIKeyID != nil {
+		apiKeyID = *t.APIKeyID
+	}
+	h.Write(apiKeyID[:])
+	prev := make([]byte, sha256.Size)
+	copy(prev, t.PrevHash)
+	h.Write(prev)
+	if version >= 2 {
+		var relatedID uuid.UUID
+		if t.RelatedID != nil {
+			relatedID = *t.RelatedID
+		}
+		h.Write(relatedID[:])
+	}
+	if version >= 3 {
+		writeChainString(h, t.ClientID)
+		writeChainString(h, t.Description)
+		writeChainString(h, t.ExternalReference)
+		binary.Write(h, binary.BigEndian, uint32(len(t.Tags)))
+		for _, tag := range t.Tags {
+			writeChainString(h, tag)
+		}
+		writeChainString(h, string(t.Metadata))
+	}
+	return h.Sum(nil)
+}
+
+// writeChainString пишет в хэш строку с префиксом длины.
+func writeChainString(w io.Writer, s string) {
+	binary.Write(w, binary.BigEndian, uint32(len(s)))
+	io.WriteString(w, s)
+}
+
+// signedAmount - изменение баланса от операции.
+func (t *Transaction) signedAmount() int64 {
+	if t.Type.IsDebit() {
+		return -t.Amount
+	}
+	return t.Amount
+}
+
+// ChainBreak - первое найденное нарушение цепочки.
+type ChainBreak struct {
+	// TransactionID и Seq - запись, на которой цепочка разорвана.
+	// Пусты, если нарушение касается кошелька целиком (хэш последней записи или баланс).
+	TransactionID uuid.UUID
+	Seq           int64
+	Reason        string
+}
+
+func (b *ChainBreak) String() string {
+	if b.TransactionID == uuid.Nil {
+		return b.Reason
+	}
+	return fmt.Sprintf("transaction %s (seq %d): %s", b.TransactionID, b.Seq, b.Reason)
+}
+
+// ChainReport - результат проверки цепочки кошелька.
+type ChainReport struct {
+	WalletID uuid.UUID
+	// Verified - сколько записей цепочки проверено до разрыва.
+	Verified int64
+	// Legacy - записи, сделанные до появления цепочки. Они не проверяются.
+	Legacy int64
+	// Break - первое нарушение, nil если цепочка цела.
+	Break *ChainBreak
+}
+
+// OK сообщает, что цепочка цела.
+func (r *ChainReport) OK() bool {
+	return r.Break == nil
+}
+
+// chainVerifier проходит записи кошелька по порядку цепочки и запоминает первый разрыв.
+type chainVerifier struct {
+	report  *ChainReport
+	prev    []byte
+	balance int64
+}
+
+func newChainVerifier(walletID uuid.UUID) *chainVerifier {
+	return &chainVerifier{report: &ChainReport{WalletID: walletID}}
+}
+
+// add проверяет очередную запись. Записи до появления цепочки (Seq == 0) идут первыми.
+func (v *chainVerifier) add(t Transaction) {
+	if v.report.Break != nil {
+		return
+	}
+	if t.Seq == 0 {
+		v.report.Legacy++
+		return
+	}
+	fail := func(reason string) {
+		v.report.Break = &ChainBreak{TransactionID: t.ID, Seq: t.Seq, Reason: reason}
+	}
+	switch want := v.report.Verified + 1; {
+	case t.Seq != want:
+		fail(fmt.Sprintf("expected seq %d, the record before it is missing", want))
+	case t.ChainVersion > chainHashVersion:
+		fail(fmt.Sprintf("unknown chain hash version %d", t.ChainVersion))
+	case !bytes.Equal(t.PrevHash, v.prev):
+		fail("prev_hash does not match the hash of the previous record")
+	case !bytes.Equal(t.Hash, t.chainHash()):
+		fail("hash does not match the record contents")
+	default:
+		v.prev = t.Hash
+		v.balance += t.signedAmount()
+		v.report.Verified++
+	}
+}
+
+// finish сверяет конец цепочки с кошельком: хэш последней записи и, если все
+// операции кошелька в цепочке, баланс.
+func (v *chainVerifier) finish(head []byte, balance int64) *ChainReport {
+	if v.report.Break != nil {
+		return v.report
+	}
+	switch {
+	case !bytes.Equal(head, v.prev):
+		v.report.Break = &ChainBreak{Reason: "wallet chain head does not match the last record, records were removed from the end"}
+	case v.report.Legacy == 0 && balance != v.balance:
+		v.report.Break = &ChainBreak{Reason: fmt.Sprintf("wallet balance %d does not match the sum of its transactions %d", balance, v.balance)}
+	}
+	return v.report
+}
+
+// VerifyChain проверяет цепочку хэшей кошелька и возвращает первый разрыв.
+// Возвращает ErrWalletNotFound, если кошелька нет.
+func (s *Service) VerifyChain(ctx context.Context, walletID uuid.UUID) (*ChainReport, error) {
+	v := newChainVerifier(walletID)
+	balance, head, err := s.db.ScanTransactionChain(ctx, walletID, func(t Transaction) error {
+		v.add(t)
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrWalletNotFound
+		}
+		return nil, fmt.Errorf("error reading transaction chain of wallet %s: %w", walletID, err)
+	}
+	return v.finish(head, balance), nil
+}
+
+// WalletIDs возвращает ID всех кошельков, например для проверки всех цепочек.
+func (s *Service) WalletIDs(ctx context.Context) ([]uuid.UUID, error) {
+	return s.db.ListWalletIDs(ctx)
+}
+
+// ScanTransactionChain передает fn все записи кошелька в порядке цепочки: сначала записи
+// без цепочки по времени, затем по chain_seq. Возвращает баланс кошелька и хэш последней
+// записи цепочки. Кошелек и записи читаются из одного снимка (REPEATABLE READ), поэтому
+// операции, зафиксированные во время проверки, не выглядят разрывом цепочки.
+// Если кошелька нет, возвращает sql.ErrNoRows.
+// Запрос не ограничен statement_timeout: у кошелька может быть длинная история.
+func (s *DBService) ScanTransactionChain(ctx context.Context, walletID uuid.UUID, fn func(Transaction) error) (_ int64, _ []byte, err error) {
+	const (
+		headQuery = `SELECT balance, chain_head FROM wallets WHERE id = $1`
+		query     = `SELECT id, wallet_id, operation_type, amount, timestamp, api_key_id, related_transaction_id,
+            chain_seq, chain_version, prev_hash, hash, client_id, description, external_reference, tags, metadata
+         FROM transactions WHERE wallet_id = $1 ORDER BY chain_seq NULLS FIRST, timestamp, id`
+	)
+	ctx, span := startDBSpan(ctx, "DBService.ScanTransactionChain", "SELECT", query)
+	defer func() { endSpan(span, err) }()
+
+	tx, err := s.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return 0, nil, s.classify(ctx, fmt.Errorf("error beginning chain transaction: %w", err))
+	}
+	defer tx.Rollback()
+
+	var balance int64
+	var head []byte
+	if err = tx.QueryRowContext(ctx, headQuery, walletID).Scan(&balance, &head); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil, err
+		}
+		return 0, nil, s.classify(ctx, fmt.Errorf("failed to read wallet chain head: %w", err))
+	}
+
+	rows, err := tx.QueryContext(ctx, query, walletID)
+	if err != nil {
+		return 0, nil, s.classify(ctx, fmt.Errorf("failed to read transaction chain: %w", err))
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t Transaction
+		var apiKeyID, relatedID uuid.NullUUID
+		var seq, version sql.NullInt64
+		var clientID sql.NullString
+		var details detailsColumns
+		dest := append([]any{&t.ID, &t.WalletID, &t.Type, &t.Amount, &t.Timestamp, &apiKeyID, &relatedID,
+			&seq, &version, &t.PrevHash, &t.Hash, &clientID}, details.dest()...)
+		if err := rows.Scan(dest...); err != nil {
+			return 0, nil, fmt.Errorf("failed to scan transaction: %w", err)
+		}
+		if apiKeyID.Valid {
+			t.APIKeyID = &apiKeyID.UUID
+		}
+		if relatedID.Valid {
+			t.RelatedID = &relatedID.UUID
+		}
+		t.Seq, t.ChainVersion = seq.Int64, int(version.Int64)
+		t.ClientID, t.Details = clientID.String, details.details()
+		if err := fn(t); err != nil {
+			return 0, nil, err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return 0, nil, s.classify(ctx, err)
+	}
+	return balance, head, nil
+}
+
+// ListWalletIDs возвращает ID всех кошельков.
+func (s *DBService) ListWalletIDs(ctx context.Context) (_ []uuid.UUID, err error) {
+	const query = `SELECT id FROM wallets ORDER BY created_at, id`
+	ctx, span := startDBSpan(ctx, "DBService.ListWalletIDs", "SELECT", query)
+	defer func() { endSpan(span, err) }()
+
+	rows, err := s.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, s.classify(ctx, fmt.Errorf("failed to list wallets: %w", err))
+	}
+	defer rows.Close()
+
+	var ids []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan wallet ID: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, s.classify(ctx, rows.Err())
+}
@@ -0,0 +1,152 @@
+package walletcore
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// buildChain собирает цепочку записей так же, как AddTransactionRecord.
+func buildChain(walletID uuid.UUID, amounts ...int64) []Transaction {
+	var chain []Transaction
+	var prev []byte
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, amount := range amounts {
+		t := Transaction{ID: uuid.New(), WalletID: walletID, Type: Deposit, Amount: amount,
+			Timestamp: start.Add(time.Duration(i) * time.Second), Seq: int64(i + 1), PrevHash: prev,
+			ChainVersion: chainHashVersion}
+		if amount < 0 {
+			t.Type, t.Amount = Withdraw, -amount
+		}
+		t.Hash = t.chainHash()
+		prev = t.Hash
+		chain = append(chain, t)
+	}
+	return chain
+}
+
+func verify(walletID uuid.UUID, chain []Transaction, head []byte, balance int64) *ChainReport {
+	v := newChainVerifier(walletID)
+	for _, t := range chain {
+		v.add(t)
+	}
+	return v.finish(head, balance)
+}
+
+func TestChainHashCoversContents(t *testing.T) {
+	base := buildChain(uuid.New(), 100)[0]
+	keyID := uuid.New()
+	changes := map[string]func(*Transaction){
+		"amount":    func(t *Transaction) { t.Amount++ },
+		"type":      func(t *Transaction) { t.Type = Withdraw },
+		"timestamp": func(t *Transaction) { t.Timestamp = t.Timestamp.Add(time.Microsecond) },
+		"wallet":    func(t *Transaction) { t.WalletID = uuid.New() },
+		"seq":       func(t *Transaction) { t.Seq++ },
+		"api key":   func(t *Transaction) { t.APIKeyID = &keyID },
+		"prev hash": func(t *Transaction) { t.PrevHash = make([]byte, 32); t.PrevHash[0] = 1 },
+		"related":   func(t *Transaction) { id := uuid.New(); t.RelatedID = &id },
+		"version":   func(t *Transaction) { t.ChainVersion = 1 },
+		"client":    func(t *Transaction) { t.ClientID = "sub:mallory" },
+		"desc":      func(t *Transaction) { t.Description = "refund" },
+		"reference": func(t *Transaction) { t.ExternalReference = "order-2" },
+		"tags":      func(t *Transaction) { t.Tags = []string{"a", "b"} },
+		"metadata":  func(t *Transaction) { t.Metadata = json.RawMessage(`{"a": 2}`) },
+	}
+	for name, change := range changes {
+		changed := base
+		change(&changed)
+		assert.NotEqual(t, base.Hash, changed.chainHash(), "hash must change with %s", name)
+	}
+	assert.Equal(t, base.Hash, base.chainHash(), "hash is deterministic")
+}
+
+func TestChainVerifier(t *testing.T) {
+	walletID := uuid.New()
+	chain := buildChain(walletID, 100, -30, 50)
+	head := chain[2].Hash
+
+	report := verify(walletID, chain, head, 120)
+	require.True(t, report.OK(), "intact chain: %v", report.Break)
+	assert.Equal(t, int64(3), report.Verified)
+
+	t.Run("tampered amount", func(t *testing.T) {
+		tampered := append([]Transaction(nil), chain...)
+		tampered[1].Amount = 10
+		report := verify(walletID, tampered, head, 140)
+		require.False(t, report.OK())
+		assert.Equal(t, chain[1].ID, report.Break.TransactionID)
+		assert.Equal(t, int64(1), report.Verified)
+	})
+
+	t.Run("deleted record", func(t *testing.T) {
+		report := verify(walletID, []Transaction{chain[0], chain[2]}, head, 150)
+		require.False(t, report.OK())
+		assert.Equal(t, chain[2].ID, report.Break.TransactionID)
+		assert.Contains(t, report.Break.Reason, "expected seq 2")
+	})
+
+	t.Run("deleted last record", func(t *testing.T) {
+		report := verify(walletID, chain[:2], head, 70)
+		require.False(t, report.OK())
+		assert.Equal(t, uuid.Nil, report.Break.TransactionID)
+		assert.Contains(t, report.Break.Reason, "chain head")
+	})
+
+	t.Run("rehashed record", func(t *testing.T) {
+		// Запись пересчитана целиком, но следующая ссылается на старый хэш.
+		tampered := append([]Transaction(nil), chain...)
+		tampered[0].Amount = 1000
+		tampered[0].Hash = tampered[0].chainHash()
+		report := verify(walletID, tampered, head, 1020)
+		require.False(t, report.OK())
+		assert.Equal(t, chain[1].ID, report.Break.TransactionID)
+		assert.Contains(t, report.Break.Reason, "prev_hash")
+	})
+
+	t.Run("balance", func(t *testing.T) {
+		report := verify(walletID, chain, head, 1000)
+		require.False(t, report.OK())
+		assert.Contains(t, report.Break.Reason, "balance")
+	})
+
+	t.Run("legacy records", func(t *testing.T) {
+		legacy := Transaction{ID: uuid.New(), WalletID: walletID, Type: Deposit, Amount: 5}
+		report := verify(walletID, append([]Transaction{legacy}, chain...), head, 1000)
+		require.True(t, report.OK(), "balance is not checked when part of the history is unchained")
+		assert.Equal(t, int64(1), report.Legacy)
+		assert.Equal(t, int64(3), report.Verified)
+	})
+}
+
+func TestChainVerifierMixedVersions(t *testing.T) {
+	walletID := uuid.New()
+	chain := buildChain(walletID, 100, 50)
+	// Первая запись сделана до второй версии хэша: у нее нет chain_version, связанная операция
+	// и описание в хэш не входят.
+	related := uuid.New()
+	chain[0].ChainVersion, chain[0].RelatedID, chain[0].Description = 0, &related, "legacy"
+	chain[0].Hash = chain[0].chainHash()
+	chain[1].PrevHash = chain[0].Hash
+	chain[1].Hash = chain[1].chainHash()
+
+	report := verify(walletID, chain, chain[1].Hash, 150)
+	require.True(t, report.OK(), "records of the first version are checked by their own format: %v", report.Break)
+
+	t.Run("unknown version", func(t *testing.T) {
+		tampered := append([]Transaction(nil), chain...)
+		tampered[1].ChainVersion = chainHashVersion + 1
+		report := verify(walletID, tampered, chain[1].Hash, 150)
+		require.False(t, report.OK())
+		assert.Contains(t, report.Break.Reason, "unknown chain hash version")
+	})
+}
+
+func TestChainVerifierEmptyWallet(t *testing.T) {
+	report := verify(uuid.New(), nil, nil, 0)
+	assert.True(t, report.OK())
+	assert.Zero(t, report.Verified)
+}
@@ -0,0 +1,58 @@
+package walletcore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCronNext(t *testing.T) {
+	// Вторник.
+	from := time.Date(2026, 3, 3, 10, 17, 30, 0, time.UTC)
+	cases := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2026, 3, 3, 10, 18, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, 3, 3, 10, 30, 0, 0, time.UTC)},
+		{"5,40 9-11 * * *", time.Date(2026, 3, 3, 10, 40, 0, 0, time.UTC)},
+		{"0 9 * * *", time.Date(2026, 3, 4, 9, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2026, 3, 4, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 12 * * 1-5", time.Date(2026, 3, 3, 12, 0, 0, 0, time.UTC)},
+		{"0 12 * * 7", time.Date(2026, 3, 8, 12, 0, 0, 0, time.UTC)},
+		// День месяца и день недели заданы оба: подходит любой.
+		{"0 0 15 * 5", time.Date(2026, 3, 6, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		sched, err := parseCron(c.expr)
+		require.NoError(t, err, c.expr)
+		got, ok := sched.next(from)
+		require.True(t, ok, c.expr)
+		assert.Equal(t, c.want, got, c.expr)
+	}
+
+	sched, err := parseCron("0 0 30 2 *")
+	require.NoError(t, err)
+	_, ok := sched.next(from)
+	assert.False(t, ok, "February 30 never comes")
+}
+
+func TestCronNextIsStrictlyAfter(t *testing.T) {
+	sched, err := parseCron("0 * * * *")
+	require.NoError(t, err)
+	at := time.Date(2026, 3, 3, 10, 0, 0, 0, time.UTC)
+	got, ok := sched.next(at)
+	require.True(t, ok)
+	assert.Equal(t, at.Add(time.Hour), got)
+}
+
+func TestParseCronRejectsInvalid(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "a * * * *", "@every"} {
+		_, err := parseCron(expr)
+		assert.Error(t, err, expr)
+	}
+}
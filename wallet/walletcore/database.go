@@ -1,146 +1,426 @@
 package walletcore 
 
 import (
+    "context"
     "database/sql"
+    "errors"
     "fmt"
-    "log"
+    "log/slog"
     "time"
 
     "github.com/google/uuid"
-    _ "github.com/lib/pq" // Импорт драйвера PostgreSQL
+    "github.com/lib/pq" // Драйвер PostgreSQL
+)
+
+// Значения по умолчанию для ограничений времени запросов.
+const (
+    DefaultStatementTimeout = 5 * time.Second
+    DefaultLockTimeout      = 2 * time.Second
+)
+
+// Коды ошибок PostgreSQL, которые обрабатываются отдельно.
+const (
+    pqLockNotAvailable     = "55P03"
+    pqQueryCanceled        = "57014"
+    pqSerializationFailure = "40001"
+    pqDeadlockDetected     = "40P01"
 )
 
 // DBService предоставляет методы для взаимодействия с базой данных.
 type DBService struct {
 	DB *sql.DB 
+
+    // StatementTimeout ограничивает время выполнения одного запроса (statement_timeout).
+    StatementTimeout time.Duration
+    // LockTimeout ограничивает ожидание блокировки строки (lock_timeout).
+    LockTimeout time.Duration
+}
+
+// PoolConfig - настройки пула соединений sql.DB.
+type PoolConfig struct {
+    MaxOpenConns    int           // Максимальное количество открытых соединений
+    MaxIdleConns    int           // Максимальное количество простаивающих соединений
+    ConnMaxLifetime time.Duration // Максимальное время жизни соединения
+    ConnMaxIdleTime time.Duration // Максимальное время простоя соединения (0 - без ограничения)
+}
+
+// DefaultPoolConfig возвращает настройки пула по умолчанию.
+func DefaultPoolConfig() PoolConfig {
+    return PoolConfig{MaxOpenConns: 25, MaxIdleConns: 25, ConnMaxLifetime: 5 * time.Minute}
 }
 
 // NewDBService создает новый экземпляр DBService.
-func NewDBService(dataSourceName string) (*DBService, error) {
+func NewDBService(ctx context.Context, dataSourceName string, pool PoolConfig) (*DBService, error) {
     db, err := sql.Open("postgres", dataSourceName)
     if err != nil {
         return nil, fmt.Errorf("error opening database: %w", err)
     }
 
     // Настройка пула соединений
-    db.SetMaxOpenConns(25)                 // Максимальное количество открытых соединений
-    db.SetMaxIdleConns(25)                 // Максимальное количество простаивающих соединений
-    db.SetConnMaxLifetime(5 * time.Minute) // Максимальное время жизни соединения
+    db.SetMaxOpenConns(pool.MaxOpenConns)
+    db.SetMaxIdleConns(pool.MaxIdleConns)
+    db.SetConnMaxLifetime(pool.ConnMaxLifetime)
+    db.SetConnMaxIdleTime(pool.ConnMaxIdleTime)
 
-    if err = db.Ping(); err != nil {
+    if err = db.PingContext(ctx); err != nil {
+        db.Close()
         return nil, fmt.Errorf("error connecting to the database: %w", err)
     }
 
-    log.Println("Successfully connected to PostgreSQL!")
-    return &DBService{DB: db}, nil
+    slog.InfoContext(ctx, "Connected to PostgreSQL")
+    return &DBService{DB: db, StatementTimeout: DefaultStatementTimeout, LockTimeout: DefaultLockTimeout}, nil
+}
+
+// Ping проверяет соединение с базой данных.
+func (s *DBService) Ping(ctx context.Context) error {
+    return s.DB.PingContext(ctx)
 }
 
-// InitSchema инициализирует схему базы данных, создавая таблицы, если они не существуют.
-func (s *DBService) InitSchema() error {
-    // Создаем таблицу wallets
-    createWalletsTableSQL := `
-    CREATE TABLE IF NOT EXISTS wallets (
-        id UUID PRIMARY KEY,
-        balance BIGINT NOT NULL DEFAULT 0,
-        created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
-        updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
-    );`
+// BeginTx начинает транзакцию и задает для нее statement_timeout и lock_timeout.
+// Транзакция отменяется вместе с ctx, поэтому блокировки не удерживаются
+// после отключения клиента или срабатывания таймаута запроса.
+func (s *DBService) BeginTx(ctx context.Context, opts *sql.TxOptions) (_ *sql.Tx, err error) {
+    ctx, span := startDBSpan(ctx, "DBService.BeginTx", "BEGIN", "")
+    defer func() { endSpan(span, err) }()
 
-    _, err := s.DB.Exec(createWalletsTableSQL)
+    tx, err := s.DB.BeginTx(ctx, opts)
     if err != nil {
-        return fmt.Errorf("error creating wallets table: %w", err)
+        return nil, s.classify(ctx, fmt.Errorf("error beginning transaction: %w", err))
     }
 
-    // Создаем таблицу transactions для истории операций (опционально, но хорошая практика)
-    createTransactionsTableSQL := `
-    CREATE TABLE IF NOT EXISTS transactions (
-        id UUID PRIMARY KEY,
-        wallet_id UUID NOT NULL,
-        operation_type VARCHAR(10) NOT NULL,
-        amount BIGINT NOT NULL,
-        timestamp TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
-        FOREIGN KEY (wallet_id) REFERENCES wallets(id) ON DELETE CASCADE
-    );`
-
-    _, err = s.DB.Exec(createTransactionsTableSQL)
+    // SET LOCAL не принимает параметры, поэтому значения подставляются через set_config.
+    _, err = tx.ExecContext(ctx,
+        `SELECT set_config('statement_timeout', $1, true), set_config('lock_timeout', $2, true)`,
+        durationSetting(s.StatementTimeout), durationSetting(s.LockTimeout),
+    )
     if err != nil {
-        return fmt.Errorf("error creating transactions table: %w", err)
+        tx.Rollback()
+        return nil, s.classify(ctx, fmt.Errorf("error setting transaction timeouts: %w", err))
     }
+    return tx, nil
+}
 
-    log.Println("Database schema initialized successfully.")
-    return nil
+// durationSetting переводит длительность в миллисекунды для настроек PostgreSQL. 0 отключает ограничение.
+func durationSetting(d time.Duration) string {
+    return fmt.Sprintf("%d", d.Milliseconds())
+}
+
+// classify оборачивает ошибки таймаутов в ErrLockTimeout и ErrStatementTimeout,
+// а ошибки из-за отмены ctx - в ошибку контекста.
+func (s *DBService) classify(ctx context.Context, err error) error {
+    if err == nil {
+        return nil
+    }
+    if ctxErr := ctx.Err(); ctxErr != nil && !errors.Is(err, ctxErr) {
+        return fmt.Errorf("%w: %w", ctxErr, err)
+    }
+    if errors.Is(err, context.DeadlineExceeded) {
+        // Истек таймаут из withStatementTimeout, а не контекст вызывающей стороны.
+        return fmt.Errorf("%w: %w", ErrStatementTimeout, err)
+    }
+    var pqErr *pq.Error
+    if errors.As(err, &pqErr) {
+        switch pqErr.Code {
+        case pqLockNotAvailable:
+            return fmt.Errorf("%w: %w", ErrLockTimeout, err)
+        case pqQueryCanceled:
+            return fmt.Errorf("%w: %w", ErrStatementTimeout, err)
+        }
+    }
+    return err
+}
+
+// withStatementTimeout ограничивает запрос вне транзакции через контекст.
+// Ошибки таких запросов классифицируются по исходному контексту вызывающей стороны.
+func (s *DBService) withStatementTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+    if s.StatementTimeout <= 0 {
+        return context.WithCancel(ctx)
+    }
+    return context.WithTimeout(ctx, s.StatementTimeout)
 }
 
 // GetWallet получает кошелек по его ID. Использует FOR UPDATE для блокировки строки.
 // Возвращает *Wallet, sql.ErrNoRows если не найден, или другую ошибку.
-func (s *DBService) GetWallet(walletID uuid.UUID, tx *sql.Tx) (*Wallet, error) {
+// Ожидание блокировки ограничено lock_timeout транзакции, при превышении возвращается ErrLockTimeout.
+func (s *DBService) GetWallet(ctx context.Context, walletID uuid.UUID, tx *sql.Tx) (_ *Wallet, err error) {
+    const query = `SELECT id, balance, created_at, updated_at, owner_id FROM wallets WHERE id = $1 FOR UPDATE`
+    ctx, span := startDBSpan(ctx, "DBService.GetWallet", "SELECT", query)
+    defer func() { endSpan(span, err) }()
+
     var row *sql.Row
     if tx != nil {
-        row = tx.QueryRow(`SELECT id, balance, created_at, updated_at FROM wallets WHERE id = $1 FOR UPDATE`, walletID)
+        row = tx.QueryRowContext(ctx, query, walletID)
     } else {
-        row = s.DB.QueryRow(`SELECT id, balance, created_at, updated_at FROM wallets WHERE id = $1 FOR UPDATE`, walletID)
+        row = s.DB.QueryRowContext(ctx, query, walletID)
     }
 
     w := &Wallet{}
-    err := row.Scan(&w.ID, &w.Balance, &w.CreatedAt, &w.UpdatedAt)
+    var owner sql.NullString
+    err = row.Scan(&w.ID, &w.Balance, &w.CreatedAt, &w.UpdatedAt, &owner)
     if err != nil {
-        return nil, err // Здесь может быть sql.ErrNoRows
+        if errors.Is(err, sql.ErrNoRows) {
+            return nil, err
+        }
+        return nil, s.classify(ctx, err)
     }
+    w.OwnerID = owner.String
     return w, nil
 }
 
 // CreateWallet создает новый кошелек в базе данных.
-func (s *DBService) CreateWallet(tx *sql.Tx, walletID uuid.UUID, initialBalance int64) (*Wallet, error) {
+// ownerID - владелец кошелька; пустая строка, если кошелек служебный.
+func (s *DBService) CreateWallet(ctx context.Context, tx *sql.Tx, walletID uuid.UUID, initialBalance int64, ownerID string) (_ *Wallet, err error) {
+    const query = `INSERT INTO wallets (id, balance, created_at, updated_at, owner_id) VALUES ($1, $2, $3, $4, $5)`
+    ctx, span := startDBSpan(ctx, "DBService.CreateWallet", "INSERT", query)
+    defer func() { endSpan(span, err) }()
+
     now := time.Now()
     w := &Wallet{
         ID:        walletID,
         Balance:   initialBalance,
         CreatedAt: now,
         UpdatedAt: now,
+        OwnerID:   ownerID,
     }
 
-    _, err := tx.Exec(
-        `INSERT INTO wallets (id, balance, created_at, updated_at) VALUES ($1, $2, $3, $4)`,
-        w.ID, w.Balance, w.CreatedAt, w.UpdatedAt,
-    )
+    _, err = tx.ExecContext(ctx, query, w.ID, w.Balance, w.CreatedAt, w.UpdatedAt,
+        sql.NullString{String: ownerID, Valid: ownerID != ""})
     if err != nil {
-        return nil, fmt.Errorf("failed to insert new wallet: %w", err)
+        return nil, s.classify(ctx, fmt.Errorf("failed to insert new wallet: %w", err))
     }
     return w, nil
 }
 
 // UpdateWalletBalance обновляет баланс существующего кошелька.
 // Принимает tx *sql.Tx, чтобы операция была частью уже существующей транзакции.
-func (s *DBService) UpdateWalletBalance(tx *sql.Tx, walletID uuid.UUID, newBalance int64) error {
-    _, err := tx.Exec(
-        `UPDATE wallets SET balance = $1, updated_at = NOW() WHERE id = $2`,
-        newBalance, walletID,
-    )
+func (s *DBService) UpdateWalletBalance(ctx context.Context, tx *sql.Tx, walletID uuid.UUID, newBalance int64) (err error) {
+    const query = `UPDATE wallets SET balance = $1, updated_at = NOW() WHERE id = $2`
+    ctx, span := startDBSpan(ctx, "DBService.UpdateWalletBalance", "UPDATE", query)
+    defer func() { endSpan(span, err) }()
+
+    _, err = tx.ExecContext(ctx, query, newBalance, walletID)
     if err != nil {
-        return fmt.Errorf("failed to update wallet balance: %w", err)
+        return s.classify(ctx, fmt.Errorf("failed to update wallet balance: %w", err))
     }
     return nil
 }
 
-// AddTransactionRecord добавляет запись о транзакции в таблицу transactions.
-func (s *DBService) AddTransactionRecord(tx *sql.Tx, walletID uuid.UUID, opType OperationType, amount int64) error {
-    transactionID := uuid.New()
-    _, err := tx.Exec(
-        `INSERT INTO transactions (id, wallet_id, operation_type, amount, timestamp) VALUES ($1, $2, $3, $4, $5)`,
-        transactionID, walletID, opType, amount, time.Now(),
-    )
+// AddTransactionRecord добавляет запись о транзакции в таблицу transactions
+// и продлевает ею цепочку хэшей кошелька (см. chain.go).
+// apiKeyID - ключ, которым выполнена операция; uuid.Nil, если операция выполнена без ключа.
+// Вызывается под блокировкой строки кошелька из GetWallet, поэтому записи одного
+// кошелька не конкурируют за место в цепочке. Возвращает добавленную запись.
+// relatedID - связанная операция (см. Transaction.RelatedID), uuid.Nil если ее нет.
+// clientID и d - клиент и описание операции (см. details.go); пустые у служебных записей.
+// Возвращает ErrExternalReferenceConflict, если у клиента уже есть операция с той же внешней ссылкой.
+func (s *DBService) AddTransactionRecord(ctx context.Context, tx *sql.Tx, walletID uuid.UUID, opType OperationType, amount int64, apiKeyID, relatedID uuid.UUID, clientID string, d Details) (_ *Transaction, err error) {
+    const lastQuery = `SELECT chain_seq, hash FROM transactions
+         WHERE wallet_id = $1 AND chain_seq IS NOT NULL ORDER BY chain_seq DESC LIMIT 1`
+    const query = `INSERT INTO transactions (id, wallet_id, operation_type, amount, timestamp, api_key_id, chain_seq, prev_hash, hash, related_transaction_id, chain_version,
+            client_id, description, external_reference, tags, metadata)
+         VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, NULLIF($12, ''), NULLIF($13, ''), NULLIF($14, ''), $15, $16::jsonb)`
+    const headQuery = `UPDATE wallets SET chain_head = $1 WHERE id = $2`
+    ctx, span := startDBSpan(ctx, "DBService.AddTransactionRecord", "INSERT", query)
+    defer func() { endSpan(span, err) }()
+
+    t := Transaction{
+        ID:       uuid.New(),
+        WalletID: walletID,
+        Type:     opType,
+        Amount:   amount,
+        // В PostgreSQL время хранится с точностью до микросекунд; хэш считается от того же значения.
+        Timestamp: time.Now().UTC().Truncate(time.Microsecond),
+        Seq:       1,
+        ChainVersion: chainHashVersion,
+        ClientID:  clientID,
+        Details:   d,
+    }
+    if apiKeyID != uuid.Nil {
+        t.APIKeyID = &apiKeyID
+    }
+    if relatedID != uuid.Nil {
+        t.RelatedID = &relatedID
+    }
+
+    var lastSeq int64
+    var lastHash []byte
+    err = tx.QueryRowContext(ctx, lastQuery, walletID).Scan(&lastSeq, &lastHash)
+    switch {
+    case err == nil:
+        t.Seq, t.PrevHash = lastSeq+1, lastHash
+    case !errors.Is(err, sql.ErrNoRows):
+        return nil, s.classify(ctx, fmt.Errorf("failed to read chain head: %w", err))
+    }
+    // Хэш считается от metadata в том виде, в каком ее вернет PostgreSQL при проверке цепочки.
+    if t.Metadata, err = s.normalizeMetadata(ctx, tx, t.Metadata); err != nil {
+        return nil, err
+    }
+    t.Hash = t.chainHash()
+
+    _, err = tx.ExecContext(ctx, query, t.ID, t.WalletID, t.Type, t.Amount, t.Timestamp,
+        uuid.NullUUID{UUID: apiKeyID, Valid: apiKeyID != uuid.Nil}, t.Seq, t.PrevHash, t.Hash,
+        uuid.NullUUID{UUID: relatedID, Valid: relatedID != uuid.Nil}, t.ChainVersion,
+        t.ClientID, t.Description, t.ExternalReference, detailsTags(t.Tags), sql.NullString{String: string(t.Metadata), Valid: len(t.Metadata) > 0})
     if err != nil {
-        return fmt.Errorf("failed to add transaction record: %w", err)
+        if isReferenceConflict(err) {
+            return nil, ErrExternalReferenceConflict
+        }
+        return nil, s.classify(ctx, fmt.Errorf("failed to add transaction record: %w", err))
     }
-    return nil
+    if _, err = tx.ExecContext(ctx, headQuery, t.Hash, walletID); err != nil {
+        return nil, s.classify(ctx, fmt.Errorf("failed to update chain head: %w", err))
+    }
+    return &t, nil
+}
+
+// GetTransaction возвращает запись об операции внутри транзакции tx.
+// Если записи нет, возвращает sql.ErrNoRows.
+func (s *DBService) GetTransaction(ctx context.Context, tx *sql.Tx, id uuid.UUID) (_ *Transaction, err error) {
+    const query = `SELECT id, wallet_id, operation_type, amount, timestamp, api_key_id, related_transaction_id,
+         description, external_reference, tags, metadata FROM transactions WHERE id = $1`
+    ctx, span := startDBSpan(ctx, "DBService.GetTransaction", "SELECT", query)
+    defer func() { endSpan(span, err) }()
+
+    var t Transaction
+    var apiKeyID, relatedID uuid.NullUUID
+    var details detailsColumns
+    dest := append([]any{&t.ID, &t.WalletID, &t.Type, &t.Amount, &t.Timestamp, &apiKeyID, &relatedID}, details.dest()...)
+    err = tx.QueryRowContext(ctx, query, id).Scan(dest...)
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            return nil, err
+        }
+        return nil, s.classify(ctx, fmt.Errorf("failed to get transaction: %w", err))
+    }
+    if apiKeyID.Valid {
+        t.APIKeyID = &apiKeyID.UUID
+    }
+    if relatedID.Valid {
+        t.RelatedID = &relatedID.UUID
+    }
+    t.Details = details.details()
+    return &t, nil
+}
+
+// GetFeeRecord возвращает комиссию за операцию transactionID внутри транзакции tx.
+// Если комиссии не было, возвращает sql.ErrNoRows.
+func (s *DBService) GetFeeRecord(ctx context.Context, tx *sql.Tx, transactionID uuid.UUID) (_ *Transaction, err error) {
+    const query = `SELECT id FROM transactions WHERE related_transaction_id = $1 AND operation_type = $2`
+    ctx, span := startDBSpan(ctx, "DBService.GetFeeRecord", "SELECT", query)
+    defer func() { endSpan(span, err) }()
+
+    var id uuid.UUID
+    err = tx.QueryRowContext(ctx, query, transactionID, Fee).Scan(&id)
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            return nil, err
+        }
+        return nil, s.classify(ctx, fmt.Errorf("failed to get fee record: %w", err))
+    }
+    return s.GetTransaction(ctx, tx, id)
 }
 
-// GetWalletBalanceSimple получает баланс кошелька без блокировки. Используется для GET запроса.
-func (s *DBService) GetWalletBalanceSimple(walletID uuid.UUID) (int64, error) {
+// GetWalletBalanceSimple получает баланс и владельца кошелька без блокировки. Используется для GET запроса.
+func (s *DBService) GetWalletBalanceSimple(ctx context.Context, walletID uuid.UUID) (_ int64, _ string, err error) {
+    const query = `SELECT balance, owner_id FROM wallets WHERE id = $1`
+    ctx, span := startDBSpan(ctx, "DBService.GetWalletBalanceSimple", "SELECT", query)
+    defer func() { endSpan(span, err) }()
+
+    qctx, cancel := s.withStatementTimeout(ctx)
+    defer cancel()
+
     var balance int64
-    err := s.DB.QueryRow(`SELECT balance FROM wallets WHERE id = $1`, walletID).Scan(&balance)
+    var owner sql.NullString
+    err = s.DB.QueryRowContext(qctx, query, walletID).Scan(&balance, &owner)
     if err != nil {
-        return 0, err
+        if errors.Is(err, sql.ErrNoRows) {
+            return 0, "", err
+        }
+        return 0, "", s.classify(ctx, err)
     }
-    return balance, nil
-}
\ No newline at end of file
+    return balance, owner.String, nil
+}
+
+// ListTransactions возвращает историю операций кошелька, начиная с последних.
+func (s *DBService) ListTransactions(ctx context.Context, walletID uuid.UUID, limit, offset int) (_ []Transaction, err error) {
+    const query = `SELECT id, wallet_id, operation_type, amount, timestamp, api_key_id, related_transaction_id,
+         description, external_reference, tags, metadata FROM transactions
+         WHERE wallet_id = $1 ORDER BY timestamp DESC, id LIMIT $2 OFFSET $3`
+    ctx, span := startDBSpan(ctx, "DBService.ListTransactions", "SELECT", query)
+    defer func() { endSpan(span, err) }()
+
+    qctx, cancel := s.withStatementTimeout(ctx)
+    defer cancel()
+
+    rows, err := s.DB.QueryContext(qctx, query, walletID, limit, offset)
+    if err != nil {
+        return nil, s.classify(ctx, fmt.Errorf("failed to list transactions: %w", err))
+    }
+    defer rows.Close()
+
+    var transactions []Transaction
+    for rows.Next() {
+        var t Transaction
+        var apiKeyID, relatedID uuid.NullUUID
+        var details detailsColumns
+        if err := rows.Scan(append([]any{&t.ID, &t.WalletID, &t.Type, &t.Amount, &t.Timestamp, &apiKeyID, &relatedID}, details.dest()...)...); err != nil {
+            return nil, fmt.Errorf("failed to scan transaction: %w", err)
+        }
+        if apiKeyID.Valid {
+            t.APIKeyID = &apiKeyID.UUID
+        }
+        if relatedID.Valid {
+            t.RelatedID = &relatedID.UUID
+        }
+        t.Details = details.details()
+        transactions = append(transactions, t)
+    }
+    return transactions, s.classify(ctx, rows.Err())
+}
+
+// ReserveIdempotencyKey пытается закрепить ключ за запросом внутри транзакции.
+// Если ключ уже использован, ожидает завершения исходной транзакции и возвращает
+// сохраненную запись и false. Для нового ключа возвращает nil и true.
+// Ключи разных клиентов (clientID) не пересекаются.
+func (s *DBService) ReserveIdempotencyKey(ctx context.Context, tx *sql.Tx, clientID, key string, req WalletRequest) (_ *IdempotencyRecord, _ bool, err error) {
+    const query = `INSERT INTO idempotency_keys (client_id, key, wallet_id, operation_type, amount, details_hash) VALUES ($1, $2, $3, $4, $5, $6)
+         ON CONFLICT (client_id, key) DO NOTHING`
+    ctx, span := startDBSpan(ctx, "DBService.ReserveIdempotencyKey", "INSERT", query)
+    defer func() { endSpan(span, err) }()
+
+    res, err := tx.ExecContext(ctx, query, clientID, key, req.WalletID, req.OperationType, req.Amount, req.Details.hash())
+    if err != nil {
+        return nil, false, s.classify(ctx, fmt.Errorf("failed to reserve idempotency key: %w", err))
+    }
+    if n, err := res.RowsAffected(); err != nil {
+        return nil, false, s.classify(ctx, fmt.Errorf("failed to reserve idempotency key: %w", err))
+    } else if n == 1 {
+        return nil, true, nil
+    }
+
+    rec := &IdempotencyRecord{Key: key}
+    var balance sql.NullInt64
+    var transactionID uuid.NullUUID
+    err = tx.QueryRowContext(ctx,
+        `SELECT wallet_id, operation_type, amount, balance, transaction_id, details_hash FROM idempotency_keys WHERE client_id = $1 AND key = $2`, clientID, key,
+    ).Scan(&rec.WalletID, &rec.OperationType, &rec.Amount, &balance, &transactionID, &rec.DetailsHash)
+    if err != nil {
+        return nil, false, s.classify(ctx, fmt.Errorf("failed to load idempotency key: %w", err))
+    }
+    rec.Balance = balance.Int64
+    rec.TransactionID = transactionID.UUID
+    return rec, false, nil
+}
+
+// CompleteIdempotencyKey сохраняет итоговый баланс и запись операции для повторных запросов.
+func (s *DBService) CompleteIdempotencyKey(ctx context.Context, tx *sql.Tx, clientID, key string, balance int64, transactionID uuid.UUID) (err error) {
+    const query = `UPDATE idempotency_keys SET balance = $1, transaction_id = $2 WHERE client_id = $3 AND key = $4`
+    ctx, span := startDBSpan(ctx, "DBService.CompleteIdempotencyKey", "UPDATE", query)
+    defer func() { endSpan(span, err) }()
+
+    _, err = tx.ExecContext(ctx, query, balance, transactionID, clientID, key)
+    if err != nil {
+        return s.classify(ctx, fmt.Errorf("failed to complete idempotency key: %w", err))
+    }
+    return nil
+}
@@ -0,0 +1,31 @@
+package walletcore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyTimeouts(t *testing.T) {
+	s := &DBService{}
+	ctx := context.Background()
+
+	lockErr := fmt.Errorf("failed to lock: %w", &pq.Error{Code: pqLockNotAvailable})
+	assert.ErrorIs(t, s.classify(ctx, lockErr), ErrLockTimeout)
+	assert.True(t, IsRetryable(s.classify(ctx, lockErr)))
+
+	stmtErr := &pq.Error{Code: pqQueryCanceled}
+	assert.ErrorIs(t, s.classify(ctx, stmtErr), ErrStatementTimeout)
+
+	assert.ErrorIs(t, s.classify(ctx, context.DeadlineExceeded), ErrStatementTimeout)
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	err := s.classify(canceled, stmtErr)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.False(t, errors.Is(err, ErrStatementTimeout), "cancellation by the caller must not look retryable")
+}
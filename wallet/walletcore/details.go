@@ -0,0 +1,245 @@
+package walletcore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+
+	"test_task_wallet/logging"
+)
+
+// Описание операции от клиента: текст, внешняя ссылка (например, номер заказа), метки
+// и произвольные данные в JSON. Записывается вместе с записью операции, входит в ее хэш
+// в цепочке (см. chain.go) и возвращается в истории, но не в квитанции. Внешняя ссылка уникальна в пределах клиента:
+// повторная операция с той же ссылкой отклоняется с ErrExternalReferenceConflict.
+
+// Ограничения описания операции.
+const (
+	MaxDescriptionLength       = 500  // Символов в description
+	MaxExternalReferenceLength = 128  // Символов в externalReference
+	MaxTags                    = 20   // Меток у одной операции
+	MaxTagLength               = 64   // Символов в метке
+	MaxMetadataSize            = 8192 // Байт в metadata
+)
+
+var (
+	// ErrTransactionNotFound - у клиента нет операции с такой внешней ссылкой.
+	ErrTransactionNotFound = errors.New("transaction not found")
+	// ErrExternalReferenceConflict - клиент уже выполнил операцию с этой внешней ссылкой.
+	ErrExternalReferenceConflict = errors.New("external reference was already used for another transaction")
+)
+
+// pqUniqueViolation - код ошибки PostgreSQL при нарушении уникальности.
+const pqUniqueViolation = "23505"
+
+// clientReferenceIndex - уникальный индекс внешних ссылок клиента (миграция 13).
+const clientReferenceIndex = "transactions_client_reference_idx"
+
+// isReferenceConflict сообщает, что err - нарушение уникальности внешней ссылки клиента.
+func isReferenceConflict(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == pqUniqueViolation && pqErr.Constraint == clientReferenceIndex
+}
+
+// Details - описание операции, которое клиент передает вместе с ней.
+type Details struct {
+	Description       string          `json:"description,omitempty"`
+	ExternalReference string          `json:"externalReference,omitempty"`
+	Tags              []string        `json:"tags,omitempty"`
+	Metadata          json.RawMessage `json:"metadata,omitempty"` // JSON объект
+}
+
+// IsZero сообщает, что описание не задано.
+func (d *Details) IsZero() bool {
+	return d.Description == "" && d.ExternalReference == "" && len(d.Tags) == 0 && len(d.Metadata) == 0
+}
+
+// validate проверяет описание операции и приводит metadata: null равносилен отсутствию данных.
+func (d *Details) validate() ValidationErrors {
+	var errs ValidationErrors
+	if utf8.RuneCountInString(d.Description) > MaxDescriptionLength {
+		errs = append(errs, FieldError{Field: "description",
+			Message: fmt.Sprintf("description must be at most %d characters", MaxDescriptionLength)})
+	}
+	switch {
+	case utf8.RuneCountInString(d.ExternalReference) > MaxExternalReferenceLength:
+		errs = append(errs, FieldError{Field: "externalReference",
+			Message: fmt.Sprintf("externalReference must be at most %d characters", MaxExternalReferenceLength)})
+	case d.ExternalReference != "" && !printable(d.ExternalReference):
+		errs = append(errs, FieldError{Field: "externalReference",
+			Message: "externalReference must not contain spaces or control characters"})
+	}
+	if len(d.Tags) > MaxTags {
+		errs = append(errs, FieldError{Field: "tags", Message: fmt.Sprintf("at most %d tags are allowed", MaxTags)})
+	}
+	seen := make(map[string]bool, len(d.Tags))
+	for _, tag := range d.Tags {
+		switch {
+		case tag == "" || utf8.RuneCountInString(tag) > MaxTagLength || !printable(tag):
+			errs = append(errs, FieldError{Field: "tags",
+				Message: fmt.Sprintf("tag %q must be 1 to %d characters without spaces or control characters", tag, MaxTagLength)})
+		case seen[tag]:
+			errs = append(errs, FieldError{Field: "tags", Message: fmt.Sprintf("duplicate tag %q", tag)})
+		}
+		seen[tag] = true
+	}
+	if meta := bytes.TrimSpace(d.Metadata); string(meta) == "null" {
+		d.Metadata = nil
+	} else if len(meta) > 0 {
+		switch {
+		case len(meta) > MaxMetadataSize:
+			errs = append(errs, FieldError{Field: "metadata",
+				Message: fmt.Sprintf("metadata must be at most %d bytes", MaxMetadataSize)})
+		case meta[0] != '{' || !json.Valid(meta):
+			errs = append(errs, FieldError{Field: "metadata", Message: "metadata must be a JSON object"})
+		}
+	}
+	return errs
+}
+
+// hash возвращает SHA-256 описания для сравнения повторных запросов с ключом идемпотентности
+// или nil, если описание не задано. metadata сравнивается по содержимому: порядок ключей
+// и пробелы на хэш не влияют. Вызывается после validate.
+func (d *Details) hash() []byte {
+	if d.IsZero() {
+		return nil
+	}
+	h := sha256.New()
+	writeChainString(h, d.Description)
+	writeChainString(h, d.ExternalReference)
+	binary.Write(h, binary.BigEndian, uint32(len(d.Tags)))
+	for _, tag := range d.Tags {
+		writeChainString(h, tag)
+	}
+	writeChainString(h, string(canonicalJSON(d.Metadata)))
+	return h.Sum(nil)
+}
+
+// canonicalJSON записывает JSON с ключами объектов по порядку и без пробелов.
+// Числа сохраняются как есть. Некорректный JSON возвращается без изменений.
+func canonicalJSON(data json.RawMessage) []byte {
+	if len(data) == 0 {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return data
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return data
+	}
+	return out
+}
+
+// printable сообщает, что в s нет пробелов и управляющих символов.
+func printable(s string) bool {
+	return strings.IndexFunc(s, func(r rune) bool { return unicode.IsSpace(r) || !unicode.IsPrint(r) }) < 0
+}
+
+// TransactionByReference возвращает операцию клиента clientID с внешней ссылкой reference.
+// Возвращает ErrTransactionNotFound, если такой операции нет.
+func (s *Service) TransactionByReference(ctx context.Context, clientID, reference string) (*Transaction, error) {
+	t, err := s.db.FindTransactionByReference(ctx, clientID, reference)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrTransactionNotFound
+		}
+		return nil, fmt.Errorf("error finding transaction by reference: %w", err)
+	}
+	logging.AddFields(ctx, slog.String(logging.KeyWalletID, t.WalletID.String()))
+	t.AmountDecimal = s.money(t.Amount).String()
+	t.Currency = s.currency.Code
+	return t, nil
+}
+
+// detailsColumns - значения колонок описания операции при чтении из transactions.
+type detailsColumns struct {
+	description, reference sql.NullString
+	tags                   pq.StringArray
+	metadata               []byte
+}
+
+// dest возвращает приемники для Scan в порядке description, external_reference, tags, metadata.
+func (c *detailsColumns) dest() []any {
+	return []any{&c.description, &c.reference, &c.tags, &c.metadata}
+}
+
+func (c *detailsColumns) details() Details {
+	d := Details{Description: c.description.String, ExternalReference: c.reference.String, Tags: c.tags}
+	if len(c.metadata) > 0 {
+		d.Metadata = json.RawMessage(c.metadata)
+	}
+	return d
+}
+
+// detailsTags возвращает метки для записи в TEXT[]: NULL, если меток нет.
+func detailsTags(tags []string) pq.StringArray {
+	if len(tags) == 0 {
+		return nil
+	}
+	return tags
+}
+
+// normalizeMetadata приводит metadata к записи, которую PostgreSQL хранит в JSONB
+// и возвращает при чтении (порядок ключей, пробелы, дубликаты).
+func (s *DBService) normalizeMetadata(ctx context.Context, tx *sql.Tx, metadata json.RawMessage) (_ json.RawMessage, err error) {
+	if len(metadata) == 0 {
+		return nil, nil
+	}
+	const query = `SELECT $1::jsonb::text`
+	ctx, span := startDBSpan(ctx, "DBService.normalizeMetadata", "SELECT", query)
+	defer func() { endSpan(span, err) }()
+
+	var normalized string
+	if err = tx.QueryRowContext(ctx, query, string(metadata)).Scan(&normalized); err != nil {
+		return nil, s.classify(ctx, fmt.Errorf("failed to normalize metadata: %w", err))
+	}
+	return json.RawMessage(normalized), nil
+}
+
+// FindTransactionByReference ищет операцию клиента clientID по внешней ссылке.
+// Если операции нет, возвращает sql.ErrNoRows.
+func (s *DBService) FindTransactionByReference(ctx context.Context, clientID, reference string) (_ *Transaction, err error) {
+	const query = `SELECT id, wallet_id, operation_type, amount, timestamp, api_key_id, related_transaction_id,
+            description, external_reference, tags, metadata
+        FROM transactions WHERE client_id = $1 AND external_reference = $2`
+	ctx, span := startDBSpan(ctx, "DBService.FindTransactionByReference", "SELECT", query)
+	defer func() { endSpan(span, err) }()
+
+	qctx, cancel := s.withStatementTimeout(ctx)
+	defer cancel()
+
+	var t Transaction
+	var apiKeyID, relatedID uuid.NullUUID
+	var details detailsColumns
+	dest := append([]any{&t.ID, &t.WalletID, &t.Type, &t.Amount, &t.Timestamp, &apiKeyID, &relatedID}, details.dest()...)
+	if err = s.DB.QueryRowContext(qctx, query, clientID, reference).Scan(dest...); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		return nil, s.classify(ctx, fmt.Errorf("failed to find transaction by reference: %w", err))
+	}
+	if apiKeyID.Valid {
+		t.APIKeyID = &apiKeyID.UUID
+	}
+	if relatedID.Valid {
+		t.RelatedID = &relatedID.UUID
+	}
+	t.Details = details.details()
+	return &t, nil
+}
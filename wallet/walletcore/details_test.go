@@ -0,0 +1,75 @@
+package walletcore
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetailsValidate(t *testing.T) {
+	valid := Details{
+		Description:       "Оплата заказа",
+		ExternalReference: "order-42",
+		Tags:              []string{"shop", "promo:spring"},
+		Metadata:          json.RawMessage(`{"orderId": 42}`),
+	}
+	assert.Empty(t, valid.validate())
+
+	null := Details{Metadata: json.RawMessage(" null ")}
+	assert.Empty(t, null.validate())
+	assert.True(t, null.IsZero(), "null metadata is the same as no metadata")
+
+	cases := map[string]Details{
+		"description":       {Description: strings.Repeat("я", MaxDescriptionLength+1)},
+		"externalReference": {ExternalReference: "order 42"},
+		"tags":              {Tags: []string{"a", "a"}},
+		"metadata":          {Metadata: json.RawMessage(`[1, 2]`)},
+	}
+	for field, d := range cases {
+		errs := d.validate()
+		require.Len(t, errs, 1, field)
+		assert.Equal(t, field, errs[0].Field)
+	}
+
+	tooMany := Details{Tags: make([]string, MaxTags+1)}
+	for i := range tooMany.Tags {
+		tooMany.Tags[i] = uuid.NewString()
+	}
+	assert.Len(t, tooMany.validate(), 1)
+	assert.Len(t, (&Details{Tags: []string{""}}).validate(), 1)
+}
+
+func TestIdempotencyRecordMatchesDetails(t *testing.T) {
+	req := WalletRequest{WalletID: uuid.New(), OperationType: Deposit, Amount: 100, Details: Details{
+		ExternalReference: "order-42",
+		Metadata:          json.RawMessage(`{"orderId": 42, "items": [1, 2]}`),
+	}}
+	rec := &IdempotencyRecord{WalletID: req.WalletID, OperationType: req.OperationType, Amount: req.Amount,
+		DetailsHash: req.Details.hash()}
+	assert.True(t, rec.Matches(req))
+
+	same := req
+	same.Details.Metadata = json.RawMessage(`{"items":[1,2],"orderId":42}`)
+	assert.True(t, rec.Matches(same), "metadata is compared by contents")
+
+	for name, change := range map[string]func(*Details){
+		"description": func(d *Details) { d.Description = "refund" },
+		"reference":   func(d *Details) { d.ExternalReference = "order-43" },
+		"tags":        func(d *Details) { d.Tags = []string{"shop"} },
+		"metadata":    func(d *Details) { d.Metadata = json.RawMessage(`{"orderId": 43, "items": [1, 2]}`) },
+		"no details":  func(d *Details) { *d = Details{} },
+	} {
+		changed := req
+		change(&changed.Details)
+		assert.False(t, rec.Matches(changed), "a changed %s is a different request", name)
+	}
+
+	plain := WalletRequest{WalletID: req.WalletID, OperationType: Deposit, Amount: 100}
+	legacy := &IdempotencyRecord{WalletID: plain.WalletID, OperationType: Deposit, Amount: 100}
+	assert.True(t, legacy.Matches(plain), "keys stored without details match requests without details")
+	assert.False(t, legacy.Matches(req))
+}
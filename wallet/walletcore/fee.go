@@ -0,0 +1,114 @@
+package walletcore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+
+	"github.com/google/uuid"
+)
+
+// Fees рассчитывает комиссии за операции и знает кошелек, на который они зачисляются.
+// Комиссия списывается с кошелька операции в той же транзакции, что и сама операция,
+// и записывается в историю отдельной операцией FEE, связанной с основной.
+type Fees struct {
+	revenue uuid.UUID
+	rules   map[OperationType]FeeRule
+}
+
+// FeeRule - комиссия за операции одного типа.
+type FeeRule struct {
+	// Operation - Deposit, Withdraw или Transfer.
+	Operation OperationType
+	// Tiers - уровни по сумме операции в порядке возрастания From.
+	Tiers []FeeTier
+	// Min и Max ограничивают комиссию; Max 0 - без верхней границы.
+	Min int64
+	Max int64
+}
+
+// FeeTier - комиссия для операций на сумму от From: Fixed плюс BasisPoints сотых долей процента от суммы.
+type FeeTier struct {
+	From        int64
+	Fixed       int64
+	BasisPoints int64
+}
+
+// NewFees создает расчет комиссий по правилам rules с зачислением на кошелек revenue.
+func NewFees(revenue uuid.UUID, rules []FeeRule) *Fees {
+	f := &Fees{revenue: revenue, rules: make(map[OperationType]FeeRule, len(rules))}
+	for _, rule := range rules {
+		f.rules[rule.Operation] = rule
+	}
+	return f
+}
+
+// RevenueWallet возвращает кошелек, на который зачисляются комиссии.
+func (f *Fees) RevenueWallet() uuid.UUID {
+	return f.revenue
+}
+
+// For возвращает комиссию за операцию op на сумму amount с кошелька walletID.
+// Операции самого кошелька комиссий не облагаются. Если сумма меньше
+// первого уровня правила, комиссии нет, и Min не применяется.
+func (f *Fees) For(op OperationType, walletID uuid.UUID, amount int64) int64 {
+	if f == nil || walletID == f.revenue {
+		return 0
+	}
+	rule, ok := f.rules[op]
+	if !ok {
+		return 0
+	}
+	var tier *FeeTier
+	for i := range rule.Tiers {
+		if rule.Tiers[i].From <= amount {
+			tier = &rule.Tiers[i]
+		}
+	}
+	if tier == nil {
+		return 0
+	}
+
+	fee := tier.Fixed
+	if pct := percentOf(amount, tier.BasisPoints); fee > math.MaxInt64-pct {
+		fee = math.MaxInt64
+	} else {
+		fee += pct
+	}
+	if fee < rule.Min {
+		fee = rule.Min
+	}
+	if rule.Max > 0 && fee > rule.Max {
+		fee = rule.Max
+	}
+	return fee
+}
+
+// percentOf возвращает bp сотых долей процента от amount с округлением половины вверх.
+// Сумма делится заранее, чтобы произведение не переполнило int64.
+func percentOf(amount, bp int64) int64 {
+	return amount/10000*bp + (amount%10000*bp+5000)/10000
+}
+
+// chargeFee списывает комиссию fee с заблокированного кошелька wlt за операцию op
+// и зачисляет ее на кошелек доходов revenue. Баланс wlt уже должен учитывать комиссию.
+// Кошелек доходов блокируется вместе с кошельками операции в общем порядке (см. lockWallets);
+// если его нет, он создается без владельца. Возвращает запись FEE кошелька операции.
+func (s *Service) chargeFee(ctx context.Context, tx *sql.Tx, wlt, revenue *Wallet, fee int64, op *Transaction, apiKeyID uuid.UUID) (*Transaction, error) {
+	t, err := s.db.AddTransactionRecord(ctx, tx, wlt.ID, Fee, fee, apiKeyID, op.ID, "", Details{})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.credit(revenue, fee); err != nil {
+		return nil, fmt.Errorf("error crediting fee to revenue wallet %s: %w", revenue.ID, err)
+	}
+	if err := s.db.UpdateWalletBalance(ctx, tx, revenue.ID, revenue.Balance); err != nil {
+		return nil, err
+	}
+	if _, err := s.db.AddTransactionRecord(ctx, tx, revenue.ID, Deposit, fee, apiKeyID, t.ID, "", Details{}); err != nil {
+		return nil, fmt.Errorf("error crediting fee to revenue wallet %s: %w", revenue.ID, err)
+	}
+	return t, nil
+}
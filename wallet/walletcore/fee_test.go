@@ -0,0 +1,67 @@
+package walletcore
+
+import (
+	"math"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFees(t *testing.T) {
+	revenue, wallet := uuid.New(), uuid.New()
+	fees := NewFees(revenue, []FeeRule{
+		{Operation: Withdraw, Tiers: []FeeTier{{BasisPoints: 150}}, Min: 10, Max: 500},
+		{Operation: Deposit, Tiers: []FeeTier{{Fixed: 5}}},
+		{Operation: Transfer, Tiers: []FeeTier{{From: 100, Fixed: 10}, {From: 1000, Fixed: 2, BasisPoints: 100}}},
+	})
+
+	cases := []struct {
+		op     OperationType
+		amount int64
+		want   int64
+	}{
+		{Withdraw, 100, 10},        // 1.5 меньше минимума
+		{Withdraw, 2000, 30},       // 1.5%
+		{Withdraw, 2010, 30},       // 30.15 округляется вниз
+		{Withdraw, 2030, 30},       // 30.45
+		{Withdraw, 2034, 31},       // 30.51 округляется вверх
+		{Withdraw, 1_000_000, 500}, // ограничено максимумом
+		{Deposit, 1, 5},
+		{Transfer, 99, 0}, // меньше первого уровня
+		{Transfer, 100, 10},
+		{Transfer, 1000, 12},
+		{Transfer, math.MaxInt64, 92233720368547760},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, fees.For(c.op, wallet, c.amount), "%s %d", c.op, c.amount)
+	}
+
+	assert.Zero(t, fees.For(Withdraw, revenue, 2000), "the revenue wallet pays no fees")
+	assert.Zero(t, fees.For(Fee, wallet, 2000))
+	huge := NewFees(revenue, []FeeRule{{Operation: Withdraw, Tiers: []FeeTier{{Fixed: math.MaxInt64, BasisPoints: 100}}}})
+	assert.Equal(t, int64(math.MaxInt64), huge.For(Withdraw, wallet, 1000), "the fee saturates instead of overflowing")
+	var none *Fees
+	assert.Zero(t, none.For(Withdraw, wallet, 2000), "fees are optional")
+}
+
+func TestPercentOf(t *testing.T) {
+	assert.Equal(t, int64(1), percentOf(50, 100), "0.5 rounds half up")
+	assert.Equal(t, int64(0), percentOf(49, 100))
+	assert.Equal(t, int64(math.MaxInt64), percentOf(math.MaxInt64, 10000))
+}
+
+func TestLockOrderIncludesRevenueWallet(t *testing.T) {
+	low := uuid.MustParse("00000000-0000-0000-0000-000000000001")
+	mid := uuid.MustParse("80000000-0000-0000-0000-000000000000")
+	high := uuid.MustParse("ffffffff-0000-0000-0000-000000000000")
+
+	// Перевод на кошелек доходов с комиссией: кошелек доходов блокируется один раз,
+	// на своем месте по ID, и не создается, раз получатель перевода должен существовать.
+	ordered := lockOrder([]walletLock{{id: high}, {id: low}, {id: low, create: true}})
+	assert.Equal(t, []walletLock{{id: low}, {id: high}}, ordered)
+
+	// Снятие с комиссией: кошелек доходов с меньшим ID блокируется первым.
+	ordered = lockOrder([]walletLock{{id: mid}, {id: low, create: true}})
+	assert.Equal(t, []walletLock{{id: low, create: true}, {id: mid}}, ordered)
+}
@@ -0,0 +1,435 @@
+package walletcore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+
+	"test_task_wallet/logging"
+)
+
+// Проценты на остаток. За каждый закончившийся день (UTC) кошельку, продукту которого задана
+// ставка, начисляется остаток на конец дня * годовая ставка / 365. Начисления хранятся с точностью
+// до 10^-6 и после окончания месяца зачисляются на кошелек одной операцией INTEREST в целых
+// единицах; дробная часть переходит в следующий месяц.
+//
+// Начисление за день и зачисление за месяц записываются не больше одного раза: повторный
+// запуск, в том числе после сбоя или одновременно в нескольких репликах, пропускает уже
+// обработанные дни и месяцы.
+
+// interestPostingBatch - сколько зачислений выбирается за один запрос.
+const interestPostingBatch = 100
+
+// WalletProduct - продукт кошелька, определяющий ставку процентов на остаток.
+type WalletProduct struct {
+	WalletID uuid.UUID `json:"walletId"`
+	Product  string    `json:"product"` // Пусто - проценты не начисляются
+}
+
+// InterestReport - итог одного запуска начисления процентов.
+type InterestReport struct {
+	Days     int   // Обработано закончившихся дней
+	Accruals int   // Записано дневных начислений
+	Postings int   // Выполнено зачислений INTEREST
+	Posted   int64 // Зачислено всего
+}
+
+// SetInterestRates задает годовые ставки по продуктам кошельков в сотых долях процента.
+// Вызывается до начала обработки запросов.
+func (s *Service) SetInterestRates(rates map[string]int64) {
+	s.rates = rates
+}
+
+// SetWalletProduct назначает кошельку продукт; пустой product отключает проценты.
+// Продукт должен быть среди продуктов со ставкой. Уже начисленные за прошлые дни
+// проценты сохраняются и будут зачислены.
+func (s *Service) SetWalletProduct(ctx context.Context, walletID uuid.UUID, product string) (*WalletProduct, error) {
+	logging.AddFields(ctx, slog.String(logging.KeyWalletID, walletID.String()))
+	if _, ok := s.rates[product]; product != "" && !ok {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidRequest, ValidationErrors{{
+			Field:   "product",
+			Message: fmt.Sprintf("unknown product %q, must be one of: %s", product, s.productNames()),
+		}})
+	}
+	found, err := s.db.SetWalletProduct(ctx, walletID, product)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrWalletNotFound
+	}
+	return &WalletProduct{WalletID: walletID, Product: product}, nil
+}
+
+func (s *Service) productNames() string {
+	names := make([]string, 0, len(s.rates))
+	for name := range s.rates {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return "(no products configured)"
+	}
+	sort.Strings(names)
+	return fmt.Sprint(names)
+}
+
+// RunInterest начисляет проценты каждые every. Завершается после отмены ctx.
+func (s *Service) RunInterest(ctx context.Context, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := s.AccrueInterest(ctx, time.Now())
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.WarnContext(ctx, "Failed to accrue interest", logging.Err(err))
+				}
+				continue
+			}
+			if report.Days > 0 || report.Postings > 0 {
+				slog.InfoContext(ctx, "Interest accrued", "days", report.Days, "accruals", report.Accruals,
+					"postings", report.Postings, "posted", report.Posted)
+			}
+		}
+	}
+}
+
+// AccrueInterest начисляет проценты за закончившиеся к моменту now дни, еще не обработанные,
+// и зачисляет начисления за закончившиеся месяцы. Каждый день и каждое зачисление выполняются
+// в своей транзакции, поэтому после ошибки повторный вызов продолжит с того же места.
+// Если дни еще не обрабатывались, начисление начинается со вчерашнего дня.
+func (s *Service) AccrueInterest(ctx context.Context, now time.Time) (*InterestReport, error) {
+	report := &InterestReport{}
+	today := now.UTC().Truncate(24 * time.Hour)
+
+	if len(s.rates) > 0 {
+		last, err := s.db.LastInterestDay(ctx)
+		if err != nil {
+			return report, fmt.Errorf("error reading last interest day: %w", err)
+		}
+		day := today.AddDate(0, 0, -1)
+		if !last.IsZero() {
+			day = last.AddDate(0, 0, 1)
+		}
+		products, rates := s.rateArrays()
+		for ; day.Before(today); day = day.AddDate(0, 0, 1) {
+			var n int
+			err := s.tx.Run(ctx, func(tx *sql.Tx) error {
+				var err error
+				n, err = s.db.AccrueInterestDay(ctx, tx, day, products, rates)
+				return err
+			})
+			if err != nil {
+				return report, fmt.Errorf("error accruing interest for %s: %w", day.Format(time.DateOnly), err)
+			}
+			report.Days++
+			report.Accruals += n
+		}
+	}
+
+	monthStart := time.Date(today.Year(), today.Month(), 1, 0, 0, 0, 0, time.UTC)
+	months, err := s.db.UnpostedInterestMonths(ctx, monthStart)
+	if err != nil {
+		return report, fmt.Errorf("error listing unposted interest months: %w", err)
+	}
+	for _, month := range months {
+		if err := s.postInterestMonth(ctx, month, report); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// postInterestMonth зачисляет начисления за месяц month всем кошелькам, которым они
+// еще не зачислены, и отмечает месяц завершенным.
+func (s *Service) postInterestMonth(ctx context.Context, month time.Time, report *InterestReport) error {
+	for {
+		pending, err := s.db.PendingInterestPostings(ctx, month, interestPostingBatch)
+		if err != nil {
+			return fmt.Errorf("error listing pending interest postings: %w", err)
+		}
+		for _, walletID := range pending {
+			var amount int64
+			err := s.tx.Run(ctx, func(tx *sql.Tx) error {
+				var err error
+				amount, err = s.postInterest(ctx, tx, walletID, month)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("error posting interest for wallet %s, %s: %w", walletID, month.Format("2006-01"), err)
+			}
+			if amount > 0 {
+				report.Postings++
+				report.Posted += amount
+				s.obs.OperationApplied(Interest, amount)
+			}
+		}
+		if len(pending) < interestPostingBatch {
+			break
+		}
+	}
+	if err := s.db.CompleteInterestMonth(ctx, month); err != nil {
+		return fmt.Errorf("error completing interest month %s: %w", month.Format("2006-01"), err)
+	}
+	return nil
+}
+
+func (s *Service) rateArrays() ([]string, []int64) {
+	products := make([]string, 0, len(s.rates))
+	rates := make([]int64, 0, len(s.rates))
+	for product, rate := range s.rates {
+		products = append(products, product)
+		rates = append(rates, rate)
+	}
+	return products, rates
+}
+
+// postInterest зачисляет кошельку начисления по конец месяца month под блокировкой кошелька.
+// Возвращает зачисленную сумму; 0, если месяц уже зачислен или набралось меньше единицы.
+func (s *Service) postInterest(ctx context.Context, tx *sql.Tx, walletID uuid.UUID, month time.Time) (int64, error) {
+	wlt, err := s.db.GetWallet(ctx, walletID, tx)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("error getting wallet %s: %w", walletID, err)
+	}
+	amount, err := s.db.InterestDue(ctx, tx, walletID, month.AddDate(0, 1, 0))
+	if err != nil {
+		return 0, err
+	}
+	claimed, err := s.db.InsertInterestPosting(ctx, tx, walletID, month, amount)
+	if err != nil || !claimed || amount <= 0 {
+		return 0, err
+	}
+
+	if err := s.credit(wlt, amount); err != nil {
+		return 0, fmt.Errorf("error posting interest to wallet %s: %w", wlt.ID, err)
+	}
+	if err := s.db.UpdateWalletBalance(ctx, tx, wlt.ID, wlt.Balance); err != nil {
+		return 0, err
+	}
+	t, err := s.db.AddTransactionRecord(ctx, tx, wlt.ID, Interest, amount, uuid.Nil, uuid.Nil, "", Details{})
+	if err != nil {
+		return 0, err
+	}
+	if err := s.db.SetInterestPostingTransaction(ctx, tx, walletID, month, t.ID); err != nil {
+		return 0, err
+	}
+	return amount, nil
+}
+
+// SetWalletProduct записывает продукт кошелька (NULL для пустого product).
+// Возвращает false, если кошелька нет.
+func (s *DBService) SetWalletProduct(ctx context.Context, walletID uuid.UUID, product string) (_ bool, err error) {
+	const query = `UPDATE wallets SET product = $2, updated_at = NOW() WHERE id = $1`
+	ctx, span := startDBSpan(ctx, "DBService.SetWalletProduct", "UPDATE", query)
+	defer func() { endSpan(span, err) }()
+
+	qctx, cancel := s.withStatementTimeout(ctx)
+	defer cancel()
+
+	res, err := s.DB.ExecContext(qctx, query, walletID, sql.NullString{String: product, Valid: product != ""})
+	if err != nil {
+		return false, s.classify(ctx, fmt.Errorf("failed to set wallet product: %w", err))
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// LastInterestDay возвращает последний обработанный день (нулевое время, если дней не было).
+func (s *DBService) LastInterestDay(ctx context.Context) (_ time.Time, err error) {
+	const query = `SELECT to_char(MAX(day), 'YYYY-MM-DD') FROM interest_days`
+	ctx, span := startDBSpan(ctx, "DBService.LastInterestDay", "SELECT", query)
+	defer func() { endSpan(span, err) }()
+
+	qctx, cancel := s.withStatementTimeout(ctx)
+	defer cancel()
+
+	var day sql.NullString
+	if err = s.DB.QueryRowContext(qctx, query).Scan(&day); err != nil {
+		return time.Time{}, s.classify(ctx, err)
+	}
+	if !day.Valid {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.DateOnly, day.String)
+}
+
+// AccrueInterestDay записывает начисления за день day кошелькам с продуктами из products
+// (ставки - в rates с теми же индексами) и отмечает день обработанным. Остаток на конец дня
+// считается от текущего баланса за вычетом операций после дня. Кошельки, которым начисление
+// за этот день уже записано, пропускаются. Возвращает число новых начислений.
+func (s *DBService) AccrueInterestDay(ctx context.Context, tx *sql.Tx, day time.Time, products []string, rates []int64) (_ int, err error) {
+	const query = `INSERT INTO interest_accruals (wallet_id, day, product, balance, rate, amount)
+        SELECT w.id, $1::date, w.product, eod.balance, r.rate, TRUNC(eod.balance::numeric * r.rate / 10000 / 365, 6)
+        FROM wallets w
+        JOIN unnest($2::text[], $3::bigint[]) AS r (product, rate) ON r.product = w.product
+        CROSS JOIN LATERAL (
+            SELECT w.balance - COALESCE(SUM(CASE WHEN t.operation_type IN ('WITHDRAW', 'FEE') THEN -t.amount ELSE t.amount END), 0) AS balance
+            FROM transactions t WHERE t.wallet_id = w.id AND t.timestamp >= $4
+        ) eod
+        WHERE w.created_at < $4 AND eod.balance > 0
+        ON CONFLICT (wallet_id, day) DO NOTHING`
+	const dayQuery = `INSERT INTO interest_days (day) VALUES ($1::date) ON CONFLICT (day) DO NOTHING`
+	ctx, span := startDBSpan(ctx, "DBService.AccrueInterestDay", "INSERT", query)
+	defer func() { endSpan(span, err) }()
+
+	res, err := tx.ExecContext(ctx, query, sqlDate(day), pq.Array(products), pq.Array(rates), day.AddDate(0, 0, 1))
+	if err != nil {
+		return 0, s.classify(ctx, fmt.Errorf("failed to accrue interest: %w", err))
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if _, err = tx.ExecContext(ctx, dayQuery, sqlDate(day)); err != nil {
+		return 0, s.classify(ctx, fmt.Errorf("failed to mark interest day: %w", err))
+	}
+	return int(n), nil
+}
+
+// sqlDate передает календарный день параметром запроса. Строка вместо time.Time, чтобы
+// приведение к date не зависело от часового пояса сессии.
+func sqlDate(t time.Time) string {
+	return t.Format(time.DateOnly)
+}
+
+// UnpostedInterestMonths возвращает месяцы до before с обработанными днями,
+// зачисления за которые еще не завершены, начиная с ранних.
+func (s *DBService) UnpostedInterestMonths(ctx context.Context, before time.Time) (_ []time.Time, err error) {
+	const query = `SELECT DISTINCT to_char(date_trunc('month', d.day), 'YYYY-MM-DD') AS month
+        FROM interest_days d
+        WHERE d.day < $1::date AND NOT EXISTS (
+            SELECT 1 FROM interest_months m WHERE m.month = date_trunc('month', d.day)::date)
+        ORDER BY 1`
+	ctx, span := startDBSpan(ctx, "DBService.UnpostedInterestMonths", "SELECT", query)
+	defer func() { endSpan(span, err) }()
+
+	qctx, cancel := s.withStatementTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.DB.QueryContext(qctx, query, sqlDate(before))
+	if err != nil {
+		return nil, s.classify(ctx, fmt.Errorf("failed to list interest months: %w", err))
+	}
+	defer rows.Close()
+
+	var months []time.Time
+	for rows.Next() {
+		var month string
+		if err := rows.Scan(&month); err != nil {
+			return nil, fmt.Errorf("failed to scan interest month: %w", err)
+		}
+		m, err := time.Parse(time.DateOnly, month)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse interest month: %w", err)
+		}
+		months = append(months, m)
+	}
+	return months, s.classify(ctx, rows.Err())
+}
+
+// CompleteInterestMonth отмечает, что зачисления за месяц выполнены всем кошелькам.
+func (s *DBService) CompleteInterestMonth(ctx context.Context, month time.Time) (err error) {
+	const query = `INSERT INTO interest_months (month) VALUES ($1::date) ON CONFLICT (month) DO NOTHING`
+	ctx, span := startDBSpan(ctx, "DBService.CompleteInterestMonth", "INSERT", query)
+	defer func() { endSpan(span, err) }()
+
+	qctx, cancel := s.withStatementTimeout(ctx)
+	defer cancel()
+
+	if _, err = s.DB.ExecContext(qctx, query, sqlDate(month)); err != nil {
+		return s.classify(ctx, fmt.Errorf("failed to complete interest month: %w", err))
+	}
+	return nil
+}
+
+// PendingInterestPostings возвращает до limit кошельков с начислениями за месяц month,
+// которым этот месяц еще не зачислен.
+func (s *DBService) PendingInterestPostings(ctx context.Context, month time.Time, limit int) (_ []uuid.UUID, err error) {
+	const query = `SELECT DISTINCT a.wallet_id
+        FROM interest_accruals a
+        WHERE a.day >= $1::date AND a.day < ($1::date + INTERVAL '1 month') AND NOT EXISTS (
+            SELECT 1 FROM interest_postings p WHERE p.wallet_id = a.wallet_id AND p.month = $1::date)
+        ORDER BY 1 LIMIT $2`
+	ctx, span := startDBSpan(ctx, "DBService.PendingInterestPostings", "SELECT", query)
+	defer func() { endSpan(span, err) }()
+
+	qctx, cancel := s.withStatementTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.DB.QueryContext(qctx, query, sqlDate(month), limit)
+	if err != nil {
+		return nil, s.classify(ctx, fmt.Errorf("failed to list pending interest postings: %w", err))
+	}
+	defer rows.Close()
+
+	var pending []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan interest posting: %w", err)
+		}
+		pending = append(pending, id)
+	}
+	return pending, s.classify(ctx, rows.Err())
+}
+
+// InterestDue возвращает целую часть начислений кошелька за дни до before за вычетом уже зачисленного.
+func (s *DBService) InterestDue(ctx context.Context, tx *sql.Tx, walletID uuid.UUID, before time.Time) (_ int64, err error) {
+	const query = `SELECT
+            FLOOR(COALESCE((SELECT SUM(amount) FROM interest_accruals WHERE wallet_id = $1 AND day < $2::date), 0))::bigint
+            - COALESCE((SELECT SUM(amount) FROM interest_postings WHERE wallet_id = $1), 0)::bigint`
+	ctx, span := startDBSpan(ctx, "DBService.InterestDue", "SELECT", query)
+	defer func() { endSpan(span, err) }()
+
+	var amount int64
+	if err = tx.QueryRowContext(ctx, query, walletID, sqlDate(before)).Scan(&amount); err != nil {
+		return 0, s.classify(ctx, fmt.Errorf("failed to sum interest: %w", err))
+	}
+	return amount, nil
+}
+
+// InsertInterestPosting записывает зачисление за месяц. Возвращает false, если месяц уже зачислен.
+func (s *DBService) InsertInterestPosting(ctx context.Context, tx *sql.Tx, walletID uuid.UUID, month time.Time, amount int64) (_ bool, err error) {
+	const query = `INSERT INTO interest_postings (wallet_id, month, amount) VALUES ($1, $2::date, $3)
+        ON CONFLICT (wallet_id, month) DO NOTHING`
+	ctx, span := startDBSpan(ctx, "DBService.InsertInterestPosting", "INSERT", query)
+	defer func() { endSpan(span, err) }()
+
+	res, err := tx.ExecContext(ctx, query, walletID, sqlDate(month), amount)
+	if err != nil {
+		return false, s.classify(ctx, fmt.Errorf("failed to insert interest posting: %w", err))
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// SetInterestPostingTransaction связывает зачисление за месяц с операцией INTEREST.
+func (s *DBService) SetInterestPostingTransaction(ctx context.Context, tx *sql.Tx, walletID uuid.UUID, month time.Time, transactionID uuid.UUID) (err error) {
+	const query = `UPDATE interest_postings SET transaction_id = $3 WHERE wallet_id = $1 AND month = $2::date`
+	ctx, span := startDBSpan(ctx, "DBService.SetInterestPostingTransaction", "UPDATE", query)
+	defer func() { endSpan(span, err) }()
+
+	if _, err = tx.ExecContext(ctx, query, walletID, sqlDate(month), transactionID); err != nil {
+		return s.classify(ctx, fmt.Errorf("failed to link interest posting: %w", err))
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package walletcore
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetWalletProductRejectsUnknownProductBeforeTouchingDB(t *testing.T) {
+	svc := NewService(nil)
+	svc.SetInterestRates(map[string]int64{"savings": 450, "premium": 600})
+
+	_, err := svc.SetWalletProduct(context.Background(), uuid.New(), "gold")
+	require.ErrorIs(t, err, ErrInvalidRequest)
+
+	var fields ValidationErrors
+	require.True(t, errors.As(err, &fields))
+	assert.Equal(t, "product", fields[0].Field)
+	assert.Contains(t, fields[0].Message, "[premium savings]")
+}
@@ -0,0 +1,287 @@
+package walletcore
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// migration - одно изменение схемы. Применяется ровно один раз, в порядке version.
+type migration struct {
+	version     int
+	description string
+	sql         string
+}
+
+// migrations - история схемы. Новые изменения добавляются только в конец списка.
+// Первые миграции используют IF NOT EXISTS, чтобы подхватить базы,
+// созданные до появления schema_migrations.
+var migrations = []migration{
+	{1, "create wallets table", `
+    CREATE TABLE IF NOT EXISTS wallets (
+        id UUID PRIMARY KEY,
+        balance BIGINT NOT NULL DEFAULT 0,
+        created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+        updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+    );`},
+	// Таблица transactions для истории операций
+	{2, "create transactions table", `
+    CREATE TABLE IF NOT EXISTS transactions (
+        id UUID PRIMARY KEY,
+        wallet_id UUID NOT NULL,
+        operation_type VARCHAR(10) NOT NULL,
+        amount BIGINT NOT NULL,
+        timestamp TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+        FOREIGN KEY (wallet_id) REFERENCES wallets(id) ON DELETE CASCADE
+    );`},
+	// Таблица idempotency_keys хранит результаты операций для повторных запросов с тем же ключом
+	{3, "create idempotency_keys table", `
+    CREATE TABLE IF NOT EXISTS idempotency_keys (
+        key VARCHAR(255) PRIMARY KEY,
+        wallet_id UUID NOT NULL,
+        operation_type VARCHAR(10) NOT NULL,
+        amount BIGINT NOT NULL,
+        balance BIGINT,
+        created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+    );`},
+	// API ключи клиентов хранятся только в виде SHA-256; prefix - открытая часть ключа для поиска.
+	// transactions.api_key_id фиксирует, каким ключом выполнена операция.
+	{4, "create api_keys table", `
+    CREATE TABLE api_keys (
+        id UUID PRIMARY KEY,
+        name VARCHAR(100) NOT NULL,
+        prefix VARCHAR(32) NOT NULL UNIQUE,
+        key_hash BYTEA NOT NULL,
+        scopes TEXT[] NOT NULL,
+        created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+        rotated_at TIMESTAMP WITH TIME ZONE,
+        revoked_at TIMESTAMP WITH TIME ZONE
+    );
+    ALTER TABLE transactions ADD COLUMN api_key_id UUID REFERENCES api_keys(id);`},
+	// owner_id - subject JWT пользователя, которому принадлежит кошелек.
+	// NULL у кошельков, созданных по API ключу или сервисным токеном.
+	{5, "add wallets.owner_id", `
+    ALTER TABLE wallets ADD COLUMN owner_id VARCHAR(255);
+    CREATE INDEX wallets_owner_id_idx ON wallets (owner_id);`},
+	// Счетчики ограничения частоты запросов, общие для всех реплик.
+	// tat - теоретическое время прибытия следующего запроса (алгоритм GCRA).
+	{6, "create rate_limits table", `
+    CREATE UNLOGGED TABLE rate_limits (
+        key VARCHAR(512) PRIMARY KEY,
+        tat TIMESTAMP WITH TIME ZONE NOT NULL
+    );`},
+	// Цепочка хэшей операций кошелька: chain_seq - номер записи в цепочке, prev_hash - хэш
+	// предыдущей записи, hash - хэш содержимого записи вместе с prev_hash.
+	// wallets.chain_head - хэш последней записи, по нему видно удаление записей с конца.
+	// У операций, записанных до этой миграции, chain_seq и хэши пустые.
+	{7, "add transaction hash chain", `
+    ALTER TABLE transactions
+        ADD COLUMN chain_seq BIGINT,
+        ADD COLUMN prev_hash BYTEA,
+        ADD COLUMN hash BYTEA;
+    CREATE UNIQUE INDEX transactions_wallet_chain_idx ON transactions (wallet_id, chain_seq);
+    ALTER TABLE wallets ADD COLUMN chain_head BYTEA;`},
+	// Операция, выполненная по ключу идемпотентности: по ней повторный запрос получает ту же квитанцию.
+	{8, "add idempotency_keys.transaction_id", `
+    ALTER TABLE idempotency_keys ADD COLUMN transaction_id UUID;`},
+	// Выписки и история операций выбирают записи кошелька за период по времени.
+	{9, "index transactions by wallet and time", `
+    CREATE INDEX transactions_wallet_timestamp_idx ON transactions (wallet_id, timestamp, id);`},
+	// Запланированные операции (см. schedule.go). next_run_at - когда планировщик выполнит
+	// операцию, NULL у неактивных расписаний; occurrence_at - плановое время текущего запуска,
+	// attempt - сколько попыток этого запуска уже не удалось.
+	// schedule_runs - журнал запусков; уникальность (schedule_id, scheduled_for, attempt)
+	// не дает записать одну и ту же попытку дважды.
+	{10, "create schedules tables", `
+    CREATE TABLE schedules (
+        id UUID PRIMARY KEY,
+        wallet_id UUID NOT NULL,
+        operation_type VARCHAR(10) NOT NULL,
+        target_wallet_id UUID,
+        amount BIGINT NOT NULL,
+        cron VARCHAR(100),
+        interval_seconds BIGINT,
+        start_at TIMESTAMP WITH TIME ZONE NOT NULL,
+        end_at TIMESTAMP WITH TIME ZONE,
+        max_retries INTEGER NOT NULL DEFAULT 0,
+        status VARCHAR(16) NOT NULL,
+        next_run_at TIMESTAMP WITH TIME ZONE,
+        occurrence_at TIMESTAMP WITH TIME ZONE,
+        attempt INTEGER NOT NULL DEFAULT 0,
+        last_run_at TIMESTAMP WITH TIME ZONE,
+        owner_id VARCHAR(255),
+        api_key_id UUID REFERENCES api_keys(id),
+        created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+        updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+    );
+    CREATE INDEX schedules_due_idx ON schedules (next_run_at) WHERE next_run_at IS NOT NULL;
+    CREATE INDEX schedules_wallet_id_idx ON schedules (wallet_id);
+    CREATE INDEX schedules_owner_id_idx ON schedules (owner_id);
+    CREATE TABLE schedule_runs (
+        id UUID PRIMARY KEY,
+        schedule_id UUID NOT NULL REFERENCES schedules(id) ON DELETE CASCADE,
+        scheduled_for TIMESTAMP WITH TIME ZONE NOT NULL,
+        attempt INTEGER NOT NULL,
+        status VARCHAR(16) NOT NULL,
+        error TEXT,
+        transaction_id UUID,
+        executed_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+        UNIQUE (schedule_id, scheduled_for, attempt)
+    );`},
+	// Связь комиссии с операцией, за которую она взята, и зачисления комиссии с ее списанием (см. fee.go).
+	{11, "add transactions.related_transaction_id", `
+    ALTER TABLE transactions ADD COLUMN related_transaction_id UUID;
+    CREATE INDEX transactions_related_idx ON transactions (related_transaction_id) WHERE related_transaction_id IS NOT NULL;`},
+	// Проценты на остаток (см. interest.go). wallets.product определяет ставку.
+	// interest_days - дни, за которые начисление выполнено; interest_accruals - начисления
+	// за день с точностью до 10^-6; interest_postings - зачисления за месяц; interest_months -
+	// месяцы, зачисления за которые выполнены всем кошелькам. Первичные ключи не дают начислить
+	// за один день или зачислить за один месяц дважды.
+	{12, "create interest tables", `
+    ALTER TABLE wallets ADD COLUMN product VARCHAR(32);
+    CREATE TABLE interest_days (
+        day DATE PRIMARY KEY,
+        accrued_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+    );
+    CREATE TABLE interest_accruals (
+        wallet_id UUID NOT NULL REFERENCES wallets(id) ON DELETE CASCADE,
+        day DATE NOT NULL,
+        product VARCHAR(32) NOT NULL,
+        balance BIGINT NOT NULL,
+        rate BIGINT NOT NULL,
+        amount NUMERIC(30, 6) NOT NULL,
+        PRIMARY KEY (wallet_id, day)
+    );
+    CREATE INDEX interest_accruals_day_idx ON interest_accruals (day);
+    CREATE TABLE interest_postings (
+        wallet_id UUID NOT NULL REFERENCES wallets(id) ON DELETE CASCADE,
+        month DATE NOT NULL,
+        amount BIGINT NOT NULL,
+        transaction_id UUID,
+        posted_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+        PRIMARY KEY (wallet_id, month)
+    );
+    CREATE TABLE interest_months (
+        month DATE PRIMARY KEY,
+        posted_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+    );`},
+	// Описание операции от клиента (см. details.go). client_id - клиент, выполнивший операцию
+	// (см. auth.ClientID); внешняя ссылка уникальна в пределах клиента.
+	{13, "add transaction details", `
+    ALTER TABLE transactions
+        ADD COLUMN client_id VARCHAR(300),
+        ADD COLUMN description TEXT,
+        ADD COLUMN external_reference VARCHAR(128),
+        ADD COLUMN tags TEXT[],
+        ADD COLUMN metadata JSONB;
+    CREATE UNIQUE INDEX transactions_client_reference_idx ON transactions (client_id, external_reference)
+        WHERE external_reference IS NOT NULL;`},
+	// Версия формата хэша записи (см. chainHashVersion). NULL - записи первой версии.
+	{14, "add transaction chain version", `
+    ALTER TABLE transactions ADD COLUMN chain_version SMALLINT;`},
+	// Клиент API ключа (см. APIKey.Client). У существующих ключей это их ID,
+	// поэтому уже записанные операции остаются за тем же клиентом.
+	{15, "add api key client", `
+    ALTER TABLE api_keys ADD COLUMN client VARCHAR(100);
+    UPDATE api_keys SET client = id::text;
+    ALTER TABLE api_keys ALTER COLUMN client SET NOT NULL;`},
+	// Хэш описания операции в ключе идемпотентности (см. IdempotencyRecord.Matches).
+	// NULL - операция без описания, как и у всех ключей до появления описаний.
+	{16, "add idempotency details hash", `
+    ALTER TABLE idempotency_keys ADD COLUMN details_hash BYTEA;`},
+	// Ключи идемпотентности у каждого клиента свои (см. auth.ClientID). Существующие
+	// ключи закрепляются за клиентом их операции; ключи без операции остаются у "".
+	{17, "scope idempotency keys by client", `
+    ALTER TABLE idempotency_keys ADD COLUMN client_id VARCHAR(300) NOT NULL DEFAULT '';
+    UPDATE idempotency_keys k SET client_id = t.client_id
+        FROM transactions t WHERE t.id = k.transaction_id AND t.client_id IS NOT NULL;
+    ALTER TABLE idempotency_keys DROP CONSTRAINT idempotency_keys_pkey;
+    ALTER TABLE idempotency_keys ADD PRIMARY KEY (client_id, key);`},
+	// Клиент, создавший расписание (см. auth.ClientID): расписания видны только ему.
+	// У существующих расписаний клиент восстанавливается по пользователю или ключу;
+	// расписания сервисных токенов остаются без клиента.
+	{18, "add schedule client", `
+    ALTER TABLE schedules ADD COLUMN client_id VARCHAR(300);
+    UPDATE schedules SET client_id = 'sub:' || owner_id WHERE owner_id IS NOT NULL;
+    UPDATE schedules s SET client_id = 'key:' || k.client FROM api_keys k WHERE k.id = s.api_key_id;
+    CREATE INDEX schedules_client_id_idx ON schedules (client_id);`},
+}
+
+// SchemaVersion - версия схемы, которую ожидает этот код.
+func SchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// migrationsLockID - ключ advisory lock, чтобы реплики не применяли миграции одновременно.
+const migrationsLockID = 7428301
+
+// InitSchema применяет все недостающие миграции. Каждая миграция выполняется
+// в своей транзакции вместе с записью в schema_migrations.
+func (s *DBService) InitSchema(ctx context.Context) error {
+	_, err := s.DB.ExecContext(ctx, `
+    CREATE TABLE IF NOT EXISTS schema_migrations (
+        version INTEGER PRIMARY KEY,
+        description TEXT NOT NULL,
+        applied_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+    );`)
+	if err != nil {
+		return fmt.Errorf("error creating schema_migrations table: %w", err)
+	}
+
+	applied := 0
+	for _, m := range migrations {
+		ok, err := s.applyMigration(ctx, m)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.description, err)
+		}
+		if ok {
+			applied++
+			slog.InfoContext(ctx, "Applied migration", "version", m.version, "description", m.description)
+		}
+	}
+
+	slog.InfoContext(ctx, "Database schema initialized", "version", SchemaVersion(), "applied", applied)
+	return nil
+}
+
+// applyMigration применяет миграцию, если она еще не записана в schema_migrations.
+func (s *DBService) applyMigration(ctx context.Context, m migration) (bool, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationsLockID); err != nil {
+		return false, err
+	}
+
+	var exists bool
+	err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, m.version).Scan(&exists)
+	if err != nil || exists {
+		return false, err
+	}
+
+	if _, err := tx.ExecContext(ctx, m.sql); err != nil {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO schema_migrations (version, description) VALUES ($1, $2)`, m.version, m.description,
+	); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// AppliedSchemaVersion возвращает последнюю примененную версию схемы (0, если миграций не было).
+func (s *DBService) AppliedSchemaVersion(ctx context.Context) (int, error) {
+	qctx, cancel := s.withStatementTimeout(ctx)
+	defer cancel()
+
+	var version int
+	err := s.DB.QueryRowContext(qctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	if err != nil {
+		return 0, s.classify(ctx, fmt.Errorf("error reading schema version: %w", err))
+	}
+	return version, nil
+}
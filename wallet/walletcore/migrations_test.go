@@ -0,0 +1,16 @@
+package walletcore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrationsAreOrdered(t *testing.T) {
+	for i, m := range migrations {
+		assert.Equal(t, i+1, m.version, "migration versions must be consecutive starting from 1")
+		assert.NotEmpty(t, m.description)
+		assert.NotEmpty(t, m.sql)
+	}
+	assert.Equal(t, len(migrations), SchemaVersion())
+}
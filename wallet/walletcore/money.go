@@ -0,0 +1,127 @@
+package walletcore
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Суммы хранятся целым числом минимальных единиц валюты (например, копеек). Money связывает
+// такое число с валютой: арифметика проверяет переполнение и совпадение валют, а десятичная
+// запись ("12.50") строится и разбирается по экспоненте валюты без потери точности.
+
+var (
+	// ErrMoneyOverflow - результат не помещается в int64 минимальных единиц.
+	ErrMoneyOverflow = errors.New("amount is out of range")
+	// ErrCurrencyMismatch - операция над суммами в разных валютах.
+	ErrCurrencyMismatch = errors.New("currency mismatch")
+)
+
+// Currency - валюта: код ISO 4217 и число знаков дробной части.
+type Currency struct {
+	Code     string
+	Exponent int
+}
+
+// DefaultCurrency - валюта кошельков, если SetCurrency не вызывался: суммы в целых рублях.
+var DefaultCurrency = Currency{Code: "RUB", Exponent: 0}
+
+// Money - сумма в минимальных единицах валюты.
+type Money struct {
+	Minor    int64
+	Currency Currency
+}
+
+// Add возвращает m + o.
+func (m Money) Add(o Money) (Money, error) {
+	if m.Currency != o.Currency {
+		return Money{}, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency.Code, o.Currency.Code)
+	}
+	sum := m.Minor + o.Minor
+	if (o.Minor > 0 && sum < m.Minor) || (o.Minor < 0 && sum > m.Minor) {
+		return Money{}, ErrMoneyOverflow
+	}
+	return Money{Minor: sum, Currency: m.Currency}, nil
+}
+
+// Sub возвращает m - o.
+func (m Money) Sub(o Money) (Money, error) {
+	if o.Minor == math.MinInt64 {
+		return Money{}, ErrMoneyOverflow
+	}
+	return m.Add(Money{Minor: -o.Minor, Currency: o.Currency})
+}
+
+// String возвращает десятичную запись без кода валюты, например "12.50" или "-0.05".
+func (m Money) String() string {
+	return FormatMinor(m.Minor, m.Currency.Exponent)
+}
+
+// FormatMinor записывает minor минимальных единиц десятичным числом с exponent знаками после точки.
+func FormatMinor(minor int64, exponent int) string {
+	digits := strconv.FormatUint(absMinor(minor), 10)
+	if exponent > 0 {
+		if len(digits) <= exponent {
+			digits = strings.Repeat("0", exponent-len(digits)+1) + digits
+		}
+		digits = digits[:len(digits)-exponent] + "." + digits[len(digits)-exponent:]
+	}
+	if minor < 0 {
+		return "-" + digits
+	}
+	return digits
+}
+
+func absMinor(v int64) uint64 {
+	if v < 0 {
+		return uint64(-(v + 1)) + 1
+	}
+	return uint64(v)
+}
+
+// ParseMoney разбирает десятичную запись суммы в валюте c: необязательный минус, целая часть
+// и не больше c.Exponent знаков после точки. Округления нет: "12.345" в валюте с двумя
+// знаками - ошибка.
+func ParseMoney(s string, c Currency) (Money, error) {
+	digits, negative := strings.CutPrefix(s, "-")
+	whole, frac, hasPoint := strings.Cut(digits, ".")
+	switch {
+	case whole == "" || !allDigits(whole) || !allDigits(frac) || (hasPoint && frac == ""):
+		return Money{}, fmt.Errorf("%q is not a decimal amount", s)
+	case len(frac) > c.Exponent:
+		return Money{}, fmt.Errorf("%q has more than %d decimal places", s, c.Exponent)
+	}
+	frac += strings.Repeat("0", c.Exponent-len(frac))
+	minor, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil {
+		return Money{}, fmt.Errorf("%q: %w", s, ErrMoneyOverflow)
+	}
+	if negative {
+		minor = -minor
+	}
+	return Money{Minor: minor, Currency: c}, nil
+}
+
+// resolveDecimal переводит десятичную сумму decimal из поля field в минимальные единицы
+// валюты c. Если amount задан, суммы должны совпадать.
+func resolveDecimal(field, decimal string, amount int64, c Currency) (int64, *FieldError) {
+	m, err := ParseMoney(decimal, c)
+	if err != nil {
+		return 0, &FieldError{Field: field, Message: fmt.Sprintf("invalid %s: %v", field, err)}
+	}
+	if amount != 0 && amount != m.Minor {
+		return 0, &FieldError{Field: field, Message: fmt.Sprintf("%s %s does not match amount %d", field, decimal, amount)}
+	}
+	return m.Minor, nil
+}
+
+func allDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
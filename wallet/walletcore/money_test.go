@@ -0,0 +1,102 @@
+package walletcore
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testEUR = Currency{Code: "EUR", Exponent: 2}
+
+func TestMoneyArithmetic(t *testing.T) {
+	sum, err := Money{Minor: 1250, Currency: testEUR}.Add(Money{Minor: 5, Currency: testEUR})
+	require.NoError(t, err)
+	assert.Equal(t, Money{Minor: 1255, Currency: testEUR}, sum)
+
+	_, err = Money{Minor: math.MaxInt64, Currency: testEUR}.Add(Money{Minor: 1, Currency: testEUR})
+	assert.ErrorIs(t, err, ErrMoneyOverflow)
+	_, err = Money{Minor: math.MinInt64, Currency: testEUR}.Sub(Money{Minor: 1, Currency: testEUR})
+	assert.ErrorIs(t, err, ErrMoneyOverflow)
+	_, err = Money{Currency: testEUR}.Sub(Money{Minor: math.MinInt64, Currency: testEUR})
+	assert.ErrorIs(t, err, ErrMoneyOverflow)
+	_, err = Money{Minor: 1, Currency: testEUR}.Add(Money{Minor: 1, Currency: DefaultCurrency})
+	assert.ErrorIs(t, err, ErrCurrencyMismatch)
+}
+
+func TestMoneyFormat(t *testing.T) {
+	cases := []struct {
+		minor    int64
+		exponent int
+		want     string
+	}{
+		{1250, 2, "12.50"},
+		{5, 2, "0.05"},
+		{-5, 2, "-0.05"},
+		{0, 2, "0.00"},
+		{42, 0, "42"},
+		{1, 3, "0.001"},
+		{math.MinInt64, 2, "-92233720368547758.08"},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, FormatMinor(c.minor, c.exponent), "%d with exponent %d", c.minor, c.exponent)
+	}
+}
+
+func TestParseMoney(t *testing.T) {
+	for s, want := range map[string]int64{"12.50": 1250, "12.5": 1250, "12": 1200, "0.05": 5, "-1.01": -101, "92233720368547758.07": math.MaxInt64} {
+		m, err := ParseMoney(s, testEUR)
+		require.NoError(t, err, s)
+		assert.Equal(t, want, m.Minor, s)
+		assert.Equal(t, testEUR, m.Currency)
+	}
+	for _, s := range []string{"", "-", ".5", "12.", "12.345", "1,50", "+1", "1e3", " 1", "92233720368547758.08"} {
+		_, err := ParseMoney(s, testEUR)
+		assert.Error(t, err, s)
+	}
+	_, err := ParseMoney("1.5", DefaultCurrency)
+	assert.Error(t, err, "whole units only")
+}
+
+func TestApplyResolvesAmountDecimalBeforeTouchingDB(t *testing.T) {
+	svc := NewService(nil)
+	svc.SetCurrency(testEUR)
+
+	for _, req := range []WalletRequest{
+		{WalletID: uuid.New(), OperationType: Deposit, AmountDecimal: "12.505"},
+		{WalletID: uuid.New(), OperationType: Deposit, Amount: 1200, AmountDecimal: "12.50"},
+	} {
+		_, err := svc.Apply(context.Background(), req, OperationOptions{})
+		require.ErrorIs(t, err, ErrInvalidRequest)
+		var fields ValidationErrors
+		require.True(t, errors.As(err, &fields))
+		assert.Equal(t, "amountDecimal", fields[0].Field)
+	}
+
+	req := WalletRequest{Amount: 1250, AmountDecimal: "12.50"}
+	assert.Nil(t, req.resolveAmount(testEUR))
+	assert.EqualValues(t, 1250, req.Amount)
+}
+
+func TestScheduleAmountDecimalIsValidatedBeforeTouchingDB(t *testing.T) {
+	svc := NewService(nil)
+	svc.SetCurrency(testEUR)
+
+	_, err := svc.CreateSchedule(context.Background(), ScheduleRequest{
+		WalletID: uuid.New(), OperationType: Deposit, AmountDecimal: "1.005", IntervalSeconds: 3600,
+	}, OperationOptions{})
+	require.ErrorIs(t, err, ErrInvalidRequest)
+	var fields ValidationErrors
+	require.True(t, errors.As(err, &fields))
+	assert.Equal(t, "amountDecimal", fields[0].Field)
+
+	amount, decimal := int64(100), "1.50"
+	_, err = svc.UpdateSchedule(context.Background(), uuid.New(), ScheduleUpdate{Amount: &amount, AmountDecimal: &decimal}, "")
+	require.ErrorIs(t, err, ErrInvalidRequest)
+	require.True(t, errors.As(err, &fields))
+	assert.Equal(t, "amountDecimal", fields[0].Field)
+}
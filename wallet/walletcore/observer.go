@@ -0,0 +1,24 @@
+package walletcore
+
+import "time"
+
+// Observer получает события сервиса для метрик.
+// Методы вызываются синхронно на пути запроса, поэтому должны быть быстрыми и потокобезопасными.
+type Observer interface {
+	// OperationApplied вызывается после фиксации операции. Повторы по ключу идемпотентности не учитываются.
+	OperationApplied(op OperationType, amount int64)
+	// InsufficientFunds вызывается, когда снятие отклонено из-за нехватки средств.
+	InsufficientFunds(op OperationType, amount int64)
+	// TxFinished вызывается после каждой попытки транзакции; err - ошибка попытки или nil после коммита.
+	TxFinished(duration time.Duration, err error)
+	// LockWaited вызывается после получения блокировки строки кошелька.
+	LockWaited(duration time.Duration)
+}
+
+// nopObserver используется, пока Observer не задан.
+type nopObserver struct{}
+
+func (nopObserver) OperationApplied(OperationType, int64)  {}
+func (nopObserver) InsufficientFunds(OperationType, int64) {}
+func (nopObserver) TxFinished(time.Duration, error)        {}
+func (nopObserver) LockWaited(time.Duration)               {}
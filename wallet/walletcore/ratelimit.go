@@ -0,0 +1,62 @@
+package walletcore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// TakeRateLimitToken учитывает запрос в счетчике key по алгоритму GCRA:
+// запросы приходят в среднем не чаще раза в interval, подряд допускается window/interval запросов.
+// Возвращает 0, если запрос разрешен, иначе - через сколько его можно повторить.
+// Время берется из БД, чтобы реплики с расходящимися часами видели одни и те же лимиты.
+func (s *DBService) TakeRateLimitToken(ctx context.Context, key string, interval, window time.Duration) (_ time.Duration, err error) {
+	const query = `INSERT INTO rate_limits AS r (key, tat) VALUES ($1, NOW() + $2 * INTERVAL '1 microsecond')
+        ON CONFLICT (key) DO UPDATE SET tat = GREATEST(r.tat, NOW()) + $2 * INTERVAL '1 microsecond'
+        WHERE GREATEST(r.tat, NOW()) + $2 * INTERVAL '1 microsecond' - NOW() <= $3 * INTERVAL '1 microsecond'
+        RETURNING tat`
+	ctx, span := startDBSpan(ctx, "DBService.TakeRateLimitToken", "INSERT", query)
+	defer func() { endSpan(span, err) }()
+
+	qctx, cancel := s.withStatementTimeout(ctx)
+	defer cancel()
+
+	var tat time.Time
+	err = s.DB.QueryRowContext(qctx, query, key, interval.Microseconds(), window.Microseconds()).Scan(&tat)
+	if err == nil {
+		return 0, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, s.classify(ctx, err)
+	}
+
+	// Условие WHERE не выполнилось: лимит исчерпан, tat не изменился.
+	const retryQuery = `SELECT EXTRACT(EPOCH FROM GREATEST(tat, NOW()) - NOW()) FROM rate_limits WHERE key = $1`
+	var ahead float64
+	if err = s.DB.QueryRowContext(qctx, retryQuery, key).Scan(&ahead); err != nil {
+		return 0, s.classify(ctx, err)
+	}
+	retry := time.Duration(ahead*float64(time.Second)) + interval - window
+	if retry <= 0 {
+		// Счетчик успел освободиться между двумя запросами; просим повторить сразу.
+		retry = time.Millisecond
+	}
+	return retry, nil
+}
+
+// DeleteExpiredRateLimits удаляет счетчики, которые уже не ограничивают запросы.
+func (s *DBService) DeleteExpiredRateLimits(ctx context.Context) (_ int64, err error) {
+	const query = `DELETE FROM rate_limits WHERE tat < NOW()`
+	ctx, span := startDBSpan(ctx, "DBService.DeleteExpiredRateLimits", "DELETE", query)
+	defer func() { endSpan(span, err) }()
+
+	qctx, cancel := s.withStatementTimeout(ctx)
+	defer cancel()
+
+	res, err := s.DB.ExecContext(qctx, query)
+	if err != nil {
+		return 0, s.classify(ctx, err)
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,967 @@
+package walletcore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+
+	"test_task_wallet/logging"
+)
+
+var (
+	// ErrScheduleNotFound возвращается, если расписания нет или оно принадлежит другому пользователю.
+	ErrScheduleNotFound = errors.New("schedule not found")
+	// ErrScheduleKeyRevoked - запуск не выполнен: ключ, которым создано расписание,
+	// отозван или больше не дает права на операцию.
+	ErrScheduleKeyRevoked = errors.New("api key of the schedule is revoked or lacks the required scope")
+)
+
+// Ограничения расписаний.
+const (
+	// MinScheduleInterval и MaxScheduleInterval - границы периода повторяющейся операции.
+	MinScheduleInterval = time.Minute
+	MaxScheduleInterval = 366 * 24 * time.Hour
+	// MaxScheduleRetries - сколько раз можно повторить неудавшийся запуск.
+	MaxScheduleRetries = 10
+	// MaxCronLength - максимальная длина выражения cron.
+	MaxCronLength = 100
+)
+
+// Пауза перед повтором неудавшегося запуска: scheduleRetryBase, затем вдвое больше
+// с каждой попыткой, но не дольше scheduleRetryMax.
+const (
+	scheduleRetryBase = time.Minute
+	scheduleRetryMax  = time.Hour
+)
+
+// ScheduleStatus - состояние расписания.
+type ScheduleStatus string
+
+const (
+	ScheduleActive    ScheduleStatus = "active"
+	SchedulePaused    ScheduleStatus = "paused"
+	ScheduleCompleted ScheduleStatus = "completed" // Запусков больше не будет
+	ScheduleFailed    ScheduleStatus = "failed"    // Разовая операция не выполнилась после всех попыток
+	ScheduleCancelled ScheduleStatus = "cancelled"
+)
+
+// finished сообщает, что расписание больше не изменяется и не запускается.
+func (st ScheduleStatus) finished() bool {
+	return st == ScheduleCompleted || st == ScheduleFailed || st == ScheduleCancelled
+}
+
+// RunStatus - результат запуска запланированной операции.
+type RunStatus string
+
+const (
+	RunSucceeded RunStatus = "succeeded"
+	RunFailed    RunStatus = "failed"
+)
+
+// Schedule - отложенная или повторяющаяся операция. Без Cron и IntervalSeconds
+// операция разовая и выполняется в StartAt. Время cron считается в UTC.
+//
+// Каждый запуск выполняется ровно один раз: планировщик блокирует строку расписания,
+// выполняет операцию и записывает результат в одной транзакции. Запуски, пропущенные
+// во время простоя, не наверстываются: выполняется один, следующий считается от текущего времени.
+type Schedule struct {
+	ID              uuid.UUID      `json:"id"`
+	WalletID        uuid.UUID      `json:"walletId"`                 // Кошелек операции, для перевода - отправитель
+	OperationType   OperationType  `json:"operationType"`            // DEPOSIT, WITHDRAW или TRANSFER
+	TargetWalletID  *uuid.UUID     `json:"targetWalletId,omitempty"` // Получатель перевода
+	Amount          int64          `json:"amount"`
+	AmountDecimal   string         `json:"amountDecimal,omitempty"` // Amount в десятичной записи; заполняется сервисом для ответов API
+	Currency        string         `json:"currency,omitempty"`
+	Cron            string         `json:"cron,omitempty"`
+	IntervalSeconds int64          `json:"intervalSeconds,omitempty"`
+	StartAt         time.Time      `json:"startAt"`
+	EndAt           *time.Time     `json:"endAt,omitempty"`
+	MaxRetries      int            `json:"maxRetries"`
+	Status          ScheduleStatus `json:"status"`
+	NextRunAt       *time.Time     `json:"nextRunAt,omitempty"` // Только у активных расписаний
+	LastRunAt       *time.Time     `json:"lastRunAt,omitempty"`
+	OwnerID         string         `json:"ownerId,omitempty"`  // Пользователь, создавший расписание
+	ClientID        string         `json:"-"`                  // Клиент, создавший расписание (см. OperationOptions.ClientID)
+	APIKeyID        *uuid.UUID     `json:"apiKeyId,omitempty"` // Ключ, которым создано расписание; записывается в операции
+	CreatedAt       time.Time      `json:"createdAt"`
+	UpdatedAt       time.Time      `json:"updatedAt"`
+
+	OccurrenceAt time.Time `json:"-"` // Плановое время текущего запуска
+	Attempt      int       `json:"-"` // Неудавшиеся попытки текущего запуска
+}
+
+// ScheduleRun - запись журнала запусков расписания.
+type ScheduleRun struct {
+	ID            uuid.UUID  `json:"id"`
+	ScheduleID    uuid.UUID  `json:"scheduleId"`
+	ScheduledFor  time.Time  `json:"scheduledFor"` // Плановое время запуска; у повторов то же, что у первой попытки
+	Attempt       int        `json:"attempt"`      // Номер попытки, начиная с 1
+	Status        RunStatus  `json:"status"`
+	Error         string     `json:"error,omitempty"`
+	TransactionID *uuid.UUID `json:"transactionId,omitempty"` // Операция списания или пополнения при успехе
+	ExecutedAt    time.Time  `json:"executedAt"`
+}
+
+// ScheduleRequest - параметры нового расписания.
+type ScheduleRequest struct {
+	WalletID        uuid.UUID     `json:"walletId"`
+	OperationType   OperationType `json:"operationType"`
+	TargetWalletID  *uuid.UUID    `json:"targetWalletId,omitempty"`
+	Amount          int64         `json:"amount"`
+	AmountDecimal   string        `json:"amountDecimal,omitempty"` // Сумма в десятичной записи вместо Amount, как в WalletRequest
+	Cron            string        `json:"cron,omitempty"`
+	IntervalSeconds int64         `json:"intervalSeconds,omitempty"`
+	// StartAt - время разовой операции или начало повторов (по умолчанию - сейчас).
+	StartAt    *time.Time `json:"startAt,omitempty"`
+	EndAt      *time.Time `json:"endAt,omitempty"`
+	MaxRetries int        `json:"maxRetries,omitempty"`
+}
+
+// ScheduleUpdate - изменение расписания. Пустые поля не меняются.
+type ScheduleUpdate struct {
+	Amount        *int64          `json:"amount,omitempty"`
+	AmountDecimal *string         `json:"amountDecimal,omitempty"`
+	EndAt         *time.Time      `json:"endAt,omitempty"`
+	MaxRetries    *int            `json:"maxRetries,omitempty"`
+	Status        *ScheduleStatus `json:"status,omitempty"` // active или paused
+}
+
+// ScheduleFilter отбирает расписания для списка.
+type ScheduleFilter struct {
+	ClientID string    // Только расписания клиента; пусто - все
+	WalletID uuid.UUID // Только расписания кошелька (в том числе как получателя); uuid.Nil - все
+	Limit    int
+	Offset   int
+}
+
+// Validate проверяет запрос и возвращает ValidationErrors со всеми найденными ошибками.
+func (r *ScheduleRequest) Validate() error {
+	var errs ValidationErrors
+	if r.WalletID == uuid.Nil {
+		errs = append(errs, FieldError{Field: "walletId", Message: "walletId cannot be empty"})
+	}
+	switch r.OperationType {
+	case Deposit, Withdraw:
+		if r.TargetWalletID != nil {
+			errs = append(errs, FieldError{Field: "targetWalletId", Message: "targetWalletId is only allowed for TRANSFER"})
+		}
+	case Transfer:
+		if r.TargetWalletID == nil || *r.TargetWalletID == uuid.Nil {
+			errs = append(errs, FieldError{Field: "targetWalletId", Message: "targetWalletId is required for TRANSFER"})
+		} else if *r.TargetWalletID == r.WalletID {
+			errs = append(errs, FieldError{Field: "targetWalletId", Message: "targetWalletId must differ from walletId"})
+		}
+	default:
+		errs = append(errs, FieldError{
+			Field:   "operationType",
+			Message: fmt.Sprintf("invalid operation type: %s, must be DEPOSIT, WITHDRAW or TRANSFER", r.OperationType),
+		})
+	}
+	if r.Amount <= 0 {
+		errs = append(errs, FieldError{Field: "amount", Message: "amount must be positive"})
+	}
+
+	switch {
+	case r.Cron != "" && r.IntervalSeconds != 0:
+		errs = append(errs, FieldError{Field: "cron", Message: "cron and intervalSeconds are mutually exclusive"})
+	case len(r.Cron) > MaxCronLength:
+		errs = append(errs, FieldError{Field: "cron", Message: fmt.Sprintf("cron must be at most %d characters", MaxCronLength)})
+	case r.Cron != "":
+		if _, err := parseCron(r.Cron); err != nil {
+			errs = append(errs, FieldError{Field: "cron", Message: fmt.Sprintf("invalid cron expression: %v", err)})
+		}
+	case r.IntervalSeconds != 0:
+		if minSec, maxSec := int64(MinScheduleInterval/time.Second), int64(MaxScheduleInterval/time.Second); r.IntervalSeconds < minSec || r.IntervalSeconds > maxSec {
+			errs = append(errs, FieldError{Field: "intervalSeconds", Message: fmt.Sprintf("intervalSeconds must be between %d and %d", minSec, maxSec)})
+		}
+	case r.StartAt == nil:
+		errs = append(errs, FieldError{Field: "startAt", Message: "startAt is required for a one-time operation"})
+	}
+	if r.EndAt != nil && r.StartAt != nil && !r.EndAt.After(*r.StartAt) {
+		errs = append(errs, FieldError{Field: "endAt", Message: "endAt must be after startAt"})
+	}
+	if r.MaxRetries < 0 || r.MaxRetries > MaxScheduleRetries {
+		errs = append(errs, FieldError{Field: "maxRetries", Message: fmt.Sprintf("maxRetries must be between 0 and %d", MaxScheduleRetries)})
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// recurring сообщает, повторяется ли операция.
+func (sc *Schedule) recurring() bool {
+	return sc.Cron != "" || sc.IntervalSeconds != 0
+}
+
+// firstOccurrence возвращает первый плановый запуск не раньше StartAt.
+func (sc *Schedule) firstOccurrence() (time.Time, bool) {
+	if sc.Cron == "" {
+		return sc.within(sc.StartAt)
+	}
+	// next ищет строго после момента, поэтому StartAt, совпавший с минутой cron, тоже подходит.
+	return sc.nextOccurrence(sc.StartAt.Add(-time.Nanosecond))
+}
+
+// nextOccurrence возвращает первый плановый запуск строго после after.
+// Запуски по интервалу отсчитываются от OccurrenceAt (или StartAt). ok == false, если запусков больше нет.
+func (sc *Schedule) nextOccurrence(after time.Time) (time.Time, bool) {
+	switch {
+	case sc.Cron != "":
+		c, err := parseCron(sc.Cron)
+		if err != nil {
+			return time.Time{}, false
+		}
+		next, ok := c.next(after)
+		if !ok {
+			return time.Time{}, false
+		}
+		return sc.within(next)
+	case sc.IntervalSeconds != 0:
+		base := sc.OccurrenceAt
+		if base.IsZero() {
+			base = sc.StartAt
+		}
+		if after.Before(base) {
+			return sc.within(base)
+		}
+		interval := time.Duration(sc.IntervalSeconds) * time.Second
+		return sc.within(base.Add((after.Sub(base)/interval + 1) * interval))
+	}
+	return time.Time{}, false
+}
+
+// within отбрасывает запуски после EndAt.
+func (sc *Schedule) within(t time.Time) (time.Time, bool) {
+	if sc.EndAt != nil && t.After(*sc.EndAt) {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// activate делает расписание активным и назначает ближайший запуск не раньше now.
+// Разовая операция с прошедшим StartAt выполняется сразу.
+func (sc *Schedule) activate(now time.Time) {
+	sc.Status, sc.Attempt, sc.OccurrenceAt = ScheduleActive, 0, time.Time{}
+	occ, ok := sc.firstOccurrence()
+	if ok && sc.recurring() && occ.Before(now) {
+		occ, ok = sc.nextOccurrence(now)
+	}
+	sc.schedule(occ, ok, ScheduleCompleted)
+}
+
+// afterRun назначает следующий запуск после попытки, выполненной в now.
+// Неудавшаяся попытка повторяется, пока не исчерпан MaxRetries, затем расписание
+// переходит к следующему плановому запуску. Разовая операция без следующего запуска
+// завершается статусом failed, если последняя попытка не удалась.
+func (sc *Schedule) afterRun(now time.Time, failed bool) {
+	sc.LastRunAt = &now
+	if failed && sc.Attempt < sc.MaxRetries {
+		sc.Attempt++
+		retry := now.Add(scheduleRetryDelay(sc.Attempt))
+		sc.NextRunAt = &retry
+		return
+	}
+
+	sc.Attempt = 0
+	after := now
+	if sc.OccurrenceAt.After(after) {
+		after = sc.OccurrenceAt
+	}
+	next, ok := sc.nextOccurrence(after)
+	end := ScheduleCompleted
+	if failed && !sc.recurring() {
+		end = ScheduleFailed
+	}
+	sc.schedule(next, ok, end)
+}
+
+// schedule назначает запуск в occ или, если ok == false, завершает расписание статусом end.
+func (sc *Schedule) schedule(occ time.Time, ok bool, end ScheduleStatus) {
+	if !ok {
+		sc.Status, sc.NextRunAt = end, nil
+		return
+	}
+	sc.OccurrenceAt = occ
+	sc.NextRunAt = &occ
+}
+
+// scheduleRetryDelay - пауза перед попыткой attempt+1.
+func scheduleRetryDelay(attempt int) time.Duration {
+	d := scheduleRetryBase
+	for i := 1; i < attempt && d < scheduleRetryMax; i++ {
+		d *= 2
+	}
+	return min(d, scheduleRetryMax)
+}
+
+// scheduleRunError - текст ошибки запуска для журнала. Подробности внутренних ошибок
+// в журнал запусков не попадают, они пишутся в лог сервиса.
+func scheduleRunError(ctx context.Context, sc *Schedule, err error) string {
+	for _, known := range []error{ErrWalletNotFound, ErrInsufficientFunds, ErrBalanceOverflow, ErrWalletAccessDenied, ErrScheduleKeyRevoked} {
+		if errors.Is(err, known) {
+			return known.Error()
+		}
+	}
+	slog.ErrorContext(ctx, "Scheduled operation failed", "schedule_id", sc.ID, logging.Err(err))
+	return "internal error"
+}
+
+// CreateSchedule проверяет запрос и создает расписание. opts.OwnerID и opts.APIKeyID
+// сохраняются в расписании и применяются к каждой операции, как если бы ее выполнил создатель:
+// пользователь может списывать и переводить только со своих кошельков. Расписание доступно
+// только клиенту opts.ClientID.
+func (s *Service) CreateSchedule(ctx context.Context, req ScheduleRequest, opts OperationOptions) (*Schedule, error) {
+	if req.AmountDecimal != "" {
+		amount, fe := resolveDecimal("amountDecimal", req.AmountDecimal, req.Amount, s.currency)
+		if fe != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidRequest, ValidationErrors{*fe})
+		}
+		req.Amount = amount
+	}
+	if err := req.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidRequest, err)
+	}
+	now := time.Now().UTC()
+	sc := &Schedule{
+		ID:              uuid.New(),
+		WalletID:        req.WalletID,
+		OperationType:   req.OperationType,
+		TargetWalletID:  req.TargetWalletID,
+		Amount:          req.Amount,
+		Cron:            req.Cron,
+		IntervalSeconds: req.IntervalSeconds,
+		StartAt:         now,
+		EndAt:           req.EndAt,
+		MaxRetries:      req.MaxRetries,
+		OwnerID:         opts.OwnerID,
+		ClientID:        opts.ClientID,
+	}
+	if req.StartAt != nil {
+		sc.StartAt = req.StartAt.UTC()
+	}
+	if opts.APIKeyID != uuid.Nil {
+		sc.APIKeyID = &opts.APIKeyID
+	}
+	sc.activate(now)
+	if sc.Status != ScheduleActive {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidRequest, ValidationErrors{{Field: "endAt", Message: "schedule has no runs before endAt"}})
+	}
+
+	// Кошельки проверяются сразу, чтобы ошибка была видна при создании, а не в журнале запусков.
+	// При запуске они проверяются снова.
+	if sc.OperationType != Deposit {
+		_, owner, err := s.db.GetWalletBalanceSimple(ctx, sc.WalletID)
+		if err != nil {
+			return nil, walletLookupError(sc.WalletID, err)
+		}
+		// Чужой кошелек выглядит как несуществующий, как и при чтении.
+		if opts.OwnerID != "" && owner != opts.OwnerID {
+			return nil, ErrWalletNotFound
+		}
+	}
+	if sc.TargetWalletID != nil {
+		if _, _, err := s.db.GetWalletBalanceSimple(ctx, *sc.TargetWalletID); err != nil {
+			return nil, walletLookupError(*sc.TargetWalletID, err)
+		}
+	}
+
+	if err := s.db.InsertSchedule(ctx, sc); err != nil {
+		return nil, err
+	}
+	slog.InfoContext(ctx, "Schedule created", "schedule_id", sc.ID, "next_run_at", sc.NextRunAt)
+	return s.scheduleWithDecimals(sc), nil
+}
+
+// scheduleWithDecimals дополняет расписание десятичной записью суммы.
+func (s *Service) scheduleWithDecimals(sc *Schedule) *Schedule {
+	sc.AmountDecimal = s.money(sc.Amount).String()
+	sc.Currency = s.currency.Code
+	return sc
+}
+
+func walletLookupError(id uuid.UUID, err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrWalletNotFound
+	}
+	return fmt.Errorf("error getting wallet %s: %w", id, err)
+}
+
+// GetSchedule возвращает расписание. Если clientID не пуст, расписание другого клиента не находится.
+func (s *Service) GetSchedule(ctx context.Context, id uuid.UUID, clientID string) (*Schedule, error) {
+	sc, err := s.db.GetSchedule(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if clientID != "" && sc.ClientID != clientID {
+		return nil, ErrScheduleNotFound
+	}
+	return s.scheduleWithDecimals(sc), nil
+}
+
+// ListSchedules возвращает расписания в порядке создания.
+func (s *Service) ListSchedules(ctx context.Context, filter ScheduleFilter) ([]Schedule, error) {
+	schedules, err := s.db.ListSchedules(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	for i := range schedules {
+		s.scheduleWithDecimals(&schedules[i])
+	}
+	return schedules, nil
+}
+
+// ScheduleRuns возвращает журнал запусков расписания, начиная с последних.
+func (s *Service) ScheduleRuns(ctx context.Context, id uuid.UUID, clientID string, limit, offset int) ([]ScheduleRun, error) {
+	if _, err := s.GetSchedule(ctx, id, clientID); err != nil {
+		return nil, err
+	}
+	return s.db.ListScheduleRuns(ctx, id, limit, offset)
+}
+
+// UpdateSchedule меняет сумму, срок, число повторов или ставит расписание на паузу.
+// После паузы запуски продолжаются с ближайшего планового времени; пропущенные не выполняются.
+func (s *Service) UpdateSchedule(ctx context.Context, id uuid.UUID, upd ScheduleUpdate, clientID string) (*Schedule, error) {
+	var errs ValidationErrors
+	if upd.AmountDecimal != nil {
+		var amount int64
+		if upd.Amount != nil {
+			amount = *upd.Amount
+		}
+		if amount, fe := resolveDecimal("amountDecimal", *upd.AmountDecimal, amount, s.currency); fe != nil {
+			errs = append(errs, *fe)
+		} else {
+			upd.Amount = &amount
+		}
+	}
+	if upd.Amount != nil && *upd.Amount <= 0 {
+		errs = append(errs, FieldError{Field: "amount", Message: "amount must be positive"})
+	}
+	if upd.MaxRetries != nil && (*upd.MaxRetries < 0 || *upd.MaxRetries > MaxScheduleRetries) {
+		errs = append(errs, FieldError{Field: "maxRetries", Message: fmt.Sprintf("maxRetries must be between 0 and %d", MaxScheduleRetries)})
+	}
+	if upd.Status != nil && *upd.Status != ScheduleActive && *upd.Status != SchedulePaused {
+		errs = append(errs, FieldError{Field: "status", Message: "status must be active or paused"})
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidRequest, errs)
+	}
+
+	var sc *Schedule
+	err := s.tx.Run(ctx, func(tx *sql.Tx) error {
+		var err error
+		sc, err = s.db.LockSchedule(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if clientID != "" && sc.ClientID != clientID {
+			return ErrScheduleNotFound
+		}
+		if sc.Status.finished() {
+			return fmt.Errorf("%w: %w", ErrInvalidRequest, ValidationErrors{{
+				Field: "status", Message: fmt.Sprintf("schedule is %s and can no longer be changed", sc.Status),
+			}})
+		}
+		if upd.EndAt != nil && !upd.EndAt.After(sc.StartAt) {
+			return fmt.Errorf("%w: %w", ErrInvalidRequest, ValidationErrors{{Field: "endAt", Message: "endAt must be after startAt"}})
+		}
+		sc.apply(upd, time.Now().UTC())
+		return s.db.UpdateSchedule(ctx, tx, sc)
+	})
+	if err != nil {
+		return nil, err
+	}
+	slog.InfoContext(ctx, "Schedule updated", "schedule_id", sc.ID, "status", sc.Status)
+	return s.scheduleWithDecimals(sc), nil
+}
+
+// apply применяет изменения к расписанию, которое еще не завершено.
+func (sc *Schedule) apply(upd ScheduleUpdate, now time.Time) {
+	if upd.Amount != nil {
+		sc.Amount = *upd.Amount
+	}
+	if upd.MaxRetries != nil {
+		sc.MaxRetries = *upd.MaxRetries
+	}
+	if upd.EndAt != nil {
+		t := upd.EndAt.UTC()
+		sc.EndAt = &t
+	}
+
+	status := sc.Status
+	if upd.Status != nil {
+		status = *upd.Status
+	}
+	switch {
+	case status == SchedulePaused:
+		sc.Status, sc.NextRunAt = SchedulePaused, nil
+	case sc.Status == SchedulePaused:
+		sc.activate(now)
+	case upd.EndAt != nil:
+		// Назначенный запуск (в том числе повтор) остается, если он не позже нового срока.
+		if _, ok := sc.within(sc.OccurrenceAt); !ok {
+			sc.Status, sc.NextRunAt = ScheduleCompleted, nil
+		}
+	}
+}
+
+// CancelSchedule отменяет расписание. Журнал запусков сохраняется.
+// Повторная отмена не считается ошибкой; завершенное расписание возвращается без изменений.
+func (s *Service) CancelSchedule(ctx context.Context, id uuid.UUID, clientID string) (*Schedule, error) {
+	var sc *Schedule
+	err := s.tx.Run(ctx, func(tx *sql.Tx) error {
+		var err error
+		sc, err = s.db.LockSchedule(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if clientID != "" && sc.ClientID != clientID {
+			return ErrScheduleNotFound
+		}
+		if sc.Status.finished() {
+			return nil
+		}
+		sc.Status, sc.NextRunAt = ScheduleCancelled, nil
+		return s.db.UpdateSchedule(ctx, tx, sc)
+	})
+	if err != nil {
+		return nil, err
+	}
+	slog.InfoContext(ctx, "Schedule cancelled", "schedule_id", sc.ID)
+	return s.scheduleWithDecimals(sc), nil
+}
+
+// RunScheduler выполняет наступившие запланированные операции каждые every, не больше batch
+// за проход подряд, пока есть наступившие. Завершается после отмены ctx.
+// Несколько реплик могут работать одновременно: расписание, которое выполняет одна, другие пропускают.
+func (s *Service) RunScheduler(ctx context.Context, every time.Duration, batch int) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for {
+				n, err := s.RunDueSchedules(ctx, batch)
+				if err != nil {
+					if ctx.Err() == nil {
+						slog.WarnContext(ctx, "Failed to run scheduled operations", logging.Err(err))
+					}
+					break
+				}
+				if n < batch {
+					break
+				}
+			}
+		}
+	}
+}
+
+// RunDueSchedules выполняет до limit наступивших запусков, каждый в своей транзакции,
+// и возвращает, сколько запусков записано. Если операция расписания не выполнилась
+// из-за временной ошибки БД и после повторов TxRunner, попытка записывается отдельной
+// транзакцией как неудавшаяся, и расписание откладывается (см. deferSchedule), чтобы
+// не задерживать очередь. Другие ошибки БД прерывают проход.
+func (s *Service) RunDueSchedules(ctx context.Context, limit int) (int, error) {
+	for done := 0; done < limit; done++ {
+		var res *scheduleResult
+		err := s.tx.Run(ctx, func(tx *sql.Tx) error {
+			var err error
+			res, err = s.runSchedule(ctx, tx)
+			return err
+		})
+		var aborted *scheduleAborted
+		if errors.As(err, &aborted) && ctx.Err() == nil {
+			if res, err = s.deferSchedule(ctx, aborted.id, aborted.err); err == nil && res == nil {
+				continue // Расписание уже обработано в другом месте
+			}
+		}
+		if err != nil {
+			return done, err
+		}
+		if res == nil {
+			return done, nil
+		}
+
+		sc, run := res.schedule, res.run
+		attrs := []any{"schedule_id", sc.ID, "attempt", run.Attempt,
+			slog.String(logging.KeyWalletID, sc.WalletID.String()),
+			slog.String(logging.KeyOperation, string(sc.OperationType)),
+			slog.Int64(logging.KeyAmount, sc.Amount)}
+		if res.err != nil {
+			s.operationFailed(sc.request(), res.err)
+			slog.WarnContext(ctx, "Scheduled operation failed", append(attrs, "error", run.Error)...)
+			continue
+		}
+		// После коммита запуск проходит тот же путь, что и операция через Apply.
+		resp := s.operationCommitted(ctx, sc.request(), res.resp, false)
+		slog.InfoContext(ctx, "Scheduled operation executed", append(attrs,
+			"balance", resp.BalanceDecimal, "fee", resp.FeeDecimal, "currency", resp.Currency)...)
+	}
+	return limit, nil
+}
+
+// scheduleResult - итог одного запуска: расписание после него, запись журнала,
+// ответ о выполненной операции или ошибка операции.
+type scheduleResult struct {
+	schedule *Schedule
+	run      *ScheduleRun
+	resp     *WalletResponse
+	err      error
+}
+
+// request - операция расписания в виде запроса, как она учитывается в метриках.
+func (sc *Schedule) request() WalletRequest {
+	return WalletRequest{WalletID: sc.WalletID, OperationType: sc.OperationType, Amount: sc.Amount}
+}
+
+// scheduleAborted - операция расписания id прервана временной ошибкой err,
+// и транзакция запуска откатывается целиком.
+type scheduleAborted struct {
+	id  uuid.UUID
+	err error
+}
+
+func (e *scheduleAborted) Error() string {
+	return fmt.Sprintf("scheduled operation %s aborted: %v", e.id, e.err)
+}
+
+func (e *scheduleAborted) Unwrap() error {
+	return e.err
+}
+
+// runSchedule забирает одно наступившее расписание и выполняет его в транзакции tx.
+// Операция выполняется внутри точки сохранения: если она не удалась, ее изменения
+// откатываются, а неудачная попытка записывается в журнал в той же транзакции.
+// Временная ошибка операции возвращается как *scheduleAborted.
+// Без наступивших расписаний возвращает nil.
+func (s *Service) runSchedule(ctx context.Context, tx *sql.Tx) (*scheduleResult, error) {
+	sc, err := s.db.ClaimDueSchedule(ctx, tx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.db.Savepoint(ctx, tx, "scheduled_operation"); err != nil {
+		return nil, err
+	}
+	op, runErr := s.executeSchedule(ctx, tx, sc)
+	if runErr != nil {
+		// При таймаутах и конфликтах транзакция откатывается целиком: TxRunner повторит ее,
+		// а если повторы не помогут, попытку запишет deferSchedule.
+		if IsRetryable(runErr) || retryReason(runErr) != "" || ctx.Err() != nil {
+			return nil, &scheduleAborted{id: sc.ID, err: runErr}
+		}
+		if err := s.db.RollbackToSavepoint(ctx, tx, "scheduled_operation"); err != nil {
+			return nil, err
+		}
+	}
+	return s.recordRun(ctx, tx, sc, op, runErr)
+}
+
+// deferSchedule записывает неудавшуюся попытку расписания id, операция которого прервана
+// временной ошибкой runErr, и назначает повтор по правилам afterRun. Расписание, которое
+// уже выполнено, изменено или занято другой репликой, не трогается: возвращает nil.
+func (s *Service) deferSchedule(ctx context.Context, id uuid.UUID, runErr error) (*scheduleResult, error) {
+	var res *scheduleResult
+	err := s.tx.Run(ctx, func(tx *sql.Tx) error {
+		res = nil
+		sc, err := s.db.LockSchedule(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if sc.Status != ScheduleActive || sc.NextRunAt == nil || sc.NextRunAt.After(time.Now()) {
+			return nil
+		}
+		res, err = s.recordRun(ctx, tx, sc, nil, runErr)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error deferring schedule %s after %v: %w", id, runErr, err)
+	}
+	return res, nil
+}
+
+// recordRun записывает попытку запуска расписания sc и назначает следующий запуск.
+// op - выполненная операция, runErr - ошибка неудавшейся.
+func (s *Service) recordRun(ctx context.Context, tx *sql.Tx, sc *Schedule, op *operation, runErr error) (*scheduleResult, error) {
+	now := time.Now().UTC()
+	run := &ScheduleRun{
+		ID:           uuid.New(),
+		ScheduleID:   sc.ID,
+		ScheduledFor: sc.OccurrenceAt,
+		Attempt:      sc.Attempt + 1,
+		Status:       RunSucceeded,
+		ExecutedAt:   now,
+	}
+	if runErr != nil {
+		run.Status, run.Error = RunFailed, scheduleRunError(ctx, sc, runErr)
+	} else {
+		run.TransactionID = &op.record.ID
+	}
+	sc.afterRun(now, runErr != nil)
+
+	if err := s.db.InsertScheduleRun(ctx, tx, run); err != nil {
+		return nil, err
+	}
+	if err := s.db.UpdateSchedule(ctx, tx, sc); err != nil {
+		return nil, err
+	}
+	res := &scheduleResult{schedule: sc, run: run, err: runErr}
+	if runErr == nil {
+		res.resp = operationResponse(op)
+	}
+	return res, nil
+}
+
+// executeSchedule выполняет операцию расписания от имени его создателя. Ключ, которым
+// создано расписание, проверяется при каждом запуске: после отзыва ключа или потери им
+// права на операцию запуски завершаются ошибкой ErrScheduleKeyRevoked.
+func (s *Service) executeSchedule(ctx context.Context, tx *sql.Tx, sc *Schedule) (*operation, error) {
+	opts := OperationOptions{OwnerID: sc.OwnerID}
+	if sc.APIKeyID != nil {
+		key, err := s.db.GetAPIKey(ctx, tx, *sc.APIKeyID)
+		switch {
+		case errors.Is(err, ErrAPIKeyNotFound):
+			return nil, ErrScheduleKeyRevoked
+		case err != nil:
+			return nil, err
+		case key.Revoked() || !key.Allows(ScopeFor(sc.OperationType)):
+			return nil, ErrScheduleKeyRevoked
+		}
+		opts.APIKeyID, opts.ClientID = key.ID, key.ClientID()
+	}
+	if sc.OperationType == Transfer {
+		return s.transfer(ctx, tx, sc.WalletID, *sc.TargetWalletID, sc.Amount, opts)
+	}
+	return s.execute(ctx, tx, sc.request(), opts)
+}
+
+const scheduleColumns = `id, wallet_id, operation_type, target_wallet_id, amount, cron, interval_seconds,
+        start_at, end_at, max_retries, status, next_run_at, occurrence_at, attempt, last_run_at,
+        owner_id, api_key_id, client_id, created_at, updated_at`
+
+// scanSchedule читает колонки scheduleColumns.
+func scanSchedule(row interface{ Scan(...any) error }) (*Schedule, error) {
+	var (
+		sc         Schedule
+		cron       sql.NullString
+		interval   sql.NullInt64
+		occurrence sql.NullTime
+		owner      sql.NullString
+		client     sql.NullString
+	)
+	err := row.Scan(&sc.ID, &sc.WalletID, &sc.OperationType, &sc.TargetWalletID, &sc.Amount, &cron, &interval,
+		&sc.StartAt, &sc.EndAt, &sc.MaxRetries, &sc.Status, &sc.NextRunAt, &occurrence, &sc.Attempt, &sc.LastRunAt,
+		&owner, &sc.APIKeyID, &client, &sc.CreatedAt, &sc.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	sc.Cron, sc.IntervalSeconds, sc.OccurrenceAt, sc.OwnerID = cron.String, interval.Int64, occurrence.Time, owner.String
+	sc.ClientID = client.String
+	return &sc, nil
+}
+
+// InsertSchedule сохраняет новое расписание и заполняет CreatedAt и UpdatedAt.
+func (s *DBService) InsertSchedule(ctx context.Context, sc *Schedule) (err error) {
+	const query = `INSERT INTO schedules (id, wallet_id, operation_type, target_wallet_id, amount, cron, interval_seconds,
+        start_at, end_at, max_retries, status, next_run_at, occurrence_at, attempt, owner_id, api_key_id, client_id)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+        RETURNING created_at, updated_at`
+	ctx, span := startDBSpan(ctx, "DBService.InsertSchedule", "INSERT", query)
+	defer func() { endSpan(span, err) }()
+
+	qctx, cancel := s.withStatementTimeout(ctx)
+	defer cancel()
+
+	err = s.DB.QueryRowContext(qctx, query, sc.ID, sc.WalletID, sc.OperationType, sc.TargetWalletID, sc.Amount,
+		sql.NullString{String: sc.Cron, Valid: sc.Cron != ""}, sql.NullInt64{Int64: sc.IntervalSeconds, Valid: sc.IntervalSeconds != 0},
+		sc.StartAt, sc.EndAt, sc.MaxRetries, sc.Status, sc.NextRunAt, sql.NullTime{Time: sc.OccurrenceAt, Valid: !sc.OccurrenceAt.IsZero()},
+		sc.Attempt, sql.NullString{String: sc.OwnerID, Valid: sc.OwnerID != ""}, sc.APIKeyID,
+		sql.NullString{String: sc.ClientID, Valid: sc.ClientID != ""},
+	).Scan(&sc.CreatedAt, &sc.UpdatedAt)
+	if err != nil {
+		return s.classify(ctx, fmt.Errorf("failed to insert schedule: %w", err))
+	}
+	return nil
+}
+
+// GetSchedule возвращает расписание без блокировки. ErrScheduleNotFound, если его нет.
+func (s *DBService) GetSchedule(ctx context.Context, id uuid.UUID) (_ *Schedule, err error) {
+	const query = `SELECT ` + scheduleColumns + ` FROM schedules WHERE id = $1`
+	ctx, span := startDBSpan(ctx, "DBService.GetSchedule", "SELECT", query)
+	defer func() { endSpan(span, err) }()
+
+	qctx, cancel := s.withStatementTimeout(ctx)
+	defer cancel()
+
+	sc, err := scanSchedule(s.DB.QueryRowContext(qctx, query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrScheduleNotFound
+		}
+		return nil, s.classify(ctx, fmt.Errorf("failed to get schedule: %w", err))
+	}
+	return sc, nil
+}
+
+// LockSchedule блокирует строку расписания до конца транзакции tx.
+// Пока планировщик выполняет расписание, ожидание ограничено lock_timeout. ErrScheduleNotFound, если его нет.
+func (s *DBService) LockSchedule(ctx context.Context, tx *sql.Tx, id uuid.UUID) (_ *Schedule, err error) {
+	const query = `SELECT ` + scheduleColumns + ` FROM schedules WHERE id = $1 FOR UPDATE`
+	ctx, span := startDBSpan(ctx, "DBService.LockSchedule", "SELECT", query)
+	defer func() { endSpan(span, err) }()
+
+	sc, err := scanSchedule(tx.QueryRowContext(ctx, query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrScheduleNotFound
+		}
+		return nil, s.classify(ctx, fmt.Errorf("failed to lock schedule: %w", err))
+	}
+	return sc, nil
+}
+
+// ClaimDueSchedule блокирует самое раннее наступившее расписание. Расписания,
+// заблокированные другой транзакцией, пропускаются, поэтому реплики не выполняют одно
+// и то же расписание одновременно. Возвращает sql.ErrNoRows, если наступивших нет.
+func (s *DBService) ClaimDueSchedule(ctx context.Context, tx *sql.Tx) (_ *Schedule, err error) {
+	const query = `SELECT ` + scheduleColumns + ` FROM schedules
+        WHERE next_run_at <= NOW() AND status = 'active'
+        ORDER BY next_run_at LIMIT 1 FOR UPDATE SKIP LOCKED`
+	ctx, span := startDBSpan(ctx, "DBService.ClaimDueSchedule", "SELECT", query)
+	defer func() { endSpan(span, err) }()
+
+	sc, err := scanSchedule(tx.QueryRowContext(ctx, query))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		return nil, s.classify(ctx, fmt.Errorf("failed to claim due schedule: %w", err))
+	}
+	return sc, nil
+}
+
+// ListSchedules возвращает расписания по фильтру в порядке создания.
+func (s *DBService) ListSchedules(ctx context.Context, filter ScheduleFilter) (_ []Schedule, err error) {
+	const query = `SELECT ` + scheduleColumns + ` FROM schedules
+        WHERE ($1 = '' OR client_id = $1) AND ($2::uuid IS NULL OR wallet_id = $2 OR target_wallet_id = $2)
+        ORDER BY created_at, id LIMIT $3 OFFSET $4`
+	ctx, span := startDBSpan(ctx, "DBService.ListSchedules", "SELECT", query)
+	defer func() { endSpan(span, err) }()
+
+	qctx, cancel := s.withStatementTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.DB.QueryContext(qctx, query, filter.ClientID,
+		uuid.NullUUID{UUID: filter.WalletID, Valid: filter.WalletID != uuid.Nil}, filter.Limit, filter.Offset)
+	if err != nil {
+		return nil, s.classify(ctx, fmt.Errorf("failed to list schedules: %w", err))
+	}
+	defer rows.Close()
+
+	schedules := []Schedule{}
+	for rows.Next() {
+		sc, err := scanSchedule(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan schedule: %w", err)
+		}
+		schedules = append(schedules, *sc)
+	}
+	return schedules, s.classify(ctx, rows.Err())
+}
+
+// UpdateSchedule сохраняет изменяемые поля расписания и обновляет UpdatedAt.
+func (s *DBService) UpdateSchedule(ctx context.Context, tx *sql.Tx, sc *Schedule) (err error) {
+	const query = `UPDATE schedules SET amount = $2, end_at = $3, max_retries = $4, status = $5, next_run_at = $6,
+        occurrence_at = $7, attempt = $8, last_run_at = $9, updated_at = NOW()
+        WHERE id = $1 RETURNING updated_at`
+	ctx, span := startDBSpan(ctx, "DBService.UpdateSchedule", "UPDATE", query)
+	defer func() { endSpan(span, err) }()
+
+	err = tx.QueryRowContext(ctx, query, sc.ID, sc.Amount, sc.EndAt, sc.MaxRetries, sc.Status, sc.NextRunAt,
+		sql.NullTime{Time: sc.OccurrenceAt, Valid: !sc.OccurrenceAt.IsZero()}, sc.Attempt, sc.LastRunAt,
+	).Scan(&sc.UpdatedAt)
+	if err != nil {
+		return s.classify(ctx, fmt.Errorf("failed to update schedule: %w", err))
+	}
+	return nil
+}
+
+// InsertScheduleRun записывает запуск в журнал.
+func (s *DBService) InsertScheduleRun(ctx context.Context, tx *sql.Tx, run *ScheduleRun) (err error) {
+	const query = `INSERT INTO schedule_runs (id, schedule_id, scheduled_for, attempt, status, error, transaction_id, executed_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	ctx, span := startDBSpan(ctx, "DBService.InsertScheduleRun", "INSERT", query)
+	defer func() { endSpan(span, err) }()
+
+	_, err = tx.ExecContext(ctx, query, run.ID, run.ScheduleID, run.ScheduledFor, run.Attempt, run.Status,
+		sql.NullString{String: run.Error, Valid: run.Error != ""}, run.TransactionID, run.ExecutedAt)
+	if err != nil {
+		return s.classify(ctx, fmt.Errorf("failed to insert schedule run: %w", err))
+	}
+	return nil
+}
+
+// ListScheduleRuns возвращает журнал запусков расписания, начиная с последних.
+func (s *DBService) ListScheduleRuns(ctx context.Context, scheduleID uuid.UUID, limit, offset int) (_ []ScheduleRun, err error) {
+	const query = `SELECT id, schedule_id, scheduled_for, attempt, status, error, transaction_id, executed_at
+        FROM schedule_runs WHERE schedule_id = $1 ORDER BY executed_at DESC, id LIMIT $2 OFFSET $3`
+	ctx, span := startDBSpan(ctx, "DBService.ListScheduleRuns", "SELECT", query)
+	defer func() { endSpan(span, err) }()
+
+	qctx, cancel := s.withStatementTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.DB.QueryContext(qctx, query, scheduleID, limit, offset)
+	if err != nil {
+		return nil, s.classify(ctx, fmt.Errorf("failed to list schedule runs: %w", err))
+	}
+	defer rows.Close()
+
+	runs := []ScheduleRun{}
+	for rows.Next() {
+		var run ScheduleRun
+		var runErr sql.NullString
+		err := rows.Scan(&run.ID, &run.ScheduleID, &run.ScheduledFor, &run.Attempt, &run.Status, &runErr, &run.TransactionID, &run.ExecutedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan schedule run: %w", err)
+		}
+		run.Error = runErr.String
+		runs = append(runs, run)
+	}
+	return runs, s.classify(ctx, rows.Err())
+}
+
+// Savepoint создает точку сохранения name в транзакции tx.
+func (s *DBService) Savepoint(ctx context.Context, tx *sql.Tx, name string) (err error) {
+	query := `SAVEPOINT ` + name
+	ctx, span := startDBSpan(ctx, "DBService.Savepoint", "SAVEPOINT", query)
+	defer func() { endSpan(span, err) }()
+
+	if _, err = tx.ExecContext(ctx, query); err != nil {
+		return s.classify(ctx, fmt.Errorf("failed to create savepoint: %w", err))
+	}
+	return nil
+}
+
+// RollbackToSavepoint отменяет изменения транзакции tx после точки сохранения name.
+// Транзакция снова пригодна для запросов, даже если ошибка прервала ее.
+func (s *DBService) RollbackToSavepoint(ctx context.Context, tx *sql.Tx, name string) (err error) {
+	query := `ROLLBACK TO SAVEPOINT ` + name
+	ctx, span := startDBSpan(ctx, "DBService.RollbackToSavepoint", "ROLLBACK", query)
+	defer func() { endSpan(span, err) }()
+
+	if _, err = tx.ExecContext(ctx, query); err != nil {
+		return s.classify(ctx, fmt.Errorf("failed to roll back to savepoint: %w", err))
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package walletcore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func timePtr(t time.Time) *time.Time { return &t }
+
+func TestScheduleRequestValidate(t *testing.T) {
+	walletID := uuid.New()
+	start := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	valid := ScheduleRequest{WalletID: walletID, OperationType: Deposit, Amount: 10, Cron: "0 9 * * *"}
+	require.NoError(t, valid.Validate())
+
+	cases := map[string]struct {
+		change func(r *ScheduleRequest)
+		fields []string
+	}{
+		"empty wallet":            {func(r *ScheduleRequest) { r.WalletID = uuid.Nil }, []string{"walletId"}},
+		"unknown operation":       {func(r *ScheduleRequest) { r.OperationType = "INTEREST" }, []string{"operationType"}},
+		"transfer without target": {func(r *ScheduleRequest) { r.OperationType = Transfer }, []string{"targetWalletId"}},
+		"transfer to itself": {func(r *ScheduleRequest) {
+			r.OperationType, r.TargetWalletID = Transfer, &walletID
+		}, []string{"targetWalletId"}},
+		"target for deposit":   {func(r *ScheduleRequest) { id := uuid.New(); r.TargetWalletID = &id }, []string{"targetWalletId"}},
+		"zero amount":          {func(r *ScheduleRequest) { r.Amount = 0 }, []string{"amount"}},
+		"cron and interval":    {func(r *ScheduleRequest) { r.IntervalSeconds = 3600 }, []string{"cron"}},
+		"bad cron":             {func(r *ScheduleRequest) { r.Cron = "every day" }, []string{"cron"}},
+		"short interval":       {func(r *ScheduleRequest) { r.Cron, r.IntervalSeconds = "", 59 }, []string{"intervalSeconds"}},
+		"one-off without time": {func(r *ScheduleRequest) { r.Cron = "" }, []string{"startAt"}},
+		"end before start": {func(r *ScheduleRequest) {
+			r.StartAt, r.EndAt = timePtr(start), timePtr(start.Add(-time.Hour))
+		}, []string{"endAt"}},
+		"too many retries": {func(r *ScheduleRequest) { r.MaxRetries = MaxScheduleRetries + 1 }, []string{"maxRetries"}},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			req := valid
+			c.change(&req)
+			var errs ValidationErrors
+			require.True(t, errors.As(req.Validate(), &errs))
+			var fields []string
+			for _, e := range errs {
+				fields = append(fields, e.Field)
+			}
+			assert.Equal(t, c.fields, fields)
+		})
+	}
+}
+
+func TestScheduleActivate(t *testing.T) {
+	now := time.Date(2026, 3, 3, 10, 17, 0, 0, time.UTC)
+
+	oneOff := &Schedule{StartAt: now.Add(-time.Hour)}
+	oneOff.activate(now)
+	require.Equal(t, ScheduleActive, oneOff.Status)
+	assert.Equal(t, now.Add(-time.Hour), *oneOff.NextRunAt, "an overdue one-time operation runs right away")
+
+	cron := &Schedule{Cron: "0 9 * * *", StartAt: now}
+	cron.activate(now)
+	assert.Equal(t, time.Date(2026, 3, 4, 9, 0, 0, 0, time.UTC), *cron.NextRunAt)
+
+	// После паузы запуски по интервалу продолжаются в той же сетке от StartAt.
+	interval := &Schedule{IntervalSeconds: 3600, StartAt: now.Add(-150 * time.Minute)}
+	interval.activate(now)
+	assert.Equal(t, now.Add(30*time.Minute), *interval.NextRunAt)
+
+	ended := &Schedule{IntervalSeconds: 3600, StartAt: now.Add(-150 * time.Minute), EndAt: timePtr(now)}
+	ended.activate(now)
+	assert.Equal(t, ScheduleCompleted, ended.Status)
+	assert.Nil(t, ended.NextRunAt)
+}
+
+func TestScheduleAfterRun(t *testing.T) {
+	start := time.Date(2026, 3, 3, 10, 0, 0, 0, time.UTC)
+
+	t.Run("recurring success skips missed runs", func(t *testing.T) {
+		sc := &Schedule{IntervalSeconds: 3600, StartAt: start}
+		sc.activate(start)
+		// Сервис простаивал три часа: следующий запуск - ближайший после текущего времени.
+		now := start.Add(3*time.Hour + 5*time.Minute)
+		sc.afterRun(now, false)
+		assert.Equal(t, ScheduleActive, sc.Status)
+		assert.Equal(t, start.Add(4*time.Hour), *sc.NextRunAt)
+		assert.Equal(t, now, *sc.LastRunAt)
+	})
+
+	t.Run("failure is retried with backoff for the same occurrence", func(t *testing.T) {
+		sc := &Schedule{IntervalSeconds: 86400, StartAt: start, MaxRetries: 2}
+		sc.activate(start)
+		sc.afterRun(start, true)
+		assert.Equal(t, 1, sc.Attempt)
+		assert.Equal(t, start, sc.OccurrenceAt)
+		assert.Equal(t, start.Add(time.Minute), *sc.NextRunAt)
+
+		retry := start.Add(time.Minute)
+		sc.afterRun(retry, true)
+		assert.Equal(t, 2, sc.Attempt)
+		assert.Equal(t, retry.Add(2*time.Minute), *sc.NextRunAt)
+
+		sc.afterRun(retry.Add(2*time.Minute), true)
+		assert.Equal(t, 0, sc.Attempt, "retries exhausted, move on to the next occurrence")
+		assert.Equal(t, ScheduleActive, sc.Status)
+		assert.Equal(t, start.Add(24*time.Hour), *sc.NextRunAt)
+	})
+
+	t.Run("one-off completes", func(t *testing.T) {
+		sc := &Schedule{StartAt: start}
+		sc.activate(start)
+		sc.afterRun(start, false)
+		assert.Equal(t, ScheduleCompleted, sc.Status)
+		assert.Nil(t, sc.NextRunAt)
+	})
+
+	t.Run("one-off fails after retries", func(t *testing.T) {
+		sc := &Schedule{StartAt: start, MaxRetries: 1}
+		sc.activate(start)
+		sc.afterRun(start, true)
+		require.Equal(t, ScheduleActive, sc.Status)
+		sc.afterRun(start.Add(time.Minute), true)
+		assert.Equal(t, ScheduleFailed, sc.Status)
+		assert.Nil(t, sc.NextRunAt)
+	})
+
+	t.Run("recurring completes at endAt", func(t *testing.T) {
+		sc := &Schedule{IntervalSeconds: 3600, StartAt: start, EndAt: timePtr(start.Add(90 * time.Minute))}
+		sc.activate(start)
+		sc.afterRun(start, false)
+		require.Equal(t, start.Add(time.Hour), *sc.NextRunAt)
+		sc.afterRun(start.Add(time.Hour), false)
+		assert.Equal(t, ScheduleCompleted, sc.Status)
+	})
+}
+
+func TestScheduleApplyUpdate(t *testing.T) {
+	start := time.Date(2026, 3, 3, 10, 0, 0, 0, time.UTC)
+	sc := &Schedule{IntervalSeconds: 3600, StartAt: start}
+	sc.activate(start)
+
+	paused := SchedulePaused
+	sc.apply(ScheduleUpdate{Status: &paused}, start.Add(time.Minute))
+	assert.Equal(t, SchedulePaused, sc.Status)
+	assert.Nil(t, sc.NextRunAt)
+
+	active := ScheduleActive
+	sc.apply(ScheduleUpdate{Status: &active}, start.Add(150*time.Minute))
+	assert.Equal(t, ScheduleActive, sc.Status)
+	assert.Equal(t, start.Add(3*time.Hour), *sc.NextRunAt)
+
+	sc.apply(ScheduleUpdate{EndAt: timePtr(start.Add(2 * time.Hour))}, start.Add(150*time.Minute))
+	assert.Equal(t, ScheduleCompleted, sc.Status, "the pending run is after the new endAt")
+}
+
+func TestScheduleRetryDelay(t *testing.T) {
+	assert.Equal(t, time.Minute, scheduleRetryDelay(1))
+	assert.Equal(t, 4*time.Minute, scheduleRetryDelay(3))
+	assert.Equal(t, time.Hour, scheduleRetryDelay(MaxScheduleRetries))
+}
+
+func TestScheduleRejectsInvalidRequestBeforeTouchingDB(t *testing.T) {
+	// Service без базы: проверка должна завершиться раньше обращения к DBService.
+	svc := NewService(nil)
+
+	_, err := svc.CreateSchedule(context.Background(), ScheduleRequest{WalletID: uuid.New(), OperationType: Deposit, Amount: 1, Cron: "bad"}, OperationOptions{})
+	require.ErrorIs(t, err, ErrInvalidRequest)
+
+	amount := int64(-1)
+	_, err = svc.UpdateSchedule(context.Background(), uuid.New(), ScheduleUpdate{Amount: &amount}, "")
+	require.ErrorIs(t, err, ErrInvalidRequest)
+}
+
+func TestScheduleAbortedKeepsCause(t *testing.T) {
+	// TxRunner оборачивает ошибку единицы работы; RunDueSchedules находит в ней расписание,
+	// а IsRetryable - причину.
+	id := uuid.New()
+	err := fmt.Errorf("%w after %d attempts: %w", ErrTxConflict, 3, &scheduleAborted{id: id, err: ErrLockTimeout})
+	var aborted *scheduleAborted
+	require.ErrorAs(t, err, &aborted)
+	assert.Equal(t, id, aborted.id)
+	assert.ErrorIs(t, err, ErrLockTimeout)
+}
@@ -0,0 +1,518 @@
+package walletcore
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"test_task_wallet/logging"
+	"test_task_wallet/receipt"
+)
+
+// Доменные ошибки сервиса. Вызывающая сторона (HTTP, gRPC, CLI, фоновые задачи)
+// проверяет их через errors.Is и сама решает, как показать их клиенту.
+var (
+	ErrInvalidRequest      = errors.New("invalid request")
+	ErrWalletNotFound      = errors.New("wallet not found")
+	ErrInsufficientFunds   = errors.New("insufficient balance")
+	ErrIdempotencyKeyReuse = errors.New("idempotency key was already used for a different request")
+	ErrWalletAccessDenied  = errors.New("wallet belongs to another owner")
+	ErrBalanceOverflow     = errors.New("balance would exceed the maximum amount")
+
+	// ErrLockTimeout и ErrStatementTimeout - временные ошибки, операцию можно повторить.
+	ErrLockTimeout      = errors.New("timed out waiting for wallet lock")
+	ErrStatementTimeout = errors.New("database statement timed out")
+)
+
+// IsRetryable сообщает, можно ли безопасно повторить операцию, завершившуюся ошибкой err.
+func IsRetryable(err error) bool {
+	return errors.Is(err, ErrLockTimeout) || errors.Is(err, ErrStatementTimeout) || errors.Is(err, ErrTxConflict)
+}
+
+// MaxIdempotencyKeyLength - максимальная длина ключа идемпотентности.
+const MaxIdempotencyKeyLength = 255
+
+// OperationOptions - необязательные параметры операции.
+type OperationOptions struct {
+	// IdempotencyKey: повторный вызов с тем же ключом и теми же параметрами
+	// возвращает результат первой операции, не изменяя баланс повторно.
+	IdempotencyKey string
+	// APIKeyID - ключ клиента, выполняющего операцию. Записывается в историю операций.
+	APIKeyID uuid.UUID
+	// OwnerID - пользователь, от имени которого выполняется операция (subject JWT).
+	// Если задан, снять средства можно только с кошелька этого пользователя,
+	// а кошелек, созданный пополнением, становится его кошельком.
+	OwnerID string
+	// ClientID - клиент, выполняющий операцию (см. auth.ClientID). Внешняя ссылка
+	// из описания операции должна быть уникальной среди операций этого клиента.
+	ClientID string
+}
+
+// ReceiptSigner подписывает квитанции об операциях.
+type ReceiptSigner interface {
+	Sign(r *receipt.Receipt) error
+}
+
+// Service содержит бизнес-правила кошелька и управляет транзакциями БД.
+type Service struct {
+	db       *DBService
+	tx       *TxRunner
+	obs      Observer
+	receipts ReceiptSigner
+	fees     *Fees
+	rates    map[string]int64
+	currency Currency
+}
+
+// NewService создает Service поверх DBService.
+// Транзакции выполняются через TxRunner с параметрами по умолчанию.
+func NewService(db *DBService) *Service {
+	return &Service{db: db, tx: NewTxRunner(db), obs: nopObserver{}, currency: DefaultCurrency}
+}
+
+// SetObserver подключает получателя событий для метрик к сервису и его TxRunner.
+// Вызывается до начала обработки запросов.
+func (s *Service) SetObserver(o Observer) {
+	if o == nil {
+		o = nopObserver{}
+	}
+	s.obs = o
+	s.tx.Observer = o
+}
+
+// SetReceiptSigner включает квитанции в ответах на операции.
+// Вызывается до начала обработки запросов.
+func (s *Service) SetReceiptSigner(signer ReceiptSigner) {
+	s.receipts = signer
+}
+
+// SetFees включает комиссии за операции. nil - операции без комиссий.
+// Вызывается до начала обработки запросов.
+func (s *Service) SetFees(fees *Fees) {
+	s.fees = fees
+}
+
+// SetCurrency задает валюту кошельков для десятичной записи сумм в запросах и ответах.
+// Вызывается до начала обработки запросов.
+func (s *Service) SetCurrency(c Currency) {
+	s.currency = c
+}
+
+// Currency возвращает валюту кошельков.
+func (s *Service) Currency() Currency {
+	return s.currency
+}
+
+// money возвращает сумму minor в валюте кошельков.
+func (s *Service) money(minor int64) Money {
+	return Money{Minor: minor, Currency: s.currency}
+}
+
+// credit увеличивает баланс кошелька w на amount. Возвращает ErrBalanceOverflow,
+// если баланс не помещается в int64; баланс при этом не меняется.
+func (s *Service) credit(w *Wallet, amount int64) error {
+	balance, err := s.money(w.Balance).Add(s.money(amount))
+	if err != nil {
+		return ErrBalanceOverflow
+	}
+	w.Balance = balance.Minor
+	return nil
+}
+
+// withDecimals дополняет ответ десятичной записью сумм.
+func (s *Service) withDecimals(resp *WalletResponse) *WalletResponse {
+	resp.Currency = s.currency.Code
+	resp.BalanceDecimal = s.money(resp.Balance).String()
+	if resp.Fee > 0 {
+		resp.FeeDecimal = s.money(resp.Fee).String()
+	}
+	return resp
+}
+
+// transactionDecimals дополняет операции десятичной записью сумм.
+func (s *Service) transactionDecimals(transactions []Transaction) {
+	for i := range transactions {
+		transactions[i].AmountDecimal = s.money(transactions[i].Amount).String()
+		transactions[i].Currency = s.currency.Code
+	}
+}
+
+// TxRunner возвращает исполнитель транзакций сервиса, например для настройки повторов или чтения метрик.
+func (s *Service) TxRunner() *TxRunner {
+	return s.tx
+}
+
+// Deposit пополняет кошелек. Несуществующий кошелек создается автоматически.
+func (s *Service) Deposit(ctx context.Context, walletID uuid.UUID, amount int64, opts OperationOptions) (*WalletResponse, error) {
+	return s.Apply(ctx, WalletRequest{WalletID: walletID, OperationType: Deposit, Amount: amount}, opts)
+}
+
+// Withdraw списывает средства. Возвращает ErrWalletNotFound, если кошелька нет,
+// и ErrInsufficientFunds, если баланса не хватает.
+func (s *Service) Withdraw(ctx context.Context, walletID uuid.UUID, amount int64, opts OperationOptions) (*WalletResponse, error) {
+	return s.Apply(ctx, WalletRequest{WalletID: walletID, OperationType: Withdraw, Amount: amount}, opts)
+}
+
+// Balance возвращает текущий баланс и владельца кошелька без блокировки.
+// Проверка, может ли вызывающий клиент видеть кошелек, остается за вызывающей стороной.
+func (s *Service) Balance(ctx context.Context, walletID uuid.UUID) (*WalletResponse, error) {
+	logging.AddFields(ctx, slog.String(logging.KeyWalletID, walletID.String()))
+	balance, owner, err := s.db.GetWalletBalanceSimple(ctx, walletID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrWalletNotFound
+		}
+		return nil, fmt.Errorf("error getting wallet balance for %s: %w", walletID, err)
+	}
+	return s.withDecimals(&WalletResponse{WalletID: walletID, Balance: balance, OwnerID: owner}), nil
+}
+
+// Transactions возвращает историю операций кошелька, начиная с последних.
+func (s *Service) Transactions(ctx context.Context, walletID uuid.UUID, limit, offset int) ([]Transaction, error) {
+	if _, err := s.Balance(ctx, walletID); err != nil {
+		return nil, err
+	}
+	transactions, err := s.db.ListTransactions(ctx, walletID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("error listing transactions for wallet %s: %w", walletID, err)
+	}
+	s.transactionDecimals(transactions)
+	return transactions, nil
+}
+
+// Apply проверяет запрос и выполняет операцию из req.OperationType в одной транзакции.
+func (s *Service) Apply(ctx context.Context, req WalletRequest, opts OperationOptions) (_ *WalletResponse, err error) {
+	ctx, span := tracer.Start(ctx, "Service.Apply", trace.WithAttributes(
+		attribute.String("wallet.id", req.WalletID.String()),
+		attribute.String("wallet.operation", string(req.OperationType)),
+		attribute.Int64("wallet.amount", req.Amount),
+		attribute.Bool("wallet.idempotent", opts.IdempotencyKey != ""),
+	))
+	defer func() { endSpan(span, err) }()
+	logging.AddFields(ctx,
+		slog.String(logging.KeyWalletID, req.WalletID.String()),
+		slog.String(logging.KeyOperation, string(req.OperationType)),
+		slog.Int64(logging.KeyAmount, req.Amount),
+	)
+
+	if req.AmountDecimal != "" {
+		if fe := req.resolveAmount(s.currency); fe != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidRequest, ValidationErrors{*fe})
+		}
+	}
+	if err := req.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidRequest, err)
+	}
+	if len(opts.IdempotencyKey) > MaxIdempotencyKeyLength {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidRequest, ValidationErrors{{
+			Field:   "Idempotency-Key",
+			Message: fmt.Sprintf("idempotency key must be at most %d characters", MaxIdempotencyKeyLength),
+		}})
+	}
+
+	var (
+		resp     *WalletResponse
+		replayed bool
+	)
+	err = s.tx.Run(ctx, func(tx *sql.Tx) error {
+		var err error
+		resp, replayed, err = s.apply(ctx, tx, req, opts)
+		return err
+	})
+	span.SetAttributes(attribute.Bool("wallet.replayed", replayed))
+	if err != nil {
+		s.operationFailed(req, err)
+		return nil, err
+	}
+	return s.operationCommitted(ctx, req, resp, replayed), nil
+}
+
+// operationFailed учитывает в метриках операцию req, которая не выполнилась с ошибкой err.
+func (s *Service) operationFailed(req WalletRequest, err error) {
+	if errors.Is(err, ErrInsufficientFunds) {
+		s.obs.InsufficientFunds(req.OperationType, req.Amount)
+	}
+}
+
+// operationCommitted завершает зафиксированную операцию req - общий путь Apply и планировщика:
+// учитывает операцию и комиссию в метриках (кроме повторов по ключу идемпотентности),
+// подписывает квитанцию и заполняет десятичные суммы ответа.
+func (s *Service) operationCommitted(ctx context.Context, req WalletRequest, resp *WalletResponse, replayed bool) *WalletResponse {
+	if !replayed {
+		s.obs.OperationApplied(req.OperationType, req.Amount)
+		if resp.Fee > 0 {
+			s.obs.OperationApplied(Fee, resp.Fee)
+		}
+	}
+	// Подписываем после коммита: квитанция подтверждает уже зафиксированную операцию.
+	// Без квитанции ответ все равно отдается - операция выполнена, а квитанцию
+	// можно получить повтором с тем же ключом идемпотентности.
+	if resp.Receipt != nil {
+		if err := s.receipts.Sign(resp.Receipt); err != nil {
+			slog.ErrorContext(ctx, "Failed to sign receipt", logging.Err(err))
+			resp.Receipt = nil
+		}
+	}
+	return s.withDecimals(resp)
+}
+
+// operationResponse - ответ о выполненной операции op без квитанции.
+func operationResponse(op *operation) *WalletResponse {
+	resp := &WalletResponse{WalletID: op.wallet.ID, Balance: op.wallet.Balance, OwnerID: op.wallet.OwnerID}
+	if op.fee != nil {
+		resp.Fee = op.fee.Amount
+	}
+	return resp
+}
+
+// newReceipt готовит неподписанную квитанцию об операции t с комиссией fee и итоговым балансом balance.
+// Возвращает nil, если квитанции не включены.
+func (s *Service) newReceipt(t *Transaction, fee, balance int64) *receipt.Receipt {
+	if s.receipts == nil {
+		return nil
+	}
+	return &receipt.Receipt{
+		TransactionID: t.ID,
+		WalletID:      t.WalletID,
+		OperationType: string(t.Type),
+		Amount:        t.Amount,
+		Fee:           fee,
+		Balance:       balance,
+		Timestamp:     t.Timestamp,
+	}
+}
+
+// apply - единица работы Apply. Может выполняться несколько раз при конфликтах транзакций.
+// replayed сообщает, что ответ взят из сохраненного результата по ключу идемпотентности.
+func (s *Service) apply(ctx context.Context, tx *sql.Tx, req WalletRequest, opts OperationOptions) (resp *WalletResponse, replayed bool, err error) {
+	if opts.IdempotencyKey != "" {
+		rec, reserved, err := s.db.ReserveIdempotencyKey(ctx, tx, opts.ClientID, opts.IdempotencyKey, req)
+		if err != nil {
+			return nil, false, err
+		}
+		if !reserved {
+			if !rec.Matches(req) {
+				return nil, false, ErrIdempotencyKeyReuse
+			}
+			// Повтор не должен раскрывать результат, который вызывающий не смог бы получить
+			// заново: проверка владельца та же, что и в execute.
+			if req.OperationType == Withdraw && opts.OwnerID != "" {
+				_, owner, err := s.db.GetWalletBalanceSimple(ctx, rec.WalletID)
+				if err != nil {
+					return nil, false, err
+				}
+				if owner != opts.OwnerID {
+					return nil, false, ErrWalletAccessDenied
+				}
+			}
+			resp := &WalletResponse{WalletID: rec.WalletID, Balance: rec.Balance}
+			if rec.TransactionID != uuid.Nil {
+				fee, err := s.db.GetFeeRecord(ctx, tx, rec.TransactionID)
+				switch {
+				case err == nil:
+					resp.Fee = fee.Amount
+				case !errors.Is(err, sql.ErrNoRows):
+					return nil, false, fmt.Errorf("error loading fee for transaction %s: %w", rec.TransactionID, err)
+				}
+			}
+			if rec.TransactionID != uuid.Nil && s.receipts != nil {
+				t, err := s.db.GetTransaction(ctx, tx, rec.TransactionID)
+				if err != nil {
+					return nil, false, fmt.Errorf("error loading transaction %s: %w", rec.TransactionID, err)
+				}
+				resp.Receipt = s.newReceipt(t, resp.Fee, rec.Balance)
+			}
+			return resp, true, nil
+		}
+	}
+
+	op, err := s.execute(ctx, tx, req, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	if opts.IdempotencyKey != "" {
+		if err := s.db.CompleteIdempotencyKey(ctx, tx, opts.ClientID, opts.IdempotencyKey, op.wallet.Balance, op.record.ID); err != nil {
+			return nil, false, err
+		}
+	}
+	resp = operationResponse(op)
+	resp.Receipt = s.newReceipt(op.record, resp.Fee, op.wallet.Balance)
+	return resp, false, nil
+}
+
+// operation - результат операции над кошельком внутри транзакции.
+type operation struct {
+	wallet *Wallet      // Кошелек операции (для перевода - отправитель) с новым балансом
+	record *Transaction // Запись операции (для перевода - списание)
+	fee    *Transaction // Запись комиссии, nil если комиссии нет
+}
+
+// execute выполняет пополнение или снятие под блокировкой кошелька в транзакции tx
+// и списывает комиссию за операцию. Комиссия за пополнение вычитается из зачисленной суммы,
+// за снятие - списывается сверх нее; если после этого баланс стал бы отрицательным,
+// возвращается ErrInsufficientFunds.
+func (s *Service) execute(ctx context.Context, tx *sql.Tx, req WalletRequest, opts OperationOptions) (*operation, error) {
+	fee := s.fees.For(req.OperationType, req.WalletID, req.Amount)
+	locks := []walletLock{{id: req.WalletID, create: req.OperationType == Deposit, ownerID: opts.OwnerID}}
+	if fee > 0 {
+		locks = append(locks, walletLock{id: s.fees.revenue, create: true})
+	}
+	locked, err := s.lockWallets(ctx, tx, locks...)
+	if err != nil {
+		return nil, err
+	}
+	wlt := locked[req.WalletID]
+	if req.OperationType == Withdraw && opts.OwnerID != "" && wlt.OwnerID != opts.OwnerID {
+		return nil, ErrWalletAccessDenied
+	}
+
+	switch req.OperationType {
+	case Deposit:
+		if err := s.credit(wlt, req.Amount); err != nil {
+			return nil, err
+		}
+		if wlt.Balance < fee {
+			return nil, ErrInsufficientFunds
+		}
+		wlt.Balance -= fee
+	case Withdraw:
+		if wlt.Balance < req.Amount || wlt.Balance-req.Amount < fee {
+			return nil, ErrInsufficientFunds
+		}
+		wlt.Balance -= req.Amount + fee
+	}
+
+	if err := s.db.UpdateWalletBalance(ctx, tx, wlt.ID, wlt.Balance); err != nil {
+		return nil, err
+	}
+	op := &operation{wallet: wlt}
+	op.record, err = s.db.AddTransactionRecord(ctx, tx, wlt.ID, req.OperationType, req.Amount, opts.APIKeyID, uuid.Nil, opts.ClientID, req.Details)
+	if err != nil {
+		return nil, err
+	}
+	if fee > 0 {
+		if op.fee, err = s.chargeFee(ctx, tx, wlt, locked[s.fees.revenue], fee, op.record, opts.APIKeyID); err != nil {
+			return nil, err
+		}
+	}
+	return op, nil
+}
+
+// transfer переводит amount с кошелька from на кошелек to в транзакции tx.
+// Оба кошелька должны существовать. Комиссия за перевод списывается с отправителя
+// сверх суммы перевода.
+func (s *Service) transfer(ctx context.Context, tx *sql.Tx, from, to uuid.UUID, amount int64, opts OperationOptions) (*operation, error) {
+	fee := s.fees.For(Transfer, from, amount)
+	locks := []walletLock{{id: from}, {id: to}}
+	if fee > 0 {
+		locks = append(locks, walletLock{id: s.fees.revenue, create: true})
+	}
+	locked, err := s.lockWallets(ctx, tx, locks...)
+	if err != nil {
+		return nil, err
+	}
+
+	src, dst := locked[from], locked[to]
+	if opts.OwnerID != "" && src.OwnerID != opts.OwnerID {
+		return nil, ErrWalletAccessDenied
+	}
+	if src.Balance < amount || src.Balance-amount < fee {
+		return nil, ErrInsufficientFunds
+	}
+	if err := s.credit(dst, amount); err != nil {
+		return nil, err
+	}
+	src.Balance -= amount + fee
+
+	for _, wlt := range []*Wallet{src, dst} {
+		if err := s.db.UpdateWalletBalance(ctx, tx, wlt.ID, wlt.Balance); err != nil {
+			return nil, err
+		}
+	}
+	op := &operation{wallet: src}
+	op.record, err = s.db.AddTransactionRecord(ctx, tx, src.ID, Withdraw, amount, opts.APIKeyID, uuid.Nil, opts.ClientID, Details{})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.db.AddTransactionRecord(ctx, tx, dst.ID, Deposit, amount, opts.APIKeyID, op.record.ID, "", Details{}); err != nil {
+		return nil, err
+	}
+	if fee > 0 {
+		if op.fee, err = s.chargeFee(ctx, tx, src, locked[s.fees.revenue], fee, op.record, opts.APIKeyID); err != nil {
+			return nil, err
+		}
+	}
+	return op, nil
+}
+
+// walletLock - кошелек, который операция блокирует.
+type walletLock struct {
+	id uuid.UUID
+	// create - создать кошелек с нулевым балансом и владельцем ownerID, если его нет.
+	// Иначе отсутствие кошелька - ErrWalletNotFound.
+	create  bool
+	ownerID string
+}
+
+// lockOrder возвращает блокировки в порядке ID кошельков, по одной на кошелек.
+// Если кошелек встречается дважды, он создается, только если это допускают обе блокировки.
+func lockOrder(locks []walletLock) []walletLock {
+	ordered := make([]walletLock, 0, len(locks))
+	for _, l := range locks {
+		if i := slices.IndexFunc(ordered, func(o walletLock) bool { return o.id == l.id }); i >= 0 {
+			ordered[i].create = ordered[i].create && l.create
+			continue
+		}
+		ordered = append(ordered, l)
+	}
+	slices.SortFunc(ordered, func(a, b walletLock) int { return bytes.Compare(a.id[:], b.id[:]) })
+	return ordered
+}
+
+// lockWallets блокирует строки кошельков до конца транзакции. Все операции берут блокировки
+// в порядке ID (см. lockOrder), включая кошелек доходов, который участвует в каждой операции
+// с комиссией: иначе встречные операции приводили бы к взаимоблокировке.
+func (s *Service) lockWallets(ctx context.Context, tx *sql.Tx, locks ...walletLock) (map[uuid.UUID]*Wallet, error) {
+	locked := make(map[uuid.UUID]*Wallet, len(locks))
+	for _, l := range lockOrder(locks) {
+		wlt, err := s.lockWallet(ctx, tx, l)
+		if err != nil {
+			return nil, err
+		}
+		locked[l.id] = wlt
+	}
+	return locked, nil
+}
+
+// lockWallet блокирует строку кошелька до конца транзакции, при необходимости создавая его.
+// Несколько кошельков блокируются только через lockWallets.
+func (s *Service) lockWallet(ctx context.Context, tx *sql.Tx, l walletLock) (*Wallet, error) {
+	start := time.Now()
+	wlt, err := s.db.GetWallet(ctx, l.id, tx)
+	s.obs.LockWaited(time.Since(start))
+	if err == nil {
+		return wlt, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("error getting wallet %s: %w", l.id, err)
+	}
+	if !l.create {
+		return nil, ErrWalletNotFound
+	}
+
+	wlt, err = s.db.CreateWallet(ctx, tx, l.id, 0, l.ownerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new wallet %s: %w", l.id, err)
+	}
+	slog.InfoContext(ctx, "New wallet created", "balance", wlt.Balance)
+	return wlt, nil
+}
@@ -0,0 +1,53 @@
+package walletcore
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyRejectsInvalidRequestBeforeTouchingDB(t *testing.T) {
+	// Service без базы: проверка должна завершиться раньше обращения к DBService.
+	svc := NewService(nil)
+
+	_, err := svc.Withdraw(context.Background(), uuid.Nil, 0, OperationOptions{})
+	require.ErrorIs(t, err, ErrInvalidRequest)
+
+	var fields ValidationErrors
+	require.True(t, errors.As(err, &fields))
+	assert.Equal(t, []string{"valletId", "amount"}, []string{fields[0].Field, fields[1].Field})
+
+	_, err = svc.Deposit(context.Background(), uuid.New(), 10, OperationOptions{IdempotencyKey: strings.Repeat("k", MaxIdempotencyKeyLength+1)})
+	require.ErrorIs(t, err, ErrInvalidRequest)
+}
+
+// recordingObserver запоминает учтенные операции.
+type recordingObserver struct {
+	nopObserver
+	applied []OperationType
+}
+
+func (o *recordingObserver) OperationApplied(op OperationType, _ int64) {
+	o.applied = append(o.applied, op)
+}
+
+func TestScheduledOperationTakesApplyPath(t *testing.T) {
+	svc := NewService(nil)
+	obs := &recordingObserver{}
+	svc.SetObserver(obs)
+	svc.SetCurrency(Currency{Code: "EUR", Exponent: 2})
+
+	sc := &Schedule{WalletID: uuid.New(), OperationType: Withdraw, Amount: 500}
+	op := &operation{wallet: &Wallet{ID: sc.WalletID, Balance: 1250}, fee: &Transaction{Type: Fee, Amount: 5}}
+	resp := svc.operationCommitted(context.Background(), sc.request(), operationResponse(op), false)
+
+	assert.Equal(t, []OperationType{Withdraw, Fee}, obs.applied, "the operation and its fee are both counted")
+	assert.Equal(t, "12.50", resp.BalanceDecimal)
+	assert.Equal(t, "0.05", resp.FeeDecimal)
+	assert.Equal(t, "EUR", resp.Currency)
+}
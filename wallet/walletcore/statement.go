@@ -0,0 +1,135 @@
+package walletcore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+
+	"test_task_wallet/logging"
+)
+
+// StatementEntryKind - вид строки выписки.
+type StatementEntryKind string
+
+const (
+	StatementOpening     StatementEntryKind = "opening"
+	StatementTransaction StatementEntryKind = "transaction"
+	StatementClosing     StatementEntryKind = "closing"
+)
+
+// StatementEntry - строка выписки: входящий остаток, операция или исходящий остаток.
+// Balance - остаток после строки; у операции это баланс сразу после нее.
+type StatementEntry struct {
+	Kind          StatementEntryKind
+	TransactionID uuid.UUID     // только у операций
+	Timestamp     time.Time     // у остатков - граница периода
+	Type          OperationType // только у операций
+	Amount        int64         // только у операций
+	Balance       int64
+	// ClosingBalance - только у входящего остатка: исходящий остаток периода. Известен заранее,
+	// чтобы форматы, где остатки идут перед операциями (camt.053), не ждали конца выгрузки.
+	ClosingBalance int64
+}
+
+// Statement передает fn выписку кошелька за период [from, to): входящий остаток,
+// операции по времени с остатком после каждой и исходящий остаток.
+// Нулевой from - с создания кошелька, нулевой to - до текущего момента.
+//
+// Операции читаются потоком и не накапливаются в памяти. Все строки берутся из одного
+// снимка базы, поэтому операции, выполненные во время выгрузки, в выписку не попадают
+// и остатки сходятся. Ошибка fn прерывает выгрузку.
+func (s *Service) Statement(ctx context.Context, walletID uuid.UUID, from, to time.Time, fn func(StatementEntry) error) error {
+	logging.AddFields(ctx, slog.String(logging.KeyWalletID, walletID.String()))
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if !from.IsZero() && !from.Before(to) {
+		return fmt.Errorf("%w: %w", ErrInvalidRequest, ValidationErrors{{Field: "from", Message: "from must be before to"}})
+	}
+
+	var balance int64
+	err := s.db.ScanStatement(ctx, walletID, from, to,
+		func(createdAt time.Time, opening, closing int64) error {
+			if from.IsZero() {
+				from = createdAt
+			}
+			balance = opening
+			return fn(StatementEntry{Kind: StatementOpening, Timestamp: from, Balance: balance, ClosingBalance: closing})
+		},
+		func(t Transaction) error {
+			balance += t.signedAmount()
+			return fn(StatementEntry{Kind: StatementTransaction, TransactionID: t.ID, Timestamp: t.Timestamp,
+				Type: t.Type, Amount: t.Amount, Balance: balance})
+		})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrWalletNotFound
+		}
+		return err
+	}
+	return fn(StatementEntry{Kind: StatementClosing, Timestamp: to, Balance: balance})
+}
+
+// ScanStatement читает данные выписки в одной транзакции REPEATABLE READ: opening получает
+// время создания кошелька и остатки на моменты from и to, fn - операции за [from, to) по времени.
+// Остатки считаются от текущего баланса назад, поэтому сходятся с ним и для кошельков,
+// часть истории которых не записана в transactions.
+// Транзакция без statement_timeout: длительность выгрузки ограничивает ctx вызывающей стороны.
+// Возвращает sql.ErrNoRows, если кошелька нет.
+func (s *DBService) ScanStatement(ctx context.Context, walletID uuid.UUID, from, to time.Time,
+	opening func(createdAt time.Time, opening, closing int64) error, fn func(Transaction) error) (err error) {
+	const (
+		walletQuery = `SELECT balance, created_at FROM wallets WHERE id = $1`
+		laterQuery  = `SELECT
+             COALESCE(SUM(CASE WHEN operation_type IN ('WITHDRAW', 'FEE') THEN -amount ELSE amount END), 0),
+             COALESCE(SUM(CASE WHEN timestamp < $3 THEN 0 WHEN operation_type IN ('WITHDRAW', 'FEE') THEN -amount ELSE amount END), 0)
+         FROM transactions WHERE wallet_id = $1 AND timestamp >= $2`
+		query = `SELECT id, wallet_id, operation_type, amount, timestamp FROM transactions
+         WHERE wallet_id = $1 AND timestamp >= $2 AND timestamp < $3 ORDER BY timestamp, id`
+	)
+	ctx, span := startDBSpan(ctx, "DBService.ScanStatement", "SELECT", query)
+	defer func() { endSpan(span, err) }()
+
+	tx, err := s.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return s.classify(ctx, fmt.Errorf("error beginning statement transaction: %w", err))
+	}
+	defer tx.Rollback()
+
+	var balance, sinceFrom, sinceTo int64
+	var createdAt time.Time
+	if err := tx.QueryRowContext(ctx, walletQuery, walletID).Scan(&balance, &createdAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		return s.classify(ctx, fmt.Errorf("failed to read wallet: %w", err))
+	}
+	// Нулевой from означает всю историю; сравнение с нулевым временем в PostgreSQL дает то же самое.
+	if err := tx.QueryRowContext(ctx, laterQuery, walletID, from, to).Scan(&sinceFrom, &sinceTo); err != nil {
+		return s.classify(ctx, fmt.Errorf("failed to compute opening balance: %w", err))
+	}
+	if err := opening(createdAt, balance-sinceFrom, balance-sinceTo); err != nil {
+		return err
+	}
+
+	rows, err := tx.QueryContext(ctx, query, walletID, from, to)
+	if err != nil {
+		return s.classify(ctx, fmt.Errorf("failed to read statement: %w", err))
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t Transaction
+		if err := rows.Scan(&t.ID, &t.WalletID, &t.Type, &t.Amount, &t.Timestamp); err != nil {
+			return fmt.Errorf("failed to scan transaction: %w", err)
+		}
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+	return s.classify(ctx, rows.Err())
+}
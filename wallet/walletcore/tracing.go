@@ -0,0 +1,50 @@
+package walletcore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.40.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer создает span'ы сервиса и запросов к БД. Пока в main не настроен
+// глобальный TracerProvider, span'ы ничего не стоят и никуда не отправляются.
+var tracer = otel.Tracer("test_task_wallet/walletcore")
+
+// startDBSpan начинает span запроса к PostgreSQL. name - метод DBService,
+// operation - SQL операция, statement - текст запроса без значений параметров.
+func startDBSpan(ctx context.Context, name, operation, statement string) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{
+		semconv.DBSystemNamePostgreSQL,
+		semconv.DBOperationName(operation),
+	}
+	if statement != "" {
+		attrs = append(attrs, semconv.DBQueryText(statement))
+	}
+	return tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// endSpan завершает span и отмечает ошибку. Ожидаемые исходы
+// (sql.ErrNoRows, доменные отказы) ошибкой span'а не считаются.
+func endSpan(span trace.Span, err error) {
+	if err != nil && !isExpectedOutcome(err) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func isExpectedOutcome(err error) bool {
+	return errors.Is(err, sql.ErrNoRows) ||
+		errors.Is(err, ErrWalletNotFound) ||
+		errors.Is(err, ErrInsufficientFunds) ||
+		errors.Is(err, ErrIdempotencyKeyReuse) ||
+		errors.Is(err, ErrInvalidRequest) ||
+		errors.Is(err, ErrWalletAccessDenied) ||
+		errors.Is(err, ErrAPIKeyNotFound)
+}
@@ -0,0 +1,184 @@
+package walletcore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Значения TxRunner по умолчанию.
+const (
+	DefaultTxMaxAttempts = 5
+	DefaultTxBaseDelay   = 10 * time.Millisecond
+	DefaultTxMaxDelay    = 500 * time.Millisecond
+)
+
+// ErrTxConflict возвращается, если транзакция так и не прошла после всех повторов
+// из-за конфликтов сериализации или взаимоблокировок.
+var ErrTxConflict = errors.New("transaction conflict, retries exhausted")
+
+// Причины повторов для метрик.
+const (
+	RetryReasonSerialization = "serialization_failure"
+	RetryReasonDeadlock      = "deadlock"
+)
+
+// TxStats - счетчики TxRunner с момента запуска.
+type TxStats struct {
+	Transactions         int64 // Запущенные единицы работы
+	Attempts             int64 // Все попытки, включая повторы
+	SerializationRetries int64 // Повторы после 40001
+	DeadlockRetries      int64 // Повторы после 40P01
+	Exhausted            int64 // Единицы работы, не прошедшие после MaxAttempts попыток
+}
+
+// TxRunner выполняет единицу работы в транзакции и повторяет ее целиком,
+// если PostgreSQL отменил транзакцию из-за конфликта сериализации (40001)
+// или взаимоблокировки (40P01).
+type TxRunner struct {
+	db *DBService
+
+	// Isolation - уровень изоляции транзакций (по умолчанию - уровень БД).
+	Isolation sql.IsolationLevel
+	// MaxAttempts - максимальное число попыток, включая первую.
+	MaxAttempts int
+	// BaseDelay и MaxDelay задают экспоненциальную паузу между попытками
+	// со случайным разбросом (full jitter).
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Observer получает длительность каждой попытки. Задается через Service.SetObserver.
+	Observer Observer
+
+	transactions         atomic.Int64
+	attempts             atomic.Int64
+	serializationRetries atomic.Int64
+	deadlockRetries      atomic.Int64
+	exhausted            atomic.Int64
+}
+
+// NewTxRunner создает TxRunner с параметрами по умолчанию.
+func NewTxRunner(db *DBService) *TxRunner {
+	return &TxRunner{
+		db:          db,
+		MaxAttempts: DefaultTxMaxAttempts,
+		BaseDelay:   DefaultTxBaseDelay,
+		MaxDelay:    DefaultTxMaxDelay,
+		Observer:    nopObserver{},
+	}
+}
+
+// Run выполняет fn в транзакции и фиксирует ее. fn может вызываться несколько раз,
+// поэтому не должна иметь побочных эффектов вне транзакции.
+// Ошибки fn, не связанные с конфликтами, возвращаются без повторов.
+func (r *TxRunner) Run(ctx context.Context, fn func(tx *sql.Tx) error) (err error) {
+	r.transactions.Add(1)
+
+	ctx, span := tracer.Start(ctx, "TxRunner.Run")
+	defer func() { endSpan(span, err) }()
+
+	for attempt := 1; ; attempt++ {
+		r.attempts.Add(1)
+		span.SetAttributes(attribute.Int("wallet.tx.attempts", attempt))
+		err = r.runOnce(ctx, fn)
+
+		reason := retryReason(err)
+		if reason == "" {
+			return err
+		}
+		if attempt >= r.MaxAttempts {
+			r.exhausted.Add(1)
+			return fmt.Errorf("%w after %d attempts: %w", ErrTxConflict, attempt, err)
+		}
+
+		span.AddEvent("retry", trace.WithAttributes(attribute.String("wallet.tx.retry_reason", reason)))
+		switch reason {
+		case RetryReasonSerialization:
+			r.serializationRetries.Add(1)
+		case RetryReasonDeadlock:
+			r.deadlockRetries.Add(1)
+		}
+
+		timer := time.NewTimer(r.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w: %w", ctx.Err(), err)
+		case <-timer.C:
+		}
+	}
+}
+
+func (r *TxRunner) runOnce(ctx context.Context, fn func(tx *sql.Tx) error) (err error) {
+	start := time.Now()
+	defer func() { r.Observer.TxFinished(time.Since(start), err) }()
+
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{Isolation: r.Isolation})
+	if err != nil {
+		return err
+	}
+	// Если транзакция будет успешно закоммичена, Rollback ничего не сделает.
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return r.commit(ctx, tx)
+}
+
+func (r *TxRunner) commit(ctx context.Context, tx *sql.Tx) (err error) {
+	_, span := startDBSpan(ctx, "TxRunner.Commit", "COMMIT", "")
+	defer func() { endSpan(span, err) }()
+
+	if err := tx.Commit(); err != nil {
+		return r.db.classify(ctx, fmt.Errorf("error committing transaction: %w", err))
+	}
+	return nil
+}
+
+// backoff возвращает случайную паузу в [0, min(MaxDelay, BaseDelay*2^(attempt-1))].
+func (r *TxRunner) backoff(attempt int) time.Duration {
+	ceiling := r.MaxDelay
+	if shift := attempt - 1; shift < 30 {
+		if d := r.BaseDelay << shift; d > 0 && d < ceiling {
+			ceiling = d
+		}
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return rand.N(ceiling + 1)
+}
+
+// Stats возвращает текущие значения счетчиков.
+func (r *TxRunner) Stats() TxStats {
+	return TxStats{
+		Transactions:         r.transactions.Load(),
+		Attempts:             r.attempts.Load(),
+		SerializationRetries: r.serializationRetries.Load(),
+		DeadlockRetries:      r.deadlockRetries.Load(),
+		Exhausted:            r.exhausted.Load(),
+	}
+}
+
+// retryReason определяет, вызвана ли ошибка конфликтом, после которого транзакцию можно повторить.
+func retryReason(err error) string {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return ""
+	}
+	switch pqErr.Code {
+	case pqSerializationFailure:
+		return RetryReasonSerialization
+	case pqDeadlockDetected:
+		return RetryReasonDeadlock
+	}
+	return ""
+}
@@ -0,0 +1,40 @@
+package walletcore
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryReason(t *testing.T) {
+	assert.Equal(t, RetryReasonSerialization, retryReason(fmt.Errorf("commit: %w", &pq.Error{Code: pqSerializationFailure})))
+	assert.Equal(t, RetryReasonDeadlock, retryReason(&pq.Error{Code: pqDeadlockDetected}))
+	assert.Empty(t, retryReason(&pq.Error{Code: pqLockNotAvailable}))
+	assert.Empty(t, retryReason(ErrInsufficientFunds))
+	assert.Empty(t, retryReason(nil))
+}
+
+func TestBackoffStaysWithinBounds(t *testing.T) {
+	r := &TxRunner{BaseDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond}
+	for attempt := 1; attempt <= 40; attempt++ {
+		ceiling := 10 * time.Millisecond << (attempt - 1)
+		if attempt > 3 || ceiling > r.MaxDelay {
+			ceiling = r.MaxDelay
+		}
+		for i := 0; i < 100; i++ {
+			d := r.backoff(attempt)
+			assert.GreaterOrEqual(t, d, time.Duration(0))
+			assert.LessOrEqual(t, d, ceiling, "attempt %d", attempt)
+		}
+	}
+}
+
+func TestConflictIsRetryable(t *testing.T) {
+	err := fmt.Errorf("%w after %d attempts: %w", ErrTxConflict, 5, &pq.Error{Code: pqDeadlockDetected})
+	assert.True(t, IsRetryable(err))
+	assert.False(t, IsRetryable(errors.New("boom")))
+}
@@ -1,18 +1,23 @@
 package walletcore
 
 import (
-    "errors"
+    "bytes"
     "fmt"
-    "github.com/google/uuid"
+    "strings"
     "time"
+
+    "github.com/google/uuid"
+
+    "test_task_wallet/receipt"
 )
 
 // Wallet представляет структуру кошелька в нашей системе.
 type Wallet struct {
     ID        uuid.UUID `json:"walletId"` // Уникальный идентификатор кошелька
-    Balance   int64     `json:"balance"`  // Баланс кошелька (в рублях, целое число)
+    Balance   int64     `json:"balance"`  // Баланс кошелька в минимальных единицах валюты (см. money.go)
     CreatedAt time.Time `json:"createdAt"` // Время создания кошелька
     UpdatedAt time.Time `json:"updatedAt"` // Время последнего обновления кошелька
+    OwnerID   string    `json:"ownerId,omitempty"` // Пользователь-владелец (subject JWT), пусто для служебных кошельков
 }
 
 // OperationType определяет тип операции (пополнение или снятие).
@@ -21,15 +26,44 @@ type OperationType string
 const (
     Deposit  OperationType = "DEPOSIT"
     Withdraw OperationType = "WITHDRAW"
+    // Transfer - перевод между кошельками. Выполняется только по расписанию (см. schedule.go)
+    // и записывается в историю как WITHDRAW у отправителя и DEPOSIT у получателя.
+    Transfer OperationType = "TRANSFER"
+    // Fee - комиссия за операцию (см. fee.go). Списывается с кошелька операции;
+    // на кошелек доходов зачисляется операцией DEPOSIT.
+    Fee OperationType = "FEE"
+    // Interest - зачисление процентов на остаток за месяц (см. interest.go).
+    Interest OperationType = "INTEREST"
 )
 
+// IsDebit сообщает, уменьшает ли операция баланс кошелька.
+func (op OperationType) IsDebit() bool {
+    return op == Withdraw || op == Fee
+}
+
 // Transaction представляет запись о транзакции.
 type Transaction struct {
     ID        uuid.UUID     `json:"transactionId"` // Уникальный идентификатор транзакции
     WalletID  uuid.UUID     `json:"walletId"`      // ID кошелька, к которому относится транзакция
     Type      OperationType `json:"operationType"` // Тип операции (DEPOSIT/WITHDRAW)
     Amount    int64         `json:"amount"`        // Сумма операции
+    // AmountDecimal и Currency - сумма в десятичной записи и валюта. Заполняются сервисом для ответов API.
+    AmountDecimal string `json:"amountDecimal,omitempty"`
+    Currency      string `json:"currency,omitempty"`
     Timestamp time.Time     `json:"timestamp"`     // Время выполнения транзакции
+    APIKeyID  *uuid.UUID    `json:"apiKeyId,omitempty"` // API ключ, которым выполнена операция
+    // RelatedID - операция, к которой относится запись: у комиссии - основная операция,
+    // у зачисления комиссии на кошелек доходов - запись комиссии, у зачисления перевода - списание.
+    RelatedID *uuid.UUID `json:"relatedTransactionId,omitempty"`
+    // Описание, переданное клиентом вместе с операцией (см. details.go).
+    Details
+    ClientID string `json:"-"` // Клиент, выполнивший операцию (см. OperationOptions.ClientID)
+
+    // Поля цепочки хэшей (см. chain.go). Заполняются только при проверке цепочки.
+    Seq      int64  `json:"-"` // Номер в цепочке кошелька, 0 у записей до появления цепочки
+    ChainVersion int `json:"-"` // Версия формата хэша (chainHashVersion), 0 у записей первой версии
+    PrevHash []byte `json:"-"` // Хэш предыдущей записи, пусто у первой
+    Hash     []byte `json:"-"` // Хэш этой записи
 }
 
 // WalletRequest представляет структуру входящего JSON-запроса для операций с кошельком.
@@ -37,24 +71,92 @@ type WalletRequest struct {
     WalletID      uuid.UUID     `json:"valletId"` // ВНИМАНИЕ: в задании указано 'valletId', не 'walletId'
     OperationType OperationType `json:"operationType"`
     Amount        int64         `json:"amount"`
+    // AmountDecimal - сумма в десятичной записи ("12.50") вместо Amount в минимальных единицах.
+    // Если заданы оба поля, они должны совпадать.
+    AmountDecimal string `json:"amountDecimal,omitempty"`
+    Details                     // Необязательное описание операции
+}
+
+// IdempotencyRecord - сохраненный результат операции, выполненной с ключом идемпотентности.
+type IdempotencyRecord struct {
+    Key           string
+    WalletID      uuid.UUID
+    OperationType OperationType
+    Amount        int64
+    Balance       int64
+    TransactionID uuid.UUID // uuid.Nil у ключей, сохраненных до появления квитанций
+    DetailsHash   []byte    // Хэш описания операции (Details.hash), nil если описания не было
+}
+
+// Matches сообщает, совпадает ли запрос с тем, для которого был использован ключ,
+// включая описание операции.
+func (r *IdempotencyRecord) Matches(req WalletRequest) bool {
+    return r.WalletID == req.WalletID && r.OperationType == req.OperationType && r.Amount == req.Amount &&
+        bytes.Equal(r.DetailsHash, req.Details.hash())
 }
 
 // WalletResponse представляет структуру ответа после операции с кошельком.
 type WalletResponse struct {
     WalletID uuid.UUID `json:"walletId"`
     Balance  int64     `json:"balance"`
+    OwnerID  string    `json:"ownerId,omitempty"`
+    // Fee - комиссия, списанная с кошелька вместе с операцией; баланс уже ее учитывает.
+    Fee int64 `json:"fee,omitempty"`
+    // Десятичная запись баланса и комиссии в валюте Currency. Заполняются сервисом.
+    BalanceDecimal string `json:"balanceDecimal,omitempty"`
+    FeeDecimal     string `json:"feeDecimal,omitempty"`
+    Currency       string `json:"currency,omitempty"`
+    // Receipt - подписанная квитанция об операции. Только в ответе на операцию
+    // и только если сервису задан ReceiptSigner.
+    Receipt *receipt.Receipt `json:"receipt,omitempty"`
+}
+
+// FieldError описывает ошибку в конкретном поле запроса.
+type FieldError struct {
+    Field   string `json:"field"`   // Имя поля в JSON
+    Message string `json:"message"` // Описание ошибки
+}
+
+// ValidationErrors - все ошибки, найденные при проверке запроса.
+type ValidationErrors []FieldError
+
+func (e ValidationErrors) Error() string {
+    msgs := make([]string, len(e))
+    for i, fe := range e {
+        msgs[i] = fe.Message
+    }
+    return strings.Join(msgs, "; ")
+}
+
+// resolveAmount переводит AmountDecimal в минимальные единицы валюты c и сверяет с Amount.
+func (r *WalletRequest) resolveAmount(c Currency) *FieldError {
+    amount, fe := resolveDecimal("amountDecimal", r.AmountDecimal, r.Amount, c)
+    if fe != nil {
+        return fe
+    }
+    r.Amount = amount
+    return nil
 }
 
 // Validate проверяет корректность входящего запроса WalletRequest.
+// Возвращает ValidationErrors со всеми найденными ошибками.
 func (r *WalletRequest) Validate() error {
+    var errs ValidationErrors
     if r.WalletID == uuid.Nil {
-        return errors.New("walletId cannot be empty")
+        errs = append(errs, FieldError{Field: "valletId", Message: "walletId cannot be empty"})
     }
     if r.Amount <= 0 {
-        return errors.New("amount must be positive")
+        errs = append(errs, FieldError{Field: "amount", Message: "amount must be positive"})
     }
     if r.OperationType != Deposit && r.OperationType != Withdraw {
-        return fmt.Errorf("invalid operation type: %s, must be DEPOSIT or WITHDRAW", r.OperationType)
+        errs = append(errs, FieldError{
+            Field:   "operationType",
+            Message: fmt.Sprintf("invalid operation type: %s, must be DEPOSIT or WITHDRAW", r.OperationType),
+        })
+    }
+    errs = append(errs, r.Details.validate()...)
+    if len(errs) > 0 {
+        return errs
     }
     return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,4 @@
+// Package walletpb содержит сгенерированный код gRPC API кошелька.
+package walletpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative wallet.proto
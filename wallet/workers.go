@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+// backgroundWorkers запускает фоновые задачи с общим контекстом
+// и позволяет дождаться их завершения при остановке сервиса.
+type backgroundWorkers struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newBackgroundWorkers() *backgroundWorkers {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &backgroundWorkers{ctx: ctx, cancel: cancel}
+}
+
+// Go запускает fn в отдельной горутине. fn должна завершиться после отмены ctx.
+func (b *backgroundWorkers) Go(name string, fn func(ctx context.Context)) {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		slog.Info("Background worker started", "worker", name)
+		fn(b.ctx)
+		slog.Info("Background worker stopped", "worker", name)
+	}()
+}
+
+// Stop отменяет контекст задач и ждет их завершения не дольше, чем позволяет ctx.
+func (b *backgroundWorkers) Stop(ctx context.Context) error {
+	b.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("background workers did not stop in time: %w", ctx.Err())
+	}
+}